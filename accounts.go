@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/daisuki"
+)
+
+// The providers accounts can be stored for
+var providers = []string{"crunchyroll", "daisuki"}
+
+// Gets the provider a name given on the command line refers to, empty if it isn't supported
+func parseProvider(name string) string {
+	for _, provider := range providers {
+		if strings.Contains(strings.ToLower(name), provider) {
+			return provider
+		}
+	}
+	return ""
+}
+
+// Creates a session for a providers profile, nil if the provider isn't supported
+func newSession(provider, profile string) anirip.Session {
+	if isDefaultProfile(profile) {
+		profile = ""
+	}
+	switch provider {
+	case "crunchyroll":
+		return &crunchyroll.CrunchyrollSession{Profile: profile}
+	case "daisuki":
+		return &daisuki.DaisukiSession{Profile: profile}
+	}
+	return nil
+}
+
+// The logged in session a rip uses for a providers profile, logged in the first time it's needed
+type accountPool struct {
+	provider string
+	proxy    string
+	profile  string
+	current  anirip.Session
+
+	// Applied to the client of the session so downloads made with it follow the rip settings
+	rateLimiter        *anirip.RateLimiter
+	segmentConcurrency int
+}
+
+// Creates a pool for profile, the default profile when it's empty
+func newAccountPool(provider, profile, proxy string) *accountPool {
+	if profile == "" {
+		profile = anirip.DefaultProfile
+	}
+	return &accountPool{provider: provider, proxy: proxy, profile: profile}
+}
+
+// Logs the profile in so the rip can begin
+func (pool *accountPool) login() error {
+	if pool.current != nil {
+		return nil
+	}
+	session := newSession(pool.provider, pool.profile)
+	client := session.GetClient()
+	if err := client.SetProxy(pool.proxy); err != nil {
+		return err
+	}
+	client.RateLimiter = pool.rateLimiter
+	if pool.segmentConcurrency > 0 {
+		client.SegmentConcurrency = pool.segmentConcurrency
+	}
+	if err := session.Login("", "", sessionDir); err != nil {
+		return anirip.Error{Message: "Unable to login to " + pool.provider + " as the " + pool.profile + " profile", Err: err}
+	}
+	pool.current = session
+	return nil
+}
+
+// Runs a step with the session, logging in again and retrying once if it expired
+func (pool *accountPool) run(step func(session anirip.Session) error) error {
+	return retryLoggedOut(pool.current, func() error {
+		return step(pool.current)
+	})
+}
+
+// Prints every stored profile with the user it's for and whether its session is still logged in
+func listAccounts(proxyFor func(provider string) string) error {
+	found := false
+	for _, provider := range providers {
+		for _, profile := range anirip.SessionProfiles(sessionDir, provider) {
+			found = true
+			stored, err := anirip.LoadSession(sessionDir, provider, profile)
+			if err != nil {
+				logger.Error(provider + " " + profile + " : " + err.Error())
+				continue
+			}
+			line := provider + " " + profile + " (" + stored.User + ") : "
+			session := newSession(provider, profile)
+			if err := session.GetClient().SetProxy(proxyFor(provider)); err != nil {
+				return err
+			}
+			valid, err := session.Validate(sessionDir)
+			switch {
+			case err != nil:
+				logger.Error(line + err.Error())
+			case valid:
+				logger.Success(line + "logged in")
+			default:
+				logger.Warn(line + "logged out, it will log in again if its credentials are saved")
+			}
+		}
+	}
+	if !found {
+		logger.Warn("No accounts have been logged in yet, use anirip login first")
+	}
+	return nil
+}
+
+// Prints the account, membership and cookie expiry of every stored session, asking each provider
+// whether it's still logged in
+func printStatus(proxyFor func(provider string) string) error {
+	found := false
+	for _, provider := range providers {
+		for _, profile := range anirip.SessionProfiles(sessionDir, provider) {
+			found = true
+			session := newSession(provider, profile)
+			if err := session.GetClient().SetProxy(proxyFor(provider)); err != nil {
+				return err
+			}
+			status, err := session.Status(sessionDir)
+			line := provider + " " + profile + " : "
+			if err != nil {
+				logger.Error(line + err.Error())
+				continue
+			}
+			if !status.LoggedIn {
+				logger.Warn(line + "logged out, stored for " + status.User)
+				continue
+			}
+			premium := status.Premium
+			if premium == "" {
+				premium = "membership unknown"
+			}
+			expires := "cookies last until the session is replaced"
+			if !status.Expires.IsZero() {
+				expires = "cookies expire " + status.Expires.Local().Format(time.RFC1123)
+			}
+			logger.Success(line + "logged in as " + status.Account + " (" + premium + "), " + expires)
+		}
+	}
+	if !found {
+		logger.Warn("No sessions are stored, use anirip login first")
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package anirip
+
+import "time"
+
+// How often a running external command checks whether it has been canceled
+const cancelPoll = 250 * time.Millisecond
+
+// Can be set to stop downloads and external commands part way through, returning true once
+// whatever is running should give up, such as when a job is canceled
+var Canceled func() bool
+
+// Gets ErrCanceled if Canceled says to stop, nil otherwise
+func CheckCanceled() error {
+	if canceled := Canceled; canceled != nil && canceled() {
+		return ErrCanceled
+	}
+	return nil
+}
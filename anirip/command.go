@@ -0,0 +1,210 @@
+package anirip
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How much of an external commands stderr is kept, from the end where the reason it failed is
+const commandOutputLimit = 4096
+
+// Returned when an external command such as ffmpeg fails, carrying the end of what it wrote to stderr
+type CommandError struct {
+	Name   string
+	Err    error
+	Output string
+}
+
+func (e CommandError) Error() string {
+	return e.Name + " failed : " + e.Err.Error()
+}
+
+// Runs an external command, keeping the end of its stderr so a failure can say why it happened
+func RunCommand(cmd *exec.Cmd) error {
+	stderr := &tailBuffer{limit: commandOutputLimit}
+	return runCommand(cmd, filepath.Base(cmd.Path), stderr, stderr, CheckCanceled)
+}
+
+// Runs an ffmpeg command, reporting how far through its first input it is from its -progress output
+func RunFFmpeg(cmd *exec.Cmd) error {
+	cmd.Args = append([]string{cmd.Args[0], "-progress", "pipe:1", "-nostats"}, cmd.Args[1:]...)
+	progress := &ffmpegProgress{}
+	cmd.Stdout = &lineWriter{onLine: progress.progressLine}
+	stderr := &tailBuffer{limit: commandOutputLimit}
+	return runCommand(cmd, filepath.Base(cmd.Path), io.MultiWriter(stderr, &lineWriter{onLine: progress.stderrLine}), stderr, CheckCanceled)
+}
+
+// Runs a command given by the user, such as a hook, in a process group of its own until it exits or stop
+// returns an error, when the whole group is killed so nothing it started in the background is left running.
+// The end of both its stdout and stderr is kept, as such commands can say why they failed on either
+func RunCommandUntil(cmd *exec.Cmd, name string, stop func() error) error {
+	output := &tailBuffer{limit: commandOutputLimit}
+	cmd.Stdout = output
+	setProcessGroup(cmd)
+	return runCommand(cmd, name, output, output, stop)
+}
+
+// Runs cmd with its stderr written to stderr, killing it if stop returns an error while it's running.
+// The end of what it wrote is taken from output for the CommandError it fails with
+func runCommand(cmd *exec.Cmd, name string, stderr io.Writer, output *tailBuffer, stop func() error) error {
+	cmd.Stderr = stderr
+	if err := stop(); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return CommandError{Name: name, Err: err, Output: strings.TrimSpace(output.String())}
+	}
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.Wait()
+	}()
+	ticker := time.NewTicker(cancelPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-finished:
+			if err != nil {
+				return CommandError{Name: name, Err: err, Output: strings.TrimSpace(output.String())}
+			}
+			return nil
+		case <-ticker.C:
+			// Doesn't wait on the command once killed, as anything it started could hold its output open
+			if err := stop(); err != nil {
+				killCommand(cmd)
+				return err
+			}
+		}
+	}
+}
+
+// Matches the length ffmpeg prints for each of its inputs
+var ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+// Follows an ffmpeg run, learning the length of its first input from stderr and
+// how far it's got from the key=value blocks -progress writes to stdout
+type ffmpegProgress struct {
+	mutex         sync.Mutex
+	progress      Progress
+	durationKnown bool
+}
+
+// Picks the length of the first input out of ffmpegs stderr
+func (ffmpeg *ffmpegProgress) stderrLine(line string) {
+	match := ffmpegDuration.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	ffmpeg.mutex.Lock()
+	defer ffmpeg.mutex.Unlock()
+	if ffmpeg.durationKnown {
+		return
+	}
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	seconds, _ := strconv.ParseFloat(match[3], 64)
+	ffmpeg.progress.Duration = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+	ffmpeg.durationKnown = true
+}
+
+// Reads a line of -progress output, reporting at the end of each block
+func (ffmpeg *ffmpegProgress) progressLine(line string) {
+	parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+	if len(parts) != 2 {
+		return
+	}
+	ffmpeg.mutex.Lock()
+	switch parts[0] {
+	case "out_time_us", "out_time_ms": // Both are in microseconds
+		if microseconds, err := strconv.ParseInt(parts[1], 10, 64); err == nil && microseconds >= 0 {
+			ffmpeg.progress.Position = time.Duration(microseconds) * time.Microsecond
+		}
+	case "total_size":
+		if size, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			ffmpeg.progress.Bytes = size
+		}
+	case "progress":
+		ffmpeg.progress.Done = parts[1] == "end"
+		progress := ffmpeg.progress
+		ffmpeg.mutex.Unlock()
+		NotifyProgress(progress)
+		return
+	}
+	ffmpeg.mutex.Unlock()
+}
+
+// A writer that hands whatever is written to it to onLine a line at a time,
+// treating carriage returns as line endings too
+type lineWriter struct {
+	onLine  func(line string)
+	partial []byte
+}
+
+func (writer *lineWriter) Write(p []byte) (int, error) {
+	writer.partial = append(writer.partial, p...)
+	for {
+		end := bytes.IndexAny(writer.partial, "\r\n")
+		if end < 0 {
+			break
+		}
+		writer.onLine(string(writer.partial[:end]))
+		writer.partial = writer.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+// Gets what the external command behind err wrote to stderr, if err or any error it wraps is a CommandError
+func CommandOutput(err error) string {
+	commandErr, _ := findCommandError(err)
+	return commandErr.Output
+}
+
+// Checks whether err is, or wraps, an external command failing
+func IsCommandError(err error) bool {
+	_, found := findCommandError(err)
+	return found
+}
+
+// Walks down the errors err wraps looking for a CommandError
+func findCommandError(err error) (CommandError, bool) {
+	for err != nil {
+		switch wrapped := err.(type) {
+		case CommandError:
+			return wrapped, true
+		case Error:
+			err = wrapped.Err
+		default:
+			return CommandError{}, false
+		}
+	}
+	return CommandError{}, false
+}
+
+// A writer that only keeps the last limit bytes written to it
+type tailBuffer struct {
+	mutex sync.Mutex
+	limit int
+	data  []byte
+}
+
+func (buffer *tailBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.data = append(buffer.data, p...)
+	if len(buffer.data) > buffer.limit {
+		buffer.data = append([]byte{}, buffer.data[len(buffer.data)-buffer.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (buffer *tailBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return string(buffer.data)
+}
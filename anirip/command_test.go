@@ -0,0 +1,84 @@
+package anirip
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandUntil(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are run by sh")
+	}
+	stopped := errors.New("stopped")
+	tests := []struct {
+		name    string
+		command string
+		stopAt  time.Duration // How long the command runs before stop says to kill it, zero to never
+		err     error         // The error expected when it isn't a CommandError
+		output  string        // What the CommandError it fails with should carry
+	}{
+		{name: "succeeds", command: "echo fine"},
+		{name: "fails", command: "echo out; echo err >&2; exit 3", output: "out\nerr"},
+		{name: "stopped", command: "sleep 30", stopAt: 300 * time.Millisecond, err: stopped},
+		{name: "stopped before starting", command: "echo never", stopAt: -1, err: stopped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := time.Now()
+			err := RunCommandUntil(exec.Command("sh", "-c", test.command), "The test", func() error {
+				if test.stopAt != 0 && time.Since(started) > test.stopAt {
+					return stopped
+				}
+				return nil
+			})
+			switch {
+			case test.err != nil:
+				if err != test.err {
+					t.Errorf("got %v, expected %v", err, test.err)
+				}
+			case test.output != "":
+				if !IsCommandError(err) || CommandOutput(err) != test.output {
+					t.Errorf("got %v with output %q", err, CommandOutput(err))
+				}
+			case err != nil:
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRunCommandUntilKillsEverything(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are run by sh")
+	}
+
+	// The shell starts a loop that keeps writing in the background and waits on it
+	fileName := filepath.Join(t.TempDir(), "ticks")
+	command := "(while true; do echo tick >> '" + fileName + "'; sleep 0.05; done) & wait"
+	started := time.Now()
+	err := RunCommandUntil(exec.Command("sh", "-c", command), "The test", func() error {
+		if time.Since(started) > 300*time.Millisecond {
+			return ErrCanceled
+		}
+		return nil
+	})
+	if !IsCanceled(err) {
+		t.Fatalf("got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	before, _ := ioutil.ReadFile(fileName)
+	time.Sleep(300 * time.Millisecond)
+	after, _ := ioutil.ReadFile(fileName)
+	if len(before) == 0 {
+		t.Fatal("the loop never ran")
+	}
+	if len(after) != len(before) {
+		t.Errorf("the loop kept running after the command was killed, %d ticks became %d", strings.Count(string(before), "\n"), strings.Count(string(after), "\n"))
+	}
+}
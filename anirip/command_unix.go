@@ -0,0 +1,25 @@
+//go:build !windows
+
+package anirip
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Starts cmd as the leader of a new process group, which everything it starts joins
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Kills a started command, along with its whole process group when it leads one
+func killCommand(cmd *exec.Cmd) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return
+	}
+	cmd.Process.Kill()
+}
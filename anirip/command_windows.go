@@ -0,0 +1,25 @@
+package anirip
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Starts cmd in a new process group, so it can be killed along with everything it starts
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// Kills a started command, along with the processes it started when it has a process group of its own
+func killCommand(cmd *exec.Cmd) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.CreationFlags&syscall.CREATE_NEW_PROCESS_GROUP != 0 {
+		if exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run() == nil {
+			return
+		}
+	}
+	cmd.Process.Kill()
+}
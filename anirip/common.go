@@ -49,8 +49,15 @@ func CleanFileName(fileName string) string {
 	return newFileName
 }
 
+// Paths to use for binaries such as ffmpeg instead of searching for them, keyed by binary name
+var BinaryPaths = map[string]string{}
+
 // Attempts to search, find, and return the absolute path of a given binary
 func FindAbsoluteBinary(binaryName string) string {
+	if path := BinaryPaths[binaryName]; path != "" {
+		binaryName = path
+	}
+
 	// Searches for the binary whether it be in the path or relative
 	lookPath, err := exec.LookPath(binaryName)
 	if err != nil {
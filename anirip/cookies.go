@@ -0,0 +1,252 @@
+package anirip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// A cookie jar which, unlike net/http/cookiejar, can hand back every cookie it
+// holds along with its domain and expiry so a session can be stored and restored.
+// As in cookies.txt files, a domain starting with a dot marks a cookie that's also
+// sent to subdomains while any other domain is only sent to that exact host
+type CookieJar struct {
+	mutex   sync.Mutex
+	cookies []*http.Cookie
+}
+
+// Creates a jar holding cookies. Cookies without a domain are sent to every host
+func NewCookieJar(cookies []*http.Cookie) *CookieJar {
+	jar := new(CookieJar)
+	for _, cookie := range cookies {
+		stored := *cookie
+		jar.set(&stored)
+	}
+	return jar
+}
+
+// Stores the cookies a response from u set, dropping any it asked us to delete. Cookies
+// set without a domain are host only, those with one are sent to its subdomains too
+func (jar *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	host := strings.ToLower(u.Hostname())
+	for _, cookie := range cookies {
+		stored := *cookie
+		if stored.Domain == "" {
+			stored.Domain = host
+		} else {
+			domain, ok := cookieDomain(stored.Domain, host)
+			if !ok {
+				continue
+			}
+			stored.Domain = domain
+		}
+		if stored.Path == "" {
+			stored.Path = "/"
+		}
+		if stored.MaxAge > 0 {
+			stored.Expires = time.Now().Add(time.Duration(stored.MaxAge) * time.Second)
+		}
+		jar.set(&stored)
+	}
+}
+
+// Works out the domain a cookie host set for domain is stored under. As in net/http/cookiejar
+// host has to be the domain or one of its subdomains, and a public suffix such as co.uk
+// or an IP address is only ever allowed as a host only cookie for that exact host
+func cookieDomain(domain, host string) (string, bool) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return "", false
+	}
+	if suffix, _ := publicsuffix.PublicSuffix(domain); net.ParseIP(host) != nil || suffix == domain {
+		return host, host == domain
+	}
+	return "." + domain, true
+}
+
+// Replaces any cookie with the same name, domain and path, whether or not it was host only
+func (jar *CookieJar) set(cookie *http.Cookie) {
+	cookie.Domain = strings.ToLower(cookie.Domain)
+	domain := strings.TrimPrefix(cookie.Domain, ".")
+	kept := jar.cookies[:0]
+	for _, existing := range jar.cookies {
+		if existing.Name != cookie.Name || strings.TrimPrefix(existing.Domain, ".") != domain || existing.Path != cookie.Path {
+			kept = append(kept, existing)
+		}
+	}
+	jar.cookies = kept
+	if cookie.MaxAge >= 0 && !isExpired(cookie) {
+		jar.cookies = append(jar.cookies, cookie)
+	}
+}
+
+// Returns the cookies that should be sent with a request to u
+func (jar *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	cookies := []*http.Cookie{}
+	for _, cookie := range jar.cookies {
+		if isExpired(cookie) || (cookie.Secure && u.Scheme != "https") {
+			continue
+		}
+		if !domainMatches(cookie.Domain, host) || !pathMatches(cookie.Path, path) {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return cookies
+}
+
+// Checks whether a cookie for domain is sent to host. Domains starting with a dot also
+// match their subdomains and cookies without a domain are sent to every host
+func domainMatches(domain, host string) bool {
+	if domain == "" {
+		return true
+	}
+	if strings.HasPrefix(domain, ".") {
+		return host == domain[1:] || strings.HasSuffix(host, domain)
+	}
+	return host == domain
+}
+
+// Checks whether a cookie for cookiePath is sent with a request for path, which it must
+// match exactly or up to a / so a cookie for /a isn't sent to /ab
+func pathMatches(cookiePath, path string) bool {
+	if cookiePath == "" || cookiePath == path {
+		return true
+	}
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
+
+// Returns a copy of every cookie that hasn't expired yet
+func (jar *CookieJar) All() []*http.Cookie {
+	jar.mutex.Lock()
+	defer jar.mutex.Unlock()
+	cookies := []*http.Cookie{}
+	for _, cookie := range jar.cookies {
+		if !isExpired(cookie) {
+			stored := *cookie
+			cookies = append(cookies, &stored)
+		}
+	}
+	return cookies
+}
+
+// Gets when the first of cookies expires, zero if they all last until they're replaced
+func EarliestExpiry(cookies []*http.Cookie) time.Time {
+	earliest := time.Time{}
+	for _, cookie := range cookies {
+		if !cookie.Expires.IsZero() && (earliest.IsZero() || cookie.Expires.Before(earliest)) {
+			earliest = cookie.Expires
+		}
+	}
+	return earliest
+}
+
+// Checks whether a cookie's expiry has passed, session cookies never expire on their own
+func isExpired(cookie *http.Cookie) bool {
+	return !cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())
+}
+
+// Reads cookies from a Netscape cookies.txt file as exported by browsers and curl. Lines
+// starting with #HttpOnly_ are HttpOnly cookies, every other line starting with # is a comment
+func ReadCookiesTxt(reader io.Reader) ([]*http.Cookie, error) {
+	cookies := []*http.Cookie{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(text, "#HttpOnly_")
+		if httpOnly {
+			text = strings.TrimPrefix(text, "#HttpOnly_")
+		}
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// Splits out the domain, subdomain flag, path, secure flag, expiry, name and value
+		fields := strings.Split(text, "\t")
+		if len(fields) == 6 {
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return nil, Error{Message: "Line " + strconv.Itoa(line) + " of the cookies file does not have 7 tab separated fields"}
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, Error{Message: "Line " + strconv.Itoa(line) + " of the cookies file has an invalid expiry", Err: err}
+		}
+		// The subdomain flag is what counts, the leading dot is only a convention
+		domain := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			domain = "." + domain
+		}
+		cookie := &http.Cookie{
+			Domain:   domain,
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		if !isExpired(cookie) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Error{Message: "There was an error reading the cookies file", Err: err}
+	}
+	return cookies, nil
+}
+
+// Writes cookies out as a Netscape cookies.txt file, those with a domain starting
+// with a dot as domain cookies and the rest as host only
+func WriteCookiesTxt(writer io.Writer, cookies []*http.Cookie) error {
+	buffered := bufio.NewWriter(writer)
+	fmt.Fprintln(buffered, "# Netscape HTTP Cookie File")
+	fmt.Fprintln(buffered, "# Exported by anirip, this file holds a logged in session so keep it private")
+	fmt.Fprintln(buffered)
+	for _, cookie := range cookies {
+		prefix := ""
+		if cookie.HttpOnly {
+			prefix = "#HttpOnly_"
+		}
+		expires := int64(0)
+		if !cookie.Expires.IsZero() {
+			expires = cookie.Expires.Unix()
+		}
+		path := cookie.Path
+		if path == "" {
+			path = "/"
+		}
+		subdomains := strings.ToUpper(strconv.FormatBool(strings.HasPrefix(cookie.Domain, ".")))
+		fmt.Fprintf(buffered, "%s%s\t%s\t%s\t%s\t%d\t%s\t%s\n", prefix, cookie.Domain, subdomains, path,
+			strings.ToUpper(strconv.FormatBool(cookie.Secure)), expires, cookie.Name, cookie.Value)
+	}
+	if err := buffered.Flush(); err != nil {
+		return Error{Message: "There was an error writing the cookies file", Err: err}
+	}
+	return nil
+}
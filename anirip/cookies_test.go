@@ -0,0 +1,172 @@
+package anirip
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Gets the names of the cookies the jar sends to rawURL
+func sentCookies(t *testing.T, jar *CookieJar, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, cookie := range jar.Cookies(u) {
+		names = append(names, cookie.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestCookieJarDomains(t *testing.T) {
+	jar := NewCookieJar(nil)
+	site, _ := url.Parse("https://www.example.com/")
+	jar.SetCookies(site, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: "example.com"},
+		{Name: "dotted", Value: "3", Domain: ".Example.com"},
+	})
+
+	tests := []struct {
+		url  string
+		sent string
+	}{
+		{"https://www.example.com/", "host,domain,dotted"},
+		{"https://example.com/", "domain,dotted"},
+		{"https://cdn.www.example.com/", "domain,dotted"},
+		{"https://static.example.com/", "domain,dotted"},
+		{"https://notexample.com/", ""},
+		{"https://example.org/", ""},
+	}
+	for _, test := range tests {
+		if sent := sentCookies(t, jar, test.url); sent != test.sent {
+			t.Errorf("sent %q to %s, expected %q", sent, test.url, test.sent)
+		}
+	}
+
+	// A domain cookie replaces the host only cookie of the same name
+	jar.SetCookies(site, []*http.Cookie{{Name: "host", Value: "4", Domain: "example.com"}})
+	if sent := sentCookies(t, jar, "https://static.example.com/"); sent != "domain,dotted,host" {
+		t.Errorf("sent %q after the host only cookie was replaced", sent)
+	}
+}
+
+func TestCookieJarRejectedDomains(t *testing.T) {
+	tests := []struct {
+		url    string
+		domain string
+		stored string // Empty when the cookie is turned away
+	}{
+		{"https://www.example.com/", "example.com", ".example.com"},
+		{"https://www.example.com/", "www.example.com", ".www.example.com"},
+		{"https://www.example.com/", "other.com", ""},
+		{"https://www.example.com/", "ample.com", ""},
+		{"https://www.example.com/", "cdn.www.example.com", ""},
+		{"https://www.example.com/", "com", ""},
+		{"https://www.example.co.uk/", "co.uk", ""},
+		{"https://co.uk/", "co.uk", "co.uk"},
+		{"http://127.0.0.1/", "127.0.0.1", "127.0.0.1"},
+		{"http://127.0.0.1/", "0.0.1", ""},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		jar := NewCookieJar(nil)
+		jar.SetCookies(u, []*http.Cookie{{Name: "a", Value: "1", Domain: test.domain}})
+		stored := ""
+		if cookies := jar.All(); len(cookies) == 1 {
+			stored = cookies[0].Domain
+		}
+		if stored != test.stored {
+			t.Errorf("%s setting a cookie for %s stored it for %q, expected %q", test.url, test.domain, stored, test.stored)
+		}
+	}
+}
+
+func TestCookieJarPaths(t *testing.T) {
+	jar := NewCookieJar([]*http.Cookie{
+		{Name: "root", Value: "1", Domain: "example.com", Path: "/"},
+		{Name: "a", Value: "2", Domain: "example.com", Path: "/a"},
+		{Name: "slash", Value: "3", Domain: "example.com", Path: "/b/"},
+	})
+	tests := []struct {
+		url  string
+		sent string
+	}{
+		{"http://example.com", "root"},
+		{"http://example.com/a", "root,a"},
+		{"http://example.com/a/", "root,a"},
+		{"http://example.com/a/b", "root,a"},
+		{"http://example.com/ab", "root"},
+		{"http://example.com/b", "root"},
+		{"http://example.com/b/c", "root,slash"},
+	}
+	for _, test := range tests {
+		if sent := sentCookies(t, jar, test.url); sent != test.sent {
+			t.Errorf("sent %q to %s, expected %q", sent, test.url, test.sent)
+		}
+	}
+}
+
+func TestCookiesTxtRoundTrip(t *testing.T) {
+	expires := time.Unix(time.Now().Add(24*time.Hour).Unix(), 0)
+	cookies := []*http.Cookie{
+		{Name: "session_id", Value: "abc", Domain: ".crunchyroll.com", Path: "/", Expires: expires, Secure: true, HttpOnly: true},
+		{Name: "host_only", Value: "def", Domain: "www.crunchyroll.com", Path: "/videos"},
+		{Name: "empty", Value: "", Domain: ".daisuki.net", Path: "/"},
+	}
+	written := new(bytes.Buffer)
+	if err := WriteCookiesTxt(written, cookies); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadCookiesTxt(bytes.NewReader(written.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, cookies) {
+		t.Errorf("read back %+v from\n%s", read, written)
+	}
+
+	// The cookies keep their subdomain flags through the jar too
+	jar := NewCookieJar(read)
+	if sent := sentCookies(t, jar, "https://static.crunchyroll.com/videos"); sent != "session_id" {
+		t.Errorf("sent %q to a subdomain", sent)
+	}
+	if sent := sentCookies(t, jar, "https://www.crunchyroll.com/videos/1"); sent != "session_id,host_only" {
+		t.Errorf("sent %q to the host", sent)
+	}
+}
+
+func TestReadCookiesTxt(t *testing.T) {
+	// Written the way curl and browser extensions export them, flag and leading dot disagreeing on the last line
+	file := "# Netscape HTTP Cookie File\r\n" +
+		"\n" +
+		"#HttpOnly_.example.com\tTRUE\t/\tFALSE\t0\tsid\t1\n" +
+		"www.example.com\tFALSE\t/\tTRUE\t0\thost\t2\n" +
+		"# a comment\n" +
+		"example.com\tTRUE\t/\tFALSE\t0\tflagged\n" +
+		".example.com\tFALSE\t/\tFALSE\t1\texpired\t4\n"
+	cookies, err := ReadCookiesTxt(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*http.Cookie{
+		{Name: "sid", Value: "1", Domain: ".example.com", Path: "/", HttpOnly: true},
+		{Name: "host", Value: "2", Domain: "www.example.com", Path: "/", Secure: true},
+		{Name: "flagged", Value: "", Domain: ".example.com", Path: "/"},
+	}
+	if !reflect.DeepEqual(cookies, expected) {
+		t.Errorf("read %+v, expected %+v", cookies, expected)
+	}
+
+	if _, err := ReadCookiesTxt(strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Error("read a line without enough fields")
+	}
+	if _, err := ReadCookiesTxt(strings.NewReader("example.com\tTRUE\t/\tFALSE\tsoon\tname\tvalue\n")); err == nil {
+		t.Error("read a line with an invalid expiry")
+	}
+}
@@ -0,0 +1,288 @@
+package anirip
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Returned when no credentials could be found for a provider
+var ErrNoCredentials = Error{Message: "No credentials were found, log in with anirip login first"}
+
+// Called by sessions that need to log in again, such as when their stored cookies have expired,
+// to find the credentials for a providers profile. user is the account the session last used, if any
+var LookupCredentials func(provider, profile, user string) (Credentials, error)
+
+// A username and password for a single provider
+type Credentials struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// Gets the directory anirip keeps its configuration in, falling back to the temp directory
+func ConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "anirip")
+	}
+	return filepath.Join(dir, "anirip")
+}
+
+// Checks whether stdin is an interactive terminal we can prompt on
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// Prompts for a line of input on the terminal, such as a username
+func Prompt(prompt string) (string, error) {
+	if !IsTerminal() {
+		return "", Error{Message: "Can't prompt for " + strings.TrimSuffix(strings.TrimSpace(prompt), ":") + " as stdin is not a terminal"}
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", Error{Message: "There was an error reading from the terminal", Err: err}
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Prompts for a password on the terminal without echoing what's typed
+func PromptPassword(prompt string) (string, error) {
+	if !IsTerminal() {
+		return "", Error{Message: "Can't prompt for " + strings.TrimSuffix(strings.TrimSpace(prompt), ":") + " as stdin is not a terminal"}
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", Error{Message: "There was an error reading the password", Err: err}
+	}
+	return string(password), nil
+}
+
+// Reads a password from the first line of reader, used for --password-stdin
+func ReadPassword(reader io.Reader) (string, error) {
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", Error{Message: "There was an error reading the password from stdin", Err: err}
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", Error{Message: "No password was given on stdin"}
+	}
+	return password, nil
+}
+
+// Gets the netrc file to read, honoring $NETRC before looking in the home directory
+func NetrcFile() string {
+	if fileName := os.Getenv("NETRC"); fileName != "" {
+		return fileName
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// Finds the credentials for host in the netrc file fileName, preferring the entry
+// for user when one is given. A host matches a machine it's equal to or a subdomain of
+func NetrcCredentials(fileName, host, user string) (Credentials, bool, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return Credentials{}, false, nil
+	}
+	if err != nil {
+		return Credentials{}, false, Error{Message: "There was an error reading " + fileName, Err: err}
+	}
+
+	// Walks the tokens collecting each machine entry, skipping over macro definitions
+	type entry struct {
+		machine     string
+		credentials Credentials
+	}
+	entries := []entry{}
+	lines := strings.Split(string(data), "\n")
+	for l := 0; l < len(lines); l++ {
+		tokens := strings.Fields(lines[l])
+		for t := 0; t < len(tokens); t++ {
+			value := ""
+			if t+1 < len(tokens) {
+				value = tokens[t+1]
+			}
+			switch tokens[t] {
+			case "machine":
+				entries = append(entries, entry{machine: strings.ToLower(value)})
+				t++
+			case "default":
+				entries = append(entries, entry{})
+			case "login", "password", "account":
+				if len(entries) > 0 {
+					if tokens[t] == "login" {
+						entries[len(entries)-1].credentials.User = value
+					} else if tokens[t] == "password" {
+						entries[len(entries)-1].credentials.Pass = value
+					}
+				}
+				t++
+			case "macdef":
+				for l+1 < len(lines) && strings.TrimSpace(lines[l+1]) != "" {
+					l++
+				}
+				t = len(tokens)
+			}
+		}
+	}
+
+	// Picks the entry for this host, falling back to the default entry
+	host = strings.ToLower(host)
+	var found *Credentials
+	for i := range entries {
+		machine := entries[i].machine
+		matches := machine == "" || machine == host || strings.HasSuffix(host, "."+machine)
+		if !matches || (user != "" && entries[i].credentials.User != user) {
+			continue
+		}
+		if found == nil || machine != "" {
+			found = &entries[i].credentials
+		}
+		if machine != "" {
+			break
+		}
+	}
+	if found == nil || found.User == "" || found.Pass == "" {
+		return Credentials{}, false, nil
+	}
+	return *found, true, nil
+}
+
+// Credentials for every provider kept in a file encrypted with a passphrase.
+// The key is derived from the passphrase with scrypt and the credentials are sealed with AES-GCM
+type CredentialStore struct {
+	mutex      sync.Mutex
+	fileName   string
+	passphrase string
+	salt       []byte
+	providers  map[string]Credentials
+}
+
+// The format of the credential file on disk
+type credentialFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Opens the credential file fileName with passphrase, starting an empty store if it doesn't exist yet
+func OpenCredentialStore(fileName, passphrase string) (*CredentialStore, error) {
+	store := &CredentialStore{fileName: fileName, passphrase: passphrase, providers: map[string]Credentials{}}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		store.salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, store.salt); err != nil {
+			return nil, Error{Message: "There was an error generating a salt for the credential file", Err: err}
+		}
+		return store, nil
+	}
+	if err != nil {
+		return nil, Error{Message: "There was an error reading the credential file", Err: err}
+	}
+
+	// Decrypts the credentials, a failure to open the seal means the passphrase was wrong
+	file := credentialFile{}
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != 1 {
+		return nil, Error{Message: "The credential file " + fileName + " is not in a format we understand", Err: err}
+	}
+	gcm, err := passphraseCipher(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, Error{Message: "The passphrase for the credential file is incorrect"}
+	}
+	if err := json.Unmarshal(plain, &store.providers); err != nil {
+		return nil, Error{Message: "There was an error parsing the credential file", Err: err}
+	}
+	store.salt = file.Salt
+	return store, nil
+}
+
+// Checks whether a credential file has been created at fileName
+func CredentialStoreExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
+
+// Gets the credentials stored for provider
+func (store *CredentialStore) Get(provider string) (Credentials, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	credentials, ok := store.providers[provider]
+	return credentials, ok
+}
+
+// Stores the credentials for provider and writes the store back to disk, readable only by us
+func (store *CredentialStore) Set(provider string, credentials Credentials) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.providers[provider] = credentials
+	plain, err := json.Marshal(store.providers)
+	if err != nil {
+		return Error{Message: "There was an error encoding the credentials", Err: err}
+	}
+	gcm, err := passphraseCipher(store.passphrase, store.salt)
+	if err != nil {
+		return err
+	}
+	file := credentialFile{Version: 1, Salt: store.salt, Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return Error{Message: "There was an error generating a nonce for the credential file", Err: err}
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return Error{Message: "There was an error encoding the credential file", Err: err}
+	}
+	if err := os.MkdirAll(filepath.Dir(store.fileName), 0700); err != nil {
+		return Error{Message: "There was an error creating the credential file directory", Err: err}
+	}
+	if err := ioutil.WriteFile(store.fileName+".tmp", data, 0600); err != nil {
+		return Error{Message: "There was an error writing the credential file", Err: err}
+	}
+	return Rename(store.fileName+".tmp", store.fileName, 10)
+}
+
+// Derives the AES-GCM cipher for a passphrase and salt, shared by credential and session files
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, Error{Message: "There was an error deriving a key from the passphrase", Err: err}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, Error{Message: "There was an error creating the passphrase cipher", Err: err}
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, Error{Message: "There was an error creating the passphrase cipher", Err: err}
+	}
+	return gcm, nil
+}
@@ -0,0 +1,97 @@
+package anirip
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNetrcCredentials(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), ".netrc")
+	netrc := `machine crunchyroll.com login first password one
+machine crunchyroll.com
+  login second
+  password two
+macdef init
+  machine daisuki.net login macro password skipped
+
+machine www.daisuki.net login daisuki password three account unused
+machine nopass.example.com login nobody
+default login fallback password four
+`
+	if err := ioutil.WriteFile(fileName, []byte(netrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host  string
+		user  string
+		want  Credentials
+		found bool
+	}{
+		{host: "crunchyroll.com", want: Credentials{"first", "one"}, found: true},
+		{host: "www.crunchyroll.com", want: Credentials{"first", "one"}, found: true},
+		{host: "WWW.Crunchyroll.com", user: "second", want: Credentials{"second", "two"}, found: true},
+		{host: "www.daisuki.net", want: Credentials{"daisuki", "three"}, found: true},
+		{host: "daisuki.net", want: Credentials{"fallback", "four"}, found: true},
+		{host: "notcrunchyroll.com", want: Credentials{"fallback", "four"}, found: true},
+		{host: "crunchyroll.com", user: "fallback", want: Credentials{"fallback", "four"}, found: true},
+		{host: "crunchyroll.com", user: "nobody"},
+		{host: "nopass.example.com", user: "nobody"},
+	}
+	for _, test := range tests {
+		credentials, found, err := NetrcCredentials(fileName, test.host, test.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != test.found || credentials != test.want {
+			t.Errorf("got %+v (%v) for %s as %q, expected %+v (%v)", credentials, found, test.host, test.user, test.want, test.found)
+		}
+	}
+	if _, found, err := NetrcCredentials(filepath.Join(t.TempDir(), "missing"), "crunchyroll.com", ""); found || err != nil {
+		t.Errorf("a missing netrc file gave %v and %v", found, err)
+	}
+}
+
+func TestCredentialStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "anirip", "credentials.json")
+	if CredentialStoreExists(fileName) {
+		t.Fatal("the credential file exists before anything was stored")
+	}
+	store, err := OpenCredentialStore(fileName, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("crunchyroll", Credentials{"user", "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("daisuki", Credentials{"other", "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"user", "pass", "secret", "crunchyroll"} {
+		if strings.Contains(string(data), plain) {
+			t.Errorf("the credential file holds %q in the clear", plain)
+		}
+	}
+
+	reopened, err := OpenCredentialStore(fileName, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials, ok := reopened.Get("crunchyroll"); !ok || credentials != (Credentials{"user", "pass"}) {
+		t.Errorf("got %+v (%v) back for crunchyroll", credentials, ok)
+	}
+	if credentials, ok := reopened.Get("daisuki"); !ok || credentials != (Credentials{"other", "secret"}) {
+		t.Errorf("got %+v (%v) back for daisuki", credentials, ok)
+	}
+	if _, ok := reopened.Get("funimation"); ok {
+		t.Error("got credentials for a provider that was never stored")
+	}
+	if _, err := OpenCredentialStore(fileName, "wrong horse"); err == nil {
+		t.Error("opened the credential file with the wrong passphrase")
+	}
+}
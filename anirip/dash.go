@@ -0,0 +1,588 @@
+package anirip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Describes a DASH stream so providers can hand it off to be downloaded
+type DASHInfo struct {
+	ManifestURL string
+	Referer     string
+}
+
+// A single downloaded track, ready to be muxed with the others
+type Track struct {
+	Kind     string // Either video or audio
+	Language string
+	File     string
+}
+
+type MPD struct {
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string   `xml:"BaseURL"`
+	Periods                   []Period `xml:"Period"`
+}
+
+type Period struct {
+	Duration       string          `xml:"duration,attr"`
+	BaseURL        string          `xml:"BaseURL"`
+	AdaptationSets []AdaptationSet `xml:"AdaptationSet"`
+}
+
+type AdaptationSet struct {
+	MimeType        string           `xml:"mimeType,attr"`
+	ContentType     string           `xml:"contentType,attr"`
+	Lang            string           `xml:"lang,attr"`
+	BaseURL         string           `xml:"BaseURL"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	Representations []Representation `xml:"Representation"`
+}
+
+type Representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       int              `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr"`
+	Height          int              `xml:"height,attr"`
+	MimeType        string           `xml:"mimeType,attr"`
+	BaseURL         string           `xml:"BaseURL"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+}
+
+type SegmentTemplate struct {
+	Media           string          `xml:"media,attr"`
+	Initialization  string          `xml:"initialization,attr"`
+	StartNumber     *int64          `xml:"startNumber,attr"`
+	Timescale       int64           `xml:"timescale,attr"`
+	Duration        int64           `xml:"duration,attr"`
+	SegmentTimeline []TimelineEntry `xml:"SegmentTimeline>S"`
+}
+
+type TimelineEntry struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type SegmentList struct {
+	Initialization *URLRange    `xml:"Initialization"`
+	SegmentURLs    []SegmentURL `xml:"SegmentURL"`
+}
+
+type URLRange struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type SegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+type SegmentBase struct {
+	IndexRange     string    `xml:"indexRange,attr"`
+	Initialization *URLRange `xml:"Initialization"`
+}
+
+// Downloads the video representation closest to quality and the audio representation in
+// language from the DASH manifest, writing each to its own file in tempDir
+func DownloadDASH(info DASHInfo, quality, language string, client *Client, tempDir string) ([]Track, error) {
+	header := http.Header{}
+	if info.Referer != "" {
+		header.Add("referer", info.Referer)
+	}
+
+	// Gets and parses the manifest
+	manifestURL, err := url.Parse(info.ManifestURL)
+	if err != nil {
+		return nil, Error{Message: "There was an error parsing the manifest url", Err: err}
+	}
+	body, err := getResource(client, manifestURL.String(), header, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	mpd := new(MPD)
+	if err := xml.Unmarshal(body, mpd); err != nil {
+		return nil, Error{Message: "There was an error parsing the DASH manifest", Err: err}
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, Error{Message: "The DASH manifest did not contain any periods"}
+	}
+	// Each period can have its own init segment and codecs, so they can't simply be joined
+	if len(mpd.Periods) > 1 {
+		return nil, Error{Message: "The DASH manifest is split into " + strconv.Itoa(len(mpd.Periods)) + " periods, which anirip can't join together"}
+	}
+	period := mpd.Periods[0]
+	duration := parseISODuration(period.Duration)
+	if duration == 0 {
+		duration = parseISODuration(mpd.MediaPresentationDuration)
+	}
+
+	// Picks one video and one audio representation
+	baseURL, err := resolveBaseURL(manifestURL, mpd.BaseURL, period.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []Track{}
+	for _, kind := range []string{"video", "audio"} {
+		set, representation, ok := selectRepresentation(period, kind, quality, language)
+		if !ok {
+			continue
+		}
+
+		// Works out every segment that makes up the representation
+		representationURL, err := resolveBaseURL(baseURL, set.BaseURL, representation.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		segments, err := representationSegments(set, representation, representationURL, duration, header, client)
+		if err != nil {
+			return nil, err
+		}
+
+		// Concatenates the init and media segments into the tracks file
+		track := Track{Kind: kind, Language: set.Lang, File: tempDir + string(os.PathSeparator) + "incomplete." + kind + ".mp4"}
+		downloader := &Downloader{Client: client, Header: header}
+		if err := downloader.Download(segments, track.File); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		return nil, Error{Message: "The DASH manifest did not contain any audio or video"}
+	}
+	return tracks, nil
+}
+
+// Picks the adaptation set and representation for kind, choosing video by
+// resolution and audio by language followed by bandwidth
+func selectRepresentation(period Period, kind, quality, language string) (AdaptationSet, Representation, bool) {
+	candidates := []AdaptationSet{}
+	for _, set := range period.AdaptationSets {
+		mimeType := set.MimeType
+		if mimeType == "" && len(set.Representations) > 0 {
+			mimeType = set.Representations[0].MimeType
+		}
+		if set.ContentType == kind || strings.HasPrefix(mimeType, kind+"/") {
+			candidates = append(candidates, set)
+		}
+	}
+	if len(candidates) == 0 {
+		return AdaptationSet{}, Representation{}, false
+	}
+
+	// Audio sets are narrowed down to the requested language when one matches
+	set := candidates[0]
+	if kind == "audio" {
+		for _, candidate := range candidates {
+			if languageMatches(candidate.Lang, language) {
+				set = candidate
+				break
+			}
+		}
+	}
+	if len(set.Representations) == 0 {
+		return AdaptationSet{}, Representation{}, false
+	}
+
+	// Sorts from best to worst so we can walk down to the quality we want
+	representations := append([]Representation{}, set.Representations...)
+	sort.Slice(representations, func(i, j int) bool {
+		if representations[i].Height != representations[j].Height {
+			return representations[i].Height > representations[j].Height
+		}
+		return representations[i].Bandwidth > representations[j].Bandwidth
+	})
+	if kind == "video" {
+		if height, err := strconv.Atoi(qualityHeight.FindString(quality)); err == nil {
+			for _, representation := range representations {
+				if representation.Height <= height {
+					return set, representation, true
+				}
+			}
+			return set, representations[len(representations)-1], true
+		}
+	}
+	return set, representations[0], true
+}
+
+// Matches the height in a quality such as 720p
+var qualityHeight = regexp.MustCompile("[0-9]+")
+
+// Three letter language codes that don't start with their two letter code
+var languageCodes = map[string]string{
+	"jpn": "ja", "zho": "zh", "chi": "zh", "kor": "ko", "ger": "de", "deu": "de",
+	"fre": "fr", "fra": "fr", "spa": "es", "por": "pt", "ara": "ar",
+}
+
+// Loosely compares a manifest language code against a language such as english, en or eng
+func languageMatches(code, language string) bool {
+	code, language = strings.ToLower(code), strings.ToLower(language)
+	if code == "" || language == "" {
+		return false
+	}
+	if short, ok := languageCodes[code]; ok {
+		code = short
+	}
+	if short, ok := languageCodes[language]; ok {
+		language = short
+	}
+	if strings.HasPrefix(language, code) || strings.HasPrefix(code, language) {
+		return true
+	}
+	return len(code) >= 2 && len(language) >= 2 && code[:2] == language[:2]
+}
+
+// Lists the segments of a representation, whichever way the manifest describes them
+func representationSegments(set AdaptationSet, representation Representation, baseURL *url.URL, duration float64, header http.Header, client *Client) ([]Segment, error) {
+	template, list, base := representation.SegmentTemplate, representation.SegmentList, representation.SegmentBase
+	if template == nil {
+		template = set.SegmentTemplate
+	}
+	if list == nil {
+		list = set.SegmentList
+	}
+	if base == nil {
+		base = set.SegmentBase
+	}
+	switch {
+	case template != nil:
+		return templateSegments(template, representation, baseURL, duration)
+	case list != nil:
+		return listSegments(list, baseURL)
+	case base != nil:
+		return baseSegments(base, baseURL, header, client)
+	}
+	// With nothing else to go on the base url is the whole representation
+	return []Segment{{URL: baseURL.String()}}, nil
+}
+
+// Expands a segment template into its init and media segments
+func templateSegments(template *SegmentTemplate, representation Representation, baseURL *url.URL, duration float64) ([]Segment, error) {
+	segments := []Segment{}
+	number := int64(1)
+	if template.StartNumber != nil {
+		number = *template.StartNumber
+	}
+	timescale := template.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+
+	// Adds the initialization segment when there is one
+	if template.Initialization != "" {
+		initURL, err := baseURL.Parse(expandTemplate(template.Initialization, representation, 0, 0))
+		if err != nil {
+			return nil, Error{Message: "There was an error parsing the init segment url", Err: err}
+		}
+		segments = append(segments, Segment{URL: initURL.String()})
+	}
+
+	// Segment timelines list each segments time explicitly, otherwise every segment is the same length
+	times := []int64{}
+	if len(template.SegmentTimeline) > 0 {
+		var err error
+		if times, err = timelineTimes(template.SegmentTimeline, int64(math.Ceil(duration*float64(timescale)))); err != nil {
+			return nil, err
+		}
+	} else if template.Duration > 0 {
+		if duration == 0 {
+			return nil, Error{Message: "The segment template has a duration but the manifest doesn't say how long the period is"}
+		}
+		count := int64(math.Ceil(duration * float64(timescale) / float64(template.Duration)))
+		for i := int64(0); i < count; i++ {
+			times = append(times, i*template.Duration)
+		}
+	} else {
+		return nil, Error{Message: "The segment template has neither a timeline nor a duration"}
+	}
+	for i, time := range times {
+		mediaURL, err := baseURL.Parse(expandTemplate(template.Media, representation, number+int64(i), time))
+		if err != nil {
+			return nil, Error{Message: "There was an error parsing a media segment url", Err: err}
+		}
+		segments = append(segments, Segment{URL: mediaURL.String()})
+	}
+	return segments, nil
+}
+
+// Lists the start time of every segment in a timeline. A negative repeat count repeats the
+// entry up until the next entry's start time, or until end for the last entry
+func timelineTimes(timeline []TimelineEntry, end int64) ([]int64, error) {
+	times := []int64{}
+	time := int64(0)
+	for i, entry := range timeline {
+		if entry.T != nil {
+			time = *entry.T
+		}
+		if entry.D <= 0 {
+			return nil, Error{Message: "The segment timeline has an entry without a duration"}
+		}
+		repeats := entry.R
+		if repeats < 0 {
+			until := end
+			if i+1 < len(timeline) && timeline[i+1].T != nil {
+				until = *timeline[i+1].T
+			} else if i+1 < len(timeline) || end <= 0 {
+				return nil, Error{Message: "The segment timeline repeats an entry without saying where it ends"}
+			}
+			repeats = (until-time+entry.D-1)/entry.D - 1
+		}
+		for r := int64(0); r <= repeats; r++ {
+			times = append(times, time)
+			time += entry.D
+		}
+	}
+	return times, nil
+}
+
+// Matches the $Identifiers$ of a segment template
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)?(%0[0-9]+d)?\$`)
+
+// Substitutes the $Identifiers$ of a segment template, including any printf style widths
+func expandTemplate(template string, representation Representation, number, time int64) string {
+	return templateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := strings.SplitN(match[1:len(match)-1], "%", 2)
+		format := "%d"
+		if len(parts) == 2 {
+			format = "%" + parts[1]
+		}
+		switch parts[0] {
+		case "RepresentationID":
+			return representation.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, time)
+		case "Bandwidth":
+			return fmt.Sprintf(format, representation.Bandwidth)
+		}
+		// An empty identifier ($$) is an escaped dollar sign
+		return "$"
+	})
+}
+
+// Lists the segments of an explicit segment list
+func listSegments(list *SegmentList, baseURL *url.URL) ([]Segment, error) {
+	segments := []Segment{}
+	if list.Initialization != nil {
+		segment, err := rangeSegment(baseURL, list.Initialization.SourceURL, list.Initialization.Range)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	for _, segmentURL := range list.SegmentURLs {
+		segment, err := rangeSegment(baseURL, segmentURL.Media, segmentURL.MediaRange)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Uses the sidx box found at the index range to split a single file into its segments
+func baseSegments(base *SegmentBase, baseURL *url.URL, header http.Header, client *Client) ([]Segment, error) {
+	segments := []Segment{}
+	if base.Initialization != nil {
+		segment, err := rangeSegment(baseURL, base.Initialization.SourceURL, base.Initialization.Range)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	if base.IndexRange == "" {
+		return append(segments, Segment{URL: baseURL.String()}), nil
+	}
+
+	// Gets the sidx box which tells us the size of every segment
+	indexStart, indexLength := parseRange(base.IndexRange)
+	references, err := sidxReferences(client, baseURL.String(), header, indexStart, indexLength, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// The init segment runs from the start of the file up until the end of the index when not given
+	if base.Initialization == nil {
+		segments = append(segments, Segment{URL: baseURL.String(), Offset: 0, Length: indexStart + indexLength})
+	}
+	for _, reference := range references {
+		segments = append(segments, Segment{URL: baseURL.String(), Offset: reference.Offset, Length: reference.Length})
+	}
+	return segments, nil
+}
+
+// How deep sidx boxes can point at further sidx boxes before we give up on the index
+const sidxMaxDepth = 8
+
+// A byte range of a single media segment, or of another sidx box, as found in a sidx box
+type sidxReference struct {
+	Offset int64
+	Length int64
+	Index  bool // Set when the range holds another sidx box rather than media
+}
+
+// Gets the sidx box at the byte range and lists the media segments it indexes, following
+// any references to further sidx boxes as hierarchical indexes are made of. A zero
+// length reads the size from the box header first
+func sidxReferences(client *Client, resourceURL string, header http.Header, offset, length int64, depth int) ([]sidxReference, error) {
+	if depth > sidxMaxDepth {
+		return nil, Error{Message: "The sidx boxes of " + resourceURL + " are nested too deeply"}
+	}
+	if length == 0 {
+		boxHeader, err := getResource(client, resourceURL, header, offset, 8)
+		if err != nil {
+			return nil, err
+		}
+		if len(boxHeader) < 8 {
+			return nil, Error{Message: "The index range did not contain a sidx box"}
+		}
+		length = int64(binary.BigEndian.Uint32(boxHeader[0:4]))
+	}
+	index, err := getResource(client, resourceURL, header, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	references, err := parseSidx(index, offset)
+	if err != nil {
+		return nil, err
+	}
+	media := []sidxReference{}
+	for _, reference := range references {
+		if !reference.Index {
+			media = append(media, reference)
+			continue
+		}
+		// Only the nested sidx box itself is fetched, not the media that follows it
+		nested, err := sidxReferences(client, resourceURL, header, reference.Offset, 0, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		media = append(media, nested...)
+	}
+	return media, nil
+}
+
+// Parses a sidx box that was found at offset within the file
+func parseSidx(data []byte, offset int64) ([]sidxReference, error) {
+	if len(data) < 8 || string(data[4:8]) != "sidx" {
+		return nil, Error{Message: "The index range did not contain a sidx box"}
+	}
+	boxSize := int64(binary.BigEndian.Uint32(data[0:4]))
+	reader := bytes.NewReader(data[8:])
+	version, _ := reader.ReadByte()
+	reader.Seek(3+4+4, io.SeekCurrent) // flags, reference ID and timescale
+
+	// Earliest presentation time and first offset are 64 bit in version 1 boxes
+	firstOffset := int64(0)
+	if version == 0 {
+		var earliest, first uint32
+		binary.Read(reader, binary.BigEndian, &earliest)
+		binary.Read(reader, binary.BigEndian, &first)
+		firstOffset = int64(first)
+	} else {
+		var earliest, first uint64
+		binary.Read(reader, binary.BigEndian, &earliest)
+		binary.Read(reader, binary.BigEndian, &first)
+		firstOffset = int64(first)
+	}
+	var count uint16
+	reader.Seek(2, io.SeekCurrent)
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, Error{Message: "The sidx box was too short", Err: err}
+	}
+
+	// Segments start right after the sidx box and follow one another
+	references := []sidxReference{}
+	position := offset + boxSize + firstOffset
+	for i := uint16(0); i < count; i++ {
+		var size, duration, sap uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return nil, Error{Message: "The sidx box was too short", Err: err}
+		}
+		binary.Read(reader, binary.BigEndian, &duration)
+		binary.Read(reader, binary.BigEndian, &sap)
+		// The top bit is the reference type, set when the range starts with another sidx box
+		// followed by the media that one indexes
+		length := int64(size & 0x7fffffff)
+		references = append(references, sidxReference{Offset: position, Length: length, Index: size&0x80000000 != 0})
+		position += length
+	}
+	return references, nil
+}
+
+// Builds a segment from a url and an optional start-end byte range
+func rangeSegment(baseURL *url.URL, source, byteRange string) (Segment, error) {
+	segmentURL, err := baseURL.Parse(source)
+	if err != nil {
+		return Segment{}, Error{Message: "There was an error parsing a segment url", Err: err}
+	}
+	segment := Segment{URL: segmentURL.String()}
+	if byteRange != "" {
+		segment.Offset, segment.Length = parseRange(byteRange)
+	}
+	return segment, nil
+}
+
+// Parses an inclusive start-end byte range into an offset and length
+func parseRange(byteRange string) (int64, int64) {
+	parts := strings.SplitN(byteRange, "-", 2)
+	start, _ := strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) < 2 {
+		return start, 0
+	}
+	end, _ := strconv.ParseInt(parts[1], 10, 64)
+	return start, end - start + 1
+}
+
+// Resolves each of the nested BaseURL elements in turn
+func resolveBaseURL(base *url.URL, references ...string) (*url.URL, error) {
+	for _, reference := range references {
+		if reference = strings.TrimSpace(reference); reference == "" {
+			continue
+		}
+		resolved, err := base.Parse(reference)
+		if err != nil {
+			return nil, Error{Message: "There was an error parsing a base url", Err: err}
+		}
+		base = resolved
+	}
+	return base, nil
+}
+
+// Matches each number and unit of an ISO 8601 duration
+var isoDurationPart = regexp.MustCompile(`([0-9.]+)([DHMS])`)
+
+// Parses the subset of ISO 8601 durations used by manifests, such as PT1H23M4.5S, into seconds
+func parseISODuration(duration string) float64 {
+	seconds := float64(0)
+	units := map[string]float64{"D": 86400, "H": 3600, "M": 60, "S": 1}
+	timePart := strings.SplitN(strings.TrimPrefix(duration, "P"), "T", 2)
+	for i, part := range timePart {
+		for _, match := range isoDurationPart.FindAllStringSubmatch(part, -1) {
+			value, _ := strconv.ParseFloat(match[1], 64)
+			// An M before the T means months which never show up in episode lengths
+			if match[2] == "M" && i == 0 {
+				continue
+			}
+			seconds += value * units[match[2]]
+		}
+	}
+	return seconds
+}
@@ -0,0 +1,304 @@
+package anirip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A reference written into a test sidx box
+type testReference struct {
+	size  int
+	index bool
+}
+
+// Builds a sidx box whose references start firstOffset bytes after it
+func sidxBox(version byte, firstOffset int, references []testReference) []byte {
+	content := []byte{version, 0, 0, 0}
+	content = binary.BigEndian.AppendUint32(content, 1)    // Reference ID
+	content = binary.BigEndian.AppendUint32(content, 1000) // Timescale
+	if version == 0 {
+		content = binary.BigEndian.AppendUint32(content, 0)
+		content = binary.BigEndian.AppendUint32(content, uint32(firstOffset))
+	} else {
+		content = binary.BigEndian.AppendUint64(content, 0)
+		content = binary.BigEndian.AppendUint64(content, uint64(firstOffset))
+	}
+	content = append(content, 0, 0)
+	content = binary.BigEndian.AppendUint16(content, uint16(len(references)))
+	for _, reference := range references {
+		size := uint32(reference.size)
+		if reference.index {
+			size |= 0x80000000
+		}
+		content = binary.BigEndian.AppendUint32(content, size)
+		content = binary.BigEndian.AppendUint32(content, 2000)
+		content = binary.BigEndian.AppendUint32(content, 0x90000000)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, "sidx"...), content...)
+}
+
+func TestParseSidx(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []sidxReference
+	}{
+		// Boxes sit at byte 1000, so their references start right after them
+		{"version 0", sidxBox(0, 0, []testReference{{100, false}, {200, false}}), []sidxReference{{1056, 100, false}, {1156, 200, false}}},
+		{"version 1 with a gap", sidxBox(1, 10, []testReference{{100, false}}), []sidxReference{{1062, 100, false}}},
+		{"hierarchical", sidxBox(0, 0, []testReference{{300, true}, {400, true}}), []sidxReference{{1056, 300, true}, {1356, 400, true}}},
+	}
+	for _, test := range tests {
+		got, err := parseSidx(test.data, 1000)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+	if _, err := parseSidx([]byte("\x00\x00\x00\x08moov"), 0); err == nil {
+		t.Error("expected a box that isn't sidx to fail")
+	}
+	if _, err := parseSidx(sidxBox(0, 0, nil)[:20], 0); err == nil {
+		t.Error("expected a truncated sidx box to fail")
+	}
+}
+
+func TestTemplateSegments(t *testing.T) {
+	baseURL, _ := url.Parse("https://cdn.example.com/episode/")
+	representation := Representation{ID: "video=1500", Bandwidth: 1500000}
+	start, six := int64(0), int64(6)
+	tests := []struct {
+		name     string
+		template SegmentTemplate
+		duration float64
+		want     []string
+	}{
+		{
+			name:     "fixed duration",
+			template: SegmentTemplate{Initialization: "$RepresentationID$/init.mp4", Media: "$RepresentationID$/$Number%05d$.m4s", Timescale: 1000, Duration: 4000},
+			duration: 10,
+			want:     []string{"video=1500/init.mp4", "video=1500/00001.m4s", "video=1500/00002.m4s", "video=1500/00003.m4s"},
+		},
+		{
+			name:     "start number",
+			template: SegmentTemplate{Media: "seg-$Number$-$Bandwidth$.m4s", StartNumber: &start, Duration: 5},
+			duration: 10,
+			want:     []string{"seg-0-1500000.m4s", "seg-1-1500000.m4s"},
+		},
+		{
+			name: "timeline",
+			template: SegmentTemplate{Media: "t$Time$.m4s?cost=$$1", Timescale: 90000, SegmentTimeline: []TimelineEntry{
+				{T: new(int64), D: 180000, R: 2},
+				{D: 90000},
+			}},
+			want: []string{"t0.m4s?cost=$1", "t180000.m4s?cost=$1", "t360000.m4s?cost=$1", "t540000.m4s?cost=$1"},
+		},
+		{
+			name: "open ended repeats",
+			template: SegmentTemplate{Media: "t$Time$.m4s", SegmentTimeline: []TimelineEntry{
+				{T: new(int64), D: 2, R: -1},
+				{T: &six, D: 3, R: -1},
+			}},
+			duration: 11,
+			want:     []string{"t0.m4s", "t2.m4s", "t4.m4s", "t6.m4s", "t9.m4s"},
+		},
+	}
+	for _, test := range tests {
+		segments, err := templateSegments(&test.template, representation, baseURL, test.duration)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, segment := range segments {
+			got = append(got, strings.TrimPrefix(segment.URL, baseURL.String()))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+	if _, err := templateSegments(&SegmentTemplate{Media: "$Number$.m4s"}, representation, baseURL, 10); err == nil {
+		t.Error("expected a template without a timeline or duration to fail")
+	}
+	if _, err := templateSegments(&SegmentTemplate{Media: "$Number$.m4s", Duration: 4}, representation, baseURL, 0); err == nil {
+		t.Error("expected a fixed duration template without a period length to fail")
+	}
+	open := &SegmentTemplate{Media: "$Time$.m4s", SegmentTimeline: []TimelineEntry{{D: 2, R: -1}}}
+	if _, err := templateSegments(open, representation, baseURL, 0); err == nil {
+		t.Error("expected an open ended timeline without a period length to fail")
+	}
+}
+
+func TestParseMPD(t *testing.T) {
+	manifestURL, _ := url.Parse("https://cdn.example.com/episode/manifest.mpd")
+	body := []byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" mediaPresentationDuration="PT1M4.5S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate media="$RepresentationID$/$Number$.m4s" initialization="$RepresentationID$/init.mp4" timescale="1" duration="30"/>
+      <Representation id="360" bandwidth="800000" width="640" height="360"/>
+      <Representation id="1080" bandwidth="5000000" width="1920" height="1080"/>
+      <Representation id="720" bandwidth="2500000" width="1280" height="720"/>
+    </AdaptationSet>
+    <AdaptationSet contentType="audio" lang="en">
+      <Representation id="audio-en" bandwidth="128000" mimeType="audio/mp4"><BaseURL>en.mp4</BaseURL></Representation>
+    </AdaptationSet>
+    <AdaptationSet lang="ja">
+      <Representation id="audio-ja-low" bandwidth="64000" mimeType="audio/mp4"/>
+      <Representation id="audio-ja" bandwidth="128000" mimeType="audio/mp4">
+        <BaseURL>ja.mp4</BaseURL>
+        <SegmentList>
+          <Initialization sourceURL="ja.mp4" range="0-99"/>
+          <SegmentURL mediaRange="100-199"/>
+          <SegmentURL media="ja-2.mp4"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`)
+	mpd := new(MPD)
+	if err := xml.Unmarshal(body, mpd); err != nil {
+		t.Fatal(err)
+	}
+	if duration := parseISODuration(mpd.MediaPresentationDuration); duration != 64.5 {
+		t.Errorf("got a duration of %v, want 64.5", duration)
+	}
+	period := mpd.Periods[0]
+	baseURL, _ := resolveBaseURL(manifestURL, mpd.BaseURL, period.BaseURL)
+
+	// Video is picked by resolution and its segments come from the sets template
+	set, representation, ok := selectRepresentation(period, "video", "720p", "jpn")
+	if !ok || representation.ID != "720" {
+		t.Fatalf("got video %+v", representation)
+	}
+	segments, err := representationSegments(set, representation, baseURL, 64.5, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 || segments[0].URL != "https://cdn.example.com/episode/media/720/init.mp4" || segments[3].URL != "https://cdn.example.com/episode/media/720/3.m4s" {
+		t.Errorf("got video segments %+v", segments)
+	}
+
+	// Audio is picked by language then bandwidth, using the representations own segment list
+	set, representation, ok = selectRepresentation(period, "audio", "720p", "jpn")
+	if !ok || representation.ID != "audio-ja" {
+		t.Fatalf("got audio %+v", representation)
+	}
+	audioURL, _ := resolveBaseURL(baseURL, set.BaseURL, representation.BaseURL)
+	segments, err = representationSegments(set, representation, audioURL, 64.5, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Segment{
+		{URL: "https://cdn.example.com/episode/media/ja.mp4", Offset: 0, Length: 100},
+		{URL: "https://cdn.example.com/episode/media/ja.mp4", Offset: 100, Length: 100},
+		{URL: "https://cdn.example.com/episode/media/ja-2.mp4"},
+	}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("got audio segments %+v, want %+v", segments, want)
+	}
+
+	// Unmatched languages fall back to the first audio set
+	if _, representation, _ := selectRepresentation(period, "audio", "", "fre"); representation.ID != "audio-en" {
+		t.Errorf("got audio %s for an unknown language", representation.ID)
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := map[string]float64{
+		"PT1H23M4.5S": 4984.5,
+		"PT24M":       1440,
+		"P1DT1S":      86401,
+		"P1M":         0,
+		"":            0,
+	}
+	for duration, want := range tests {
+		if got := parseISODuration(duration); got != want {
+			t.Errorf("%q: got %v, want %v", duration, got, want)
+		}
+	}
+}
+
+func TestDownloadDASH(t *testing.T) {
+	// A single file video track with a hierarchical index, the top sidx pointing at
+	// two more that each index their own media
+	init := bytes.Repeat([]byte("I"), 100)
+	mediaA, mediaB, mediaC := bytes.Repeat([]byte("A"), 50), bytes.Repeat([]byte("B"), 60), bytes.Repeat([]byte("C"), 70)
+	child1 := sidxBox(0, 0, []testReference{{len(mediaA), false}, {len(mediaB), false}})
+	child2 := sidxBox(1, 0, []testReference{{len(mediaC), false}})
+	top := sidxBox(0, 0, []testReference{{len(child1) + len(mediaA) + len(mediaB), true}, {len(child2) + len(mediaC), true}})
+	video := bytes.Join([][]byte{init, top, child1, mediaA, mediaB, child2, mediaC}, nil)
+	indexRange := "100-" + strconv.Itoa(100+len(top)-1)
+
+	files := map[string][]byte{
+		"/manifest.mpd": []byte(`<MPD mediaPresentationDuration="PT4S"><Period>
+  <AdaptationSet mimeType="video/mp4"><Representation id="v" height="720">
+    <BaseURL>video.mp4</BaseURL><SegmentBase indexRange="` + indexRange + `"><Initialization range="0-99"/></SegmentBase>
+  </Representation></AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" lang="ja"><SegmentTemplate media="audio-$Number$.m4s" initialization="audio-init.mp4" duration="2"/>
+    <Representation id="a"/>
+  </AdaptationSet>
+</Period></MPD>`),
+		"/video.mp4":      video,
+		"/audio-init.mp4": []byte("i"),
+		"/audio-1.m4s":    []byte("1"),
+		"/audio-2.m4s":    []byte("2"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, ok := files[request.URL.Path]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		http.ServeContent(writer, request, request.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "anirip-dash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tracks, err := DownloadDASH(DASHInfo{ManifestURL: server.URL + "/manifest.mpd"}, "720p", "jpn", NewClient(nil), tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Track{
+		{Kind: "video", File: filepath.Join(tempDir, "incomplete.video.mp4")},
+		{Kind: "audio", Language: "ja", File: filepath.Join(tempDir, "incomplete.audio.mp4")},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Fatalf("got tracks %+v, want %+v", tracks, want)
+	}
+	data, _ := ioutil.ReadFile(tracks[0].File)
+	if want := bytes.Join([][]byte{init, mediaA, mediaB, mediaC}, nil); !bytes.Equal(data, want) {
+		t.Errorf("got video %q, want %q", data, want)
+	}
+	data, _ = ioutil.ReadFile(tracks[1].File)
+	if string(data) != "i12" {
+		t.Errorf("got audio %q, want i12", data)
+	}
+
+	// Periods can't be joined so a manifest with several has to fail rather than lose the rest
+	files["/periods.mpd"] = []byte(`<MPD><Period duration="PT2S"></Period><Period duration="PT2S"></Period></MPD>`)
+	if _, err := DownloadDASH(DASHInfo{ManifestURL: server.URL + "/periods.mpd"}, "720p", "jpn", NewClient(nil), tempDir); err == nil || !strings.Contains(err.Error(), "2 periods") {
+		t.Errorf("got %v, want an error about the periods", err)
+	}
+}
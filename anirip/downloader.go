@@ -0,0 +1,388 @@
+package anirip
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of times a single segment is attempted before the download fails
+var SegmentRetries = 5
+
+// A piece of a stream to download, either a whole resource or a byte range of one
+type Segment struct {
+	URL    string
+	Offset int64
+	Length int64 // Zero when the whole resource is the segment
+}
+
+// Fetches the segments of a single stream in parallel
+type Downloader struct {
+	Client *Client // Client to make requests with, a fresh one is used when nil
+	Header http.Header
+
+	// Optionally transforms each segment once downloaded, for example to decrypt it
+	Transform func(index int, data []byte) ([]byte, error)
+
+	progress *downloadProgress
+}
+
+// Counts what a download has fetched so far, updated by every worker at once
+type downloadProgress struct {
+	bytes    int64
+	segments int64
+	total    int
+}
+
+// Sends how far the download has got to ReportProgress
+func (progress *downloadProgress) report(done bool) {
+	NotifyProgress(Progress{
+		Bytes:         atomic.LoadInt64(&progress.bytes),
+		Segments:      int(atomic.LoadInt64(&progress.segments)),
+		TotalSegments: progress.total,
+		Done:          done,
+	})
+}
+
+// A token bucket limiting how many bytes per second can be read across every download
+// it's shared with, whether segments or an RTMP stream
+type RateLimiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	tokens    float64
+	lastCheck time.Time
+}
+
+// Creates a limiter allowing bytesPerSecond in total, nil when there is no limit
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), lastCheck: time.Now()}
+}
+
+// Wraps reader so reading from it waits on the limiter, returning reader as is when there is no limit
+func (limiter *RateLimiter) Reader(reader io.Reader) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return limitedReader{reader, limiter}
+}
+
+// Parses a rate such as 500K, 2M or 1048576 into bytes per second
+func ParseRate(rate string) (int64, error) {
+	rate = strings.ToUpper(strings.TrimSpace(rate))
+	if rate == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(rate, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(rate, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(rate, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	value, err := strconv.ParseFloat(strings.TrimRight(rate, "KMGB"), 64)
+	if err != nil || value < 0 {
+		return 0, Error{Message: "The rate limit " + rate + " is invalid", Err: err}
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// Blocks until n bytes worth of tokens are available
+func (limiter *RateLimiter) Wait(n int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Refills the bucket based on how long it's been, never holding more than a seconds worth
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastCheck).Seconds() * limiter.rate
+	if limiter.tokens > limiter.rate {
+		limiter.tokens = limiter.rate
+	}
+	limiter.lastCheck = now
+
+	// Takes the tokens, sleeping off any debt while holding the lock so others queue up behind us
+	limiter.tokens -= float64(n)
+	if limiter.tokens < 0 {
+		wait := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+		time.Sleep(wait)
+		limiter.tokens = 0
+		limiter.lastCheck = time.Now()
+	}
+}
+
+// Reads through a rate limiter
+type limitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := lr.reader.Read(p)
+	if n > 0 {
+		lr.limiter.Wait(n)
+	}
+	return n, err
+}
+
+// Counts the bytes read towards the downloads progress, reporting as they arrive
+type countingReader struct {
+	reader   io.Reader
+	progress *downloadProgress
+	read     int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if err := CheckCanceled(); err != nil {
+		return 0, err
+	}
+	n, err := cr.reader.Read(p)
+	if n > 0 && cr.progress != nil {
+		cr.read += int64(n)
+		atomic.AddInt64(&cr.progress.bytes, int64(n))
+		cr.progress.report(false)
+	}
+	return n, err
+}
+
+// Downloads every segment and writes them in order to fileName. Each finished
+// segment is kept in a parts directory next to the file, so rerunning a failed
+// download only fetches the segments that are missing
+func (downloader *Downloader) Download(segments []Segment, fileName string) error {
+	if downloader.Client == nil {
+		downloader.Client = NewClient(nil)
+	}
+	partsDir := fileName + ".parts"
+	if err := preparePartsDir(partsDir, segments); err != nil {
+		return err
+	}
+
+	// Starts our progress from whatever parts an earlier attempt left behind
+	downloader.progress = &downloadProgress{total: len(segments)}
+	for i := range segments {
+		if info, err := os.Stat(partFileName(partsDir, i)); err == nil {
+			downloader.progress.bytes += info.Size()
+			downloader.progress.segments++
+		}
+	}
+	downloader.progress.report(false)
+
+	// Hands segment indexes out to our workers
+	indexes := make(chan int)
+	errs := make(chan error, len(segments))
+	done := make(chan struct{})
+	var workers sync.WaitGroup
+	for w := 0; w < downloader.Client.SegmentConcurrency || w < 1; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				if err := downloader.fetchPart(segments[i], i, partsDir); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(indexes)
+		for i := range segments {
+			select {
+			case indexes <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Waits for everything to finish, stopping early on the first failure
+	finished := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(finished)
+	}()
+	select {
+	case err := <-errs:
+		close(done)
+		workers.Wait()
+		return err
+	case <-finished:
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	// Joins the parts together in order and clears them out
+	os.Remove(fileName)
+	file, err := os.Create(fileName)
+	if err != nil {
+		return Error{Message: "There was an error creating " + fileName, Err: err}
+	}
+	defer file.Close()
+	for i := range segments {
+		part, err := os.Open(partFileName(partsDir, i))
+		if err != nil {
+			return Error{Message: "There was an error opening a downloaded segment", Err: err}
+		}
+		_, err = io.Copy(file, part)
+		part.Close()
+		if err != nil {
+			return Error{Message: "There was an error writing to " + fileName, Err: err}
+		}
+	}
+	os.RemoveAll(partsDir)
+	downloader.progress.report(true)
+	return nil
+}
+
+// Fetches and stores a single segment unless an earlier attempt already did
+func (downloader *Downloader) fetchPart(segment Segment, index int, partsDir string) error {
+	partFile := partFileName(partsDir, index)
+	if _, err := os.Stat(partFile); err == nil {
+		return nil
+	}
+
+	// Retries the segment on its own, backing off a little more each time
+	var data []byte
+	var err error
+	for attempt := 0; attempt < SegmentRetries; attempt++ {
+		if err := CheckCanceled(); err != nil {
+			return err
+		}
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if data, err = downloader.fetchSegment(segment); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if downloader.Transform != nil {
+		if data, err = downloader.Transform(index, data); err != nil {
+			return err
+		}
+	}
+
+	// Writes to a temp file first so a half written part is never mistaken for a finished one
+	if err := ioutil.WriteFile(partFile+".tmp", data, 0644); err != nil {
+		return Error{Message: "There was an error saving a downloaded segment", Err: err}
+	}
+	if err := Rename(partFile+".tmp", partFile, 10); err != nil {
+		return err
+	}
+	if downloader.progress != nil {
+		atomic.AddInt64(&downloader.progress.segments, 1)
+		downloader.progress.report(false)
+	}
+	return nil
+}
+
+// Performs a single request for a segment, reading it through the rate limiter
+func (downloader *Downloader) fetchSegment(segment Segment) ([]byte, error) {
+	header := http.Header{}
+	for name, values := range downloader.Header {
+		header[name] = values
+	}
+	if segment.Length > 0 {
+		header.Set("range", byteRange(segment.Offset, segment.Length))
+	}
+	response, err := downloader.Client.Stream("GET", segment.URL, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if err := checkRangeResponse(response, segment.URL, segment.Offset, segment.Length); err != nil {
+		return nil, err
+	}
+	counter := &countingReader{reader: downloader.Client.RateLimiter.Reader(response.Body), progress: downloader.progress}
+	data, err := ioutil.ReadAll(counter)
+	if err != nil {
+		// Takes back what this attempt counted as the segment will be fetched again
+		if downloader.progress != nil {
+			atomic.AddInt64(&downloader.progress.bytes, -counter.read)
+		}
+		return nil, Error{Message: "There was an error reading " + segment.URL, Err: err}
+	}
+	return data, nil
+}
+
+// Builds the value of a Range header asking for length bytes from offset
+func byteRange(offset, length int64) string {
+	return "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)
+}
+
+// Checks the status of a response, which has to be a 206 starting at offset when a range
+// was asked for. A server that ignores the Range header answers 200 with the whole file,
+// which would otherwise be taken as the segment
+func checkRangeResponse(response *http.Response, resourceURL string, offset, length int64) error {
+	if length <= 0 {
+		if response.StatusCode != 200 {
+			return Error{Message: resourceURL + " returned " + response.Status}
+		}
+		return nil
+	}
+	if response.StatusCode != 206 {
+		return Error{Message: resourceURL + " returned " + response.Status + " instead of the byte range " + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)}
+	}
+	contentRange := response.Header.Get("content-range")
+	start := int64(-1)
+	if strings.HasPrefix(contentRange, "bytes ") {
+		if dash := strings.Index(contentRange, "-"); dash > 0 {
+			start, _ = strconv.ParseInt(contentRange[len("bytes "):dash], 10, 64)
+		}
+	}
+	if start != offset {
+		return Error{Message: resourceURL + " returned the range \"" + contentRange + "\" instead of one starting at " + strconv.FormatInt(offset, 10)}
+	}
+	return nil
+}
+
+// Makes sure the parts directory belongs to this list of segments, starting
+// it over if it was left behind by a different stream
+func preparePartsDir(partsDir string, segments []Segment) error {
+	// Identifies the stream by its segment paths as query strings tend to carry expiring tokens
+	hash := sha1.New()
+	for _, segment := range segments {
+		segmentPath := segment.URL
+		if parsed, err := url.Parse(segment.URL); err == nil {
+			segmentPath = parsed.Path
+		}
+		hash.Write([]byte(segmentPath + "@" + strconv.FormatInt(segment.Offset, 10) + "\n"))
+	}
+	signature := hex.EncodeToString(hash.Sum(nil))
+	signatureFile := filepath.Join(partsDir, "segments")
+	if existing, err := ioutil.ReadFile(signatureFile); err != nil || string(existing) != signature {
+		os.RemoveAll(partsDir)
+	}
+	if err := os.MkdirAll(partsDir, 0777); err != nil {
+		return Error{Message: "There was an error creating the segment directory", Err: err}
+	}
+	if err := ioutil.WriteFile(signatureFile, []byte(signature), 0644); err != nil {
+		return Error{Message: "There was an error writing the segment directory signature", Err: err}
+	}
+	return nil
+}
+
+// The file a finished segment is stored in
+func partFileName(partsDir string, index int) string {
+	return filepath.Join(partsDir, strconv.Itoa(index)+".part")
+}
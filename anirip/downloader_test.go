@@ -0,0 +1,159 @@
+package anirip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloaderConcurrency(t *testing.T) {
+	mutex := sync.Mutex{}
+	running, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		writer.Write([]byte(request.URL.Path))
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "anirip-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	segments := []Segment{}
+	want := new(bytes.Buffer)
+	for i := 0; i < 8; i++ {
+		segments = append(segments, Segment{URL: server.URL + "/" + strconv.Itoa(i)})
+		want.WriteString("/" + strconv.Itoa(i))
+	}
+	for _, concurrency := range []int{1, 4} {
+		most = 0
+		client := NewClient(nil)
+		client.SegmentConcurrency = concurrency
+		fileName := filepath.Join(tempDir, "stream"+strconv.Itoa(concurrency))
+		if err := (&Downloader{Client: client}).Download(segments, fileName); err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadFile(fileName); !bytes.Equal(data, want.Bytes()) {
+			t.Errorf("concurrency %d: got %q, want the segments in order", concurrency, data)
+		}
+		if most > concurrency || (concurrency > 1 && most < 2) {
+			t.Errorf("concurrency %d: %d segments were fetched at once", concurrency, most)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var limiter *RateLimiter
+	reader := bytes.NewReader(nil)
+	if limiter.Reader(reader) != reader {
+		t.Error("no limiter should leave the reader as is")
+	}
+	if NewRateLimiter(0) != nil {
+		t.Error("a zero rate should mean no limit")
+	}
+
+	// A second worth is let through at once, the next half second worth has to wait for it
+	limiter = NewRateLimiter(10000)
+	started := time.Now()
+	data, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, 15000))))
+	if err != nil || len(data) != 15000 {
+		t.Fatalf("got %d bytes and %v", len(data), err)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("reading took %v, want at least half a second", elapsed)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]int64{"": 0, "500": 500, "500K": 512000, "2m": 2097152, "1.5M": 1572864, "1G": 1073741824}
+	for rate, want := range tests {
+		if got, err := ParseRate(rate); err != nil || got != want {
+			t.Errorf("%q: got %d %v, want %d", rate, got, err, want)
+		}
+	}
+	for _, rate := range []string{"fast", "-1K"} {
+		if _, err := ParseRate(rate); err == nil {
+			t.Errorf("%q: expected an error", rate)
+		}
+	}
+}
+
+func TestRangeResponse(t *testing.T) {
+	data := []byte("0123456789")
+	tests := map[string]http.HandlerFunc{
+		"honoured": func(writer http.ResponseWriter, request *http.Request) {
+			http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(data))
+		},
+		"ignored": func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write(data)
+		},
+		"wrong start": func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("content-range", "bytes 0-3/10")
+			writer.WriteHeader(http.StatusPartialContent)
+			writer.Write(data[:4])
+		},
+	}
+	for name, handler := range tests {
+		server := httptest.NewServer(handler)
+		client := NewClient(nil)
+		segment, err := (&Downloader{Client: client}).fetchSegment(Segment{URL: server.URL, Offset: 2, Length: 4})
+		resource, resourceErr := getResource(client, server.URL, nil, 2, 4)
+		server.Close()
+		if name == "honoured" {
+			if err != nil || string(segment) != "2345" {
+				t.Errorf("%s: got segment %q and %v, want 2345", name, segment, err)
+			}
+			if resourceErr != nil || string(resource) != "2345" {
+				t.Errorf("%s: got resource %q and %v, want 2345", name, resource, resourceErr)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got segment %q, want an error", name, segment)
+		}
+		if resourceErr == nil {
+			t.Errorf("%s: got resource %q, want an error", name, resource)
+		}
+	}
+}
+
+func TestDownloaderStalledSegment(t *testing.T) {
+	server, attempts := stallingServer(1)
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "anirip-downloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The stall fails the first fetch and the segment retries take it from there
+	client := NewClient(nil)
+	client.IdleTimeout = 50 * time.Millisecond
+	fileName := filepath.Join(tempDir, "stream")
+	if err := (&Downloader{Client: client}).Download([]Segment{{URL: server.URL}}, fileName); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fileName); string(data) != "okok" {
+		t.Errorf("got %q, expected the segment from the second attempt", data)
+	}
+	if *attempts != 2 {
+		t.Errorf("made %d attempts, expected 2", *attempts)
+	}
+}
@@ -13,3 +13,45 @@ func (e Error) Error() string {
 	}
 	return fmt.Sprintf("Error : %v.", e.Message)
 }
+
+// Returned by providers when the video can't be watched from where the request came from
+var ErrRegionLocked = Error{Message: "This video is not available in your region"}
+
+// Returned by providers when a step failed because the session was logged out part way through
+var ErrLoggedOut = Error{Message: "The session is no longer logged in"}
+
+// Returned by downloads and external commands stopped part way through because Canceled said to
+var ErrCanceled = Error{Message: "The download was canceled"}
+
+// Returned when reading a response body that stopped sending anything for longer than the clients IdleTimeout
+var ErrStalled = Error{Message: "The server stopped sending data"}
+
+// Checks whether err, or any error it wraps, is a region lock
+func IsRegionLocked(err error) bool {
+	return wraps(err, ErrRegionLocked)
+}
+
+// Checks whether err, or any error it wraps, means the session was logged out
+func IsLoggedOut(err error) bool {
+	return wraps(err, ErrLoggedOut)
+}
+
+// Checks whether err, or any error it wraps, means the work was canceled
+func IsCanceled(err error) bool {
+	return wraps(err, ErrCanceled)
+}
+
+// Checks whether err is target or wraps it
+func wraps(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+		wrapped, ok := err.(Error)
+		if !ok {
+			return false
+		}
+		err = wrapped.Err
+	}
+	return false
+}
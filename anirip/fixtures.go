@@ -0,0 +1,288 @@
+package anirip
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Query parameters that change on every run, such as cache busters and random ids,
+// and so are left out when matching a request against the recorded fixtures
+var VolatileParams = []string{"g", "cashPath", "_"}
+
+// Form fields holding account details, which are never written to a fixture or used
+// to match one so recordings can be shared without giving away whose account made them
+var CredentialParams = []string{"name", "password", "emailAddress", "email", "username", "user", "pass"}
+
+// Stands in for every credential and cookie value left out of the fixtures
+const redacted = "REDACTED"
+
+// Wraps the transport of every client NewClient creates, used to record or replay fixtures
+var WrapTransport func(http.RoundTripper) http.RoundTripper
+
+// The metadata of a single recorded exchange, the response body is stored beside it
+type Fixture struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody string      `json:"request_body,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+}
+
+// A directory of recorded exchanges. Repeated requests are numbered so that
+// replaying serves responses back in the same order they were recorded
+type FixtureStore struct {
+	Dir    string
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+// Records exchanges into the store as they pass through to the real transport
+type recordingTransport struct {
+	store     *FixtureStore
+	transport http.RoundTripper
+}
+
+// Serves exchanges back out of the store without touching the network
+type replayTransport struct {
+	store *FixtureStore
+}
+
+// Opens the fixture directory dir, creating it if it doesn't exist yet
+func NewFixtureStore(dir string) (*FixtureStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, Error{Message: "There was an error creating the fixture directory " + dir, Err: err}
+	}
+	return &FixtureStore{Dir: dir, counts: map[string]int{}}, nil
+}
+
+// Wraps transport so every exchange is saved to the store
+func (store *FixtureStore) Recorder(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &recordingTransport{store: store, transport: transport}
+}
+
+// Creates a transport that answers every request from the store
+func (store *FixtureStore) Replayer() http.RoundTripper {
+	return &replayTransport{store: store}
+}
+
+func (recorder *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	requestBody = redactBody(request, requestBody)
+	response, err := recorder.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads the body so it can be saved and hands the caller a copy
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, Error{Message: "There was an error reading the response to record", Err: err}
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Saves the exchange under the next free number for this request, keeping the
+	// names of the cookies set so the replayed session still has them
+	name := recorder.store.next(request, requestBody)
+	header := http.Header{}
+	for key, values := range response.Header {
+		header[key] = values
+	}
+	if cookies := header["Set-Cookie"]; len(cookies) > 0 {
+		header["Set-Cookie"] = redactCookies(cookies)
+	}
+	fixture := Fixture{
+		Method:      request.Method,
+		URL:         request.URL.String(),
+		RequestBody: string(requestBody),
+		Status:      response.StatusCode,
+		Header:      header,
+	}
+	if err := recorder.store.write(name, fixture, body); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Gets the transport being recorded so its proxy settings can still be changed
+func (recorder *recordingTransport) Unwrap() http.RoundTripper {
+	return recorder.transport
+}
+
+func (replayer *replayTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	requestBody = redactBody(request, requestBody)
+
+	// Serves the next recording of this request, repeating the last one once they run out
+	name := replayer.store.next(request, requestBody)
+	fixture, body, err := replayer.store.read(name)
+	for n := replayer.store.count(request, requestBody) - 1; os.IsNotExist(err) && n > 0; n-- {
+		fixture, body, err = replayer.store.read(fixtureName(request, requestBody, n))
+	}
+	if err != nil {
+		return nil, Error{Message: "No fixture was recorded for " + request.Method + " " + request.URL.String(), Err: err}
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(fixture.Status) + " " + http.StatusText(fixture.Status),
+		StatusCode:    fixture.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fixture.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
+
+// Claims the next number for this request, returning the fixtures name
+func (store *FixtureStore) next(request *http.Request, requestBody []byte) string {
+	key := fixtureKey(request, requestBody)
+	store.mutex.Lock()
+	store.counts[key]++
+	n := store.counts[key]
+	store.mutex.Unlock()
+	return fixtureName(request, requestBody, n)
+}
+
+// Gets how many times this request has been seen
+func (store *FixtureStore) count(request *http.Request, requestBody []byte) int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.counts[fixtureKey(request, requestBody)]
+}
+
+// Writes a fixtures metadata and body
+func (store *FixtureStore) write(name string, fixture Fixture, body []byte) error {
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return Error{Message: "There was an error encoding fixture " + name, Err: err}
+	}
+	if err := ioutil.WriteFile(filepath.Join(store.Dir, name+".json"), data, 0644); err != nil {
+		return Error{Message: "There was an error writing fixture " + name, Err: err}
+	}
+	if err := ioutil.WriteFile(filepath.Join(store.Dir, name+".body"), body, 0644); err != nil {
+		return Error{Message: "There was an error writing fixture " + name, Err: err}
+	}
+	return nil
+}
+
+// Reads a fixtures metadata and body
+func (store *FixtureStore) read(name string) (Fixture, []byte, error) {
+	fixture := Fixture{}
+	data, err := ioutil.ReadFile(filepath.Join(store.Dir, name+".json"))
+	if err != nil {
+		return fixture, nil, err
+	}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return fixture, nil, Error{Message: "There was an error parsing fixture " + name, Err: err}
+	}
+	body, err := ioutil.ReadFile(filepath.Join(store.Dir, name+".body"))
+	return fixture, body, err
+}
+
+// Reads the requests body, leaving a copy in place for the real transport
+func readRequestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, Error{Message: "There was an error reading the request body", Err: err}
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Replaces the values of any credential fields in a form body, leaving other bodies as they are
+func redactBody(request *http.Request, body []byte) []byte {
+	if !strings.HasPrefix(strings.ToLower(request.Header.Get("content-type")), "application/x-www-form-urlencoded") {
+		return body
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return body
+	}
+	changed := false
+	for _, param := range CredentialParams {
+		if _, ok := form[param]; ok {
+			form.Set(param, redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	return []byte(form.Encode())
+}
+
+// Replaces the value of each Set-Cookie header, keeping its name and attributes
+func redactCookies(cookies []string) []string {
+	redactedCookies := []string{}
+	for _, cookie := range cookies {
+		attributes := ""
+		if semicolon := strings.Index(cookie, ";"); semicolon >= 0 {
+			cookie, attributes = cookie[:semicolon], cookie[semicolon:]
+		}
+		if equals := strings.Index(cookie, "="); equals >= 0 {
+			cookie = cookie[:equals+1] + redacted
+		}
+		redactedCookies = append(redactedCookies, cookie+attributes)
+	}
+	return redactedCookies
+}
+
+// Identifies a request by its method, url without volatile parameters, range and body, which
+// has already had its credentials redacted
+func fixtureKey(request *http.Request, requestBody []byte) string {
+	query := request.URL.Query()
+	for _, param := range VolatileParams {
+		query.Del(param)
+	}
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	stable := url.Values{}
+	for _, key := range keys {
+		stable[key] = query[key]
+	}
+	hash := sha1.New()
+	hash.Write([]byte(request.Method + " " + request.URL.Scheme + "://" + request.URL.Host + request.URL.Path + "?" + stable.Encode() + "\n"))
+	hash.Write([]byte(request.Header.Get("range") + "\n"))
+	hash.Write(requestBody)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Builds a readable file name for the nth recording of a request
+func fixtureName(request *http.Request, requestBody []byte, n int) string {
+	readable := regexp.MustCompile("[^A-Za-z0-9]+").ReplaceAllString(request.URL.Host+request.URL.Path, "_")
+	readable = strings.Trim(readable, "_")
+	if len(readable) > 60 {
+		readable = readable[len(readable)-60:]
+	}
+	return strings.ToLower(request.Method) + "_" + readable + "_" + fixtureKey(request, requestBody)[:10] + "_" + strconv.Itoa(n)
+}
@@ -0,0 +1,57 @@
+package anirip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFixtureRedaction(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.SetCookie(writer, &http.Cookie{Name: "session_id", Value: "secretsession", Path: "/"})
+		writer.Write([]byte("welcome"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "anirip-fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Logs in through the recorder, then replays the same login with different credentials
+	login := func(transport http.RoundTripper, password string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL+"/login", strings.NewReader("name=someone&password="+password+"&remember=1"))
+		request.Header.Set("content-type", "application/x-www-form-urlencoded")
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	store, err := NewFixtureStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := login(store.Recorder(nil), "hunter2"); len(response.Cookies()) == 0 || response.Cookies()[0].Value != "secretsession" {
+		t.Error("the recorder should hand back the real cookies")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(dir + string(os.PathSeparator) + file.Name())
+		for _, secret := range []string{"someone", "hunter2", "secretsession"} {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("%s contains %q", file.Name(), secret)
+			}
+		}
+	}
+
+	store, _ = NewFixtureStore(dir)
+	response := login(store.Replayer(), "another")
+	if cookies := response.Cookies(); len(cookies) != 1 || cookies[0].Name != "session_id" || cookies[0].Value != redacted {
+		t.Errorf("got cookies %v, want session_id kept with its value redacted", cookies)
+	}
+}
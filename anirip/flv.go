@@ -0,0 +1,74 @@
+package anirip
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// FLV tag types
+const (
+	FLVAudio  = 0x08
+	FLVVideo  = 0x09
+	FLVScript = 0x12
+)
+
+// Writes media tags out as an FLV file, adding the file header before the first tag
+type FLVWriter struct {
+	Out           io.Writer
+	headerWritten bool
+}
+
+// Writes a single FLV tag for the passed tag type, timestamp and payload
+func (flv *FLVWriter) WriteTag(tagType byte, timestamp uint32, payload []byte) error {
+	// Writes the FLV file header before our very first tag
+	if !flv.headerWritten {
+		header := []byte{'F', 'L', 'V', 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+		if _, err := flv.Out.Write(header); err != nil {
+			return Error{Message: "There was an error writing the FLV header", Err: err}
+		}
+		flv.headerWritten = true
+	}
+
+	// Builds the 11 byte tag header followed by the data and previous tag size
+	tag := make([]byte, 11, 11+len(payload)+4)
+	tag[0] = tagType
+	tag[1], tag[2], tag[3] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	tag[4], tag[5], tag[6], tag[7] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp), byte(timestamp>>24)
+	tag = append(tag, payload...)
+	tag = binary.BigEndian.AppendUint32(tag, uint32(11+len(payload)))
+	if _, err := flv.Out.Write(tag); err != nil {
+		return Error{Message: "There was an error writing an FLV tag", Err: err}
+	}
+	return nil
+}
+
+// A single tag read out of a stream of FLV tags
+type FLVTag struct {
+	Type      byte
+	Timestamp uint32
+	Payload   []byte
+}
+
+// Splits a stream of back to back FLV tags (each followed by its previous tag
+// size) as found in RTMP aggregate messages and HDS fragments
+func ParseFLVTags(data []byte) []FLVTag {
+	tags := []FLVTag{}
+	for len(data) >= 11 {
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 11+size {
+			break
+		}
+		tags = append(tags, FLVTag{
+			Type:      data[0],
+			Timestamp: uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24,
+			Payload:   data[11 : 11+size],
+		})
+
+		// Skips past the tag and the previous tag size which follows it
+		if len(data) < 11+size+4 {
+			break
+		}
+		data = data[11+size+4:]
+	}
+	return tags
+}
@@ -0,0 +1,334 @@
+package anirip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Describes an HLS stream so providers can hand it off to be downloaded
+type HLSInfo struct {
+	PlaylistURL string
+	Referer     string
+}
+
+// A single stream variant listed in a master playlist
+type HLSVariant struct {
+	URL       string
+	Bandwidth int
+	Width     int
+	Height    int
+	Codecs    string
+}
+
+// A single media segment listed in a media playlist
+type HLSSegment struct {
+	URL      string
+	Duration float64
+	Sequence int64
+	Offset   int64 // Byte range offset, only used when Length is set
+	Length   int64 // Byte range length, zero when the whole resource is the segment
+	Key      *HLSKey
+}
+
+// The encryption applied to a segment
+type HLSKey struct {
+	Method string
+	URI    string
+	IV     []byte
+}
+
+// A parsed media playlist
+type HLSPlaylist struct {
+	InitSection *HLSSegment // Set by EXT-X-MAP for fragmented mp4 streams
+	Segments    []HLSSegment
+}
+
+// Downloads the HLS stream, picking the variant that best matches quality,
+// and writes every decrypted segment in order to fileName
+func DownloadHLS(info HLSInfo, quality string, client *Client, fileName string) error {
+	header := http.Header{}
+	if info.Referer != "" {
+		header.Add("referer", info.Referer)
+	}
+
+	// Gets the playlist we were given which may be either a master or media playlist
+	playlistURL, err := url.Parse(info.PlaylistURL)
+	if err != nil {
+		return Error{Message: "There was an error parsing the playlist url", Err: err}
+	}
+	body, err := getResource(client, playlistURL.String(), header, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	// Master playlists need a variant picked before we can get to the segments
+	if strings.Contains(string(body), "#EXT-X-STREAM-INF") {
+		variants, err := ParseMasterPlaylist(body, playlistURL)
+		if err != nil {
+			return err
+		}
+		variant := SelectVariant(variants, quality)
+		if playlistURL, err = url.Parse(variant.URL); err != nil {
+			return Error{Message: "There was an error parsing the variant url", Err: err}
+		}
+		if body, err = getResource(client, playlistURL.String(), header, 0, 0); err != nil {
+			return err
+		}
+	}
+	playlist, err := ParseMediaPlaylist(body, playlistURL)
+	if err != nil {
+		return err
+	}
+
+	// Puts the initialization section first for fragmented mp4 streams
+	hlsSegments := playlist.Segments
+	if playlist.InitSection != nil {
+		hlsSegments = append([]HLSSegment{*playlist.InitSection}, hlsSegments...)
+	}
+
+	// Gets every key ahead of time so the segment workers never race on the key cache
+	keys := map[string][]byte{}
+	segments := []Segment{}
+	for _, segment := range hlsSegments {
+		segments = append(segments, Segment{URL: segment.URL, Offset: segment.Offset, Length: segment.Length})
+		if segment.Key != nil && segment.Key.Method == "AES-128" {
+			if _, ok := keys[segment.Key.URI]; !ok {
+				key, err := getResource(client, segment.Key.URI, header, 0, 0)
+				if err != nil {
+					return err
+				}
+				keys[segment.Key.URI] = key
+			}
+		}
+	}
+
+	// Hands the segments to the downloader, decrypting each as it arrives
+	downloader := &Downloader{
+		Header: header,
+		Client: client,
+		Transform: func(index int, data []byte) ([]byte, error) {
+			return decryptHLSSegment(hlsSegments[index], data, keys)
+		},
+	}
+	return downloader.Download(segments, fileName)
+}
+
+// Parses a master playlist into the variants it lists
+func ParseMasterPlaylist(body []byte, playlistURL *url.URL) ([]HLSVariant, error) {
+	variants := []HLSVariant{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	var pending *HLSVariant
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+			pending = &HLSVariant{Codecs: attributes["CODECS"]}
+			pending.Bandwidth, _ = strconv.Atoi(attributes["BANDWIDTH"])
+			if resolution := strings.SplitN(attributes["RESOLUTION"], "x", 2); len(resolution) == 2 {
+				pending.Width, _ = strconv.Atoi(resolution[0])
+				pending.Height, _ = strconv.Atoi(resolution[1])
+			}
+		case line != "" && !strings.HasPrefix(line, "#") && pending != nil:
+			variantURL, err := playlistURL.Parse(line)
+			if err != nil {
+				return nil, Error{Message: "There was an error parsing a variant url", Err: err}
+			}
+			pending.URL = variantURL.String()
+			variants = append(variants, *pending)
+			pending = nil
+		}
+	}
+	if len(variants) == 0 {
+		return nil, Error{Message: "The master playlist did not contain any variants"}
+	}
+	return variants, nil
+}
+
+// Parses a media playlist into the segments it lists
+func ParseMediaPlaylist(body []byte, playlistURL *url.URL) (*HLSPlaylist, error) {
+	playlist := new(HLSPlaylist)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	sequence := int64(0)
+	duration := float64(0)
+	length, offset := int64(0), int64(-1)
+	nextOffset := map[string]int64{}
+	var key *HLSKey
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, _ = strconv.ParseFloat(strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0], 64)
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			length, offset = parseByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"))
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			if attributes["METHOD"] == "NONE" {
+				key = nil
+				continue
+			}
+			if attributes["METHOD"] != "AES-128" {
+				return nil, Error{Message: "Unsupported HLS encryption method " + attributes["METHOD"]}
+			}
+			keyURL, err := playlistURL.Parse(attributes["URI"])
+			if err != nil {
+				return nil, Error{Message: "There was an error parsing the key url", Err: err}
+			}
+			key = &HLSKey{Method: attributes["METHOD"], URI: keyURL.String()}
+			if iv := attributes["IV"]; iv != "" {
+				if key.IV, err = hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")); err != nil {
+					return nil, Error{Message: "There was an error decoding the key IV", Err: err}
+				}
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			mapURL, err := playlistURL.Parse(attributes["URI"])
+			if err != nil {
+				return nil, Error{Message: "There was an error parsing the init section url", Err: err}
+			}
+			// An init section is encrypted by whichever key is in effect where it's declared
+			playlist.InitSection = &HLSSegment{URL: mapURL.String(), Sequence: sequence, Key: key}
+			if attributes["BYTERANGE"] != "" {
+				playlist.InitSection.Length, playlist.InitSection.Offset = parseByteRange(attributes["BYTERANGE"])
+				if playlist.InitSection.Offset < 0 {
+					playlist.InitSection.Offset = 0
+				}
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segmentURL, err := playlistURL.Parse(line)
+			if err != nil {
+				return nil, Error{Message: "There was an error parsing a segment url", Err: err}
+			}
+			segment := HLSSegment{
+				URL:      segmentURL.String(),
+				Duration: duration,
+				Sequence: sequence,
+				Key:      key,
+			}
+
+			// Byte ranges without an offset continue on from the previous range of the same resource
+			if length > 0 {
+				if offset < 0 {
+					offset = nextOffset[segment.URL]
+				}
+				segment.Length, segment.Offset = length, offset
+				nextOffset[segment.URL] = offset + length
+			}
+			playlist.Segments = append(playlist.Segments, segment)
+			sequence++
+			duration, length, offset = 0, 0, -1
+		}
+	}
+	if len(playlist.Segments) == 0 {
+		return nil, Error{Message: "The media playlist did not contain any segments"}
+	}
+	return playlist, nil
+}
+
+// Picks the variant whose resolution matches quality, falling back to the
+// tallest variant below it and finally to the highest bandwidth available
+func SelectVariant(variants []HLSVariant, quality string) HLSVariant {
+	sorted := append([]HLSVariant{}, variants...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Height != sorted[j].Height {
+			return sorted[i].Height > sorted[j].Height
+		}
+		return sorted[i].Bandwidth > sorted[j].Bandwidth
+	})
+	height, err := strconv.Atoi(qualityHeight.FindString(quality))
+	if err != nil {
+		return sorted[0]
+	}
+	for _, variant := range sorted {
+		if variant.Height <= height {
+			return variant
+		}
+	}
+	return sorted[len(sorted)-1]
+}
+
+// Decrypts a downloaded segment if the playlist told us it's encrypted
+func decryptHLSSegment(segment HLSSegment, data []byte, keys map[string][]byte) ([]byte, error) {
+	if segment.Key == nil {
+		return data, nil
+	}
+
+	// Segments without an explicit IV use their media sequence number
+	iv := segment.Key.IV
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(segment.Sequence))
+	}
+	block, err := aes.NewCipher(keys[segment.Key.URI])
+	if err != nil {
+		return nil, Error{Message: "There was an error creating the segment cipher", Err: err}
+	}
+	if len(data)%aes.BlockSize != 0 || len(iv) != aes.BlockSize {
+		return nil, Error{Message: "The encrypted segment " + segment.URL + " is malformed"}
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	// Strips the PKCS7 padding off of the decrypted segment
+	if len(data) > 0 {
+		padding := int(data[len(data)-1])
+		if padding > 0 && padding <= aes.BlockSize && padding <= len(data) {
+			data = data[:len(data)-padding]
+		}
+	}
+	return data, nil
+}
+
+// Gets a playlist, manifest, key or index, limiting it to a byte range when length is set
+func getResource(client *Client, resourceURL string, header http.Header, offset, length int64) ([]byte, error) {
+	requestHeader := http.Header{}
+	for name, values := range header {
+		requestHeader[name] = values
+	}
+	if length > 0 {
+		requestHeader.Set("range", byteRange(offset, length))
+	}
+	response, err := client.Do("GET", resourceURL, nil, requestHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRangeResponse(response, resourceURL, offset, length); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// Parses a BYTERANGE value of the form length[@offset], returning -1 for a missing offset
+func parseByteRange(value string) (int64, int64) {
+	parts := strings.SplitN(strings.Trim(value, "\""), "@", 2)
+	length, _ := strconv.ParseInt(parts[0], 10, 64)
+	offset := int64(-1)
+	if len(parts) == 2 {
+		offset, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return length, offset
+}
+
+// Matches each KEY=value of a playlist tag attribute list
+var hlsAttribute = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+
+// Splits a playlist tag attribute list into its keys and values, removing any quotes
+func parseHLSAttributes(list string) map[string]string {
+	attributes := map[string]string{}
+	for _, match := range hlsAttribute.FindAllStringSubmatch(list, -1) {
+		attributes[match[1]] = strings.Trim(match[2], "\"")
+	}
+	return attributes
+}
@@ -0,0 +1,209 @@
+package anirip
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseMasterPlaylist(t *testing.T) {
+	playlistURL, _ := url.Parse("https://cdn.example.com/episode/master.m3u8?token=abc")
+	body := []byte(`#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-STREAM-INF:BANDWIDTH=1200000,RESOLUTION=854x480,CODECS="avc1.4d401f,mp4a.40.2"
+480p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"
+https://other.example.com/1080p/index.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720
+/episode/720p/index.m3u8
+`)
+	variants, err := ParseMasterPlaylist(body, playlistURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HLSVariant{
+		{URL: "https://cdn.example.com/episode/480p/index.m3u8", Bandwidth: 1200000, Width: 854, Height: 480, Codecs: "avc1.4d401f,mp4a.40.2"},
+		{URL: "https://other.example.com/1080p/index.m3u8", Bandwidth: 4000000, Width: 1920, Height: 1080, Codecs: "avc1.640028,mp4a.40.2"},
+		{URL: "https://cdn.example.com/episode/720p/index.m3u8", Bandwidth: 2500000, Width: 1280, Height: 720},
+	}
+	if !reflect.DeepEqual(variants, want) {
+		t.Errorf("got %+v, want %+v", variants, want)
+	}
+	if _, err := ParseMasterPlaylist([]byte("#EXTM3U\n"), playlistURL); err == nil {
+		t.Error("expected a master playlist without variants to fail")
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	variants := []HLSVariant{
+		{URL: "480", Height: 480, Bandwidth: 1200000},
+		{URL: "1080", Height: 1080, Bandwidth: 4000000},
+		{URL: "720-low", Height: 720, Bandwidth: 1500000},
+		{URL: "720", Height: 720, Bandwidth: 2500000},
+	}
+	tests := map[string]string{
+		"1080p": "1080",
+		"720":   "720",
+		"900p":  "720",
+		"480p":  "480",
+		"240p":  "480",
+		"best":  "1080",
+		"":      "1080",
+	}
+	for quality, want := range tests {
+		if got := SelectVariant(variants, quality); got.URL != want {
+			t.Errorf("%q: got %s, want %s", quality, got.URL, want)
+		}
+	}
+}
+
+func TestParseMediaPlaylist(t *testing.T) {
+	playlistURL, _ := url.Parse("https://cdn.example.com/episode/720p/index.m3u8")
+	body := []byte(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="../key.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:1000@720
+media.mp4
+#EXTINF:6.006,
+#EXT-X-BYTERANGE:2000
+media.mp4
+#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example.com/2"
+#EXTINF:4.5,title
+segment3.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:2,
+segment4.ts
+#EXT-X-ENDLIST
+`)
+	playlist, err := ParseMediaPlaylist(body, playlistURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey := &HLSKey{Method: "AES-128", URI: "https://cdn.example.com/episode/key.bin", IV: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}}
+	secondKey := &HLSKey{Method: "AES-128", URI: "https://keys.example.com/2"}
+	want := &HLSPlaylist{
+		InitSection: &HLSSegment{URL: "https://cdn.example.com/episode/720p/init.mp4", Length: 720, Sequence: 7, Key: firstKey},
+		Segments: []HLSSegment{
+			{URL: "https://cdn.example.com/episode/720p/media.mp4", Duration: 6.006, Sequence: 7, Offset: 720, Length: 1000, Key: firstKey},
+			{URL: "https://cdn.example.com/episode/720p/media.mp4", Duration: 6.006, Sequence: 8, Offset: 1720, Length: 2000, Key: firstKey},
+			{URL: "https://cdn.example.com/episode/720p/segment3.ts", Duration: 4.5, Sequence: 9, Key: secondKey},
+			{URL: "https://cdn.example.com/episode/720p/segment4.ts", Duration: 2, Sequence: 10},
+		},
+	}
+	if !reflect.DeepEqual(playlist, want) {
+		t.Errorf("got %+v, want %+v", playlist, want)
+	}
+}
+
+func TestParseMediaPlaylistErrors(t *testing.T) {
+	playlistURL, _ := url.Parse("https://cdn.example.com/index.m3u8")
+	tests := map[string]string{
+		"no segments":     "#EXTM3U\n#EXT-X-ENDLIST\n",
+		"sample aes":      "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key\"\n#EXTINF:2,\na.ts\n",
+		"bad iv":          "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0xZZ\n#EXTINF:2,\na.ts\n",
+		"bad map url":     "#EXTM3U\n#EXT-X-MAP:URI=\"%zz\"\n#EXTINF:2,\na.ts\n",
+		"bad key url":     "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"%zz\"\n#EXTINF:2,\na.ts\n",
+		"bad segment url": "#EXTM3U\n#EXTINF:2,\n%zz\n",
+	}
+	for name, body := range tests {
+		if _, err := ParseMediaPlaylist([]byte(body), playlistURL); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// Encrypts data with AES-128 CBC and PKCS7 padding as HLS servers do
+func encryptHLS(key, iv, data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded
+}
+
+func TestDownloadHLS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	explicitIV := []byte("fedcba9876543210")
+	sequenceIV := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(sequenceIV[8:], 4)
+	files := map[string][]byte{
+		"/master.m3u8": []byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nlow/index.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720\nhigh/index.m3u8\n"),
+		"/high/index.m3u8": []byte("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:3\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"/key\",IV=0x" + "66656463626139383736353433323130" + "\n" +
+			"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+			"#EXTINF:2,\nsegment1.m4s\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"/key\"\n" +
+			"#EXTINF:2,\nsegment2.m4s\n" +
+			"#EXT-X-KEY:METHOD=NONE\n" +
+			"#EXTINF:2,\nsegment3.m4s\n"),
+		"/key":               key,
+		"/high/init.mp4":     encryptHLS(key, explicitIV, []byte("init section")),
+		"/high/segment1.m4s": encryptHLS(key, explicitIV, []byte("first segment")),
+		"/high/segment2.m4s": encryptHLS(key, sequenceIV, []byte("second segment")),
+		"/high/segment3.m4s": []byte("third segment"),
+	}
+	mutex := sync.Mutex{}
+	referers := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		referers = append(referers, request.Header.Get("referer"))
+		data, ok := files[request.URL.Path]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Write(data)
+	}))
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "anirip-hls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := filepath.Join(tempDir, "episode.ts")
+	info := HLSInfo{PlaylistURL: server.URL + "/master.m3u8", Referer: "https://example.com/watch"}
+	if err := DownloadHLS(info, "720p", NewClient(nil), fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "init sectionfirst segmentsecond segmentthird segment"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	for _, referer := range referers {
+		if referer != info.Referer {
+			t.Errorf("a request was sent with the referer %q", referer)
+		}
+	}
+
+	// A missing segment fails the download, without waiting on retries
+	defer func(retries int) { SegmentRetries = retries }(SegmentRetries)
+	SegmentRetries = 1
+	mutex.Lock()
+	delete(files, "/high/segment3.m4s")
+	mutex.Unlock()
+	if err := DownloadHLS(HLSInfo{PlaylistURL: server.URL + "/high/index.m3u8"}, "", NewClient(nil), fileName); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want the missing segment to fail the download", err)
+	}
+}
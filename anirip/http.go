@@ -1,35 +1,249 @@
 package anirip
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
-// A shorthand function for writing http requests. NOTE: Uses a default user-agent for every request
-func GetHTTPResponse(method, urlStr string, body io.Reader, header http.Header, cookies []*http.Cookie) (*http.Response, error) {
-	// Builds out request based on first 3 params
-	request, err := http.NewRequest(method, urlStr, body)
-	if err != nil {
-		return nil, Error{Message: "There was an error creating the " + method + " request on " + urlStr, Err: err}
+// The user-agent sent with every request unless the client is given another
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/51.0.2704.103 Safari/537.36"
+
+// An HTTP client that keeps a session's cookies up to date, follows redirects
+// and retries requests that fail because of the network or the server
+type Client struct {
+	Jar          *CookieJar
+	Transport    http.RoundTripper
+	Proxy        *url.URL // Set through SetProxy, also used by Dial for non HTTP connections
+	UserAgent    string
+	Timeout      time.Duration // Limits a whole request including reading the body, streams only limit the wait for headers
+	IdleTimeout  time.Duration // How long reading a body can go without receiving anything before it fails with ErrStalled
+	MaxRedirects int
+	Retries      int           // The number of extra attempts made for a GET or HEAD after a network error, 429 or 5xx
+	RetryWait    time.Duration // How long to wait before the first retry, doubled after every attempt
+
+	// Applied to the streams downloaded with the client. The limiter can be shared between
+	// clients so the limit holds across every download running at once
+	RateLimiter        *RateLimiter
+	SegmentConcurrency int // The number of segments of a single stream fetched at the same time
+}
+
+// Creates a client with sensible defaults and a cookie jar holding cookies
+func NewClient(cookies []*http.Cookie) *Client {
+	client := &Client{
+		Jar: NewCookieJar(cookies),
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   8,
+		},
+		UserAgent:    DefaultUserAgent,
+		Timeout:      60 * time.Second,
+		IdleTimeout:  30 * time.Second,
+		MaxRedirects: 10,
+		Retries:      3,
+		RetryWait:    time.Second,
+
+		SegmentConcurrency: 4,
+	}
+	if WrapTransport != nil {
+		client.Transport = WrapTransport(client.Transport)
+	}
+	return client
+}
+
+// Performs a request and reads the whole response body into memory, so the
+// caller never has to close it. Any 5xx left after retrying is returned as is
+func (client *Client) Do(method, urlStr string, body io.Reader, header http.Header) (*http.Response, error) {
+	return client.do(method, urlStr, body, header, true)
+}
+
+// Performs a request leaving the response body open so large responses can be
+// read as they arrive. The caller must close the body
+func (client *Client) Stream(method, urlStr string, body io.Reader, header http.Header) (*http.Response, error) {
+	return client.do(method, urlStr, body, header, false)
+}
+
+// The longest a Retry-After header is allowed to hold up a retry
+const maxRetryAfter = 5 * time.Minute
+
+// Performs the request, retrying GET and HEAD requests with an exponential backoff
+// when they fail. Anything else could have side effects so is only ever sent once
+func (client *Client) do(method, urlStr string, body io.Reader, header http.Header, buffered bool) (*http.Response, error) {
+	// Reads the body up front so every attempt can send it again
+	var requestBody []byte
+	if body != nil {
+		var err error
+		if requestBody, err = ioutil.ReadAll(body); err != nil {
+			return nil, Error{Message: "There was an error reading the " + method + " body for " + urlStr, Err: err}
+		}
 	}
 
-	// Sets the headers passed as the request headers
-	if header != nil {
-		request.Header = header
+	wait := client.RetryWait
+	for attempt := 0; ; attempt++ {
+		if err := CheckCanceled(); err != nil {
+			return nil, err
+		}
+		response, err := client.attempt(method, urlStr, requestBody, header, buffered)
+		idempotent := method == http.MethodGet || method == http.MethodHead
+		retryable := err != nil || response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+		if !idempotent || !retryable || attempt >= client.Retries {
+			return response, err
+		}
+
+		// Waits as long as the server asked us to when it told us, otherwise backs off
+		delay := wait
+		if response != nil {
+			if after, ok := retryAfter(response.Header.Get("retry-after")); ok {
+				delay = after
+			}
+			response.Body.Close()
+		}
+		time.Sleep(delay)
+		wait *= 2
+	}
+}
+
+// Parses a Retry-After header, given either in seconds or as an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var after time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		after = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		after = time.Until(date)
 	} else {
-		request.Header = http.Header{}
+		return 0, false
+	}
+	if after < 0 {
+		after = 0
+	}
+	if after > maxRetryAfter {
+		after = maxRetryAfter
+	}
+	return after, true
+}
+
+// Performs a single attempt of the request
+func (client *Client) attempt(method, urlStr string, requestBody []byte, header http.Header, buffered bool) (*http.Response, error) {
+	request, err := http.NewRequest(method, urlStr, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, Error{Message: "There was an error creating the " + method + " request on " + urlStr, Err: err}
+	}
+	if requestBody == nil {
+		request.Body = nil
 	}
-	request.Header.Add("user-agent", "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/51.0.2704.103 Safari/537.36")
 
-	// Attaches all cookies passed
-	for _, cookie := range cookies {
-		request.AddCookie(cookie)
+	// Copies the headers passed so the callers header is never modified
+	request.Header = http.Header{}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if request.Header.Get("user-agent") == "" {
+		request.Header.Set("user-agent", client.UserAgent)
 	}
 
-	// Executes the new request and returns the response, retries recursively if theres a failure
-	response, err := http.DefaultTransport.RoundTrip(request)
+	// Buffered requests are bounded as a whole, including reading the body, while streams can
+	// take as long as they need once started so long as data keeps arriving
+	ctx := context.Background()
+	if buffered && client.Timeout > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeout(ctx, client.Timeout)
+		defer timeoutCancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	response, err := client.httpClient().Do(request.WithContext(ctx))
 	if err != nil {
+		cancel()
 		return nil, Error{Message: "There was an error performing the " + method + " request on " + urlStr, Err: err}
 	}
+	response.Body = newIdleReader(response.Body, client.IdleTimeout, cancel)
+	if !buffered {
+		return response, nil
+	}
+
+	// Reads the body in full and closes it, handing back an in memory copy. A stalled body
+	// fails the attempt so it's retried like any other network error
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, Error{Message: "There was an error reading the response from " + urlStr, Err: err}
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(data))
 	return response, nil
 }
+
+// A response body that fails with ErrStalled when a single Read waits longer than
+// timeout for data, canceling the request so the connection is let go of
+type idleReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+	cancel  context.CancelFunc
+}
+
+// Wraps body so reads time out after timeout, which never happens when it's zero
+func newIdleReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleReader {
+	reader := &idleReader{body: body, timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		reader.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&reader.stalled, 1)
+			cancel()
+		})
+		reader.timer.Stop()
+	}
+	return reader
+}
+
+// Reads from the body with the timer running, so time spent by the caller between reads doesn't count
+func (reader *idleReader) Read(p []byte) (int, error) {
+	if reader.timer != nil {
+		reader.timer.Reset(reader.timeout)
+	}
+	n, err := reader.body.Read(p)
+	if reader.timer != nil {
+		reader.timer.Stop()
+	}
+	if atomic.LoadInt32(&reader.stalled) == 1 {
+		return n, ErrStalled
+	}
+	return n, err
+}
+
+func (reader *idleReader) Close() error {
+	if reader.timer != nil {
+		reader.timer.Stop()
+	}
+	reader.cancel()
+	return reader.body.Close()
+}
+
+// Builds the standard library client that carries out our requests
+func (client *Client) httpClient() *http.Client {
+	httpClient := &http.Client{
+		Transport: client.Transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= client.MaxRedirects {
+				return Error{Message: "Stopped after " + strconv.Itoa(client.MaxRedirects) + " redirects"}
+			}
+			return nil
+		},
+	}
+	if client.Jar != nil {
+		httpClient.Jar = client.Jar
+	}
+	return httpClient
+}
@@ -0,0 +1,153 @@
+package anirip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		header   string
+		attempts int32
+	}{
+		{name: "get retried after 503", method: "GET", status: http.StatusServiceUnavailable, attempts: 3},
+		{name: "head retried after 500", method: "HEAD", status: http.StatusInternalServerError, attempts: 3},
+		{name: "get retried after 429", method: "GET", status: http.StatusTooManyRequests, attempts: 3},
+		{name: "post never retried", method: "POST", status: http.StatusServiceUnavailable, attempts: 1},
+		{name: "get not retried after 404", method: "GET", status: http.StatusNotFound, attempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				// Fails everything but the third attempt
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					writer.WriteHeader(test.status)
+					return
+				}
+				writer.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			client := NewClient(nil)
+			client.RetryWait = time.Millisecond
+			response, err := client.Do(test.method, server.URL, strings.NewReader("body"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempts != test.attempts {
+				t.Errorf("made %d attempts, expected %d", attempts, test.attempts)
+			}
+			if test.attempts == 1 && response.StatusCode != test.status {
+				t.Errorf("got status %d, expected %d", response.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	var first time.Time
+	var waited time.Duration
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if first.IsZero() {
+			first = time.Now()
+			writer.Header().Set("retry-after", "1")
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		waited = time.Since(first)
+	}))
+	defer server.Close()
+
+	client := NewClient(nil)
+	client.RetryWait = time.Millisecond
+	if _, err := client.Do("GET", server.URL, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if waited < time.Second {
+		t.Errorf("retried after %v, expected the second asked for", waited)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		after time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "soon", ok: false},
+		{value: "30", after: 30 * time.Second, ok: true},
+		{value: "-5", after: 0, ok: true},
+		{value: "86400", after: maxRetryAfter, ok: true},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", after: 0, ok: true},
+	}
+	for _, test := range tests {
+		after, ok := retryAfter(test.value)
+		if after != test.after || ok != test.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, expected %v, %v", test.value, after, ok, test.after, test.ok)
+		}
+	}
+}
+
+// Serves part of a body then stops sending for the first stalls requests, and the whole body after
+func stallingServer(stalls int32) (*httptest.Server, *int32) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("content-length", "4")
+		writer.Write([]byte("ok"))
+		if atomic.AddInt32(&attempts, 1) <= stalls {
+			writer.(http.Flusher).Flush()
+			select {
+			case <-request.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		writer.Write([]byte("ok"))
+	}))
+	return server, &attempts
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	server, attempts := stallingServer(2)
+	defer server.Close()
+	client := NewClient(nil)
+	client.RetryWait = time.Millisecond
+	client.IdleTimeout = 50 * time.Millisecond
+
+	// A stream hands back the stall to whoever is reading it
+	response, err := client.Stream("GET", server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if !wraps(err, ErrStalled) {
+		t.Errorf("reading a stalled stream gave %v, expected ErrStalled", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("took %v to notice the stall", time.Since(start))
+	}
+
+	// A buffered request retries past the stall like any other network error
+	response, err = client.Do("GET", server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(response.Body); string(data) != "okok" {
+		t.Errorf("got %q after retrying, expected okok", data)
+	}
+	if *attempts != 3 {
+		t.Errorf("made %d attempts, expected 3", *attempts)
+	}
+}
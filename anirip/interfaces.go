@@ -4,11 +4,16 @@ import "net/http"
 
 type Session interface {
 	Login(string, string, string) error
-	GetCookies() []*http.Cookie
+	Refresh(string) error
+	Validate(string) (bool, error)
+	ImportCookies(string, []*http.Cookie, string) error
+	Status(string) (SessionStatus, error)
+	Logout(string) error
+	GetClient() *Client
 }
 
 type Show interface {
-	ScrapeEpisodes(string, []*http.Cookie) error
+	ScrapeEpisodes(string, *Client) error
 	GetTitle() string
 	GetSeasons() Seasons
 }
@@ -23,8 +28,19 @@ type Season interface {
 type Episodes []Episode
 
 type Episode interface {
-	GetEpisodeInfo(string, []*http.Cookie) error
-	DownloadEpisode(string, string, []*http.Cookie) error
-	DownloadSubtitles(string, int, string, []*http.Cookie) (string, error)
+	GetEpisodeInfo(string, *Client) error
+	DownloadEpisode(string, string, *Client) error
+	DownloadSubtitles(string, int, string, *Client) (string, error)
 	GetFileName() string
+	GetNumber() float64
+	GetURL() string
+	GetID() string
+	GetStreamInfo() StreamInfo
+}
+
+// Describes a stream anirip downloads itself rather than leaving to the providers
+// DownloadEpisode. Everything is left unset for providers that download their own
+type StreamInfo struct {
+	HLS  *HLSInfo  // Set once GetEpisodeInfo has found an HLS playlist
+	DASH *DASHInfo // Set once GetEpisodeInfo has found a DASH manifest
 }
@@ -0,0 +1,237 @@
+package anirip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// How much a log message matters, messages below a loggers level aren't shown
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Gets the name a level is written out with
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	}
+	return "error"
+}
+
+// Context attached to log messages, such as the show and episode being ripped
+type Fields map[string]interface{}
+
+// A leveled logger writing to the console, in color or as JSON lines, and optionally
+// every message including debug ones to a file such as the runs log file
+type Logger struct {
+	output *logOutput
+	fields Fields
+}
+
+// Where a logger and every logger made from it with With write to
+type logOutput struct {
+	mutex   sync.Mutex
+	console io.Writer
+	level   Level
+	json    bool
+	file    io.Writer
+	hook    func(level Level, message string)
+}
+
+// A single message as written out
+type logEntry struct {
+	time    time.Time
+	level   Level
+	message string
+	success bool
+	fields  Fields
+	output  string // What an external command wrote to stderr before failing, if anything
+}
+
+// Creates a logger writing messages at level or above to console, as JSON lines if json is set
+func NewLogger(console io.Writer, level Level, json bool) *Logger {
+	return &Logger{output: &logOutput{console: console, level: level, json: json}, fields: Fields{}}
+}
+
+// Changes which messages are written to the console and how
+func (logger *Logger) SetConsole(level Level, json bool) {
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.level, logger.output.json = level, json
+}
+
+// Also writes every message, whatever the console level, to file
+func (logger *Logger) SetFile(file io.Writer) {
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.file = file
+}
+
+// Has hook called with every message logged whatever the console level, such as to pass warnings on elsewhere
+func (logger *Logger) SetHook(hook func(level Level, message string)) {
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.hook = hook
+}
+
+// Creates a logger that adds fields to every message, on top of any this logger adds
+func (logger *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{output: logger.output, fields: merged}
+}
+
+// Logs detail only wanted when tracking down a problem
+func (logger *Logger) Debug(message string) {
+	logger.log(logEntry{level: LevelDebug, message: message})
+}
+
+// Logs progress
+func (logger *Logger) Info(message string) {
+	logger.log(logEntry{level: LevelInfo, message: message})
+}
+
+// Logs something finishing successfully, shown in green
+func (logger *Logger) Success(message string) {
+	logger.log(logEntry{level: LevelInfo, message: message, success: true})
+}
+
+// Logs something that went wrong but didn't stop us
+func (logger *Logger) Warn(message string) {
+	logger.log(logEntry{level: LevelWarn, message: message})
+}
+
+// Logs something that failed
+func (logger *Logger) Error(message string) {
+	logger.log(logEntry{level: LevelError, message: message})
+}
+
+// Logs a failed step, along with anything an external command it ran wrote to stderr
+func (logger *Logger) Failure(err error) {
+	logger.log(logEntry{level: LevelError, message: err.Error(), output: CommandOutput(err)})
+}
+
+// Writes an entry to the console if it's at the console level, and to the log file
+func (logger *Logger) log(entry logEntry) {
+	entry.time = time.Now()
+	entry.fields = logger.fields
+	entry.message = strings.TrimRight(entry.message, " \n")
+	logger.output.mutex.Lock()
+	hook := logger.output.hook
+	defer func() {
+		logger.output.mutex.Unlock()
+		if hook != nil {
+			hook(entry.level, entry.message)
+		}
+	}()
+	if entry.level >= logger.output.level {
+		if logger.output.json {
+			writeJSONEntry(logger.output.console, entry)
+		} else {
+			writeConsoleEntry(logger.output.console, entry, logger.output.level == LevelDebug)
+		}
+	}
+	if logger.output.file != nil {
+		if logger.output.json {
+			writeJSONEntry(logger.output.file, entry)
+		} else {
+			writeTextEntry(logger.output.file, entry)
+		}
+	}
+}
+
+// Writes an entry for a person to read, colored by its level. Its time and fields are only
+// shown when verbose, to keep the usual output short
+func writeConsoleEntry(writer io.Writer, entry logEntry, verbose bool) {
+	line := "[anirip] " + entry.message
+	if verbose {
+		line = entry.time.Format("15:04:05") + " " + line + formatFields(entry.fields)
+	}
+	switch {
+	case entry.level == LevelError:
+		color.New(color.FgRed).Fprintln(writer, line)
+	case entry.level == LevelWarn:
+		color.New(color.FgYellow).Fprintln(writer, line)
+	case entry.success:
+		color.New(color.FgGreen).Fprintln(writer, line)
+	case entry.level == LevelDebug:
+		color.New(color.FgHiBlack).Fprintln(writer, line)
+	default:
+		color.New(color.FgWhite).Fprintln(writer, line)
+	}
+	if entry.output != "" {
+		color.New(color.FgHiBlack).Fprintln(writer, indent(entry.output))
+	}
+}
+
+// Writes an entry as a plain line with its time and level, as kept in log files
+func writeTextEntry(writer io.Writer, entry logEntry) {
+	fmt.Fprintf(writer, "%s %-5s %s%s\n", entry.time.Format(time.RFC3339), entry.level, entry.message, formatFields(entry.fields))
+	if entry.output != "" {
+		fmt.Fprintln(writer, indent(entry.output))
+	}
+}
+
+// Writes an entry as a single JSON object on its own line
+func writeJSONEntry(writer io.Writer, entry logEntry) {
+	object := map[string]interface{}{}
+	for key, value := range entry.fields {
+		object[key] = value
+	}
+	object["time"] = entry.time.Format(time.RFC3339Nano)
+	object["level"] = entry.level.String()
+	object["msg"] = entry.message
+	if entry.output != "" {
+		object["stderr"] = entry.output
+	}
+	line, err := json.Marshal(object)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"time": object["time"].(string), "level": entry.level.String(), "msg": entry.message})
+	}
+	writer.Write(append(line, '\n'))
+}
+
+// Formats fields as key=value pairs sorted by key, quoting values with spaces
+func formatFields(fields Fields) string {
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	formatted := ""
+	for _, key := range keys {
+		value := fmt.Sprint(fields[key])
+		if strings.ContainsAny(value, " \t\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		formatted += " " + key + "=" + value
+	}
+	return formatted
+}
+
+// Indents every line of text so it reads as belonging to the line above
+func indent(text string) string {
+	return "    " + strings.Replace(strings.TrimRight(text, "\n"), "\n", "\n    ", -1)
+}
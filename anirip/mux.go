@@ -0,0 +1,47 @@
+package anirip
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Muxes separately downloaded tracks into a single MKV, tagging each with its language
+func MuxTracks(tracks []Track, outputFile string) error {
+	// Remove stale output file to avoid conflcts with ffmpeg
+	os.Remove(outputFile)
+
+	// Adds every track as an input and maps it through to the output untouched
+	args := []string{}
+	for _, track := range tracks {
+		args = append(args, "-i", track.File)
+	}
+	for i := range tracks {
+		args = append(args, "-map", strconv.Itoa(i))
+	}
+	args = append(args, "-c", "copy")
+	audioIndex := 0
+	for _, track := range tracks {
+		if track.Kind == "audio" && track.Language != "" {
+			args = append(args, "-metadata:s:a:"+strconv.Itoa(audioIndex), "language="+track.Language)
+		}
+		if track.Kind == "audio" {
+			audioIndex++
+		}
+	}
+	args = append(args, "-y", filepath.Base(outputFile))
+
+	// Executes the mux within the output directory
+	cmd := exec.Command(FindAbsoluteBinary("ffmpeg"), args...)
+	cmd.Dir = filepath.Dir(outputFile)
+	if err := RunFFmpeg(cmd); err != nil {
+		return Error{Message: "There was an error while muxing tracks", Err: err}
+	}
+
+	// Removes the separate tracks as they are no longer needed
+	for _, track := range tracks {
+		os.Remove(track.File)
+	}
+	return nil
+}
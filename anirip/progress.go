@@ -0,0 +1,41 @@
+package anirip
+
+import (
+	"time"
+)
+
+// How far a download or an external command has got. Anything that isn't known is left at zero
+type Progress struct {
+	Bytes         int64         // Bytes downloaded or written so far
+	Segments      int           // Segments or fragments finished so far
+	TotalSegments int           // Segments or fragments that make up the stream
+	Position      time.Duration // How far into the media has been downloaded or processed
+	Duration      time.Duration // How long the media is
+	Done          bool          // Set on the last report once the download or command has finished
+}
+
+// Can be set to be told as downloads and external commands make progress, such as to draw a progress bar
+var ReportProgress func(Progress)
+
+// Passes progress on to ReportProgress if it's set
+func NotifyProgress(progress Progress) {
+	if report := ReportProgress; report != nil {
+		report(progress)
+	}
+}
+
+// Gets how far through progress is from 0 to 1, by segments if it has them and otherwise by
+// media time, along with whether that could be worked out at all
+func (progress Progress) Fraction() (float64, bool) {
+	switch {
+	case progress.TotalSegments > 0:
+		return float64(progress.Segments) / float64(progress.TotalSegments), true
+	case progress.Duration > 0:
+		fraction := float64(progress.Position) / float64(progress.Duration)
+		if fraction > 1 {
+			fraction = 1
+		}
+		return fraction, true
+	}
+	return 0, false
+}
@@ -0,0 +1,146 @@
+package anirip
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Routes every request the client makes through proxyURL, which may be an
+// http, https, socks5 or socks5h URL with optional user:pass credentials.
+// An empty proxyURL goes back to using the environments proxy settings
+func (client *Client) SetProxy(proxyURL string) error {
+	if proxyURL == "" {
+		client.Proxy = nil
+	} else {
+		parsed, err := ParseProxyURL(proxyURL)
+		if err != nil {
+			return err
+		}
+		client.Proxy = parsed
+	}
+
+	// Finds the real transport underneath any that wrap it, replays have no network to proxy
+	roundTripper := client.Transport
+	for {
+		wrapper, ok := roundTripper.(interface{ Unwrap() http.RoundTripper })
+		if !ok {
+			break
+		}
+		roundTripper = wrapper.Unwrap()
+	}
+	if _, ok := roundTripper.(*replayTransport); ok {
+		return nil
+	}
+	transport, ok := roundTripper.(*http.Transport)
+	if !ok {
+		return Error{Message: "The clients transport does not support proxies"}
+	}
+	if client.Proxy == nil {
+		transport.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+
+	// The standard library always resolves names on the proxy for socks5 so socks5h means the same
+	transportProxy := *client.Proxy
+	if transportProxy.Scheme == "socks5h" {
+		transportProxy.Scheme = "socks5"
+	}
+	transport.Proxy = http.ProxyURL(&transportProxy)
+	return nil
+}
+
+// Parses a proxy URL, filling in the default port for its scheme
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, Error{Message: "There was an error parsing the proxy " + proxyURL, Err: err}
+	}
+	defaultPort := map[string]string{"http": "8080", "https": "443", "socks5": "1080", "socks5h": "1080"}
+	port, ok := defaultPort[parsed.Scheme]
+	if !ok {
+		return nil, Error{Message: "The proxy scheme " + parsed.Scheme + " is not supported"}
+	}
+	if parsed.Port() == "" {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), port)
+	}
+	return parsed, nil
+}
+
+// Opens a raw connection to address through the clients proxy, if it has one,
+// so protocols other than HTTP such as RTMP can follow the same route
+func (client *Client) Dial(network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if client.Proxy == nil {
+		return dialer.Dial(network, address)
+	}
+	switch client.Proxy.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if client.Proxy.User != nil {
+			password, _ := client.Proxy.User.Password()
+			auth = &proxy.Auth{User: client.Proxy.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", client.Proxy.Host, auth, dialer)
+		if err != nil {
+			return nil, Error{Message: "There was an error creating the SOCKS5 dialer", Err: err}
+		}
+		conn, err := socks.Dial(network, address)
+		if err != nil {
+			return nil, Error{Message: "There was an error connecting to " + address + " through the SOCKS5 proxy", Err: err}
+		}
+		return conn, nil
+	}
+	return dialHTTPProxy(dialer, client.Proxy, address)
+}
+
+// Tunnels a connection to address through an HTTP proxy using CONNECT
+func dialHTTPProxy(dialer *net.Dialer, proxyURL *url.URL, address string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, Error{Message: "There was an error connecting to the proxy " + proxyURL.Host, Err: err}
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+
+	// Asks the proxy to open the tunnel, authenticating if we were given credentials
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, Error{Message: "There was an error sending the CONNECT request to the proxy", Err: err}
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		conn.Close()
+		return nil, Error{Message: "There was an error reading the proxies CONNECT response", Err: err}
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		conn.Close()
+		return nil, Error{Message: "The proxy refused to connect to " + address + ": " + response.Status}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,43 @@
+package anirip
+
+import (
+	"strings"
+)
+
+// A proxy that exits in a particular country, used to get around region locks
+type RegionProxy struct {
+	Country string
+	URL     string
+}
+
+// Parses proxies given as COUNTRY=URL, such as us=socks5://127.0.0.1:1080
+func ParseRegionProxies(values []string) ([]RegionProxy, error) {
+	proxies := []RegionProxy{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, Error{Message: "The region proxy " + value + " should look like COUNTRY=URL"}
+		}
+		if _, err := ParseProxyURL(parts[1]); err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, RegionProxy{Country: strings.ToUpper(parts[0]), URL: parts[1]})
+	}
+	return proxies, nil
+}
+
+// Orders proxies so the one for country comes first, leaving the rest as they were
+func OrderRegionProxies(proxies []RegionProxy, country string) []RegionProxy {
+	ordered := []RegionProxy{}
+	for _, proxy := range proxies {
+		if proxy.Country == country {
+			ordered = append(ordered, proxy)
+		}
+	}
+	for _, proxy := range proxies {
+		if proxy.Country != country {
+			ordered = append(ordered, proxy)
+		}
+	}
+	return ordered
+}
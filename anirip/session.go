@@ -0,0 +1,258 @@
+package anirip
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The version of the session file format written by SaveSession
+const SessionVersion = 2
+
+// The profile used when none is given, its session keeps the file name used before profiles existed
+const DefaultProfile = "default"
+
+// The names a profile may have, kept simple as they end up in file names
+var profilePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Gets the passphrase sessions are encrypted with, sessions are stored in the clear when nil
+var SessionPassphrase func() (string, error)
+
+// A providers logged in session as it's kept on disk
+type StoredSession struct {
+	Provider string         `json:"provider"`
+	Profile  string         `json:"profile,omitempty"`
+	User     string         `json:"user"`
+	Saved    time.Time      `json:"saved"`
+	Cookies  []StoredCookie `json:"cookies"`
+}
+
+// A cookie along with the absolute time it expires, cookies without one last until the session is replaced
+type StoredCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Domain   string     `json:"domain,omitempty"`
+	Path     string     `json:"path,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+	HttpOnly bool       `json:"http_only,omitempty"`
+}
+
+// What a stored session says about the account it's logged in to
+type SessionStatus struct {
+	LoggedIn bool
+	User     string    // The user the session was stored for
+	Account  string    // The account name the provider shows while logged in
+	Premium  string    // premium or free, empty when unknown which it is for every provider so far
+	Expires  time.Time // When the first of the sessions cookies expires, zero if none of them do
+}
+
+// The session file on disk, holding the session itself or its encrypted form
+type sessionFile struct {
+	Version   int            `json:"version"`
+	Encrypted bool           `json:"encrypted,omitempty"`
+	Salt      []byte         `json:"salt,omitempty"`
+	Nonce     []byte         `json:"nonce,omitempty"`
+	Data      []byte         `json:"data,omitempty"`
+	Session   *StoredSession `json:"session,omitempty"`
+}
+
+// Gets the directory sessions are stored in
+func SessionDir() string {
+	return filepath.Join(ConfigDir(), "sessions")
+}
+
+// Gets the file a providers session is stored in for profile
+func SessionFile(dir, provider, profile string) string {
+	if profile == "" || profile == DefaultProfile {
+		return filepath.Join(dir, provider+".session")
+	}
+	return filepath.Join(dir, provider+"."+profile+".session")
+}
+
+// Checks that a profile name is safe to use in file names
+func ValidateProfile(profile string) error {
+	if !profilePattern.MatchString(profile) {
+		return Error{Message: "The profile name " + profile + " may only contain letters, numbers, dashes and underscores"}
+	}
+	return nil
+}
+
+// Gets the profiles with a session stored for provider in dir, the default profile first
+func SessionProfiles(dir, provider string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, provider+".*session"))
+	profiles := []string{}
+	hasDefault := false
+	for _, match := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(match), provider), ".session")
+		if name == "" {
+			hasDefault = true
+		} else if profile := strings.TrimPrefix(name, "."); profile != name && ValidateProfile(profile) == nil {
+			profiles = append(profiles, profile)
+		}
+	}
+	sort.Strings(profiles)
+	if hasDefault {
+		profiles = append([]string{DefaultProfile}, profiles...)
+	}
+	return profiles
+}
+
+// Creates a stored session from the cookies in a jar
+func NewStoredSession(provider, profile, user string, cookies []*http.Cookie) StoredSession {
+	if profile == DefaultProfile {
+		profile = ""
+	}
+	session := StoredSession{Provider: provider, Profile: profile, User: user, Saved: time.Now(), Cookies: []StoredCookie{}}
+	for _, cookie := range cookies {
+		stored := StoredCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+		}
+		if !cookie.Expires.IsZero() {
+			expires := cookie.Expires
+			stored.Expires = &expires
+		}
+		session.Cookies = append(session.Cookies, stored)
+	}
+	return session
+}
+
+// Gets the sessions cookies, leaving out any that have expired since it was stored
+func (session StoredSession) HTTPCookies() []*http.Cookie {
+	cookies := []*http.Cookie{}
+	for _, stored := range session.Cookies {
+		cookie := &http.Cookie{
+			Name:     stored.Name,
+			Value:    stored.Value,
+			Domain:   stored.Domain,
+			Path:     stored.Path,
+			Secure:   stored.Secure,
+			HttpOnly: stored.HttpOnly,
+		}
+		if stored.Expires != nil {
+			cookie.Expires = *stored.Expires
+		}
+		if !isExpired(cookie) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// Loads the session stored for a providers profile in dir, returning nil if there isn't one
+func LoadSession(dir, provider, profile string) (*StoredSession, error) {
+	fileName := SessionFile(dir, provider, profile)
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, Error{Message: "There was an error reading the session file " + fileName, Err: err}
+	}
+	file := sessionFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, Error{Message: "The session file " + fileName + " is not in a format we understand", Err: err}
+	}
+	if file.Version > SessionVersion {
+		return nil, Error{Message: "The session file " + fileName + " was written by a newer version of anirip"}
+	}
+
+	// Decrypts the session if it was stored encrypted
+	if file.Encrypted {
+		if SessionPassphrase == nil {
+			return nil, Error{Message: "The session file " + fileName + " is encrypted, use --encrypt-sessions to read it"}
+		}
+		passphrase, err := SessionPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := passphraseCipher(passphrase, file.Salt)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+		if err != nil {
+			return nil, Error{Message: "The passphrase for the session file " + fileName + " is incorrect"}
+		}
+		file.Session = new(StoredSession)
+		if err := json.Unmarshal(plain, file.Session); err != nil {
+			return nil, Error{Message: "There was an error parsing the session file " + fileName, Err: err}
+		}
+	}
+	if file.Session == nil {
+		return nil, Error{Message: "The session file " + fileName + " does not contain a session"}
+	}
+
+	// Sessions before version 2 dropped the dot marking domain cookies, back when every cookie was one
+	if file.Version < 2 {
+		for i, cookie := range file.Session.Cookies {
+			if cookie.Domain != "" && !strings.HasPrefix(cookie.Domain, ".") {
+				file.Session.Cookies[i].Domain = "." + cookie.Domain
+			}
+		}
+	}
+	return file.Session, nil
+}
+
+// Saves session to dir, readable only by us and encrypted if a passphrase is set
+func SaveSession(dir string, session StoredSession) error {
+	file := sessionFile{Version: SessionVersion, Session: &session}
+	if SessionPassphrase != nil {
+		passphrase, err := SessionPassphrase()
+		if err != nil {
+			return err
+		}
+		plain, err := json.Marshal(session)
+		if err != nil {
+			return Error{Message: "There was an error encoding the session", Err: err}
+		}
+		file = sessionFile{Version: SessionVersion, Encrypted: true, Salt: make([]byte, 16)}
+		if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+			return Error{Message: "There was an error generating a salt for the session file", Err: err}
+		}
+		gcm, err := passphraseCipher(passphrase, file.Salt)
+		if err != nil {
+			return err
+		}
+		file.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+			return Error{Message: "There was an error generating a nonce for the session file", Err: err}
+		}
+		file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return Error{Message: "There was an error encoding the session", Err: err}
+	}
+
+	// Writes to a temp file first so a crash never leaves half a session behind
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Error{Message: "There was an error creating the session directory", Err: err}
+	}
+	fileName := SessionFile(dir, session.Provider, session.Profile)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0600); err != nil {
+		return Error{Message: "There was an error writing the session file", Err: err}
+	}
+	return Rename(fileName+".tmp", fileName, 10)
+}
+
+// Removes the session stored for a providers profile in dir
+func RemoveSession(dir, provider, profile string) error {
+	if err := os.Remove(SessionFile(dir, provider, profile)); err != nil && !os.IsNotExist(err) {
+		return Error{Message: "There was an error removing the " + provider + " " + profile + " session", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package anirip
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionEncryption(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := SessionPassphrase
+	t.Cleanup(func() { SessionPassphrase = passphrase })
+	given := "correct horse"
+	SessionPassphrase = func() (string, error) { return given, nil }
+
+	expires := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	cookies := []*http.Cookie{{Name: "session_id", Value: "secretsession", Domain: ".crunchyroll.com", Path: "/", Expires: expires}}
+	if err := SaveSession(dir, NewStoredSession("crunchyroll", "work", "someone", cookies)); err != nil {
+		t.Fatal(err)
+	}
+	fileName := SessionFile(dir, "crunchyroll", "work")
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"someone", "secretsession"} {
+		if strings.Contains(string(data), plain) {
+			t.Errorf("the encrypted session holds %q in the clear", plain)
+		}
+	}
+	if info, err := os.Stat(fileName); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("the session file can be read by others, its mode is %v", info.Mode())
+	}
+
+	stored, err := LoadSession(dir, "crunchyroll", "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.User != "someone" || len(stored.HTTPCookies()) != 1 || stored.HTTPCookies()[0].Value != "secretsession" {
+		t.Errorf("got %+v back", stored)
+	}
+	given = "wrong horse"
+	if _, err := LoadSession(dir, "crunchyroll", "work"); err == nil {
+		t.Error("loaded the session with the wrong passphrase")
+	}
+	SessionPassphrase = nil
+	if _, err := LoadSession(dir, "crunchyroll", "work"); err == nil {
+		t.Error("loaded an encrypted session without a passphrase")
+	}
+	if stored, err := LoadSession(dir, "crunchyroll", DefaultProfile); stored != nil || err != nil {
+		t.Errorf("got %+v and %v for a profile without a session", stored, err)
+	}
+}
+
+func TestSessionVersions(t *testing.T) {
+	dir := t.TempDir()
+	passphrase := SessionPassphrase
+	t.Cleanup(func() { SessionPassphrase = passphrase })
+	SessionPassphrase = nil
+
+	// Version 1 files stored domain cookies without their leading dot
+	version1 := `{"version":1,"session":{"provider":"daisuki","user":"someone","cookies":[
+		{"name":"domain","value":"1","domain":"daisuki.net"},
+		{"name":"dotted","value":"2","domain":".daisuki.net"},
+		{"name":"anywhere","value":"3"}]}}`
+	if err := ioutil.WriteFile(SessionFile(dir, "daisuki", DefaultProfile), []byte(version1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := LoadSession(dir, "daisuki", DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := []string{}
+	for _, cookie := range stored.Cookies {
+		domains = append(domains, cookie.Domain)
+	}
+	if strings.Join(domains, ",") != ".daisuki.net,.daisuki.net," {
+		t.Errorf("got domains %q from a version 1 session", domains)
+	}
+
+	newer := `{"version":99,"session":{"provider":"daisuki","user":"someone"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "daisuki.session"), []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSession(dir, "daisuki", DefaultProfile); err == nil {
+		t.Error("loaded a session written by a newer version")
+	}
+}
@@ -6,6 +6,14 @@ cd daisuki
 go get
 go install
 cd..
+cd hds
+go get
+go install
+cd..
+cd rtmp
+go get
+go install
+cd..
 cd crunchyroll
 go get
 go install
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/daisuki"
+)
+
+// The config file kept next to whatever anirip is run in, overriding the users config file
+const projectConfigFile = "anirip.toml"
+
+// Every setting that can be given a default in a config file. Each top level key matches
+// the global flag of the same name, which along with its environment variable overrides it
+type config struct {
+	Lang            string                    `toml:"lang"`
+	Quality         string                    `toml:"quality"`
+	Trim            string                    `toml:"trim"`
+	Concurrency     int                       `toml:"concurrency"`
+	LimitRate       string                    `toml:"limit-rate"`
+	Proxy           string                    `toml:"proxy"`
+	RegionProxies   []string                  `toml:"region-proxy"`
+	Record          string                    `toml:"record"`
+	Replay          string                    `toml:"replay"`
+	Netrc           string                    `toml:"netrc"`
+	CredentialFile  string                    `toml:"credential-file"`
+	EncryptSessions bool                      `toml:"encrypt-sessions"`
+	Profile         string                    `toml:"profile"`
+	Verbose         bool                      `toml:"verbose"`
+	Quiet           bool                      `toml:"quiet"`
+	LogFormat       string                    `toml:"log-format"`
+	LogDir          string                    `toml:"log-dir"`
+	Events          string                    `toml:"events"`
+	Force           bool                      `toml:"force"`
+	Login           loginConfig               `toml:"login"`
+	Export          exportConfig              `toml:"export"`
+	Watch           watchConfig               `toml:"watch"`
+	Serve           serveConfig               `toml:"serve"`
+	Queue           queueConfig               `toml:"queue"`
+	Providers       map[string]providerConfig `toml:"providers"`
+	Trims           map[string]int            `toml:"trims"` // Intro lengths in milliseconds --trim can pick from
+	Tools           map[string]string         `toml:"tools"` // Paths to ffmpeg, mkvmerge and mkclean
+	Hooks           hookConfig                `toml:"hooks"`
+}
+
+// Defaults for the login command
+type loginConfig struct {
+	User string `toml:"user"`
+	Save bool   `toml:"save"`
+}
+
+// Defaults for the session export command
+type exportConfig struct {
+	Output string `toml:"output"`
+}
+
+// Defaults for the watch command
+type watchConfig struct {
+	Interval string `toml:"interval"` // Such as 1h
+	Once     bool   `toml:"once"`
+}
+
+// Defaults for the serve command
+type serveConfig struct {
+	Listen   string `toml:"listen"`
+	Token    string `toml:"token"`
+	Interval string `toml:"interval"`
+}
+
+// Defaults for the queue add command
+type queueConfig struct {
+	Priority int    `toml:"priority"`
+	Dir      string `toml:"dir"`
+}
+
+// Settings for a single provider
+type providerConfig struct {
+	Proxy         string `toml:"proxy"`
+	BaseURL       string `toml:"base-url"`
+	SecureBaseURL string `toml:"secure-base-url"`
+}
+
+// Commands run by the shell once an episode has been ripped or has failed and once a show is
+// done, such as to copy episodes elsewhere or have a media library rescan
+type hookConfig struct {
+	OnEpisodeDone   string `toml:"on_episode_done"`
+	OnEpisodeFailed string `toml:"on_episode_failed"`
+	OnShowDone      string `toml:"on_show_done"`
+	Timeout         string `toml:"timeout"` // How long a hook can run before it's killed, such as 10m
+}
+
+// Gets the settings used when nothing else is given
+func defaultConfig() config {
+	return config{
+		Lang:           "english",
+		Quality:        "1080p",
+		Concurrency:    4,
+		RegionProxies:  []string{},
+		Netrc:          anirip.NetrcFile(),
+		CredentialFile: filepath.Join(anirip.ConfigDir(), "credentials.json"),
+		Profile:        anirip.DefaultProfile,
+		LogFormat:      "text",
+		LogDir:         filepath.Join(anirip.ConfigDir(), "logs"),
+		Export:         exportConfig{Output: "cookies.txt"},
+		Watch:          watchConfig{Interval: "1h"},
+		Serve:          serveConfig{Listen: "127.0.0.1:8680", Interval: "1h"},
+		Providers:      map[string]providerConfig{"crunchyroll": {}, "daisuki": {}},
+		Trims:          map[string]int{"daisuki": 5040, "aniplex": 6747, "sunrise": 8227},
+		Tools:          map[string]string{"ffmpeg": "", "mkvmerge": "", "mkclean": ""},
+		Hooks:          hookConfig{Timeout: "10m"},
+	}
+}
+
+// Gets the users config file
+func userConfigFile() string {
+	return filepath.Join(anirip.ConfigDir(), "config.toml")
+}
+
+// Loads the defaults, then the users config file, then the project config file, each
+// overriding the last. The files that were found are returned along with the config
+func loadConfig() (config, []string, error) {
+	settings := defaultConfig()
+	loaded := []string{}
+	for _, fileName := range []string{userConfigFile(), projectConfigFile} {
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			continue
+		}
+		metaData, err := toml.DecodeFile(fileName, &settings)
+		if err != nil {
+			return settings, loaded, anirip.Error{Message: "There was an error reading the config file " + fileName, Err: err}
+		}
+
+		// Catches misspelt settings, which would otherwise be quietly ignored
+		if undecoded := metaData.Undecoded(); len(undecoded) > 0 {
+			keys := []string{}
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			return settings, loaded, anirip.Error{Message: "The config file " + fileName + " has unknown settings " + strings.Join(keys, ", ")}
+		}
+		loaded = append(loaded, fileName)
+	}
+	if timeout, err := time.ParseDuration(settings.Hooks.Timeout); err != nil || timeout <= 0 {
+		return settings, loaded, anirip.Error{Message: "The hook timeout " + settings.Hooks.Timeout + " should be a duration such as 10m"}
+	}
+	for _, interval := range []string{settings.Watch.Interval, settings.Serve.Interval} {
+		if _, err := time.ParseDuration(interval); err != nil {
+			return settings, loaded, anirip.Error{Message: "The interval " + interval + " should be a duration such as 1h"}
+		}
+	}
+	for provider := range settings.Providers {
+		if parseProvider(provider) != provider {
+			return settings, loaded, anirip.Error{Message: "The config has settings for " + provider + " which isn't a supported provider"}
+		}
+	}
+	return settings, loaded, nil
+}
+
+// Points the providers and tools at the places the config gives
+func (settings config) apply() {
+	if provider := settings.Providers["crunchyroll"]; provider.BaseURL != "" {
+		crunchyroll.BaseURL, crunchyroll.SecureBaseURL = provider.BaseURL, provider.BaseURL
+	}
+	if provider := settings.Providers["crunchyroll"]; provider.SecureBaseURL != "" {
+		crunchyroll.SecureBaseURL = provider.SecureBaseURL
+	}
+	if provider := settings.Providers["daisuki"]; provider.BaseURL != "" {
+		daisuki.BaseURL, daisuki.SecureBaseURL = provider.BaseURL, provider.BaseURL
+	}
+	if provider := settings.Providers["daisuki"]; provider.SecureBaseURL != "" {
+		daisuki.SecureBaseURL = provider.SecureBaseURL
+	}
+	for tool, path := range settings.Tools {
+		anirip.BinaryPaths[tool] = path
+	}
+}
+
+// Gets the trim profiles named in trim, in the order their intros are cut
+func (settings config) trimIntros(trim string) []string {
+	intros := []string{}
+	for name := range settings.Trims {
+		if strings.Contains(strings.ToLower(trim), strings.ToLower(name)) {
+			intros = append(intros, name)
+		}
+	}
+	sort.Strings(intros)
+	return intros
+}
+
+// Gets a duration the config has already checked parses
+func configDuration(duration string) time.Duration {
+	parsed, _ := time.ParseDuration(duration)
+	return parsed
+}
+
+// Writes the config out as TOML, as used by config show, with the credentials in
+// proxies and the serve token masked so it can be shared
+func (settings config) write(writer io.Writer) error {
+	settings.Proxy = maskProxy(settings.Proxy)
+	regionProxies := []string{}
+	for _, regionProxy := range settings.RegionProxies {
+		if parts := strings.SplitN(regionProxy, "=", 2); len(parts) == 2 {
+			regionProxy = parts[0] + "=" + maskProxy(parts[1])
+		}
+		regionProxies = append(regionProxies, regionProxy)
+	}
+	settings.RegionProxies = regionProxies
+	providers := map[string]providerConfig{}
+	for name, provider := range settings.Providers {
+		provider.Proxy = maskProxy(provider.Proxy)
+		providers[name] = provider
+	}
+	settings.Providers = providers
+	if settings.Serve.Token != "" {
+		settings.Serve.Token = maskedCredential
+	}
+	if err := toml.NewEncoder(writer).Encode(settings); err != nil {
+		return anirip.Error{Message: "There was an error encoding the config", Err: err}
+	}
+	return nil
+}
+
+// Stands in for the credentials left out of config show
+const maskedCredential = "****"
+
+// Replaces the user and password in a proxy url, leaving the rest as given
+func maskProxy(proxy string) string {
+	start := 0
+	if scheme := strings.Index(proxy, "://"); scheme >= 0 {
+		start = scheme + len("://")
+	}
+	at := strings.LastIndex(proxy, "@")
+	if at < start {
+		return proxy
+	}
+	return proxy[:start] + maskedCredential + proxy[at:]
+}
+
+// Gets the environment variable that overrides a flag, such as ANIRIP_LIMIT_RATE for --limit-rate
+func flagEnvVar(flag string) string {
+	return "ANIRIP_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/daisuki"
+)
+
+// Environment variable holding the credential and session file passphrase, so it's never prompted for
+const passphraseEnv = "ANIRIP_PASSPHRASE"
+
+// Where credentials are looked up when they aren't given, opening the credential file at most once
+type credentialSources struct {
+	netrcFile string
+	storeFile string
+	mutex     sync.Mutex
+	store     *anirip.CredentialStore
+}
+
+// Finds credentials for a providers profile in the netrc file and then the credential file. The netrc
+// file only knows hosts, so other profiles only use it once we know which user they belong to
+func (sources *credentialSources) lookup(provider, profile, user string) (anirip.Credentials, error) {
+	if sources.netrcFile != "" && (isDefaultProfile(profile) || user != "") {
+		credentials, ok, err := anirip.NetrcCredentials(sources.netrcFile, providerHost(provider), user)
+		if err != nil {
+			return anirip.Credentials{}, err
+		}
+		if ok {
+			return credentials, nil
+		}
+	}
+	if !anirip.CredentialStoreExists(sources.storeFile) {
+		return anirip.Credentials{}, anirip.ErrNoCredentials
+	}
+	store, err := sources.openStore()
+	if err != nil {
+		return anirip.Credentials{}, err
+	}
+	credentials, ok := store.Get(credentialKey(provider, profile))
+	if !ok || (user != "" && credentials.User != user) {
+		return anirip.Credentials{}, anirip.ErrNoCredentials
+	}
+	return credentials, nil
+}
+
+// Saves credentials for a providers profile to the credential file, creating it if needed
+func (sources *credentialSources) save(provider, profile string, credentials anirip.Credentials) error {
+	store, err := sources.openStore()
+	if err != nil {
+		return err
+	}
+	return store.Set(credentialKey(provider, profile), credentials)
+}
+
+// Opens the credential file, getting its passphrase from the environment or the terminal
+func (sources *credentialSources) openStore() (*anirip.CredentialStore, error) {
+	sources.mutex.Lock()
+	defer sources.mutex.Unlock()
+	if sources.store != nil {
+		return sources.store, nil
+	}
+	passphrase, err := getPassphrase(!anirip.CredentialStoreExists(sources.storeFile))
+	if err != nil {
+		return nil, err
+	}
+	store, err := anirip.OpenCredentialStore(sources.storeFile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sources.store = store
+	return store, nil
+}
+
+// Remembers the passphrase once it's been entered so it's only asked for once a run
+var passphrase struct {
+	sync.Mutex
+	value string
+}
+
+// Gets the passphrase shared by the credential and session files from the environment or the
+// terminal. A new passphrase is typed twice so a typo doesn't lock anything away
+func getPassphrase(confirm bool) (string, error) {
+	passphrase.Lock()
+	defer passphrase.Unlock()
+	if passphrase.value != "" {
+		return passphrase.value, nil
+	}
+	if value := os.Getenv(passphraseEnv); value != "" {
+		passphrase.value = value
+		return value, nil
+	}
+	value, err := anirip.PromptPassword("Passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", anirip.Error{Message: "A passphrase is needed to encrypt credentials and sessions"}
+	}
+	if confirm {
+		confirmation, err := anirip.PromptPassword("Confirm passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if confirmation != value {
+			return "", anirip.Error{Message: "The passphrases entered did not match"}
+		}
+	}
+	passphrase.value = value
+	return value, nil
+}
+
+// Gets the name a profiles credentials are saved under, the default profile keeps the provider name
+func credentialKey(provider, profile string) string {
+	if isDefaultProfile(profile) {
+		return provider
+	}
+	return provider + "." + profile
+}
+
+// Checks whether profile is the default profile
+func isDefaultProfile(profile string) bool {
+	return profile == "" || profile == anirip.DefaultProfile
+}
+
+// Gets the host a provider is reached at, used to find its netrc entry
+func providerHost(provider string) string {
+	baseURL := crunchyroll.BaseURL
+	if provider == "daisuki" {
+		baseURL = daisuki.BaseURL
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
@@ -0,0 +1,140 @@
+package crunchyroll_test
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/providertest"
+)
+
+var record = flag.Bool("record", false, "records the fixtures in testdata against providertest instead of replaying them")
+
+// Replays the fixtures recorded for name through every client created, or records them
+// again against providertest when -record is passed
+func useFixtures(t *testing.T, name string) {
+	dir := filepath.Join("testdata", name)
+	wrapTransport := anirip.WrapTransport
+	t.Cleanup(func() { anirip.WrapTransport = wrapTransport })
+	if !*record {
+		store, err := anirip.NewFixtureStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anirip.WrapTransport = func(http.RoundTripper) http.RoundTripper { return store.Replayer() }
+		return
+	}
+
+	// Records the real sites urls with every request routed to providertest
+	server, err := providertest.NewCrunchyroll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	store, err := anirip.NewFixtureStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anirip.WrapTransport = func(http.RoundTripper) http.RoundTripper { return store.Recorder(server.Transport()) }
+}
+
+// Logs the test account in with a fresh session directory
+func login(t *testing.T) *crunchyroll.CrunchyrollSession {
+	session := &crunchyroll.CrunchyrollSession{}
+	if err := session.Login("testuser", "testpass", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestLogin(t *testing.T) {
+	useFixtures(t, "login")
+	sessionDir := t.TempDir()
+	session := &crunchyroll.CrunchyrollSession{}
+	if err := session.Login("testuser", "testpass", sessionDir); err != nil {
+		t.Fatal(err)
+	}
+	if session.User != "testuser" {
+		t.Errorf("logged in as %q", session.User)
+	}
+	stored, err := anirip.LoadSession(sessionDir, "crunchyroll", "")
+	if err != nil || stored == nil {
+		t.Fatalf("the session wasn't stored: %v", err)
+	}
+	status, err := session.Status(sessionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.LoggedIn || status.Account != "testuser" || status.Premium != "" {
+		t.Errorf("got status %+v", status)
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	useFixtures(t, "login-rejected")
+	session := &crunchyroll.CrunchyrollSession{}
+	if err := session.Login("testuser", "wrongpass", t.TempDir()); err == nil {
+		t.Error("logged in with the wrong password")
+	}
+}
+
+func TestScrapeEpisodes(t *testing.T) {
+	useFixtures(t, "scrape")
+	session := login(t)
+	show := &crunchyroll.CrunchyrollShow{}
+	if err := show.ScrapeEpisodes(crunchyroll.BaseURL+"/test-show", session.GetClient()); err != nil {
+		t.Fatal(err)
+	}
+	if show.Title != "Test Show" {
+		t.Errorf("got title %q", show.Title)
+	}
+	expected := [][]int{{600001, 600002}, {600003, 600004}}
+	if len(show.Seasons) != len(expected) {
+		t.Fatalf("got %d seasons, expected %d", len(show.Seasons), len(expected))
+	}
+	for s, season := range show.Seasons {
+		if season.Number != s+1 || len(season.Episodes) != len(expected[s]) {
+			t.Fatalf("season %d has number %d and %d episodes", s, season.Number, len(season.Episodes))
+		}
+		for e, episode := range season.Episodes {
+			if episode.ID != expected[s][e] || episode.Number != float64(e+1) {
+				t.Errorf("season %d episode %d is %d number %v", s+1, e+1, episode.ID, episode.Number)
+			}
+			if episode.URL != crunchyroll.BaseURL+episode.Path {
+				t.Errorf("episode %d has url %q", episode.ID, episode.URL)
+			}
+		}
+	}
+}
+
+func TestGetEpisodeInfo(t *testing.T) {
+	useFixtures(t, "episode")
+	session := login(t)
+	show := &crunchyroll.CrunchyrollShow{}
+	if err := show.ScrapeEpisodes(crunchyroll.BaseURL+"/test-show", session.GetClient()); err != nil {
+		t.Fatal(err)
+	}
+
+	episode := &show.Seasons[0].Episodes[0]
+	if err := episode.GetEpisodeInfo("1080p", session.GetClient()); err != nil {
+		t.Fatal(err)
+	}
+	if episode.Title != "The Beginning" || episode.Quality != "1080p" {
+		t.Errorf("got title %q and quality %q", episode.Title, episode.Quality)
+	}
+	if episode.MediaInfo.File != "mp4:600001.mp4" || episode.MediaInfo.URLOne == "" || episode.MediaInfo.URLTwo == "" {
+		t.Errorf("got media info %+v", episode.MediaInfo)
+	}
+
+	locked := &show.Seasons[1].Episodes[1]
+	if err := locked.GetEpisodeInfo("1080p", session.GetClient()); !anirip.IsRegionLocked(err) {
+		t.Errorf("expected the region locked episode to fail with ErrRegionLocked, got %v", err)
+	}
+}
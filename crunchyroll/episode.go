@@ -7,12 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/rtmp"
 )
 
 type EpisodeMetaData struct {
@@ -34,17 +35,21 @@ type EpisodeMetaData struct {
 }
 
 // Parses the xml and returns what we need from the xml
-func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, cookies []*http.Cookie) error {
+func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, client *anirip.Client) error {
+	return sessionError(client, episode.getEpisodeInfo(quality, client))
+}
+
+// Scrapes the episode page and player config for the episodes metadata and stream
+func (episode *CrunchyrollEpisode) getEpisodeInfo(quality string, client *anirip.Client) error {
 	episode.Quality = quality // Sets the quality to the passed quality string
 
 	// Gets the HTML of the episode page
 	episodeReqHeaders := http.Header{}
-	episodeReqHeaders.Add("referer", "http://www.crunchyroll.com/"+strings.Split(episode.Path, "/")[1])
-	episodeResponse, err := anirip.GetHTTPResponse("GET",
+	episodeReqHeaders.Add("referer", BaseURL+"/"+strings.Split(episode.Path, "/")[1])
+	episodeResponse, err := client.Do("GET",
 		episode.URL,
 		nil,
-		episodeReqHeaders,
-		cookies)
+		episodeReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -71,12 +76,12 @@ func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, cookies []*htt
 
 	// Querystring for getting the crunchyroll standard config
 	queryString := url.Values{
-		"req":           {"RpcApiVideoPlayer_GetStandardConfig"},
-		"media_id":      {strconv.Itoa(episode.ID)},
-		"video_format":  {getVideoFormat(episode.Quality)},
-		"video_quality": {getVideoQuality(episode.Quality)},
-		"auto_play":     {"1"},
-		"aff":           {"crunchyroll-website"},
+		"req":                     {"RpcApiVideoPlayer_GetStandardConfig"},
+		"media_id":                {strconv.Itoa(episode.ID)},
+		"video_format":            {getVideoFormat(episode.Quality)},
+		"video_quality":           {getVideoQuality(episode.Quality)},
+		"auto_play":               {"1"},
+		"aff":                     {"crunchyroll-website"},
 		"show_pop_out_controls":   {"1"},
 		"pop_out_disable_message": {""},
 		"click_through":           {"0"},
@@ -89,11 +94,10 @@ func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, cookies []*htt
 	standardConfigReqHeaders.Add("Content-type", "application/x-www-form-urlencoded")
 	standardConfigReqHeaders.Add("Referer", "http://static.ak.crunchyroll.com/versioned_assets/StandardVideoPlayer.f3770232.swf")
 	standardConfigReqHeaders.Add("X-Requested-With", "ShockwaveFlash/22.0.0.192")
-	standardConfigResponse, err := anirip.GetHTTPResponse("POST",
-		"http://www.crunchyroll.com/xml/?"+queryString.Encode(),
+	standardConfigResponse, err := client.Do("POST",
+		BaseURL+"/xml/?"+queryString.Encode(),
 		bytes.NewBufferString(formData.Encode()),
-		standardConfigReqHeaders,
-		cookies)
+		standardConfigReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -108,7 +112,7 @@ func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, cookies []*htt
 	// Checks for an unsupported region first
 	if strings.Contains(xmlString, "<code>") && strings.Contains(xmlString, "</code>") {
 		if strings.SplitN(strings.SplitN(xmlString, "<code>", 2)[1], "</code>", 2)[0] == "4" {
-			return anirip.Error{Message: "This video is not available in your region", Err: err}
+			return anirip.ErrRegionLocked
 		}
 	}
 
@@ -146,9 +150,14 @@ func (episode *CrunchyrollEpisode) GetEpisodeInfo(quality string, cookies []*htt
 }
 
 // Downloads entire FLV episodes to our temp directory
-func (episode *CrunchyrollEpisode) DownloadEpisode(quality, tempDir string, cookies []*http.Cookie) error {
+func (episode *CrunchyrollEpisode) DownloadEpisode(quality, tempDir string, client *anirip.Client) error {
+	return sessionError(client, episode.downloadEpisode(quality, tempDir, client))
+}
+
+// Dumps the episodes stream and renames it to the file the muxer expects
+func (episode *CrunchyrollEpisode) downloadEpisode(quality, tempDir string, client *anirip.Client) error {
 	// Attempts to dump the FLV of the episode to file / will retry up to 5 times
-	err := episode.dumpEpisodeFLV(tempDir)
+	err := episode.dumpEpisodeFLV(tempDir, client)
 	if err != nil {
 		return err
 	}
@@ -165,26 +174,57 @@ func (episode *CrunchyrollEpisode) GetFileName() string {
 	return episode.FileName
 }
 
-// Calls rtmpdump.exe to dump the episode and names it
-func (episode *CrunchyrollEpisode) dumpEpisodeFLV(tempDir string) error {
+// Gets the number of the episode within its season
+func (episode *CrunchyrollEpisode) GetNumber() float64 {
+	return episode.Number
+}
+
+// Gets the url of the episodes page
+func (episode *CrunchyrollEpisode) GetURL() string {
+	return episode.URL
+}
+
+// Gets the stream anirip should download itself, which is none as RTMP
+// streams are downloaded by DownloadEpisode
+func (episode *CrunchyrollEpisode) GetStreamInfo() anirip.StreamInfo {
+	return anirip.StreamInfo{}
+}
+
+// Gets the id the provider knows the episode by, empty when it isn't known
+func (episode *CrunchyrollEpisode) GetID() string {
+	if episode.ID == 0 {
+		return ""
+	}
+	return strconv.Itoa(episode.ID)
+}
+
+// Dumps the episode's RTMP stream straight to an FLV file in our temp directory
+func (episode *CrunchyrollEpisode) dumpEpisodeFLV(tempDir string, client *anirip.Client) error {
 	// Remove stale temp file to avoid conflcts with CLI
 	os.Remove(tempDir + string(os.PathSeparator) + "incomplete.episode.flv")
 
-	// Executes the command which we will use to dump the episode
-	cmd := exec.Command(anirip.FindAbsoluteBinary("rtmpdump"),
-		"-r", episode.MediaInfo.URLOne,
-		"-a", episode.MediaInfo.URLTwo,
-		"-f", "WIN 19,0,0,245",
-		"-W", "http://static.ak.crunchyroll.com/versioned_assets/ChromelessPlayerApp.6282d5bd.swf",
-		"-m", "10",
-		"-p", episode.URL,
-		"-y", episode.MediaInfo.File,
-		"-o", "incomplete.episode.flv")
-	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
-		return anirip.Error{Message: "There was an error while starting the rtmpdump command...", Err: err}
+	// Creates the file which the FLV stream will be written to
+	flvFile, err := os.Create(tempDir + string(os.PathSeparator) + "incomplete.episode.flv")
+	if err != nil {
+		return anirip.Error{Message: "There was an error creating the episode FLV file", Err: err}
 	}
+	defer flvFile.Close()
 
+	// Connects to the RTMP server, verifying our player SWF, and dumps the episode
+	if err := rtmp.Dump(rtmp.Options{
+		URL:       episode.MediaInfo.URLOne,
+		App:       episode.MediaInfo.URLTwo,
+		Playpath:  episode.MediaInfo.File,
+		FlashVer:  "WIN 19,0,0,245",
+		SwfURL:    PlayerURL,
+		SwfVerify: true,
+		PageURL:   episode.URL,
+		Timeout:   10 * time.Second,
+		Client:    client,
+		Dial:      client.Dial,
+	}, flvFile); err != nil {
+		return anirip.Error{Message: "There was an error while dumping the RTMP stream, Crunchyroll's servers require handshake type 10 which the built in RTMP client doesn't support", Err: err}
+	}
 	return nil
 }
 
@@ -2,7 +2,7 @@ package crunchyroll
 
 import (
 	"encoding/json"
-	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -55,14 +55,38 @@ type ShowMetaData struct {
 	Description    string `json:"description"`
 }
 
+// Gets the show an episode url belongs to, so a single episode can be ripped. Episode
+// paths are the shows path followed by the episode, ending in its six digit id
+func EpisodeShowURL(episodeURL string) (string, bool) {
+	parsed, err := url.Parse(episodeURL)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) != 2 || len(parts[1]) < 6 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(parts[1][len(parts[1])-6:]); err != nil {
+		return "", false
+	}
+	parsed.Path, parsed.RawQuery, parsed.Fragment = "/"+parts[0], "", ""
+	return parsed.String(), true
+}
+
 // Given a show pointer, appends all the seasons/episodes found for the show
-func (show *CrunchyrollShow) ScrapeEpisodes(showURL string, cookies []*http.Cookie) error {
+func (show *CrunchyrollShow) ScrapeEpisodes(showURL string, client *anirip.Client) error {
+	return sessionError(client, show.scrapeEpisodes(showURL, client))
+}
+
+// Scrapes the show page, starting the seasons over so a retried scrape doesn't repeat any
+func (show *CrunchyrollShow) scrapeEpisodes(showURL string, client *anirip.Client) error {
+	show.Seasons = nil
+
 	// Gets the HTML of the show page
-	showResponse, err := anirip.GetHTTPResponse("GET",
+	showResponse, err := client.Do("GET",
 		showURL,
 		nil,
-		nil,
-		cookies)
+		nil)
 	if err != nil {
 		return err
 	}
@@ -85,7 +109,7 @@ func (show *CrunchyrollShow) ScrapeEpisodes(showURL string, cookies []*http.Cook
 	// Sets Title, and Path and URL on our show object
 	show.Title = showMetaData.Name
 	show.URL = showMetaData.URL
-	show.Path = strings.Replace(show.URL, "http://www.crunchyroll.com", "", 1) // Removes the host so we have just the path
+	show.Path = strings.Replace(show.URL, BaseURL, "", 1) // Removes the host so we have just the path
 
 	// Searches first for the search div
 	showDoc.Find("ul.list-of-seasons.cf").Each(func(i int, seasonList *goquery.Selection) {
@@ -110,7 +134,7 @@ func (show *CrunchyrollShow) ScrapeEpisodes(showURL string, cookies []*http.Cook
 					Title:  episodeTitle,
 					Number: episodeNumber,
 					Path:   episodePath,
-					URL:    "http://www.crunchyroll.com" + episodePath,
+					URL:    BaseURL + episodePath,
 				})
 			})
 		})
@@ -101,13 +101,19 @@ type Event struct {
 
 // Entirely downloads subtitles to our temp directory
 // IGNORING offset for now (no reason to trim cr subs)
-func (episode *CrunchyrollEpisode) DownloadSubtitles(language string, offset int, tempDir string, cookies []*http.Cookie) (string, error) {
+func (episode *CrunchyrollEpisode) DownloadSubtitles(language string, offset int, tempDir string, client *anirip.Client) (string, error) {
+	subtitleLang, err := episode.downloadSubtitles(language, offset, tempDir, client)
+	return subtitleLang, sessionError(client, err)
+}
+
+// Fetches the episodes subtitles and dumps them as an ass file
+func (episode *CrunchyrollEpisode) downloadSubtitles(language string, offset int, tempDir string, client *anirip.Client) (string, error) {
 	// Remove stale temp file to avoid conflcts in func
 	os.Remove(tempDir + string(os.PathSeparator) + "subtitles.episode.ass")
 
 	// Populates the subtitle info for the episode
 	subtitles := new(Subtitle)
-	subtitleLang, err := episode.getSubtitleInfo(subtitles, language, cookies)
+	subtitleLang, err := episode.getSubtitleInfo(subtitles, language, client)
 	if err != nil {
 		return "", err
 	}
@@ -118,7 +124,7 @@ func (episode *CrunchyrollEpisode) DownloadSubtitles(language string, offset int
 	}
 
 	// Places the new subtitle object with JUST INFO into the episode and gets the sub data
-	if err = episode.getSubtitleData(subtitles, cookies); err != nil {
+	if err = episode.getSubtitleData(subtitles, client); err != nil {
 		return "", err
 	}
 
@@ -131,7 +137,7 @@ func (episode *CrunchyrollEpisode) DownloadSubtitles(language string, offset int
 	return subtitleLang, nil
 }
 
-func (episode *CrunchyrollEpisode) getSubtitleInfo(subtitles *Subtitle, language string, cookies []*http.Cookie) (string, error) {
+func (episode *CrunchyrollEpisode) getSubtitleInfo(subtitles *Subtitle, language string, client *anirip.Client) (string, error) {
 	// Formdata to indicate the source page
 	formData := url.Values{
 		"current_page": {episode.URL},
@@ -152,11 +158,10 @@ func (episode *CrunchyrollEpisode) getSubtitleInfo(subtitles *Subtitle, language
 	subtitleInfoReqHeaders.Add("Content-type", "application/x-www-form-urlencoded")
 	subtitleInfoReqHeaders.Add("Referer", "http://static.ak.crunchyroll.com/versioned_assets/StandardVideoPlayer.fb2c7182.swf")
 	subtitleInfoReqHeaders.Add("X-Requested-With", "ShockwaveFlash/19.0.0.245")
-	subtitleInfoResponse, err := anirip.GetHTTPResponse("POST",
-		"http://www.crunchyroll.com/xml/?"+queryString.Encode(),
+	subtitleInfoResponse, err := client.Do("POST",
+		BaseURL+"/xml/?"+queryString.Encode(),
 		bytes.NewBufferString(formData.Encode()),
-		subtitleInfoReqHeaders,
-		cookies)
+		subtitleInfoReqHeaders)
 	if err != nil {
 		return "", err
 	}
@@ -201,7 +206,7 @@ func (episode *CrunchyrollEpisode) getSubtitleInfo(subtitles *Subtitle, language
 }
 
 // Assigns the subtitle to the passed episode and attempts to get the xml subs for this episode
-func (episode *CrunchyrollEpisode) getSubtitleData(subtitles *Subtitle, cookies []*http.Cookie) error {
+func (episode *CrunchyrollEpisode) getSubtitleData(subtitles *Subtitle, client *anirip.Client) error {
 	// Formdata to indicate the source page
 	formData := url.Values{
 		"current_page": {episode.URL},
@@ -220,11 +225,10 @@ func (episode *CrunchyrollEpisode) getSubtitleData(subtitles *Subtitle, cookies
 	subtitleDataReqHeaders.Add("Content-type", "application/x-www-form-urlencoded")
 	subtitleDataReqHeaders.Add("Referer", "http://static.ak.crunchyroll.com/versioned_assets/StandardVideoPlayer.fb2c7182.swf")
 	subtitleDataReqHeaders.Add("X-Requested-With", "ShockwaveFlash/19.0.0.245")
-	subtitleDataResponse, err := anirip.GetHTTPResponse("POST",
-		"http://www.crunchyroll.com/xml/?"+queryString.Encode(),
+	subtitleDataResponse, err := client.Do("POST",
+		BaseURL+"/xml/?"+queryString.Encode(),
 		bytes.NewBufferString(formData.Encode()),
-		subtitleDataReqHeaders,
-		cookies)
+		subtitleDataReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -269,7 +273,7 @@ func (episode *CrunchyrollEpisode) dumpSubtitleASS(offset int, subtitles *Subtit
 // Decrypts the titles
 func decryptSubtitles(subtitle *Subtitle) (string, error) {
 	// Generates the key that will be used to decrypt our subtitles
-	key := generateKey(subtitle.ID)
+	key := GenerateSubtitleKey(subtitle.ID)
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", anirip.Error{Message: "There was an error while creating a key cipher block", Err: err}
@@ -365,7 +369,8 @@ func formatSubtitles(offset int, subString string) (string, error) {
 	return header + styles + events, nil
 }
 
-func generateKey(subtitleID int) []byte {
+// Generates the AES key a subtitle script is encrypted with from its id
+func GenerateSubtitleKey(subtitleID int) []byte {
 	// Does some dank maths to calculate the location of waldo
 	eq1 := int(math.Floor((math.Sqrt(6.9) * math.Pow(2, 25)))) ^ subtitleID
 	eq2 := int(math.Floor(math.Sqrt(6.9) * math.Pow(2, 25)))
@@ -398,7 +403,7 @@ func createString(args []int) string {
 	}
 	finalString := ""
 	for _, arg := range argArray[2:] {
-		finalString += string(arg%args[1] + 33)
+		finalString += string(rune(arg%args[1] + 33))
 	}
 	return finalString
 }
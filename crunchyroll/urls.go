@@ -0,0 +1,8 @@
+package crunchyroll
+
+// Where Crunchyroll is reached, replaceable so a local copy such as providertest can stand in
+var (
+	BaseURL       = "http://www.crunchyroll.com"
+	SecureBaseURL = "https://www.crunchyroll.com"
+	PlayerURL     = "http://static.ak.crunchyroll.com/versioned_assets/ChromelessPlayerApp.6282d5bd.swf"
+)
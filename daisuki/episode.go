@@ -15,13 +15,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/hds"
 )
 
 type ApiData struct {
@@ -74,17 +74,21 @@ type MetaData struct {
 }
 
 // Parses the xml and returns what we need from the xml
-func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Cookie) error {
+func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, client *anirip.Client) error {
+	return sessionError(client, episode.getEpisodeInfo(quality, client))
+}
+
+// Scrapes the episode page and player config for the episodes metadata and stream
+func (episode *DaisukiEpisode) getEpisodeInfo(quality string, client *anirip.Client) error {
 	episode.Quality = quality // Sets the quality to the passed quality string
 
 	// Gets the HTML of the episode page
 	episodeReqHeaders := http.Header{}
-	episodeReqHeaders.Add("referer", "http://www.daisuki.net/us/en/anime/detail."+strings.Split(episode.Path, ".")[1]+".html")
-	episodeResponse, err := anirip.GetHTTPResponse("GET",
+	episodeReqHeaders.Add("referer", BaseURL+"/us/en/anime/detail."+strings.Split(episode.Path, ".")[1]+".html")
+	episodeResponse, err := client.Do("GET",
 		episode.URL,
 		nil,
-		episodeReqHeaders,
-		cookies)
+		episodeReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -137,11 +141,10 @@ func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Co
 	countryReqHeaders := http.Header{}
 	countryReqHeaders.Add("referer", "https://www.crunchyroll.com/login")
 	countryReqHeaders.Add("content-type", "application/x-www-form-urlencoded")
-	countryResponse, err := anirip.GetHTTPResponse("GET",
-		"http://www.daisuki.net"+flashVars["country"]+"?cashPath="+nowMillis,
+	countryResponse, err := client.Do("GET",
+		BaseURL+flashVars["country"]+"?cashPath="+nowMillis,
 		nil,
-		countryReqHeaders,
-		cookies)
+		countryReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -155,7 +158,7 @@ func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Co
 
 	// Generates a new random 256bit key
 	key := make([]byte, 32)
-	if _, err = io.ReadFull(crand.Reader, key); err != nil {
+	if _, err = io.ReadFull(KeySource, key); err != nil {
 		return anirip.Error{Message: "There was an error generating 256 bit key", Err: err}
 	}
 
@@ -204,15 +207,11 @@ func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Co
 	mode := cipher.NewCBCEncrypter(cipherBlock, iv)
 	mode.CryptBlocks(cipherApiJSON, plainApiJSON)
 
-	// Key uused to re-encrypt our request data to daisuki
-	var pemPublicKey = "-----BEGIN PUBLIC KEY-----\n" +
-		"MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDFUkwl6OFLNms3VJQL7rb5bLfi\n" +
-		"/u8Lkyx2WaDFw78XPWAkZMLfc9aTtROuBv8b6PNnUpqzC/lpxWQFIhgfKgxR6lRq\n" +
-		"4SDT2NkIWV5O/3ZbOJzeCAoe9/G7+wdBHMVo23O39SHO3ycMv74N28KbGsnQ8tj0\n" +
-		"NZCYyv/ubQeRUCAHfQIDAQAB\n" +
-		"-----END PUBLIC KEY-----"
-
-	pemBlock, _ := pem.Decode([]byte(pemPublicKey))
+	// Encrypts the key we generated with daisukis public key
+	pemBlock, _ := pem.Decode([]byte(PublicKey))
+	if pemBlock == nil {
+		return anirip.Error{Message: "The daisuki public key is not valid PEM"}
+	}
 	pub, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
 	if err != nil {
 		return anirip.Error{Message: "There was an error x509 parsing our pem public key", Err: err}
@@ -236,11 +235,10 @@ func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Co
 	bgnInitReqHeaders := http.Header{}
 	bgnInitReqHeaders.Add("Content-Type", "application/x-www-form-urlencoded")
 	bgnInitReqHeaders.Add("X-Requested-With", "ShockwaveFlash/20.0.0.306")
-	bgnInitResponse, err := anirip.GetHTTPResponse("GET",
-		"http://www.daisuki.net"+flashVars["init"]+"?"+queryParams.Encode(),
+	bgnInitResponse, err := client.Do("GET",
+		BaseURL+flashVars["init"]+"?"+queryParams.Encode(),
 		nil,
-		bgnInitReqHeaders,
-		cookies)
+		bgnInitReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -306,9 +304,14 @@ func (episode *DaisukiEpisode) GetEpisodeInfo(quality string, cookies []*http.Co
 }
 
 // Downloads entire FLV episodes to our temp directory
-func (episode *DaisukiEpisode) DownloadEpisode(quality, tempDir string, cookies []*http.Cookie) error {
+func (episode *DaisukiEpisode) DownloadEpisode(quality, tempDir string, client *anirip.Client) error {
+	return sessionError(client, episode.downloadEpisode(quality, tempDir, client))
+}
+
+// Dumps the episodes stream and renames it to the file the muxer expects
+func (episode *DaisukiEpisode) downloadEpisode(quality, tempDir string, client *anirip.Client) error {
 	// Attempts to dump the FLV of the episode to file
-	err := episode.dumpEpisodeFLV(quality, tempDir)
+	err := episode.dumpEpisodeFLV(quality, tempDir, client)
 	if err != nil {
 		return err
 	}
@@ -325,22 +328,44 @@ func (episode *DaisukiEpisode) GetFileName() string {
 	return episode.FileName
 }
 
-// Calls on AdobeHDS.php to dump the episode and name it
-func (episode *DaisukiEpisode) dumpEpisodeFLV(quality, tempDir string) error {
+// Gets the number of the episode within its season
+func (episode *DaisukiEpisode) GetNumber() float64 {
+	return episode.Number
+}
+
+// Gets the url of the episodes page
+func (episode *DaisukiEpisode) GetURL() string {
+	return episode.URL
+}
+
+// Gets the stream anirip should download itself, which is none as HDS
+// streams are downloaded by DownloadEpisode
+func (episode *DaisukiEpisode) GetStreamInfo() anirip.StreamInfo {
+	return anirip.StreamInfo{}
+}
+
+// Gets the id the provider knows the episode by, empty when it isn't known
+func (episode *DaisukiEpisode) GetID() string {
+	if episode.ID == 0 {
+		return ""
+	}
+	return strconv.Itoa(episode.ID)
+}
+
+// Downloads the episode's HDS stream straight to an FLV file in our temp directory
+func (episode *DaisukiEpisode) dumpEpisodeFLV(quality, tempDir string, client *anirip.Client) error {
 	// Remove stale temp file to avoid conflcts with CLI
 	os.Remove(tempDir + string(os.PathSeparator) + "incomplete.episode.flv")
 	episode.Quality = quality // Sets the quality to the passed quality string
 
-	// Executes the dump command and gets the episode
-	cmd := exec.Command(anirip.FindAbsoluteBinary("php"), tempDir+string(os.PathSeparator)+"AdobeHDS.php",
-		"--manifest", episode.MediaInfo.ManifestURL+"&g="+generateGUID(12)+"&hdcore=3.2.0",
-		"--outfile", "incomplete.episode",
-		"--quality", "high",
-		"--referrer", episode.URL,
-		"--rename", "--delete")
-	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
-		return anirip.Error{Message: "There was an error while running the AdobeHDS script...", Err: err}
+	// Fetches every fragment of the requested quality and assembles them into our FLV
+	if err := hds.Download(hds.Options{
+		ManifestURL: episode.MediaInfo.ManifestURL + "&g=" + generateGUID(12) + "&hdcore=3.2.0",
+		Quality:     quality,
+		Referer:     episode.URL,
+		Client:      client,
+	}, tempDir+string(os.PathSeparator)+"incomplete.episode.flv"); err != nil {
+		return anirip.Error{Message: "There was an error while downloading the HDS stream", Err: err}
 	}
 	return nil
 }
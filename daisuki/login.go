@@ -2,98 +2,188 @@ package daisuki
 
 import (
 	"bytes"
-	"encoding/gob"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/sdwolfe32/anirip/anirip"
 )
 
 type DaisukiSession struct {
+	Profile string // The named account the session belongs to, the default profile when empty
 	User    string
 	Pass    string
 	Cookies []*http.Cookie
+	client  *anirip.Client
 }
 
-// Attempts to log the user in, store a cookie and return the login status
-func (session *DaisukiSession) Login(user, pass, tempDir string) error {
-	// First checks to see if we already have a cookie config
-	exists, err := getStoredCookies(session, tempDir)
+// Attempts to log the user in, store the session and return the login status
+func (session *DaisukiSession) Login(user, pass, sessionDir string) error {
+	// First checks to see if we already have a stored session
+	exists, err := getStoredSession(session, sessionDir)
 	if err != nil {
 		return err
 	}
 
-	// If we don't already have cookies, get new ones
-	if session.Cookies == nil || session.User == "" {
-		// Sets the credentials and attempts to generate new cookies
-		session.User = user
-		session.Pass = pass
-		if err := createNewCookies(session); err != nil {
+	// If we don't already have cookies for this user, get new ones
+	if session.Cookies == nil || session.User == "" || (user != "" && user != session.User) {
+		if err := authenticate(session, user, pass); err != nil {
 			return err
 		}
+		exists = false
 	}
 
 	// Test the cookies we currently have at this point
-	valid, err := validateCookies(session)
+	valid, err := validateCookies(session.GetClient())
+
+	// Logs in again if our stored cookies have expired, storing the new ones afterwards
+	if err == nil && !valid && exists {
+		if err := authenticate(session, user, pass); err != nil {
+			return err
+		}
+		exists = false
+		valid, err = validateCookies(session.GetClient())
+	}
 	if err != nil || !valid {
 		return anirip.Error{Message: "Our Daisuki cookies are invalid", Err: err}
 	}
 
-	// If the cookies we have are currently valid but dont exist, store them
+	// If the cookies we have are currently valid but weren't stored, store them
 	if valid && !exists {
-		// Prepares a buffer and marshals the session object
-		var sessionBytes bytes.Buffer
-		sessionEncoder := gob.NewEncoder(&sessionBytes)
-		session.Pass = "" // Clears the password before writing it to our cookie file
-		err = sessionEncoder.Encode(session)
-		if err != nil {
-			return anirip.Error{Message: "There was an error encoding your cookies", Err: err}
-		}
+		return storeSession(session, sessionDir)
+	}
+	return nil
+}
 
-		// Writes cookies to cookies file
-		err := ioutil.WriteFile(tempDir+string(os.PathSeparator)+"daisuki.cookie", sessionBytes.Bytes(), 0644)
-		if err != nil {
-			return anirip.Error{Message: "There was an error writing cookies to file", Err: err}
+// Returns a client carrying our session cookies, creating it the first time it's needed
+func (session *DaisukiSession) GetClient() *anirip.Client {
+	if session.client == nil {
+		session.client = anirip.NewClient(session.Cookies)
+	}
+	return session.client
+}
+
+// Logs in with cookies exported from a browser, for when logging in with a password is blocked,
+// storing them once they're shown to be logged in. user is who they belong to, if known
+func (session *DaisukiSession) ImportCookies(user string, cookies []*http.Cookie, sessionDir string) error {
+	session.User = user
+	session.Cookies = cookies
+	session.GetClient().Jar = anirip.NewCookieJar(cookies)
+	valid, err := validateCookies(session.GetClient())
+	if err != nil || !valid {
+		return anirip.Error{Message: "The imported Daisuki cookies are not logged in", Err: err}
+	}
+	return storeSession(session, sessionDir)
+}
+
+// Loads the stored session and checks whether it's still logged in, without ever logging in again
+func (session *DaisukiSession) Validate(sessionDir string) (bool, error) {
+	exists, err := getStoredSession(session, sessionDir)
+	if err != nil || !exists {
+		return false, err
+	}
+	return validateCookies(session.GetClient())
+}
+
+// Loads the stored session and asks Daisuki which account it's logged in to
+func (session *DaisukiSession) Status(sessionDir string) (anirip.SessionStatus, error) {
+	exists, err := getStoredSession(session, sessionDir)
+	if err != nil || !exists {
+		return anirip.SessionStatus{}, err
+	}
+	status := anirip.SessionStatus{User: session.User, Expires: anirip.EarliestExpiry(session.Cookies)}
+	// The membership is left unknown as the markup that would show it has never been checked against a real account
+	status.Account, err = getAccount(session.GetClient())
+	status.LoggedIn = status.Account != ""
+	return status, err
+}
+
+// Logs the stored session out on Daisuki where we can, then deletes it. The session
+// is deleted even if Daisuki couldn't be told, which is reported afterwards
+func (session *DaisukiSession) Logout(sessionDir string) error {
+	var logoutErr error
+	if exists, err := getStoredSession(session, sessionDir); err == nil && exists {
+		logoutReqHeaders := http.Header{}
+		logoutReqHeaders.Add("referer", BaseURL+"/us/en/top.html")
+		logoutResponse, err := session.GetClient().Do("GET", SecureBaseURL+"/bin/SignOutServlet.html", nil, logoutReqHeaders)
+		if err == nil && logoutResponse.StatusCode >= 400 {
+			err = anirip.Error{Message: "Daisuki logout failed with " + logoutResponse.Status}
 		}
-		return nil
+		logoutErr = err
+	}
+	if err := anirip.RemoveSession(sessionDir, "daisuki", session.Profile); err != nil {
+		return err
+	}
+	if logoutErr != nil {
+		return anirip.Error{Message: "The session was deleted but logging out of Daisuki failed", Err: logoutErr}
 	}
 	return nil
 }
 
-// Gets the daisuki cookies so they can be passed accessed outside this lib
-func (session *DaisukiSession) GetCookies() []*http.Cookie {
-	return session.Cookies
+// Logs in again with the credentials we can find for the sessions user, storing the
+// new session in sessionDir. Used when the session expires part way through a run
+func (session *DaisukiSession) Refresh(sessionDir string) error {
+	if err := authenticate(session, "", ""); err != nil {
+		return err
+	}
+	valid, err := validateCookies(session.GetClient())
+	if err != nil || !valid {
+		return anirip.Error{Message: "Logging in to Daisuki again failed", Err: err}
+	}
+	return storeSession(session, sessionDir)
 }
 
-// Gets stored cookies found in cookiesFile
-func getStoredCookies(session *DaisukiSession, tempDir string) (bool, error) {
-	// Checks if file exists - will return it's contents if so
-	if _, err := os.Stat(tempDir + string(os.PathSeparator) + "daisuki.cookie"); err == nil {
-		sessionBytes, err := ioutil.ReadFile(tempDir + string(os.PathSeparator) + "daisuki.cookie")
-		if err != nil {
-			// Attempts a deletion of an unreadable cookies file
-			_ = os.Remove(tempDir + string(os.PathSeparator) + "daisuki.cookie")
-			return false, anirip.Error{Message: "There was an error reading your cookies file", Err: err}
-		}
+// Checks whether a failed step was down to our session having expired, in which case
+// ErrLoggedOut is returned so the caller knows logging in again and retrying may help
+func sessionError(client *anirip.Client, err error) error {
+	if err == nil || anirip.IsLoggedOut(err) || anirip.IsRegionLocked(err) {
+		return err
+	}
+	if valid, validationErr := validateCookies(client); validationErr == nil && !valid {
+		return anirip.ErrLoggedOut
+	}
+	return err
+}
 
-		// Creates a decoder to decode the bytes found in our cookiesFile
-		sessionBuffer := bytes.NewBuffer(sessionBytes)
-		sessionDecoder := gob.NewDecoder(sessionBuffer)
+// Loads the session stored for our profile in sessionDir, if there is one, into our client
+func getStoredSession(session *DaisukiSession, sessionDir string) (bool, error) {
+	stored, err := anirip.LoadSession(sessionDir, "daisuki", session.Profile)
+	if err != nil || stored == nil {
+		return false, err
+	}
+	session.User = stored.User
+	session.Cookies = stored.HTTPCookies()
+	session.GetClient().Jar = anirip.NewCookieJar(session.Cookies)
+	return true, nil
+}
+
+// Stores the clients latest cookies in sessionDir, never keeping the password
+func storeSession(session *DaisukiSession, sessionDir string) error {
+	session.Cookies = session.GetClient().Jar.All()
+	return anirip.SaveSession(sessionDir, anirip.NewStoredSession("daisuki", session.Profile, session.User, session.Cookies))
+}
 
-		// Decodes the stored cookie and returns it
-		err = sessionDecoder.Decode(&session)
+// Logs in with the credentials passed, looking them up if they weren't given
+func authenticate(session *DaisukiSession, user, pass string) error {
+	if user == "" || pass == "" {
+		if anirip.LookupCredentials == nil {
+			return anirip.ErrNoCredentials
+		}
+		if user == "" {
+			user = session.User
+		}
+		credentials, err := anirip.LookupCredentials("daisuki", session.Profile, user)
 		if err != nil {
-			// Attempts a deletion of an unreadable cookies file
-			_ = os.Remove(tempDir + string(os.PathSeparator) + "daisuki.cookie")
-			return false, anirip.Error{Message: "There was an error decoding your cookies file", Err: err}
+			return err
 		}
-		// Cookies are able to be decoded so return true
-		return true, nil
+		user, pass = credentials.User, credentials.Pass
 	}
-	return false, nil
+
+	// Starts from an empty jar so cookies left over from the old login don't linger
+	session.User = user
+	session.Pass = pass
+	session.GetClient().Jar = anirip.NewCookieJar(nil)
+	return createNewCookies(session)
 }
 
 // Creates new cookies by re-authenticating with Daisuki
@@ -106,48 +196,53 @@ func createNewCookies(session *DaisukiSession) error {
 
 	// Performs the HTTP Request that will log the user in
 	loginReqHeaders := http.Header{}
-	loginReqHeaders.Add("referer", "http://www.daisuki.net/us/en/top.html")
+	loginReqHeaders.Add("referer", BaseURL+"/us/en/top.html")
 	loginReqHeaders.Add("content-type", "application/x-www-form-urlencoded")
-	loginResponse, err := anirip.GetHTTPResponse("POST",
-		"https://www.daisuki.net/bin/SignInServlet.html/input",
+	loginResponse, err := session.GetClient().Do("POST",
+		SecureBaseURL+"/bin/SignInServlet.html/input",
 		bytes.NewBufferString(formData.Encode()),
-		loginReqHeaders,
-		[]*http.Cookie{})
+		loginReqHeaders)
 	if err != nil {
 		return err
 	}
 
-	// Sets cookies to recieved cookies and returns
-	session.Cookies = loginResponse.Cookies()
+	// Keeps the cookies the login left in our clients jar unless the login was rejected outright
+	if loginResponse.StatusCode >= 400 {
+		return anirip.Error{Message: "Daisuki login failed with " + loginResponse.Status}
+	}
+	session.Cookies = session.GetClient().Jar.All()
 	return nil
 }
 
 // Validates the cookies to be sure that we are still logged in
-func validateCookies(session *DaisukiSession) (bool, error) {
+func validateCookies(client *anirip.Client) (bool, error) {
+	account, err := getAccount(client)
+	return account != "", err
+}
+
+// Gets the nickname shown on the account page, empty when we aren't logged in
+func getAccount(client *anirip.Client) (string, error) {
 	// We use the cookie we recieved to attempt a simple authenticated request
 	validationReqHeaders := http.Header{}
-	validationReqHeaders.Add("referer", "http://www.daisuki.net/us/en/mypage/info.html")
-	validationResponse, err := anirip.GetHTTPResponse("GET",
-		"https://www.daisuki.net/us/en/mypage/info.html",
+	validationReqHeaders.Add("referer", BaseURL+"/us/en/mypage/info.html")
+	validationResponse, err := client.Do("GET",
+		SecureBaseURL+"/us/en/mypage/info.html",
 		nil,
-		validationReqHeaders,
-		session.Cookies)
+		validationReqHeaders)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	// Creates a goquery document for scraping
 	validationRespDoc, err := goquery.NewDocumentFromResponse(validationResponse)
 	if err != nil {
-		return false, anirip.Error{Message: "There was an error while accessing the validation page", Err: err}
+		return "", anirip.Error{Message: "There was an error while accessing the validation page", Err: err}
 	}
 
 	// Scrapes the document and attempts to find the username
 	userName := validationRespDoc.Find("div#Nickname.clearFix.accountInformation div.list02").First().Text()
-
-	// Checks if the Username used to login is in the account info page...
-	if validationResponse.StatusCode == 200 && userName != "" {
-		return true, nil
+	if validationResponse.StatusCode != 200 || userName == "" {
+		return "", nil
 	}
-	return false, nil
+	return userName, nil
 }
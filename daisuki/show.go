@@ -1,7 +1,8 @@
 package daisuki
 
 import (
-	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
 
@@ -46,14 +47,39 @@ type HDSInfo struct {
 	ManifestURL string
 }
 
+// Gets the show an episode url belongs to, so a single episode can be ripped. Watch
+// pages are named watch.ADID.EPISODEID.html next to the shows detail.ADID.html
+func EpisodeShowURL(episodeURL string) (string, bool) {
+	parsed, err := url.Parse(episodeURL)
+	if err != nil {
+		return "", false
+	}
+	dir, file := path.Split(parsed.Path)
+	if !strings.HasPrefix(file, "watch.") || !strings.HasSuffix(file, ".html") {
+		return "", false
+	}
+	ids := strings.Split(strings.TrimSuffix(strings.TrimPrefix(file, "watch."), ".html"), ".")
+	if len(ids) != 2 || ids[0] == "" {
+		return "", false
+	}
+	parsed.Path, parsed.RawQuery, parsed.Fragment = dir+"detail."+ids[0]+".html", "", ""
+	return parsed.String(), true
+}
+
 // Given a show pointer, appends all the seasons/episodes found for the show
-func (show *DaisukiShow) ScrapeEpisodes(showURL string, cookies []*http.Cookie) error {
+func (show *DaisukiShow) ScrapeEpisodes(showURL string, client *anirip.Client) error {
+	return sessionError(client, show.scrapeEpisodes(showURL, client))
+}
+
+// Scrapes the show page, starting the seasons over so a retried scrape doesn't repeat any
+func (show *DaisukiShow) scrapeEpisodes(showURL string, client *anirip.Client) error {
+	show.Seasons = nil
+
 	// Gets the HTML of the show page
-	showResponse, err := anirip.GetHTTPResponse("GET",
+	showResponse, err := client.Do("GET",
 		showURL,
 		nil,
-		nil,
-		cookies)
+		nil)
 	if err != nil {
 		return err
 	}
@@ -72,11 +98,11 @@ func (show *DaisukiShow) ScrapeEpisodes(showURL string, cookies []*http.Cookie)
 		show.URL = showURL
 	}
 	if show.Path == "" {
-		show.Path = strings.Replace(show.URL, "http://www.daisuki.net", "", 1) // Removes the host so we have just the path
+		show.Path = strings.Replace(show.URL, BaseURL, "", 1) // Removes the host so we have just the path
 	}
 	if show.AdID == "" {
-		show.AdID = strings.Replace(show.URL, "http://www.daisuki.net/us/en/anime/detail.", "", 1) // Removes the leading path
-		show.AdID = strings.Replace(show.AdID, ".html", "", 1)                                     // Replaces the .html so we have just the AdID
+		show.AdID = strings.Replace(show.URL, BaseURL+"/us/en/anime/detail.", "", 1) // Removes the leading path
+		show.AdID = strings.Replace(show.AdID, ".html", "", 1)                       // Replaces the .html so we have just the AdID
 	}
 
 	// Searches first for the episodes/movies
@@ -109,10 +135,16 @@ func (show *DaisukiShow) ScrapeEpisodes(showURL string, cookies []*http.Cookie)
 		Length: len(episodeMap),
 	})
 	for i := 0; i < len(episodeMap); i++ {
+		// Takes the product id from the watch.ADID.EPID.html path
+		episodeID := 0
+		if ids := strings.Split(episodeMap[i+1], "."); len(ids) == 4 {
+			episodeID, _ = strconv.Atoi(ids[2])
+		}
 		show.Seasons[0].Episodes = append(show.Seasons[0].Episodes, DaisukiEpisode{
+			ID:     episodeID,
 			Number: float64(i + 1),
 			Path:   episodeMap[i+1],
-			URL:    "http://www.daisuki.net" + episodeMap[i+1],
+			URL:    BaseURL + episodeMap[i+1],
 		})
 	}
 
@@ -49,7 +49,13 @@ type Event struct {
 }
 
 // Entirely downloads subtitles to our temp directory
-func (episode *DaisukiEpisode) DownloadSubtitles(language string, offset int, tempDir string, cookies []*http.Cookie) (string, error) {
+func (episode *DaisukiEpisode) DownloadSubtitles(language string, offset int, tempDir string, client *anirip.Client) (string, error) {
+	subtitleLang, err := episode.downloadSubtitles(language, offset, tempDir, client)
+	return subtitleLang, sessionError(client, err)
+}
+
+// Fetches the episodes subtitles and dumps them as an ass file
+func (episode *DaisukiEpisode) downloadSubtitles(language string, offset int, tempDir string, client *anirip.Client) (string, error) {
 	// Remove stale temp file to avoid conflcts in func
 	os.Remove(tempDir + string(os.PathSeparator) + "subtitles.episode.ass")
 
@@ -61,7 +67,7 @@ func (episode *DaisukiEpisode) DownloadSubtitles(language string, offset int, te
 
 	// Reaches out to the xml page and gets all the available subtitles
 	subtitles := new(TT)
-	if err := episode.getSubtitles(subtitles, cookies); err != nil {
+	if err := episode.getSubtitles(subtitles, client); err != nil {
 		return "", err
 	}
 
@@ -75,18 +81,17 @@ func (episode *DaisukiEpisode) DownloadSubtitles(language string, offset int, te
 }
 
 // Gets the subtitles xml from daisuki, parses and popuulates XMTT param
-func (episode *DaisukiEpisode) getSubtitles(subtitles *TT, cookies []*http.Cookie) error {
+func (episode *DaisukiEpisode) getSubtitles(subtitles *TT, client *anirip.Client) error {
 	// Gets the current time and sets up a referrer for our subtitle request
 	nowMillis := strconv.FormatInt(time.Now().UnixNano()/1000000, 10)
 
 	// Performs the HTTP Request that will get the XML of the subtitles
 	subReqHeaders := http.Header{}
 	subReqHeaders.Add("referrer", episode.URL)
-	subtitleResp, err := anirip.GetHTTPResponse("GET",
+	subtitleResp, err := client.Do("GET",
 		episode.SubtitleInfo.TTMLUrl+"?cashPath="+nowMillis,
 		nil,
-		subReqHeaders,
-		cookies)
+		subReqHeaders)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,24 @@
+package daisuki
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// Where Daisuki is reached, replaceable so a local copy such as providertest can stand in
+var (
+	BaseURL       = "http://www.daisuki.net"
+	SecureBaseURL = "https://www.daisuki.net"
+)
+
+// Key used to re-encrypt our request data to daisuki, replaceable along with the base urls
+var PublicKey = "-----BEGIN PUBLIC KEY-----\n" +
+	"MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDFUkwl6OFLNms3VJQL7rb5bLfi\n" +
+	"/u8Lkyx2WaDFw78XPWAkZMLfc9aTtROuBv8b6PNnUpqzC/lpxWQFIhgfKgxR6lRq\n" +
+	"4SDT2NkIWV5O/3ZbOJzeCAoe9/G7+wdBHMVo23O39SHO3ycMv74N28KbGsnQ8tj0\n" +
+	"NZCYyv/ubQeRUCAHfQIDAQAB\n" +
+	"-----END PUBLIC KEY-----"
+
+// Where the key our init request is encrypted with is read from, replaceable so that
+// recorded fixtures, whose responses are encrypted with that key, can be replayed
+var KeySource io.Reader = rand.Reader
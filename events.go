@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// How often progress events are written for a stage that's still running
+const eventProgressInterval = time.Second
+
+// A single event written by --events json. Fields that don't apply to an event are left out,
+// and the names of events, stages, error kinds and fields won't change between versions
+type event struct {
+	Event     string    `json:"event"` // show_scraped, episode_started, stage, progress, warning, episode_done, episode_failed, summary or job
+	Time      time.Time `json:"time"`
+	Job       string    `json:"job,omitempty"` // The serve job the event belongs to
+	Provider  string    `json:"provider,omitempty"`
+	Show      string    `json:"show,omitempty"`
+	Season    *int      `json:"season,omitempty"`  // Zero is specials so this is only left out outside of an episode
+	Episode   *float64  `json:"episode,omitempty"` // The episode number within its season
+	FileName  string    `json:"file_name,omitempty"`
+	Output    string    `json:"output,omitempty"` // Where the episodes MKV ends up
+	Stage     string    `json:"stage,omitempty"`  // episode_info, download, trim, subtitles, merge or clean
+	Message   string    `json:"message,omitempty"`
+	Skipped   bool      `json:"skipped,omitempty"` // Set on episode_done when the episode had already been downloaded
+	ErrorKind string    `json:"error_kind,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Status    string    `json:"status,omitempty"` // Set on job events, the status the job moved to
+
+	// Set on progress events, along with stage
+	Percent    *float64 `json:"percent,omitempty"`
+	Bytes      int64    `json:"bytes,omitempty"`
+	Segments   int      `json:"segments,omitempty"`
+	Total      int      `json:"total_segments,omitempty"`
+	PositionMS int64    `json:"position_ms,omitempty"`
+	DurationMS int64    `json:"duration_ms,omitempty"`
+
+	// Set on show_scraped
+	Seasons  *int `json:"seasons,omitempty"`
+	Episodes *int `json:"episodes,omitempty"`
+
+	// Set on summary
+	Totals *eventTotals `json:"totals,omitempty"`
+}
+
+// How a run went, as given by the summary event
+type eventTotals struct {
+	Shows             int     `json:"shows"`
+	Episodes          int     `json:"episodes"`
+	Downloaded        int     `json:"downloaded"`
+	AlreadyDownloaded int     `json:"already_downloaded"`
+	Failed            int     `json:"failed"`
+	Seconds           float64 `json:"seconds"`
+}
+
+// Writes events as one JSON object per line for tools wrapping anirip, keeping track of the
+// show and episode being ripped so every event says what it's about
+type eventStream struct {
+	mutex        sync.Mutex
+	out          io.Writer   // Nothing is written when nil
+	listener     func(event) // Also given every event when set, such as by serve
+	started      time.Time
+	job          string
+	provider     string
+	show         string
+	season       *int
+	episode      *float64
+	fileName     string
+	output       string
+	stage        string
+	lastProgress time.Time
+	shows        int
+	downloaded   int
+	skipped      int
+	failed       int
+}
+
+// Starts writing events to out
+func (events *eventStream) enable(out io.Writer) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.out, events.started = out, time.Now()
+}
+
+// Passes every event to listener as well, which is called with the stream locked so mustn't write events itself
+func (events *eventStream) listen(listener func(event)) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.listener = listener
+	if events.started.IsZero() {
+		events.started = time.Now()
+	}
+}
+
+// Fills in what the stream is currently working on and writes the event
+func (events *eventStream) write(e event) {
+	if events.out == nil && events.listener == nil {
+		return
+	}
+	e.Time = time.Now()
+	if e.Event != "job" {
+		e.Job = events.job
+		e.Provider, e.Show, e.Season, e.Episode = events.provider, events.show, events.season, events.episode
+		if e.FileName == "" {
+			e.FileName = events.fileName
+		}
+		if e.Output == "" {
+			e.Output = events.output
+		}
+		if e.Stage == "" && e.Event != "stage" {
+			e.Stage = events.stage
+		}
+	}
+	if events.listener != nil {
+		events.listener(e)
+	}
+	if events.out == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	events.out.Write(append(line, '\n'))
+}
+
+// Moves on to a serve job, every event until the next one belongs to it. An empty id ends the job
+func (events *eventStream) jobStarted(id string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.job = id
+	events.provider, events.show, events.season, events.episode, events.fileName, events.output, events.stage = "", "", nil, nil, "", "", ""
+}
+
+// Writes that a serve job moved to another status, which is about that job rather than whatever is running
+func (events *eventStream) jobChanged(id, status, message string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.write(event{Event: "job", Job: id, Status: status, Message: message})
+}
+
+// Moves on to a show once its episodes have been scraped
+func (events *eventStream) showScraped(provider string, show anirip.Show) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.provider, events.show = provider, show.GetTitle()
+	events.season, events.episode, events.fileName, events.output, events.stage = nil, nil, "", "", ""
+	events.shows++
+	seasons, episodes := len(show.GetSeasons()), 0
+	for _, season := range show.GetSeasons() {
+		episodes += len(season.GetEpisodes())
+	}
+	events.write(event{Event: "show_scraped", Seasons: &seasons, Episodes: &episodes})
+}
+
+// Moves on to an episode of the current show
+func (events *eventStream) episodeStarted(season anirip.Season, episode anirip.Episode) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	seasonNumber, episodeNumber := season.GetNumber(), episode.GetNumber()
+	events.season, events.episode = &seasonNumber, &episodeNumber
+	events.fileName, events.output, events.stage = episode.GetFileName(), "", ""
+	events.write(event{Event: "episode_started"})
+}
+
+// Notes the episodes file name and where it'll be saved once its info is known
+func (events *eventStream) episodeFile(fileName, output string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.fileName, events.output = fileName, output
+}
+
+// Moves the current episode on to another stage
+func (events *eventStream) stageChanged(stage string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.stage, events.lastProgress = stage, time.Time{}
+	events.write(event{Event: "stage", Stage: stage})
+}
+
+// Passes on progress of the current stage, every eventProgressInterval and once it's done
+func (events *eventStream) progress(progress anirip.Progress) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if events.stage == "" || (!progress.Done && time.Since(events.lastProgress) < eventProgressInterval) {
+		return
+	}
+	events.lastProgress = time.Now()
+	e := event{
+		Event:      "progress",
+		Bytes:      progress.Bytes,
+		Segments:   progress.Segments,
+		Total:      progress.TotalSegments,
+		PositionMS: int64(progress.Position / time.Millisecond),
+		DurationMS: int64(progress.Duration / time.Millisecond),
+	}
+	if fraction, known := progress.Fraction(); known {
+		percent := math.Floor(fraction*1000) / 10
+		e.Percent = &percent
+	}
+	events.write(e)
+}
+
+// Passes on a warning that was logged
+func (events *eventStream) warning(message string) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.write(event{Event: "warning", Message: message})
+}
+
+// Finishes the current episode successfully, skipped if it had already been downloaded
+func (events *eventStream) episodeDone(skipped bool) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if skipped {
+		events.skipped++
+	} else {
+		events.downloaded++
+	}
+	events.stage = ""
+	events.write(event{Event: "episode_done", Skipped: skipped})
+}
+
+// Finishes the current episode with the error that stopped it, the stage it failed in is kept on the event
+func (events *eventStream) episodeFailed(err error) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.failed++
+	events.write(event{Event: "episode_failed", ErrorKind: errorKind(err), Error: err.Error()})
+	events.stage = ""
+}
+
+// Writes the totals for the run, along with the error that ended it early if there was one.
+// The totals start over afterwards, so watch gives a summary of each pass
+func (events *eventStream) summary(err error) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	events.provider, events.show, events.season, events.episode, events.fileName, events.output, events.stage = "", "", nil, nil, "", "", ""
+	e := event{Event: "summary", Totals: &eventTotals{
+		Shows:             events.shows,
+		Episodes:          events.downloaded + events.skipped + events.failed,
+		Downloaded:        events.downloaded,
+		AlreadyDownloaded: events.skipped,
+		Failed:            events.failed,
+		Seconds:           math.Round(time.Since(events.started).Seconds()*10) / 10,
+	}}
+	if err != nil {
+		e.ErrorKind, e.Error = errorKind(err), err.Error()
+	}
+	events.write(e)
+	events.started, events.shows, events.downloaded, events.skipped, events.failed = time.Now(), 0, 0, 0, 0
+}
+
+// Sorts an error into a kind wrappers can act on without matching its message
+func errorKind(err error) string {
+	switch {
+	case anirip.IsRegionLocked(err):
+		return "region_locked"
+	case anirip.IsLoggedOut(err):
+		return "logged_out"
+	case anirip.IsCommandError(err):
+		return "tool_failed"
+	case anirip.IsCanceled(err):
+		return "canceled"
+	}
+	return "error"
+}
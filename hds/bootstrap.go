@@ -0,0 +1,257 @@
+package hds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// The parts of an abst (bootstrap info) box we need to enumerate fragments
+type Bootstrap struct {
+	Live         bool
+	Timescale    uint32
+	SegmentRuns  []SegmentRun
+	FragmentRuns []FragmentRun
+}
+
+type SegmentRun struct {
+	FirstSegment        uint32
+	FragmentsPerSegment uint32
+}
+
+type FragmentRun struct {
+	FirstFragment          uint32
+	FirstFragmentTimestamp uint64
+	FragmentDuration       uint32
+	Discontinuity          byte
+}
+
+// A single fragment and the segment it belongs to
+type Fragment struct {
+	Segment  uint32
+	Fragment uint32
+}
+
+// Reads the header of the next box, returning its type and contents
+func readBox(reader *bytes.Reader) (string, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", nil, err
+	}
+	size := uint64(binary.BigEndian.Uint32(header[0:4]))
+	boxType := string(header[4:8])
+	headerSize := uint64(8)
+
+	// A size of 1 means the real size follows as a 64 bit integer, 0 means the box runs to the end
+	switch size {
+	case 1:
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return "", nil, err
+		}
+		headerSize = 16
+	case 0:
+		size = uint64(reader.Len()) + headerSize
+	}
+	if size < headerSize || size-headerSize > uint64(reader.Len()) {
+		return "", nil, anirip.Error{Message: "Found a malformed " + boxType + " box"}
+	}
+	content := make([]byte, size-headerSize)
+	_, err := io.ReadFull(reader, content)
+	return boxType, content, err
+}
+
+// Reads a null terminated string
+func readString(reader *bytes.Reader) (string, error) {
+	str := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil || b == 0 {
+			return string(str), err
+		}
+		str = append(str, b)
+	}
+}
+
+// Skips over a count prefixed list of null terminated strings
+func skipStrings(reader *bytes.Reader) error {
+	count, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	for i := byte(0); i < count; i++ {
+		if _, err := readString(reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses the abst box found in the bootstrap info
+func parseBootstrap(data []byte) (*Bootstrap, error) {
+	boxType, content, err := readBox(bytes.NewReader(data))
+	if err != nil || boxType != "abst" {
+		return nil, anirip.Error{Message: "The bootstrap info did not contain an abst box", Err: err}
+	}
+	reader := bytes.NewReader(content)
+	bootstrap := new(Bootstrap)
+
+	// Skips the version, flags and bootstrap version before reading the live flag and timescale
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, anirip.Error{Message: "The abst box was too short", Err: err}
+	}
+	bootstrap.Live = header[8]&0x20 != 0
+	binary.Read(reader, binary.BigEndian, &bootstrap.Timescale)
+
+	// Skips the current media time, smpte offset, movie identifier, servers, qualities, drm and metadata
+	reader.Seek(16, io.SeekCurrent)
+	readString(reader)
+	skipStrings(reader)
+	skipStrings(reader)
+	readString(reader)
+	if _, err := readString(reader); err != nil {
+		return nil, anirip.Error{Message: "The abst box was too short", Err: err}
+	}
+
+	// Reads every segment run table
+	segmentTables, err := reader.ReadByte()
+	if err != nil {
+		return nil, anirip.Error{Message: "The abst box was too short", Err: err}
+	}
+	for i := byte(0); i < segmentTables; i++ {
+		boxType, content, err := readBox(reader)
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error reading a segment run table", Err: err}
+		}
+		if boxType == "asrt" {
+			bootstrap.SegmentRuns = append(bootstrap.SegmentRuns, parseSegmentRuns(content)...)
+		}
+	}
+
+	// Reads every fragment run table
+	fragmentTables, err := reader.ReadByte()
+	if err != nil {
+		return nil, anirip.Error{Message: "The abst box was too short", Err: err}
+	}
+	for i := byte(0); i < fragmentTables; i++ {
+		boxType, content, err := readBox(reader)
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error reading a fragment run table", Err: err}
+		}
+		if boxType == "afrt" {
+			bootstrap.FragmentRuns = append(bootstrap.FragmentRuns, parseFragmentRuns(content)...)
+		}
+	}
+
+	if len(bootstrap.SegmentRuns) == 0 || len(bootstrap.FragmentRuns) == 0 {
+		return nil, anirip.Error{Message: "The bootstrap info did not contain any segments or fragments"}
+	}
+	return bootstrap, nil
+}
+
+// Parses the entries of an asrt box
+func parseSegmentRuns(content []byte) []SegmentRun {
+	reader := bytes.NewReader(content)
+	reader.Seek(4, io.SeekCurrent)
+	skipStrings(reader)
+	var count uint32
+	binary.Read(reader, binary.BigEndian, &count)
+	runs := []SegmentRun{}
+	for i := uint32(0); i < count; i++ {
+		run := SegmentRun{}
+		if err := binary.Read(reader, binary.BigEndian, &run); err != nil {
+			break
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Parses the entries of an afrt box
+func parseFragmentRuns(content []byte) []FragmentRun {
+	reader := bytes.NewReader(content)
+	reader.Seek(8, io.SeekCurrent)
+	skipStrings(reader)
+	var count uint32
+	binary.Read(reader, binary.BigEndian, &count)
+	runs := []FragmentRun{}
+	for i := uint32(0); i < count; i++ {
+		run := FragmentRun{}
+		if binary.Read(reader, binary.BigEndian, &run.FirstFragment) != nil ||
+			binary.Read(reader, binary.BigEndian, &run.FirstFragmentTimestamp) != nil ||
+			binary.Read(reader, binary.BigEndian, &run.FragmentDuration) != nil {
+			break
+		}
+		// A zero duration marks a discontinuity which carries an extra indicator byte
+		if run.FragmentDuration == 0 {
+			run.Discontinuity, _ = reader.ReadByte()
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Expands the compact segment and fragment run tables into the full list of fragments to fetch
+func (bootstrap *Bootstrap) fragments() []Fragment {
+	// Counts the fragments covered by the segment table, each run lasting until the next one starts
+	segments := bootstrap.SegmentRuns
+	fragmentCount := segments[0].FragmentsPerSegment
+	for i := 1; i < len(segments); i++ {
+		fragmentCount += (segments[i].FirstSegment - segments[i-1].FirstSegment - 1) * segments[i-1].FragmentsPerSegment
+		fragmentCount += segments[i].FragmentsPerSegment
+	}
+	firstFragment := bootstrap.FragmentRuns[0].FirstFragment
+	if firstFragment == 0 {
+		firstFragment = 1
+	}
+	fragmentCount += firstFragment - 1
+
+	// The fragment table may know about more fragments than the segment table does
+	for _, run := range bootstrap.FragmentRuns {
+		if run.FragmentDuration == 0 && run.Discontinuity == 0 {
+			// An end of presentation marker means nothing after it exists
+			if run.FirstFragment > 0 && run.FirstFragment-1 < fragmentCount {
+				fragmentCount = run.FirstFragment - 1
+			}
+			break
+		}
+		if run.FirstFragment > fragmentCount {
+			fragmentCount = run.FirstFragment
+		}
+	}
+
+	// Assigns every fragment the segment it lives in
+	fragments := []Fragment{}
+	for fragment := firstFragment; fragment <= fragmentCount; fragment++ {
+		fragments = append(fragments, Fragment{
+			Segment:  bootstrap.segmentFor(fragment, firstFragment),
+			Fragment: fragment,
+		})
+	}
+	return fragments
+}
+
+// Finds the segment number the passed fragment belongs to
+func (bootstrap *Bootstrap) segmentFor(fragment, firstFragment uint32) uint32 {
+	segments := bootstrap.SegmentRuns
+	if len(segments) == 1 {
+		return segments[0].FirstSegment
+	}
+	next := firstFragment
+	for i, run := range segments {
+		// Each run covers every segment up until the next run begins
+		lastSegment := run.FirstSegment
+		if i+1 < len(segments) {
+			lastSegment = segments[i+1].FirstSegment - 1
+		}
+		for segment := run.FirstSegment; segment <= lastSegment; segment++ {
+			next += run.FragmentsPerSegment
+			if fragment < next {
+				return segment
+			}
+		}
+	}
+	return segments[len(segments)-1].FirstSegment
+}
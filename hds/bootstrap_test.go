@@ -0,0 +1,158 @@
+package hds
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// A live bootstrap with a quality and server entry, three segments spread over two
+// segment runs, and a fragment table carrying a timestamp discontinuity followed by
+// an end of presentation marker
+const capturedBootstrap = "AAAAwmFic3QAAAAAAAAAAyAAAAPoAAAAAAAA2sAAAAAAAAAAAGVwaXNvZGUAAXNlcnZlcjEAAWhpZ2gAAAABAAAAJmFzcnQAAAAAAWhpZ2gAAAAAAgAAAAEAAAAFAAAAAwAAAAQBAAAAXGFmcnQAAAAAAAAD6AFoaWdoAAAAAAQAAAABAAAAAAAAAAAAAA+gAAAACAAAAAAAAG1gAAAAAAIAAAAIAAAAAAAAdTAAAA+gAAAADwAAAAAAAAAAAAAAAAA="
+
+func TestParseBootstrap(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(capturedBootstrap)
+	bootstrap, err := parseBootstrap(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Bootstrap{
+		Live:      true,
+		Timescale: 1000,
+		SegmentRuns: []SegmentRun{
+			{FirstSegment: 1, FragmentsPerSegment: 5},
+			{FirstSegment: 3, FragmentsPerSegment: 4},
+		},
+		FragmentRuns: []FragmentRun{
+			{FirstFragment: 1, FirstFragmentTimestamp: 0, FragmentDuration: 4000},
+			{FirstFragment: 8, FirstFragmentTimestamp: 28000, Discontinuity: 2},
+			{FirstFragment: 8, FirstFragmentTimestamp: 30000, FragmentDuration: 4000},
+			{FirstFragment: 15},
+		},
+	}
+	if !reflect.DeepEqual(bootstrap, want) {
+		t.Errorf("got %+v, want %+v", bootstrap, want)
+	}
+
+	// Segments one and two hold five fragments each and segment three the last four
+	fragments := bootstrap.fragments()
+	if len(fragments) != 14 {
+		t.Fatalf("got %d fragments, want 14", len(fragments))
+	}
+	for _, fragment := range fragments {
+		segment := uint32(3)
+		switch {
+		case fragment.Fragment <= 5:
+			segment = 1
+		case fragment.Fragment <= 10:
+			segment = 2
+		}
+		if fragment.Segment != segment {
+			t.Errorf("fragment %d is in segment %d, want %d", fragment.Fragment, fragment.Segment, segment)
+		}
+	}
+}
+
+func TestParseBootstrapErrors(t *testing.T) {
+	data, _ := base64.StdEncoding.DecodeString(capturedBootstrap)
+	tests := map[string][]byte{
+		"empty":     {},
+		"not abst":  append([]byte{0, 0, 0, 8}, "moov"...),
+		"truncated": data[:40],
+		"too large": append([]byte{0, 0, 1, 0}, data[4:]...),
+	}
+
+	// A bootstrap whose tables are left empty has nothing to download
+	empty := append([]byte{}, data[:8+9+4+16]...)
+	empty = append(empty, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(empty, uint32(len(empty)))
+	tests["no tables"] = empty
+
+	for name, data := range tests {
+		if _, err := parseBootstrap(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReadBox(t *testing.T) {
+	// A 64 bit size and a box running to the end of the data
+	large := append([]byte{0, 0, 0, 1}, "mdat"...)
+	large = binary.BigEndian.AppendUint64(large, 19)
+	large = append(large, 1, 2, 3)
+	open := append([]byte{0, 0, 0, 0}, "mdat"...)
+	open = append(open, 4, 5)
+	reader := bytes.NewReader(append(large, open...))
+	for _, want := range [][]byte{{1, 2, 3}, {4, 5}} {
+		boxType, content, err := readBox(reader)
+		if err != nil || boxType != "mdat" || !bytes.Equal(content, want) {
+			t.Errorf("got %q %v %v, want mdat %v", boxType, content, err, want)
+		}
+	}
+}
+
+func TestFragments(t *testing.T) {
+	tests := []struct {
+		name      string
+		bootstrap Bootstrap
+		want      []Fragment
+	}{
+		{
+			name: "single segment",
+			bootstrap: Bootstrap{
+				SegmentRuns:  []SegmentRun{{FirstSegment: 1, FragmentsPerSegment: 3}},
+				FragmentRuns: []FragmentRun{{FirstFragment: 1, FragmentDuration: 2000}},
+			},
+			want: []Fragment{{1, 1}, {1, 2}, {1, 3}},
+		},
+		{
+			name: "fragment numbering starts late",
+			bootstrap: Bootstrap{
+				SegmentRuns:  []SegmentRun{{FirstSegment: 1, FragmentsPerSegment: 2}, {FirstSegment: 2, FragmentsPerSegment: 1}},
+				FragmentRuns: []FragmentRun{{FirstFragment: 10, FragmentDuration: 2000}},
+			},
+			want: []Fragment{{1, 10}, {1, 11}, {2, 12}},
+		},
+		{
+			name: "end of presentation cuts the segment table short",
+			bootstrap: Bootstrap{
+				SegmentRuns: []SegmentRun{{FirstSegment: 1, FragmentsPerSegment: 5}},
+				FragmentRuns: []FragmentRun{
+					{FirstFragment: 1, FragmentDuration: 2000},
+					{FirstFragment: 4},
+				},
+			},
+			want: []Fragment{{1, 1}, {1, 2}, {1, 3}},
+		},
+		{
+			name: "discontinuities don't end the presentation",
+			bootstrap: Bootstrap{
+				SegmentRuns: []SegmentRun{{FirstSegment: 1, FragmentsPerSegment: 2}},
+				FragmentRuns: []FragmentRun{
+					{FirstFragment: 1, FragmentDuration: 2000},
+					{FirstFragment: 2, Discontinuity: 1},
+					{FirstFragment: 3, FragmentDuration: 2000},
+					{FirstFragment: 4, Discontinuity: 3},
+				},
+			},
+			want: []Fragment{{1, 1}, {1, 2}, {1, 3}, {1, 4}},
+		},
+		{
+			name: "live fragment table ahead of the segment table",
+			bootstrap: Bootstrap{
+				Live:         true,
+				SegmentRuns:  []SegmentRun{{FirstSegment: 1, FragmentsPerSegment: 2}},
+				FragmentRuns: []FragmentRun{{FirstFragment: 1, FragmentDuration: 2000}, {FirstFragment: 4, FragmentDuration: 2000}},
+			},
+			want: []Fragment{{1, 1}, {1, 2}, {1, 3}, {1, 4}},
+		},
+	}
+	for _, test := range tests {
+		if got := test.bootstrap.fragments(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package hds
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// Everything needed to download a single HDS stream
+type Options struct {
+	ManifestURL string         // URL of the f4m manifest, including any auth parameters
+	Quality     string         // Desired quality such as 1080p, falls back to the highest bitrate
+	Referer     string         // Page the player was embedded in
+	Client      *anirip.Client // Client to make requests with, a fresh one is used when nil
+}
+
+// Keeps track of what we've already written so overlapping fragments don't duplicate tags
+type fragmentWriter struct {
+	flv           *anirip.FLVWriter
+	lastTimestamp map[byte]uint32
+	wroteHeader   map[string]bool
+}
+
+// Downloads the HDS stream described by options and writes it out as a single FLV to fileName
+func Download(options Options, fileName string) error {
+	client := options.Client
+	if client == nil {
+		client = anirip.NewClient(nil)
+	}
+	header := http.Header{}
+	if options.Referer != "" {
+		header.Add("referer", options.Referer)
+	}
+
+	// Gets the manifest and follows it down to a media level manifest if it's a set level one
+	manifestURL, err := url.Parse(options.ManifestURL)
+	if err != nil {
+		return anirip.Error{Message: "There was an error parsing the manifest url", Err: err}
+	}
+	manifest, err := getManifest(client, manifestURL.String(), header)
+	if err != nil {
+		return err
+	}
+	media := manifest.selectMedia(options.Quality)
+	if media.Href != "" {
+		if manifestURL, err = manifestURL.Parse(media.Href); err != nil {
+			return anirip.Error{Message: "There was an error parsing the child manifest url", Err: err}
+		}
+		if manifest, err = getManifest(client, manifestURL.String(), header); err != nil {
+			return err
+		}
+		media = manifest.selectMedia(options.Quality)
+	}
+
+	// Fragments are relative to the manifests base url, or the manifest itself if it has none
+	baseURL := manifestURL
+	if manifestBaseURL := strings.TrimSpace(manifest.BaseURL); manifestBaseURL != "" {
+		if !strings.HasSuffix(manifestBaseURL, "/") {
+			manifestBaseURL = manifestBaseURL + "/"
+		}
+		if baseURL, err = manifestURL.Parse(manifestBaseURL); err != nil {
+			return anirip.Error{Message: "There was an error parsing the manifest base url", Err: err}
+		}
+	}
+
+	// Decodes the bootstrap info so we know what fragments make up the stream
+	bootstrapData, err := manifest.getBootstrap(client, media, baseURL, header)
+	if err != nil {
+		return err
+	}
+	bootstrap, err := parseBootstrap(bootstrapData)
+	if err != nil {
+		return err
+	}
+	if bootstrap.Live {
+		return anirip.Error{Message: "Live HDS streams are not supported"}
+	}
+
+	// Works out every fragments url, carrying over the manifests auth parameters
+	segments := []anirip.Segment{}
+	for _, fragment := range bootstrap.fragments() {
+		fragmentURL, err := baseURL.Parse(media.URL + "Seg" + strconv.FormatUint(uint64(fragment.Segment), 10) +
+			"-Frag" + strconv.FormatUint(uint64(fragment.Fragment), 10))
+		if err != nil {
+			return anirip.Error{Message: "There was an error building the fragment url", Err: err}
+		}
+		fragmentURL.RawQuery = manifestURL.RawQuery
+		segments = append(segments, anirip.Segment{URL: fragmentURL.String()})
+	}
+
+	// Downloads every fragment, keeping only the FLV tags each carries
+	tagsFile := fileName + ".tags"
+	downloader := &anirip.Downloader{
+		Client: client,
+		Header: header,
+		Transform: func(index int, data []byte) ([]byte, error) {
+			return extractTags(data)
+		},
+	}
+	if err := downloader.Download(segments, tagsFile); err != nil {
+		return err
+	}
+	defer os.Remove(tagsFile)
+
+	// Writes the metadata the manifest gave us before any of the media
+	os.Remove(fileName)
+	out, err := os.Create(fileName)
+	if err != nil {
+		return anirip.Error{Message: "There was an error creating " + fileName, Err: err}
+	}
+	defer out.Close()
+	writer := &fragmentWriter{
+		flv:           &anirip.FLVWriter{Out: out},
+		lastTimestamp: map[byte]uint32{},
+		wroteHeader:   map[string]bool{},
+	}
+	if metadata, err := base64.StdEncoding.DecodeString(strings.TrimSpace(media.Metadata)); err == nil && len(metadata) > 0 {
+		if err := writer.flv.WriteTag(anirip.FLVScript, 0, metadata); err != nil {
+			return err
+		}
+	}
+
+	// Writes out each fragments tags in order now that we have all of them
+	tags, err := os.Open(tagsFile)
+	if err != nil {
+		return anirip.Error{Message: "There was an error opening the downloaded fragments", Err: err}
+	}
+	defer tags.Close()
+	reader := bufio.NewReader(tags)
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return anirip.Error{Message: "There was an error reading the downloaded fragments", Err: err}
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return anirip.Error{Message: "There was an error reading the downloaded fragments", Err: err}
+		}
+		if err := writer.writeFragment(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Pulls the FLV tags out of the mdat boxes of a fragment, prefixing them with
+// their length so fragments can be told apart once they're joined together
+func extractTags(data []byte) ([]byte, error) {
+	tags := []byte{}
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		boxType, content, err := readBox(reader)
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error reading a fragment", Err: err}
+		}
+		if boxType == "mdat" {
+			tags = append(tags, content...)
+		}
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(tags)))
+	return append(length, tags...), nil
+}
+
+// Writes out the tags pulled from a single fragment
+func (writer *fragmentWriter) writeFragment(data []byte) error {
+	for _, tag := range anirip.ParseFLVTags(data) {
+		if err := writer.writeTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a tag unless we've already written it, only keeping the first
+// codec configuration seen as every fragment repeats them
+func (writer *fragmentWriter) writeTag(tag anirip.FLVTag) error {
+	// Encrypted tags have the filter bit set. AdobeHDS.php could decrypt Akamai's encryption but
+	// the native downloader can't, so these streams fail rather than being saved scrambled
+	if tag.Type&0x20 != 0 {
+		return anirip.Error{Message: "The HDS stream is Akamai encrypted, which anirip can no longer decrypt since AdobeHDS.php was replaced"}
+	}
+	switch tag.Type {
+	case anirip.FLVAudio, anirip.FLVVideo:
+		if len(tag.Payload) < 2 {
+			return nil
+		}
+		// AAC and AVC sequence headers are written the first time they're seen
+		if isSequenceHeader(tag) {
+			key := string(tag.Type) + string(tag.Payload)
+			if writer.wroteHeader[key] {
+				return nil
+			}
+			writer.wroteHeader[key] = true
+			return writer.flv.WriteTag(tag.Type, tag.Timestamp, tag.Payload)
+		}
+		// Skips anything that overlaps with what the previous fragment already gave us
+		if last, ok := writer.lastTimestamp[tag.Type]; ok && tag.Timestamp <= last {
+			return nil
+		}
+		writer.lastTimestamp[tag.Type] = tag.Timestamp
+		return writer.flv.WriteTag(tag.Type, tag.Timestamp, tag.Payload)
+	case anirip.FLVScript:
+		// Metadata was already written from the manifest
+		return nil
+	}
+	return nil
+}
+
+// Checks whether the tag is an AAC or AVC sequence header
+func isSequenceHeader(tag anirip.FLVTag) bool {
+	if tag.Type == anirip.FLVAudio {
+		return tag.Payload[0]>>4 == 10 && tag.Payload[1] == 0
+	}
+	return tag.Payload[0]&0x0f == 7 && tag.Payload[1] == 0
+}
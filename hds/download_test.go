@@ -0,0 +1,23 @@
+package hds
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+func TestWriteTagEncrypted(t *testing.T) {
+	out := new(bytes.Buffer)
+	writer := &fragmentWriter{flv: &anirip.FLVWriter{Out: out}, lastTimestamp: map[byte]uint32{}, wroteHeader: map[string]bool{}}
+	if err := writer.writeTag(anirip.FLVTag{Type: anirip.FLVVideo, Timestamp: 0, Payload: []byte{0x17, 0x01, 0, 0, 0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Akamai encrypted tags have the filter bit set on their type and are refused rather than saved scrambled
+	err := writer.writeTag(anirip.FLVTag{Type: anirip.FLVVideo | 0x20, Timestamp: 40, Payload: []byte{0x27, 0x01, 0, 0, 0}})
+	if err == nil || !strings.Contains(err.Error(), "Akamai encrypted") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package hds
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+type Manifest struct {
+	ID            string          `xml:"id"`
+	StreamType    string          `xml:"streamType"`
+	BaseURL       string          `xml:"baseURL"`
+	BootstrapInfo []BootstrapInfo `xml:"bootstrapInfo"`
+	Media         []Media         `xml:"media"`
+}
+
+type BootstrapInfo struct {
+	ID      string `xml:"id,attr"`
+	Profile string `xml:"profile,attr"`
+	URL     string `xml:"url,attr"`
+	Data    string `xml:",chardata"`
+}
+
+type Media struct {
+	URL             string `xml:"url,attr"`
+	Href            string `xml:"href,attr"`
+	Bitrate         int    `xml:"bitrate,attr"`
+	Width           int    `xml:"width,attr"`
+	Height          int    `xml:"height,attr"`
+	BootstrapInfoID string `xml:"bootstrapInfoId,attr"`
+	Metadata        string `xml:"metadata"`
+}
+
+// Gets and parses the f4m manifest found at manifestURL
+func getManifest(client *anirip.Client, manifestURL string, header http.Header) (*Manifest, error) {
+	manifestResponse, err := client.Do("GET",
+		manifestURL,
+		nil,
+		header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads and parses the manifest xml into our manifest object
+	manifestBody, err := ioutil.ReadAll(manifestResponse.Body)
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the f4m manifest", Err: err}
+	}
+	manifest := new(Manifest)
+	if err := xml.Unmarshal(manifestBody, manifest); err != nil {
+		return nil, anirip.Error{Message: "There was an error parsing the f4m manifest", Err: err}
+	}
+	if len(manifest.Media) == 0 {
+		return nil, anirip.Error{Message: "The f4m manifest did not contain any media"}
+	}
+	return manifest, nil
+}
+
+// Picks the media entry that matches the quality passed, preferring an exact
+// match on resolution and otherwise falling back to the highest bitrate
+func (manifest *Manifest) selectMedia(quality string) Media {
+	best := manifest.Media[0]
+	for _, media := range manifest.Media[1:] {
+		if media.Bitrate > best.Bitrate {
+			best = media
+		}
+	}
+	height, err := strconv.Atoi(regexp.MustCompile("[0-9]+").FindString(quality))
+	if err != nil {
+		return best
+	}
+	for _, media := range manifest.Media {
+		if media.Height == height {
+			return media
+		}
+	}
+	return best
+}
+
+// Finds the bootstrap info the passed media refers to, downloading it if it isn't inline
+func (manifest *Manifest) getBootstrap(client *anirip.Client, media Media, baseURL *url.URL, header http.Header) ([]byte, error) {
+	for _, info := range manifest.BootstrapInfo {
+		if media.BootstrapInfoID != "" && info.ID != media.BootstrapInfoID {
+			continue
+		}
+
+		// Inline bootstrap info is base64 encoded within the manifest
+		if info.URL == "" {
+			bootstrap, err := base64.StdEncoding.DecodeString(strings.TrimSpace(info.Data))
+			if err != nil {
+				return nil, anirip.Error{Message: "There was an error decoding the bootstrap info", Err: err}
+			}
+			return bootstrap, nil
+		}
+
+		// Otherwise we need to go and download it
+		bootstrapURL, err := baseURL.Parse(info.URL)
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error parsing the bootstrap info url", Err: err}
+		}
+		bootstrapResponse, err := client.Do("GET",
+			bootstrapURL.String(),
+			nil,
+			header)
+		if err != nil {
+			return nil, err
+		}
+		bootstrap, err := ioutil.ReadAll(bootstrapResponse.Body)
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error reading the bootstrap info", Err: err}
+		}
+		return bootstrap, nil
+	}
+	return nil, anirip.Error{Message: "No bootstrap info was found for the selected media"}
+}
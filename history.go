@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// An episode that has been ripped, wherever its file has ended up since
+type historyEntry struct {
+	Provider  string    `json:"provider"`
+	ID        string    `json:"id"` // The id the provider knows the episode by
+	Show      string    `json:"show"`
+	Season    int       `json:"season"`
+	Episode   float64   `json:"episode"`
+	FileName  string    `json:"file_name"`
+	Output    string    `json:"output"`              // Where the episode was saved when it was ripped
+	Quality   string    `json:"quality,omitempty"`   // Left out along with subtitles for files found already on disk
+	Subtitles string    `json:"subtitles,omitempty"` // The language of the subtitles merged in
+	Ripped    time.Time `json:"ripped"`
+}
+
+// Keeps every episode ripped in a JSON file in the users config directory, so an episode isn't
+// ripped again after its file is renamed, moved or re-encoded
+type downloadHistory struct {
+	fileName string
+}
+
+// What's kept in the history file, keyed by historyKey
+type historyState struct {
+	Episodes map[string]*historyEntry `json:"episodes"`
+}
+
+// Gets the file the download history is kept in
+func historyFile() string {
+	return filepath.Join(anirip.ConfigDir(), "history.json")
+}
+
+// Identifies an episode by its provider and the id the provider knows it by
+func historyKey(provider, id string) string {
+	return provider + ":" + id
+}
+
+// Reads the history file, starting empty if nothing has been ripped yet
+func (history *downloadHistory) load() (*historyState, error) {
+	state := &historyState{Episodes: map[string]*historyEntry{}}
+	data, err := ioutil.ReadFile(history.fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the download history", Err: err}
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, anirip.Error{Message: "There was an error parsing the download history", Err: err}
+	}
+	if state.Episodes == nil {
+		state.Episodes = map[string]*historyEntry{}
+	}
+	return state, nil
+}
+
+// Gets when and where an episode was ripped, nil if it never has been. The file is read fresh
+// each time so episodes ripped by other processes sharing the queue are seen
+func (history *downloadHistory) find(provider, id string) (*historyEntry, error) {
+	if id == "" {
+		return nil, nil
+	}
+	state, err := history.load()
+	if err != nil {
+		return nil, err
+	}
+	return state.Episodes[historyKey(provider, id)], nil
+}
+
+// Records a ripped episode, replacing what was there for it before
+func (history *downloadHistory) record(entry historyEntry) error {
+	if entry.ID == "" {
+		return nil
+	}
+	if output, err := filepath.Abs(entry.Output); err == nil {
+		entry.Output = output
+	}
+	unlock, err := lockFile(history.fileName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := history.load()
+	if err != nil {
+		return err
+	}
+	state.Episodes[historyKey(entry.Provider, entry.ID)] = &entry
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return anirip.Error{Message: "There was an error encoding the download history", Err: err}
+	}
+	return writeFileAtomic(history.fileName, data)
+}
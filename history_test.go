@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadHistory(t *testing.T) {
+	history := &downloadHistory{fileName: filepath.Join(t.TempDir(), "history.json")}
+	recorded := []historyEntry{
+		{Provider: "crunchyroll", ID: "1", FileName: "first", Output: "/anime/first.mkv"},
+		{Provider: "daisuki", ID: "1", FileName: "other provider", Output: "/anime/daisuki.mkv"},
+		{Provider: "crunchyroll", ID: "10", FileName: "longer id", Output: "/anime/tenth.mkv"},
+		{Provider: "crunchyroll", ID: "1", FileName: "ripped again", Output: "/anime/again.mkv"},
+		{Provider: "crunchyroll", ID: "", FileName: "no id", Output: "/anime/none.mkv"},
+		{Provider: "daisuki", ID: "2", FileName: "relative", Output: "relative.mkv"},
+	}
+	for _, entry := range recorded {
+		if err := history.record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		provider string
+		id       string
+		fileName string // Empty when the episode shouldn't be found
+		output   string // Made absolute when it was recorded
+	}{
+		{provider: "crunchyroll", id: "1", fileName: "ripped again", output: "/anime/again.mkv"},
+		{provider: "daisuki", id: "1", fileName: "other provider", output: "/anime/daisuki.mkv"},
+		{provider: "crunchyroll", id: "10", fileName: "longer id", output: "/anime/tenth.mkv"},
+		{provider: "daisuki", id: "2", fileName: "relative", output: "relative.mkv"},
+		{provider: "daisuki", id: "10"},
+		{provider: "crunchyroll", id: "2"},
+		{provider: "crunchyroll", id: "100"},
+		{provider: "crunchyroll", id: ""},
+		{provider: "crunchyroll:1", id: ""},
+	}
+	for _, test := range tests {
+		found, err := history.find(test.provider, test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, _ := filepath.Abs(test.output)
+		switch {
+		case test.fileName == "" && found != nil:
+			t.Errorf("found %+v for %s %q", found, test.provider, test.id)
+		case test.fileName == "":
+		case found == nil:
+			t.Errorf("didn't find %s %q", test.provider, test.id)
+		case found.FileName != test.fileName || found.Output != output:
+			t.Errorf("found %s saved to %s for %s %q, expected %s saved to %s", found.FileName, found.Output, test.provider, test.id, test.fileName, output)
+		}
+	}
+
+	state, err := history.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Episodes) != 4 {
+		t.Errorf("the history has %d episodes, expected 4", len(state.Episodes))
+	}
+}
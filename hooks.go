@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// What a hook is given as JSON on its stdin
+type hookPayload struct {
+	Hook      string       `json:"hook"` // on_episode_done, on_episode_failed or on_show_done
+	Provider  string       `json:"provider"`
+	Show      string       `json:"show"`
+	Season    *int         `json:"season,omitempty"`
+	Episode   *float64     `json:"episode,omitempty"`
+	FileName  string       `json:"file_name,omitempty"`
+	Path      string       `json:"path,omitempty"` // The episodes MKV, or the shows directory for on_show_done. Left out when an episode fails before its info is known
+	Quality   string       `json:"quality,omitempty"`
+	Subtitles string       `json:"subtitles,omitempty"`
+	ErrorKind string       `json:"error_kind,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	Totals    *eventTotals `json:"totals,omitempty"` // Set on on_show_done
+}
+
+// Gets the command set for a hook, empty if there isn't one
+func (hooks hookConfig) command(hook string) string {
+	switch hook {
+	case "on_episode_done":
+		return hooks.OnEpisodeDone
+	case "on_episode_failed":
+		return hooks.OnEpisodeFailed
+	case "on_show_done":
+		return hooks.OnShowDone
+	}
+	return ""
+}
+
+// Runs a hook if one is set, passing payload as JSON on stdin along with its main fields as
+// ANIRIP_ environment variables. A hook failing is only reported, the rip it's about stands either way
+func (hooks hookConfig) run(hook string, payload hookPayload, log *anirip.Logger) {
+	command := hooks.command(hook)
+	if strings.TrimSpace(command) == "" {
+		return
+	}
+	payload.Hook = hook
+	if path, err := filepath.Abs(payload.Path); err == nil && payload.Path != "" {
+		payload.Path = path
+	}
+	if err := hooks.exec(command, payload); err != nil {
+		log.Warn(err.Error())
+		if output := anirip.CommandOutput(err); output != "" {
+			log.Debug(output)
+		}
+		return
+	}
+	log.Debug("The " + hook + " hook finished")
+}
+
+// Runs command through the shell with the payload, killing it and anything it started once it runs past the timeout
+func (hooks hookConfig) exec(command string, payload hookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return anirip.Error{Message: "There was an error encoding the " + payload.Hook + " hook payload", Err: err}
+	}
+	timeout, err := time.ParseDuration(hooks.Timeout)
+	if err != nil {
+		return anirip.Error{Message: "The hook timeout " + hooks.Timeout + " isn't a valid duration", Err: err}
+	}
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(),
+		"ANIRIP_HOOK="+payload.Hook,
+		"ANIRIP_PROVIDER="+payload.Provider,
+		"ANIRIP_SHOW="+payload.Show,
+		"ANIRIP_PATH="+payload.Path,
+	)
+	if payload.Season != nil {
+		cmd.Env = append(cmd.Env, "ANIRIP_SEASON="+strconv.Itoa(*payload.Season))
+	}
+	if payload.Episode != nil {
+		cmd.Env = append(cmd.Env, "ANIRIP_EPISODE="+strconv.FormatFloat(*payload.Episode, 'f', -1, 64))
+	}
+	if payload.Error != "" {
+		cmd.Env = append(cmd.Env, "ANIRIP_ERROR="+payload.Error)
+	}
+
+	// Whatever the hook writes is kept for the log rather than mixed into ours, as stdout can be the event stream
+	cmd.Stdin = bytes.NewReader(data)
+	name := "The " + payload.Hook + " hook"
+	started := time.Now()
+	return anirip.RunCommandUntil(cmd, name, func() error {
+		if time.Since(started) > timeout {
+			return anirip.Error{Message: name + " was killed after running for " + hooks.Timeout}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/daisuki"
+	"github.com/sdwolfe32/anirip/providertest"
+)
+
+func TestShowDoneHook(t *testing.T) {
+	tests := []struct {
+		name     string
+		canceled bool // Whether the rip is canceled once the first episode is saved
+	}{
+		{name: "done"},
+		{name: "canceled", canceled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			work := testEnvironment(t)
+			server, err := providertest.NewDaisuki()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			defer server.Use()()
+			if err := new(daisuki.DaisukiSession).Login("test@example.com", "testpass", sessionDir); err != nil {
+				t.Fatal(err)
+			}
+
+			payloadFile := filepath.Join(t.TempDir(), "payload.json")
+			config, err := os.OpenFile(filepath.Join(work, "anirip.toml"), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.WriteString("\n[hooks]\non_show_done = \"cat > '" + payloadFile + "'\"\n")
+			config.Close()
+			if test.canceled {
+				defer func() { anirip.Canceled = nil }()
+				anirip.Canceled = func() bool {
+					saved, _ := filepath.Glob(filepath.Join(work, "*", "*", "*.mkv"))
+					return len(saved) > 0
+				}
+			}
+
+			runWithEvents(t, server.ShowURL("TESTSHOW"))
+			data, err := ioutil.ReadFile(payloadFile)
+			if test.canceled {
+				if err == nil {
+					t.Errorf("the hook was run for a canceled show with %s", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("the hook wasn't run: %v", err)
+			}
+			payload := hookPayload{}
+			if err := json.Unmarshal(data, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Hook != "on_show_done" || payload.Totals == nil || payload.Totals.Downloaded != 4 {
+				t.Errorf("got payload %s", data)
+			}
+		})
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	testEnvironment(t)
+	hooks := hookConfig{OnShowDone: "sleep 30", Timeout: "300ms"}
+	err := hooks.exec(hooks.OnShowDone, hookPayload{Hook: "on_show_done"})
+	if err == nil || !strings.Contains(err.Error(), "The on_show_done hook was killed after running for 300ms") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package rtmptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// A message read from or written to the client
+type message struct {
+	kind      byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// What's known about a chunk stream from its last header, along with the message being put together on it
+type chunkStream struct {
+	length    int
+	kind      byte
+	streamID  uint32
+	timestamp uint32
+	partial   []byte
+}
+
+// The chunk streams of a client that has finished the handshake
+type conn struct {
+	reader       io.Reader
+	writer       io.Writer
+	inChunkSize  int
+	outChunkSize int
+	chunks       map[byte]*chunkStream
+}
+
+// Reads chunks until a message is complete. The client only uses chunk streams below 64 and
+// never needs an extended timestamp, so neither is supported
+func (c *conn) read() (*message, error) {
+	for {
+		basic := make([]byte, 1)
+		if _, err := io.ReadFull(c.reader, basic); err != nil {
+			return nil, err
+		}
+		format, id := basic[0]>>6, basic[0]&0x3f
+		if id < 2 {
+			return nil, anirip.Error{Message: "The client used a chunk stream id over 63"}
+		}
+		stream := c.chunks[id]
+		if stream == nil {
+			stream = &chunkStream{}
+			c.chunks[id] = stream
+		}
+		header := make([]byte, []int{11, 7, 3, 0}[format])
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if format <= 2 {
+			timestamp := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			if format == 0 {
+				stream.timestamp = timestamp
+			} else {
+				stream.timestamp += timestamp
+			}
+		}
+		if format <= 1 {
+			stream.length = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+			stream.kind = header[6]
+		}
+		if format == 0 {
+			stream.streamID = binary.LittleEndian.Uint32(header[7:])
+		}
+		size := stream.length - len(stream.partial)
+		if size > c.inChunkSize {
+			size = c.inChunkSize
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		stream.partial = append(stream.partial, data...)
+		if len(stream.partial) == stream.length {
+			read := &message{kind: stream.kind, streamID: stream.streamID, timestamp: stream.timestamp, payload: stream.partial}
+			stream.partial = nil
+			return read, nil
+		}
+	}
+}
+
+// Writes a message as a full header followed by continuation chunks. Timestamps must fit in three bytes
+func (c *conn) write(id byte, m *message) error {
+	out := new(bytes.Buffer)
+	out.WriteByte(id)
+	out.Write([]byte{byte(m.timestamp >> 16), byte(m.timestamp >> 8), byte(m.timestamp)})
+	out.Write([]byte{byte(len(m.payload) >> 16), byte(len(m.payload) >> 8), byte(len(m.payload)), m.kind})
+	binary.Write(out, binary.LittleEndian, m.streamID)
+	for start := 0; start < len(m.payload); start += c.outChunkSize {
+		if start > 0 {
+			out.WriteByte(0xc0 | id)
+		}
+		end := start + c.outChunkSize
+		if end > len(m.payload) {
+			end = len(m.payload)
+		}
+		out.Write(m.payload[start:end])
+	}
+	_, err := c.writer.Write(out.Bytes())
+	return err
+}
+
+// An AMF0 object, in the order its properties are written
+type object [][2]interface{}
+
+// Encodes values as AMF0, supporting only what the server sends
+func encode(values ...interface{}) []byte {
+	out := new(bytes.Buffer)
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			out.WriteByte(0x05)
+		case float64:
+			out.WriteByte(0x00)
+			binary.Write(out, binary.BigEndian, math.Float64bits(v))
+		case string:
+			out.WriteByte(0x02)
+			writeString(out, v)
+		case object:
+			out.WriteByte(0x03)
+			for _, property := range v {
+				writeString(out, property[0].(string))
+				out.Write(encode(property[1]))
+			}
+			out.Write([]byte{0, 0, 0x09})
+		}
+	}
+	return out.Bytes()
+}
+
+// Writes a string prefixed by its length
+func writeString(out *bytes.Buffer, s string) {
+	binary.Write(out, binary.BigEndian, uint16(len(s)))
+	out.WriteString(s)
+}
+
+// Decodes AMF0 values, with objects and ECMA arrays as maps
+func decode(payload []byte) ([]interface{}, error) {
+	in := bytes.NewReader(payload)
+	values := []interface{}{}
+	for in.Len() > 0 {
+		value, err := decodeValue(in)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Decodes a single AMF0 value
+func decodeValue(in *bytes.Reader) (interface{}, error) {
+	marker, err := in.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case 0x00:
+		var bits uint64
+		err := binary.Read(in, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0x01:
+		b, err := in.ReadByte()
+		return b != 0, err
+	case 0x02:
+		return readString(in)
+	case 0x05, 0x06:
+		return nil, nil
+	case 0x03, 0x08:
+		if marker == 0x08 {
+			in.Seek(4, io.SeekCurrent)
+		}
+		properties := map[string]interface{}{}
+		for {
+			name, err := readString(in)
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				if end, err := in.ReadByte(); err != nil || end != 0x09 {
+					return nil, anirip.Error{Message: "An AMF object wasn't ended properly"}
+				}
+				return properties, nil
+			}
+			if properties[name], err = decodeValue(in); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, anirip.Error{Message: "The client sent an AMF value the server doesn't understand"}
+}
+
+// Reads a string prefixed by its length
+func readString(in *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(in, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(in, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
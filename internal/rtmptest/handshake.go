@@ -0,0 +1,150 @@
+package rtmptest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+const handshakeSize = 1536
+
+// The keys flash player and flash media server sign their handshakes with. Signatures only
+// use the text at the start of each, the whole key is used to derive the C2 signing key
+var (
+	keySuffix, _ = hex.DecodeString("f0eec24a8068bee82e00d0d1029e7e576eec5d2d29806fab93b8e636cfeb31ae")
+	playerKey    = append([]byte("Genuine Adobe Flash Player 001"), keySuffix...)
+	serverKey    = append([]byte("Genuine Adobe Flash Media Server 001"), keySuffix...)
+)
+
+// The Oakley group 2 prime RTMPE does its Diffie-Hellman key exchange in
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
+
+// Finds where the digest sits in a signature, going by the four bytes after the timestamp and version
+func digestAt(signature []byte) int {
+	return (int(signature[8])+int(signature[9])+int(signature[10])+int(signature[11]))%728 + 12
+}
+
+// Finds where the public key sits in a signature, going by its last four bytes
+func publicKeyAt(signature []byte) int {
+	return (int(signature[1532])+int(signature[1533])+int(signature[1534])+int(signature[1535]))%632 + 772
+}
+
+// Signs everything in signature but the digest with key
+func digest(signature []byte, key []byte) []byte {
+	at := digestAt(signature)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signature[:at])
+	mac.Write(signature[at+32:])
+	return mac.Sum(nil)
+}
+
+// Shorthand for a single HMAC-SHA256
+func sign(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Gets a number as the 128 bytes RTMPE sends it as
+func keyBytes(n *big.Int) []byte {
+	b := make([]byte, 128)
+	return n.FillBytes(b)
+}
+
+// Does the server side of the handshake, checking the signatures of C1 and C2. The connection
+// returned reads and writes through RC4 when the client asked for RTMPE
+func (server *Server) acceptHandshake(netConn net.Conn) (*conn, []byte, error) {
+	c0c1 := make([]byte, handshakeSize+1)
+	if _, err := io.ReadFull(netConn, c0c1); err != nil {
+		return nil, nil, err
+	}
+	version, c1 := c0c1[0], c0c1[1:]
+	encrypted := version == 0x06
+	if version != 0x03 && !encrypted {
+		return nil, nil, anirip.Error{Message: "The client asked for an unknown handshake type"}
+	}
+	if !hmac.Equal(c1[digestAt(c1):digestAt(c1)+32], digest(c1, playerKey[:30])) {
+		return nil, nil, anirip.Error{Message: "The client handshake signature could not be verified"}
+	}
+
+	// S1 carries our public key when encrypting and is signed with the server key
+	s1 := make([]byte, handshakeSize)
+	rand.Read(s1)
+	binary.BigEndian.PutUint32(s1, uint32(time.Now().Unix()))
+	copy(s1[4:], []byte{0x03, 0x05, 0x01, 0x01})
+	secret := make([]byte, 128)
+	rand.Read(secret)
+	private := new(big.Int).SetBytes(secret)
+	if encrypted {
+		copy(s1[publicKeyAt(s1):], keyBytes(new(big.Int).Exp(big.NewInt(2), private, prime)))
+	}
+	copy(s1[digestAt(s1):], digest(s1, serverKey[:36]))
+	answer := version
+	if server.HandshakeType != 0 {
+		answer = server.HandshakeType
+	}
+	if _, err := netConn.Write(append(append([]byte{answer}, s1...), c1...)); err != nil {
+		return nil, nil, err
+	}
+
+	// C2 is signed with a key derived from the S1 digest
+	c2 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(netConn, c2); err != nil {
+		return nil, nil, err
+	}
+	c2Key := sign(playerKey, s1[digestAt(s1):digestAt(s1)+32])
+	if !hmac.Equal(c2[handshakeSize-32:], sign(c2Key, c2[:handshakeSize-32])) {
+		return nil, nil, anirip.Error{Message: "The client C2 signature could not be verified"}
+	}
+	c := &conn{reader: netConn, writer: netConn, inChunkSize: 128, outChunkSize: 128, chunks: map[byte]*chunkStream{}}
+	if !encrypted {
+		return c, s1, nil
+	}
+
+	// Each side encrypts with a key made from the shared secret and the others public key, with
+	// the first handshakes worth of each keystream thrown away
+	clientPublic := c1[publicKeyAt(c1) : publicKeyAt(c1)+128]
+	serverPublic := s1[publicKeyAt(s1) : publicKeyAt(s1)+128]
+	secret = keyBytes(new(big.Int).Exp(new(big.Int).SetBytes(clientPublic), private, prime))
+	out, _ := rc4.NewCipher(sign(secret, clientPublic)[:16])
+	in, _ := rc4.NewCipher(sign(secret, serverPublic)[:16])
+	skip := make([]byte, handshakeSize)
+	out.XORKeyStream(skip, skip)
+	in.XORKeyStream(skip, skip)
+	c.reader = rc4Reader{netConn, in}
+	c.writer = rc4Writer{netConn, out}
+	return c, s1, nil
+}
+
+// Decrypts everything read through it
+type rc4Reader struct {
+	reader io.Reader
+	cipher *rc4.Cipher
+}
+
+func (r rc4Reader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.cipher.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Encrypts everything written through it
+type rc4Writer struct {
+	writer io.Writer
+	cipher *rc4.Cipher
+}
+
+func (w rc4Writer) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	w.cipher.XORKeyStream(encrypted, p)
+	return w.writer.Write(encrypted)
+}
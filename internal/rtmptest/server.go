@@ -0,0 +1,264 @@
+// Package rtmptest runs a stand in RTMP(E) server that plays back streams held in memory, so
+// the rtmp package and the Crunchyroll provider can be tested without a real media server. It
+// shares no code with the rtmp client, so the two only agree when both follow the protocol
+package rtmptest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// RTMP message types the server sends or reads
+const (
+	setChunkSize     = 0x01
+	userControl      = 0x04
+	windowAckSize    = 0x05
+	setPeerBandwidth = 0x06
+	dataAMF0         = 0x12
+	commandAMF0      = 0x14
+	aggregate        = 0x16
+)
+
+// A minimal RTMP(E) server speaking just enough of the protocol to play a stream back
+type Server struct {
+	Streams       map[string][]anirip.FLVTag // The tags played back for each playpath
+	SWF           []byte                     // When set every client must pass SWF verification for this SWF
+	ChunkSize     int                        // The chunk size the server switches to after connect, 128 when zero
+	HandshakeType byte                       // Answered in S0 instead of the type the client asked for when set
+	listener      net.Listener
+	mutex         sync.Mutex
+	conns         map[net.Conn]bool
+	wait          sync.WaitGroup
+}
+
+// Starts a server on a random local port that plays back the passed streams
+func NewServer(streams map[string][]anirip.FLVTag) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error starting the RTMP server", Err: err}
+	}
+	server := &Server{Streams: streams, listener: listener, conns: map[net.Conn]bool{}}
+	server.wait.Add(1)
+	go server.accept()
+	return server, nil
+}
+
+// Gets the host and port the server is listening on
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Stops the server, dropping any clients still connected
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.mutex.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mutex.Unlock()
+	server.wait.Wait()
+	return err
+}
+
+// Accepts clients until the server is closed, serving each on its own goroutine
+func (server *Server) accept() {
+	defer server.wait.Done()
+	for {
+		netConn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mutex.Lock()
+		server.conns[netConn] = true
+		server.mutex.Unlock()
+		server.wait.Add(1)
+		go func() {
+			defer server.wait.Done()
+			netConn.SetDeadline(time.Now().Add(30 * time.Second))
+			server.serve(netConn)
+			server.mutex.Lock()
+			delete(server.conns, netConn)
+			server.mutex.Unlock()
+			netConn.Close()
+		}()
+	}
+}
+
+// Serves a single client from the handshake through to the end of its stream
+func (server *Server) serve(netConn net.Conn) {
+	c, s1, err := server.acceptHandshake(netConn)
+	if err != nil {
+		return
+	}
+
+	// Asks for SWF verification straight away as the real servers do
+	var expected []byte
+	if server.SWF != nil {
+		if err := c.write(2, &message{kind: userControl, payload: []byte{0x00, 0x1a}}); err != nil {
+			return
+		}
+		if expected = swfVerification(server.SWF, s1); expected == nil {
+			return
+		}
+	}
+
+	verified := server.SWF == nil
+	for {
+		m, err := c.read()
+		if err != nil {
+			return
+		}
+		switch m.kind {
+		case setChunkSize:
+			if len(m.payload) >= 4 {
+				c.inChunkSize = int(binary.BigEndian.Uint32(m.payload) & 0x7fffffff)
+			}
+		case userControl:
+			if len(m.payload) > 2 && m.payload[0] == 0x00 && m.payload[1] == 0x1b {
+				verified = bytes.Equal(m.payload[2:], expected)
+			}
+		case commandAMF0:
+			done, err := server.command(c, m, verified)
+			if err != nil || done {
+				return
+			}
+		}
+	}
+}
+
+// Works out the reply a client with the right SWF sends: its uncompressed size twice then the HMAC,
+// keyed with the end of S1, of the HMAC of the uncompressed SWF keyed with the start of the player key
+func swfVerification(swf []byte, s1 []byte) []byte {
+	if len(swf) > 8 && swf[0] == 'C' {
+		reader, err := zlib.NewReader(bytes.NewReader(swf[8:]))
+		if err != nil {
+			return nil
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil
+		}
+		swf = append([]byte{'F', swf[1], swf[2], swf[3], swf[4], swf[5], swf[6], swf[7]}, body...)
+	}
+	reply := []byte{0x01, 0x01}
+	reply = binary.BigEndian.AppendUint32(reply, uint32(len(swf)))
+	reply = binary.BigEndian.AppendUint32(reply, uint32(len(swf)))
+	return append(reply, sign(s1[handshakeSize-32:], sign(playerKey[:30], swf))...)
+}
+
+// Answers a single command from the client, returning true once a stream has been played back
+func (server *Server) command(c *conn, m *message, verified bool) (bool, error) {
+	values, err := decode(m.payload)
+	if err != nil || len(values) < 2 {
+		return false, err
+	}
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+	switch name {
+	case "connect":
+		if err := c.write(2, &message{kind: windowAckSize, payload: binary.BigEndian.AppendUint32(nil, 2500000)}); err != nil {
+			return false, err
+		}
+		if err := c.write(2, &message{kind: setPeerBandwidth, payload: append(binary.BigEndian.AppendUint32(nil, 2500000), 2)}); err != nil {
+			return false, err
+		}
+		if server.ChunkSize > 0 {
+			if err := c.write(2, &message{kind: setChunkSize, payload: binary.BigEndian.AppendUint32(nil, uint32(server.ChunkSize))}); err != nil {
+				return false, err
+			}
+			c.outChunkSize = server.ChunkSize
+		}
+		return false, c.write(3, &message{kind: commandAMF0, payload: encode("_result", transactionID,
+			object{{"fmsVer", "FMS/3,5,7,7009"}, {"capabilities", float64(31)}},
+			object{{"level", "status"}, {"code", "NetConnection.Connect.Success"}},
+		)})
+	case "createStream":
+		return false, c.write(3, &message{kind: commandAMF0, payload: encode("_result", transactionID, nil, float64(1))})
+	case "play":
+		playpath := ""
+		if len(values) > 3 {
+			playpath, _ = values[3].(string)
+		}
+		return true, server.play(c, m.streamID, playpath, verified)
+	}
+	return false, nil
+}
+
+// Plays back the stream for playpath on the clients stream, or tells it why it can't
+func (server *Server) play(c *conn, streamID uint32, playpath string, verified bool) error {
+	tags, ok := server.Streams[playpath]
+	switch {
+	case !verified:
+		return sendStatus(c, streamID, "NetStream.Play.Failed", "SWF verification failed")
+	case !ok:
+		return sendStatus(c, streamID, "NetStream.Play.StreamNotFound", "Failed to play "+playpath)
+	}
+	if err := c.write(2, &message{kind: userControl, payload: binary.BigEndian.AppendUint32([]byte{0, 0}, streamID)}); err != nil {
+		return err
+	}
+	if err := sendStatus(c, streamID, "NetStream.Play.Start", "Started playing "+playpath); err != nil {
+		return err
+	}
+
+	// Sends the streams length up front so the client can report its progress
+	duration := float64(0)
+	if len(tags) > 0 {
+		duration = float64(tags[len(tags)-1].Timestamp) / 1000
+	}
+	if err := c.write(5, &message{kind: dataAMF0, streamID: streamID, payload: encode("onMetaData", object{{"duration", duration}})}); err != nil {
+		return err
+	}
+
+	// Sends the first half of the tags one message at a time and the rest as a single aggregate
+	half := len(tags) / 2
+	for _, tag := range tags[:half] {
+		if err := c.write(6, &message{kind: tag.Type, streamID: streamID, timestamp: tag.Timestamp, payload: tag.Payload}); err != nil {
+			return err
+		}
+	}
+	if half < len(tags) {
+		if err := c.write(6, &message{kind: aggregate, streamID: streamID, timestamp: tags[half].Timestamp, payload: aggregateTags(tags[half:])}); err != nil {
+			return err
+		}
+	}
+	if err := sendStatus(c, streamID, "NetStream.Play.Complete", "Finished playing "+playpath); err != nil {
+		return err
+	}
+
+	// Waits for the client to hang up so nothing is cut off before it's read
+	io.Copy(ioutil.Discard, c.reader)
+	return nil
+}
+
+// Packs tags into an aggregate message, each an FLV tag followed by its size
+func aggregateTags(tags []anirip.FLVTag) []byte {
+	out := new(bytes.Buffer)
+	for _, tag := range tags {
+		size := len(tag.Payload)
+		out.Write([]byte{tag.Type, byte(size >> 16), byte(size >> 8), byte(size)})
+		out.Write([]byte{byte(tag.Timestamp >> 16), byte(tag.Timestamp >> 8), byte(tag.Timestamp), byte(tag.Timestamp >> 24)})
+		out.Write([]byte{0, 0, 0})
+		out.Write(tag.Payload)
+		binary.Write(out, binary.BigEndian, uint32(size+11))
+	}
+	return out.Bytes()
+}
+
+// Sends an onStatus command with the passed code
+func sendStatus(c *conn, streamID uint32, code, description string) error {
+	level := "status"
+	if code == "NetStream.Play.Failed" || code == "NetStream.Play.StreamNotFound" {
+		level = "error"
+	}
+	return c.write(5, &message{kind: commandAMF0, streamID: streamID, payload: encode("onStatus", float64(0), nil,
+		object{{"level", level}, {"code", code}, {"description", description}},
+	)})
+}
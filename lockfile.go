@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// How long a lock held by another process is waited for
+const lockWait = 30 * time.Second
+
+// Takes the lock guarding fileName so other processes can't change it at the same time. The lock
+// is an advisory lock the operating system holds on fileName.lock for us, so it's let go of when a
+// process dies holding it and there's never a stale lock to break. The returned func releases it
+func lockFile(fileName string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, anirip.Error{Message: "There was an error creating the directory " + filepath.Dir(fileName), Err: err}
+	}
+
+	// The lock file is left in place afterwards, removing it would let another process lock a file
+	// that's already gone while a third creates and locks a new one
+	lockName := fileName + ".lock"
+	file, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error opening the lock file " + lockName, Err: err}
+	}
+	deadline := time.Now().Add(lockWait)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, anirip.Error{Message: "There was an error locking " + fileName, Err: err}
+		}
+		if locked {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, anirip.Error{Message: fileName + " is still locked by another anirip process"}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Writes data to a temporary file and renames it over fileName, so it can be read at any time without
+// the lock and is never left half written. The caller must hold the lock
+func writeFileAtomic(fileName string, data []byte) error {
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return anirip.Error{Message: "There was an error writing " + fileName, Err: err}
+	}
+	return anirip.Rename(fileName+".tmp", fileName, 10)
+}
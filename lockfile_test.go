@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "history.json")
+
+	// A lock file left behind by a process that exited doesn't hold anything
+	if err := ioutil.WriteFile(fileName+".lock", []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release, err := lockFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anyone else locking the file waits until it's released
+	locked := make(chan func())
+	go func() {
+		release, err := lockFile(fileName)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- release
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked the file while it was already locked")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release()
+	select {
+	case release := <-locked:
+		if release != nil {
+			release()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the file stayed locked after it was released")
+	}
+
+	// Releasing leaves the lock file for the next process instead of removing it from under them
+	if _, err := os.Stat(fileName + ".lock"); err != nil {
+		t.Errorf("the lock file was removed: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// How many run logs are kept in the log directory before the oldest are removed
+const keptRunLogs = 20
+
+// The log file of the current run, if one is being kept
+var runLog *os.File
+
+// Starts a log file for this run in logDir, which gets every message including debug ones,
+// and removes the oldest run logs so no more than keptRunLogs are left
+func openRunLog(logDir string) error {
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return anirip.Error{Message: "There was an error creating the log directory " + logDir, Err: err}
+	}
+	fileName := filepath.Join(logDir, "anirip-"+time.Now().Format("20060102-150405")+".log")
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return anirip.Error{Message: "There was an error creating the log file " + fileName, Err: err}
+	}
+	runLog = file
+	logger.SetFile(file)
+	logger.Debug("Logging this run to " + fileName)
+
+	// Run logs are named by when they started, so sorting them puts the oldest first
+	logs, _ := filepath.Glob(filepath.Join(logDir, "anirip-*.log"))
+	sort.Strings(logs)
+	for len(logs) > keptRunLogs {
+		os.Remove(logs[0])
+		logs = logs[1:]
+	}
+	return nil
+}
+
+// Closes the current runs log file, if one is being kept
+func closeRunLog() error {
+	if runLog == nil {
+		return nil
+	}
+	logger.SetFile(nil)
+	err := runLog.Close()
+	runLog = nil
+	return err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/daisuki"
+	"github.com/sdwolfe32/anirip/providertest"
+)
+
+// Gives the test its own config and work directories, with stand ins for ffmpeg and mkclean
+// that join their inputs into their output so what was merged can be checked afterwards
+func testEnvironment(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand in tools are shell scripts")
+	}
+	home, work, tools := t.TempDir(), t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	oldSessionDir, oldTempDir := sessionDir, tempDir
+	t.Cleanup(func() { sessionDir, tempDir = oldSessionDir, oldTempDir })
+	sessionDir, tempDir = anirip.SessionDir(), filepath.Join(t.TempDir(), "anirip")
+
+	ffmpeg := "#!/bin/sh\ninputs=\"\"\nwhile [ $# -gt 1 ]; do\n  if [ \"$1\" = -i ]; then inputs=\"$inputs $2\"; fi\n  shift\ndone\ncat $inputs > \"$1\"\n"
+	if err := ioutil.WriteFile(filepath.Join(tools, "ffmpeg"), []byte(ffmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tools, "mkclean"), []byte("#!/bin/sh\ncp \"$1\" \"$2\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "[tools]\nffmpeg = \"" + filepath.Join(tools, "ffmpeg") + "\"\nmkclean = \"" + filepath.Join(tools, "mkclean") + "\"\n"
+	if err := ioutil.WriteFile(filepath.Join(work, "anirip.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return work
+}
+
+// Runs anirip with events written as JSON, returning its exit status and the events it wrote
+func runWithEvents(t *testing.T, args ...string) (int, []event) {
+	out, err := ioutil.TempFile(t.TempDir(), "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	status := run(append([]string{"anirip", "--events", "json"}, args...))
+	os.Stdout = stdout
+	events.enable(nil)
+
+	written := []event{}
+	out.Seek(0, 0)
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		e := event{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("wrote an event that isn't JSON %q: %v", scanner.Text(), err)
+		}
+		written = append(written, e)
+	}
+	return status, written
+}
+
+// Counts the events of each kind
+func countEvents(written []event) map[string]int {
+	counts := map[string]int{}
+	for _, e := range written {
+		counts[e.Event]++
+	}
+	return counts
+}
+
+// Finds every MKV saved under dir
+func findMKVs(t *testing.T, dir string) []string {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".mkv") {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestRipShow(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    func(t *testing.T) (showURL string, login func() error, stop func())
+		provider string
+		ripped   []string // The ids of the episodes that should be ripped
+		failed   int
+	}{
+		{
+			name: "crunchyroll",
+			start: func(t *testing.T) (string, func() error, func()) {
+				server, err := providertest.NewCrunchyroll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				restore := server.Use()
+				login := func() error { return new(crunchyroll.CrunchyrollSession).Login("testuser", "testpass", sessionDir) }
+				return server.ShowURL("test-show"), login, func() { restore(); server.Close() }
+			},
+			provider: "crunchyroll",
+			ripped:   []string{"600001", "600002", "600003"},
+			failed:   1, // The last episode is region locked
+		},
+		{
+			name: "daisuki",
+			start: func(t *testing.T) (string, func() error, func()) {
+				server, err := providertest.NewDaisuki()
+				if err != nil {
+					t.Fatal(err)
+				}
+				restore := server.Use()
+				login := func() error { return new(daisuki.DaisukiSession).Login("test@example.com", "testpass", sessionDir) }
+				return server.ShowURL("TESTSHOW"), login, func() { restore(); server.Close() }
+			},
+			provider: "daisuki",
+			ripped:   []string{"600001", "600002", "600003", "600004"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			work := testEnvironment(t)
+			showURL, login, stop := test.start(t)
+			defer stop()
+			if err := login(); err != nil {
+				t.Fatal(err)
+			}
+
+			status, written := runWithEvents(t, showURL)
+			if status != 0 {
+				t.Fatalf("exited with %d", status)
+			}
+
+			// Every episode is saved with its subtitles merged in and the stream joined ahead of them
+			files := findMKVs(t, work)
+			if len(files) != len(test.ripped) {
+				t.Fatalf("saved %v, expected %d episodes", files, len(test.ripped))
+			}
+			for _, file := range files {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(data, []byte("FLV")) || !bytes.Contains(data, []byte("Where am I?")) {
+					t.Errorf("%s doesn't hold the stream followed by the subtitles", file)
+				}
+			}
+
+			// Each ripped episode is in the history along with where it was saved
+			state, err := (&downloadHistory{fileName: historyFile()}).load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Episodes) != len(test.ripped) {
+				t.Errorf("the history has %d episodes, expected %d", len(state.Episodes), len(test.ripped))
+			}
+			for _, id := range test.ripped {
+				entry := state.Episodes[historyKey(test.provider, id)]
+				if entry == nil {
+					t.Errorf("episode %s isn't in the history", id)
+					continue
+				}
+				if _, err := os.Stat(entry.Output); err != nil {
+					t.Errorf("episode %s was recorded as saved to %s which doesn't exist", id, entry.Output)
+				}
+			}
+
+			counts := countEvents(written)
+			if counts["show_scraped"] != 1 || counts["episode_done"] != len(test.ripped) || counts["episode_failed"] != test.failed || counts["summary"] != 1 {
+				t.Errorf("got events %v", counts)
+			}
+			summary := written[len(written)-1]
+			if summary.Event != "summary" || summary.Totals.Downloaded != len(test.ripped) || summary.Totals.Failed != test.failed || summary.Error != "" {
+				t.Errorf("got summary %+v", summary)
+			}
+
+			// Ripping the show again skips everything already in the history
+			status, written = runWithEvents(t, showURL)
+			if status != 0 {
+				t.Fatalf("exited with %d the second time", status)
+			}
+			summary = written[len(written)-1]
+			if summary.Totals.Downloaded != 0 || summary.Totals.AlreadyDownloaded != len(test.ripped) {
+				t.Errorf("got summary %+v the second time", summary.Totals)
+			}
+			if files := findMKVs(t, work); len(files) != len(test.ripped) {
+				t.Errorf("saved %v the second time", files)
+			}
+		})
+	}
+}
+
+func TestRipFailures(t *testing.T) {
+	testEnvironment(t)
+	server, err := providertest.NewDaisuki()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer server.Use()()
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no show", args: nil},
+		{name: "not logged in", args: []string{server.ShowURL("TESTSHOW")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, written := runWithEvents(t, test.args...)
+			if status != 1 {
+				t.Errorf("exited with %d, expected 1", status)
+			}
+			if counts := countEvents(written); counts["episode_done"] != 0 {
+				t.Errorf("got events %v", counts)
+			}
+		})
+	}
+}
+
+func TestRipForce(t *testing.T) {
+	work := testEnvironment(t)
+	server, err := providertest.NewDaisuki()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer server.Use()()
+	if err := new(daisuki.DaisukiSession).Login("test@example.com", "testpass", sessionDir); err != nil {
+		t.Fatal(err)
+	}
+	showURL := server.ShowURL("TESTSHOW")
+	if status, _ := runWithEvents(t, showURL); status != 0 {
+		t.Fatalf("exited with %d", status)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(work, "anirip.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    string // The value of ANIRIP_FORCE, unset when empty
+		config string // Added to the top of the project config file
+		forced bool
+	}{
+		{name: "flag", args: []string{"--force"}, forced: true},
+		{name: "environment", env: "1", forced: true},
+		{name: "config", config: "force = true\n", forced: true},
+		{name: "flag turning off the config", args: []string{"--force=false"}, config: "force = true\n"},
+		{name: "none"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(flagEnvVar("force"), test.env)
+			if test.env == "" {
+				os.Unsetenv(flagEnvVar("force")) // Even an empty variable turns forcing off
+			}
+			if err := ioutil.WriteFile(filepath.Join(work, "anirip.toml"), append([]byte(test.config), config...), 0644); err != nil {
+				t.Fatal(err)
+			}
+			status, written := runWithEvents(t, append(test.args, showURL)...)
+			if status != 0 {
+				t.Fatalf("exited with %d", status)
+			}
+			summary := written[len(written)-1].Totals
+			if test.forced && (summary.Downloaded != 4 || summary.AlreadyDownloaded != 0) {
+				t.Errorf("got summary %+v, expected every episode ripped again", summary)
+			}
+			if !test.forced && (summary.Downloaded != 0 || summary.AlreadyDownloaded != 4) {
+				t.Errorf("got summary %+v, expected every episode skipped", summary)
+			}
+			if files := findMKVs(t, work); len(files) != 4 {
+				t.Errorf("saved %v", files)
+			}
+		})
+	}
+}
+
+func TestQueueRunStatus(t *testing.T) {
+	testEnvironment(t)
+	server, err := providertest.NewDaisuki()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer server.Use()()
+	showURL := server.ShowURL("TESTSHOW")
+
+	// Without a session the job fails, which queue run has to report
+	if status, _ := runWithEvents(t, "queue", "add", showURL); status != 0 {
+		t.Fatalf("queue add exited with %d", status)
+	}
+	if status, _ := runWithEvents(t, "queue", "run"); status != 1 {
+		t.Errorf("queue run exited with %d after a job failed, expected 1", status)
+	}
+
+	if err := new(daisuki.DaisukiSession).Login("test@example.com", "testpass", sessionDir); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := runWithEvents(t, "queue", "add", showURL); status != 0 {
+		t.Fatalf("queue add exited with %d", status)
+	}
+	if status, written := runWithEvents(t, "queue", "run"); status != 0 || countEvents(written)["episode_done"] == 0 {
+		t.Errorf("queue run exited with %d and events %v once the job worked, expected 0", status, countEvents(written))
+	}
+}
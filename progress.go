@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"golang.org/x/term"
+)
+
+const (
+	// How often the progress bar is redrawn on a terminal
+	progressRedraw = 200 * time.Millisecond
+
+	// How often a progress line is logged when there's no terminal to draw a bar on
+	progressInterval = 10 * time.Second
+
+	// How many characters wide the bar itself is
+	progressBarWidth = 20
+)
+
+// Shows the progress of the step running for an episode, as a bar redrawn in place when
+// the console is a terminal and otherwise as a log line every progressInterval. It also sits
+// between the logger and the console so log messages never end up on the same line as the bar
+type progressDisplay struct {
+	mutex    sync.Mutex
+	out      *os.File
+	bars     bool           // Draws bars rather than logging lines
+	label    string         // What the step is, such as Downloading video
+	log      *anirip.Logger // Where progress lines go, carrying the episodes fields
+	start    time.Time      // When the first report of the step arrived
+	first    anirip.Progress
+	last     anirip.Progress
+	lastShow time.Time
+	bar      string // The bar currently on screen, if any
+}
+
+// Creates a display writing to out, which is where the logger writes too
+func newProgressDisplay(out *os.File) *progressDisplay {
+	return &progressDisplay{out: out}
+}
+
+// Checks whether bars can be drawn, which needs a terminal to redraw them in place
+func (display *progressDisplay) isTerminal() bool {
+	return term.IsTerminal(int(display.out.Fd()))
+}
+
+// Switches between drawing bars and logging progress lines
+func (display *progressDisplay) setBars(bars bool) {
+	display.mutex.Lock()
+	defer display.mutex.Unlock()
+	display.bars = bars
+}
+
+// Starts showing progress for a step, any reports until end belong to it
+func (display *progressDisplay) begin(log *anirip.Logger, label string) {
+	display.mutex.Lock()
+	defer display.mutex.Unlock()
+	display.clearBar()
+	display.label, display.log = label, log
+	display.start = time.Time{}
+}
+
+// Stops showing progress for the current step, clearing its bar
+func (display *progressDisplay) end() {
+	display.mutex.Lock()
+	defer display.mutex.Unlock()
+	display.clearBar()
+	display.label, display.log = "", nil
+}
+
+// Takes a progress report from a download or external command, set as anirip.ReportProgress
+func (display *progressDisplay) report(progress anirip.Progress) {
+	display.mutex.Lock()
+	if display.label == "" {
+		display.mutex.Unlock()
+		return
+	}
+
+	// A report that goes backwards is a new stream within the step, such as the audio after the video
+	now := time.Now()
+	if display.start.IsZero() || progress.Segments < display.last.Segments || progress.TotalSegments != display.last.TotalSegments ||
+		(display.last.Done && !progress.Done) {
+		display.start, display.first, display.lastShow = now, progress, time.Time{}
+	}
+	display.last = progress
+
+	// Redraws the bar often, but only logs a line every so often and when the stream is done
+	if display.bars {
+		if progress.Done || now.Sub(display.lastShow) >= progressRedraw {
+			display.lastShow = now
+			display.bar = display.fit("[anirip] " + display.label + " " + display.summary(now, true))
+			fmt.Fprint(display.out, "\r\033[K"+display.bar)
+		}
+		display.mutex.Unlock()
+		return
+	}
+	if !progress.Done && now.Sub(display.lastShow) < progressInterval {
+		display.mutex.Unlock()
+		return
+	}
+	display.lastShow = now
+	message := display.label + " " + display.summary(now, false)
+	log := display.log.With(display.fields(now))
+	display.mutex.Unlock()
+
+	// Logged once unlocked as the logger writes back through us
+	log.Info(message)
+}
+
+// Writes a log message, moving the bar out of its way and drawing it again below
+func (display *progressDisplay) Write(p []byte) (int, error) {
+	display.mutex.Lock()
+	defer display.mutex.Unlock()
+	if display.bar != "" {
+		fmt.Fprint(display.out, "\r\033[K")
+	}
+	n, err := display.out.Write(p)
+	if display.bar != "" {
+		fmt.Fprint(display.out, display.bar)
+	}
+	return n, err
+}
+
+// Cuts a bar short so it stays on one line of the terminal, as a wrapped bar can't be redrawn in place
+func (display *progressDisplay) fit(bar string) string {
+	width, _, err := term.GetSize(int(display.out.Fd()))
+	if err != nil || width <= 1 || len(bar) < width {
+		return bar
+	}
+	return bar[:width-1]
+}
+
+// Removes the bar from the screen, if one is drawn
+func (display *progressDisplay) clearBar() {
+	if display.bar != "" {
+		fmt.Fprint(display.out, "\r\033[K")
+		display.bar = ""
+	}
+}
+
+// Describes the latest report as a percentage, size, speed and time left, with a bar in front if asked
+func (display *progressDisplay) summary(now time.Time, withBar bool) string {
+	progress := display.last
+	parts := []string{}
+	fraction, known := progress.Fraction()
+	if known {
+		if withBar {
+			filled := int(fraction * progressBarWidth)
+			bar := strings.Repeat("=", filled)
+			if filled < progressBarWidth {
+				bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+			}
+			parts = append(parts, "["+bar+"]", fmt.Sprintf("%3.0f%%", fraction*100))
+		} else {
+			parts = append(parts, fmt.Sprintf("%.0f%%", fraction*100))
+		}
+	} else if progress.Position > 0 {
+		parts = append(parts, formatDuration(progress.Position))
+	}
+	if progress.Bytes > 0 {
+		parts = append(parts, formatBytes(progress.Bytes))
+	}
+	if speed := display.speed(now); speed != "" {
+		parts = append(parts, speed)
+	}
+	if eta, ok := display.eta(now); ok && !progress.Done {
+		parts = append(parts, "ETA "+formatDuration(eta))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// Gets how fast the step is going, in bytes per second when downloading and as a multiple
+// of real time when only the media position is known
+func (display *progressDisplay) speed(now time.Time) string {
+	elapsed := now.Sub(display.start).Seconds()
+	if elapsed < 1 {
+		return ""
+	}
+	if bytes := display.last.Bytes - display.first.Bytes; bytes > 0 {
+		return formatBytes(int64(float64(bytes)/elapsed)) + "/s"
+	}
+	if position := display.last.Position - display.first.Position; position > 0 {
+		return fmt.Sprintf("%.1fx", position.Seconds()/elapsed)
+	}
+	return ""
+}
+
+// Estimates how long the step has left from how fast it's gone since its first report
+func (display *progressDisplay) eta(now time.Time) (time.Duration, bool) {
+	fraction, known := display.last.Fraction()
+	firstFraction, _ := display.first.Fraction()
+	elapsed := now.Sub(display.start)
+	if !known || fraction <= firstFraction || elapsed < time.Second {
+		return 0, false
+	}
+	remaining := float64(elapsed) * (1 - fraction) / (fraction - firstFraction)
+	return time.Duration(remaining), true
+}
+
+// Gets the latest report as fields for JSON logs and log files
+func (display *progressDisplay) fields(now time.Time) anirip.Fields {
+	fields := anirip.Fields{"step": display.label, "bytes": display.last.Bytes}
+	if fraction, known := display.last.Fraction(); known {
+		fields["percent"] = math.Floor(fraction*1000) / 10
+	}
+	if eta, ok := display.eta(now); ok && !display.last.Done {
+		fields["eta_seconds"] = int(eta.Seconds())
+	}
+	return fields
+}
+
+// Formats a byte count as B, KB, MB or GB
+func formatBytes(bytes int64) string {
+	size := float64(bytes)
+	for _, unit := range []string{"B", "KB", "MB", "GB"} {
+		if size < 1024 || unit == "GB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", bytes)
+			}
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return ""
+}
+
+// Formats a duration as h:mm:ss, or m:ss when it's under an hour
+func formatDuration(duration time.Duration) string {
+	seconds := int(duration.Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
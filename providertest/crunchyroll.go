@@ -0,0 +1,313 @@
+package providertest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/internal/rtmptest"
+)
+
+// A local server shaped like the parts of Crunchyroll anirip talks to
+type Crunchyroll struct {
+	*httptest.Server
+	RTMP     *rtmptest.Server // Plays back every episode, requiring SWF verification against playerSWF
+	Username string
+	Password string
+	Shows    []Show
+	mutex    sync.Mutex
+	token    string
+}
+
+// Starts a fake Crunchyroll with a test account and the default shows, along
+// with the RTMP server its episodes are streamed from
+func NewCrunchyroll() (*Crunchyroll, error) {
+	server := &Crunchyroll{
+		Username: "testuser",
+		Password: "testpass",
+		Shows:    defaultShows(),
+	}
+
+	// Every episode plays the same few fragments worth of tags
+	tags := []anirip.FLVTag{}
+	for fragment := 1; fragment <= 3; fragment++ {
+		tags = append(tags, anirip.ParseFLVTags(fragmentTags(fragment))...)
+	}
+	streams := map[string][]anirip.FLVTag{}
+	for _, show := range server.Shows {
+		for _, season := range show.Seasons {
+			for _, episode := range season.Episodes {
+				streams["mp4:"+strconv.Itoa(episode.ID)+".mp4"] = tags
+			}
+		}
+	}
+	var err error
+	if server.RTMP, err = rtmptest.NewServer(streams); err != nil {
+		return nil, err
+	}
+	server.RTMP.SWF = playerSWF()
+	server.RTMP.ChunkSize = 4096
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server, nil
+}
+
+// Stops both the web and RTMP servers
+func (server *Crunchyroll) Close() {
+	server.Server.Close()
+	server.RTMP.Close()
+}
+
+// Points the crunchyroll package at this server, returning a func that puts the real site back
+func (server *Crunchyroll) Use() func() {
+	baseURL, secureBaseURL, playerURL := crunchyroll.BaseURL, crunchyroll.SecureBaseURL, crunchyroll.PlayerURL
+	crunchyroll.BaseURL, crunchyroll.SecureBaseURL = server.URL, server.URL
+	crunchyroll.PlayerURL = server.URL + "/player.swf"
+	return func() {
+		crunchyroll.BaseURL, crunchyroll.SecureBaseURL, crunchyroll.PlayerURL = baseURL, secureBaseURL, playerURL
+	}
+}
+
+// Creates a transport that sends requests for the real site here, so the real sites
+// urls can be used as they are, such as when recording fixtures against the server
+func (server *Crunchyroll) Transport() http.RoundTripper {
+	return newRoutingTransport(server.URL)
+}
+
+// Gets the url of a shows page
+func (server *Crunchyroll) ShowURL(id string) string {
+	return server.URL + "/" + id
+}
+
+// Routes a request to the page or endpoint it's for
+func (server *Crunchyroll) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(request.URL.Path, "/")
+	switch {
+	case request.URL.Query().Get("a") == "formhandler":
+		server.serveLogin(writer, request)
+	case path == "":
+		server.serveHome(writer, request)
+	case path == "logout":
+		server.serveLogout(writer, request)
+	case path == "login":
+		writer.Write([]byte("<html><body><form id=\"login_form\"></form></body></html>"))
+	case path == "player.swf":
+		writer.Header().Set("content-type", "application/x-shockwave-flash")
+		writer.Write(playerSWF())
+	case path == "xml":
+		server.serveXML(writer, request)
+	case strings.Contains(path, "/"):
+		server.serveEpisode(writer, request, path)
+	default:
+		server.serveShow(writer, request, path)
+	}
+}
+
+// Logs the user in, sending them home either way like the real form handler
+func (server *Crunchyroll) serveLogin(writer http.ResponseWriter, request *http.Request) {
+	if request.FormValue("name") != server.Username || request.FormValue("password") != server.Password {
+		http.Redirect(writer, request, "/login", http.StatusFound)
+		return
+	}
+	server.mutex.Lock()
+	server.token = newToken()
+	http.SetCookie(writer, &http.Cookie{Name: "session_id", Value: server.token, Path: "/"})
+	server.mutex.Unlock()
+	http.Redirect(writer, request, "/", http.StatusFound)
+}
+
+// Ends the session the request carries, so it no longer works from anywhere
+func (server *Crunchyroll) serveLogout(writer http.ResponseWriter, request *http.Request) {
+	if server.loggedIn(request) {
+		server.mutex.Lock()
+		server.token = ""
+		server.mutex.Unlock()
+	}
+	http.SetCookie(writer, &http.Cookie{Name: "session_id", Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(writer, request, "/", http.StatusFound)
+}
+
+// Shows the username on the home page once logged in
+func (server *Crunchyroll) serveHome(writer http.ResponseWriter, request *http.Request) {
+	body := "<html><body><ul class=\"header\">"
+	if server.loggedIn(request) {
+		body += "<li class=\"username\">" + html.EscapeString(server.Username) + "</li>"
+	}
+	writer.Write([]byte(body + "</ul></body></html>"))
+}
+
+// Lists a shows seasons and episodes newest first, as the real show page does
+func (server *Crunchyroll) serveShow(writer http.ResponseWriter, request *http.Request, id string) {
+	show, ok := findShow(server.Shows, id)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	body := "<html><head>" + metadataScript(map[string]string{"name": show.Title, "url": siteURL(request) + "/" + show.ID}) + "</head><body>"
+	body += "<ul class=\"list-of-seasons cf\">"
+	for s := len(show.Seasons) - 1; s >= 0; s-- {
+		season := show.Seasons[s]
+		body += "<li class=\"season\"><a title=\"" + html.EscapeString(season.Title) + "\">" + html.EscapeString(season.Title) + "</a><ul>"
+		for e := len(season.Episodes) - 1; e >= 0; e-- {
+			episode := season.Episodes[e]
+			body += "<li><div class=\"wrapper container-shadow hover-classes\">" +
+				"<a href=\"" + server.episodePath(show, episode) + "\">" +
+				"<span class=\"series-title block ellipsis\">\nEpisode " + strconv.Itoa(episode.Number) + "</span></a></div></li>"
+		}
+		body += "</ul></li>"
+	}
+	writer.Write([]byte(body + "</ul></body></html>"))
+}
+
+// Serves an episode page carrying its metadata
+func (server *Crunchyroll) serveEpisode(writer http.ResponseWriter, request *http.Request, path string) {
+	if len(path) < 6 {
+		http.NotFound(writer, request)
+		return
+	}
+	id, _ := strconv.Atoi(path[len(path)-6:])
+	episode, ok := findEpisode(server.Shows, id)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Write([]byte("<html><head>" + metadataScript(map[string]string{
+		"media_id":       strconv.Itoa(episode.ID),
+		"episode_number": strconv.Itoa(episode.Number),
+		"name":           episode.Title,
+		"url":            siteURL(request) + "/" + path,
+	}) + "</head><body></body></html>"))
+}
+
+// Answers the RPC calls the flash player makes
+func (server *Crunchyroll) serveXML(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	writer.Header().Set("content-type", "text/xml")
+	switch query.Get("req") {
+	case "RpcApiVideoPlayer_GetStandardConfig":
+		id, _ := strconv.Atoi(query.Get("media_id"))
+		episode, ok := findEpisode(server.Shows, id)
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		if episode.RegionLocked {
+			writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><config><error><code>4</code><msg>Media not available</msg></error></config>"))
+			return
+		}
+		// Streams are premium only, so a logged out player gets a config without one
+		if !server.loggedIn(request) {
+			writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><config><stream_info></stream_info></config>"))
+			return
+		}
+		writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><config><stream_info>" +
+			"<host>rtmpe://" + server.RTMP.Addr() + "/ondemand/?auth=" + newToken() + "</host>" +
+			"<file>mp4:" + strconv.Itoa(episode.ID) + ".mp4</file>" +
+			"</stream_info></config>"))
+	case "RpcApiSubtitle_GetListing":
+		id, _ := strconv.Atoi(query.Get("media_id"))
+		episode, ok := findEpisode(server.Shows, id)
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		body := "<?xml version=\"1.0\" encoding=\"UTF-8\"?><subtitles><media_id>" + strconv.Itoa(episode.ID) + "</media_id>"
+		if len(episode.Subtitles) > 0 {
+			body += "<subtitle id=\"" + strconv.Itoa(episode.ID) + "\" link=\"\" title=\"[English (US)] English (US)\" default=\"1\"/>"
+		}
+		writer.Write([]byte(body + "</subtitles>"))
+	case "RpcApiSubtitle_GetXml":
+		id, _ := strconv.Atoi(query.Get("subtitle_script_id"))
+		episode, ok := findEpisode(server.Shows, id)
+		if !ok || len(episode.Subtitles) == 0 {
+			http.NotFound(writer, request)
+			return
+		}
+		iv, data, err := encryptSubtitles(id, subtitleScript(episode))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><subtitle id=\"" + strconv.Itoa(id) + "\">" +
+			"<iv>" + iv + "</iv><data>" + data + "</data></subtitle>"))
+	default:
+		http.Error(writer, "unknown request", http.StatusBadRequest)
+	}
+}
+
+// Checks whether the request carries the current session, expiring the token logs everyone out
+func (server *Crunchyroll) loggedIn(request *http.Request) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return hasSession(request, "session_id", server.token)
+}
+
+// Builds the path of an episodes page, which ends in its six digit id
+func (server *Crunchyroll) episodePath(show Show, episode Episode) string {
+	return "/" + show.ID + "/episode-" + strconv.Itoa(episode.Number) + "-" + slugify(episode.Title) + "-" + strconv.Itoa(episode.ID)
+}
+
+// Builds the metadata script both show and episode pages carry
+func metadataScript(metadata map[string]string) string {
+	metadataJSON, _ := json.Marshal(metadata)
+	return "<script id=\"liftigniter-metadata\" type=\"application/json\">" + string(metadataJSON) + "</script>"
+}
+
+// Builds the subtitle script xml for an episode
+func subtitleScript(episode Episode) string {
+	script := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>" +
+		"<subtitle_script id=\"" + strconv.Itoa(episode.ID) + "\" title=\"English (US)\" play_res_x=\"656\" play_res_y=\"368\" lang_code=\"enUS\" lang_string=\"English (US)\" wrap_style=\"0\">" +
+		"<styles><style id=\"1\" name=\"Main\" font_name=\"Arial\" font_size=\"24\" primary_colour=\"&amp;H00FFFFFF\" secondary_colour=\"&amp;H000000FF\"" +
+		" outline_colour=\"&amp;H00000000\" back_colour=\"&amp;H00000000\" bold=\"0\" italic=\"0\" underline=\"0\" strikeout=\"0\" scale_x=\"100\" scale_y=\"100\"" +
+		" spacing=\"0\" angle=\"0\" border_style=\"1\" outline=\"2\" shadow=\"1\" alignment=\"2\" margin_l=\"0020\" margin_r=\"0020\" margin_v=\"0022\" encoding=\"1\"/></styles><events>"
+	for i, line := range episode.Subtitles {
+		text := new(bytes.Buffer)
+		xml.EscapeText(text, []byte(line.Text))
+		script += "<event id=\"" + strconv.Itoa(i+1) + "\" start=\"" + line.Start + "\" end=\"" + line.End + "\" style=\"Main\" name=\"\"" +
+			" margin_l=\"0000\" margin_r=\"0000\" margin_v=\"0000\" effect=\"\" text=\"" + text.String() + "\"/>"
+	}
+	return script + "</events></subtitle_script>"
+}
+
+// Compresses and encrypts a subtitle script the way Crunchyroll does, returning the base64 iv and data
+func encryptSubtitles(subtitleID int, script string) (string, string, error) {
+	compressed := new(bytes.Buffer)
+	zlibWriter := zlib.NewWriter(compressed)
+	zlibWriter.Write([]byte(script))
+	zlibWriter.Close()
+
+	// Pads the compressed script out to a whole number of blocks
+	data := compressed.Bytes()
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	block, err := aes.NewCipher(crunchyroll.GenerateSubtitleKey(subtitleID))
+	if err != nil {
+		return "", "", err
+	}
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Builds a small compressed SWF standing in for the flash player
+func playerSWF() []byte {
+	body := new(bytes.Buffer)
+	zlibWriter := zlib.NewWriter(body)
+	zlibWriter.Write(bytes.Repeat([]byte("ChromelessPlayerApp"), 64))
+	zlibWriter.Close()
+	return append([]byte{'C', 'W', 'S', 10, 0xc8, 0x04, 0, 0}, body.Bytes()...)
+}
@@ -0,0 +1,292 @@
+package providertest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sdwolfe32/anirip/daisuki"
+)
+
+// A local server shaped like the parts of Daisuki anirip talks to
+type Daisuki struct {
+	*httptest.Server
+	Username  string
+	Password  string
+	Nickname  string
+	Shows     []Show
+	Fragments int // The number of HDS fragments each episode is split into
+	key       *rsa.PrivateKey
+	mutex     sync.Mutex
+	token     string
+}
+
+// Starts a fake Daisuki with a test account and the default shows
+func NewDaisuki() (*Daisuki, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	server := &Daisuki{
+		Username:  "test@example.com",
+		Password:  "testpass",
+		Nickname:  "testuser",
+		Shows:     defaultShows(),
+		Fragments: 3,
+		key:       key,
+	}
+
+	// Daisuki doesn't split shows into seasons so the default seasons are run together
+	show := &server.Shows[0]
+	show.ID = "TESTSHOW"
+	show.Seasons = []Season{{Title: show.Title, Episodes: server.episodes(*show)}}
+	for i := range show.Seasons[0].Episodes {
+		show.Seasons[0].Episodes[i].Number = i + 1
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server, nil
+}
+
+// Points the daisuki package at this server and its key, returning a func that puts the real site back
+func (server *Daisuki) Use() func() {
+	baseURL, secureBaseURL, publicKey := daisuki.BaseURL, daisuki.SecureBaseURL, daisuki.PublicKey
+	daisuki.BaseURL, daisuki.SecureBaseURL = server.URL, server.URL
+	daisuki.PublicKey = server.PublicKey()
+	return func() {
+		daisuki.BaseURL, daisuki.SecureBaseURL, daisuki.PublicKey = baseURL, secureBaseURL, publicKey
+	}
+}
+
+// Gets the PEM encoded public key the server expects requests to be encrypted for
+func (server *Daisuki) PublicKey() string {
+	publicKeyDER, _ := x509.MarshalPKIXPublicKey(&server.key.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER}))
+}
+
+// Creates a transport that sends requests for the real site here, so the real sites
+// urls can be used as they are, such as when recording fixtures against the server
+func (server *Daisuki) Transport() http.RoundTripper {
+	return newRoutingTransport(server.URL)
+}
+
+// Gets the url of a shows detail page
+func (server *Daisuki) ShowURL(id string) string {
+	return server.URL + "/us/en/anime/detail." + id + ".html"
+}
+
+// Routes a request to the page or endpoint it's for
+func (server *Daisuki) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	switch {
+	case path == "/bin/SignInServlet.html/input":
+		server.serveLogin(writer, request)
+	case path == "/bin/SignOutServlet.html":
+		server.serveLogout(writer, request)
+	case path == "/us/en/mypage/info.html":
+		server.serveAccount(writer, request)
+	case path == "/us/en/top.html":
+		writer.Write([]byte("<html><body></body></html>"))
+	case strings.HasPrefix(path, "/us/en/anime/detail."):
+		server.serveShow(writer, request, strings.TrimSuffix(strings.TrimPrefix(path, "/us/en/anime/detail."), ".html"))
+	case strings.HasPrefix(path, "/us/en/anime/watch."):
+		server.serveWatch(writer, request, strings.TrimSuffix(strings.TrimPrefix(path, "/us/en/anime/watch."), ".html"))
+	case path == "/fastAPI/country/code/":
+		writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><result><country_code>US</country_code></result>"))
+	case path == "/fastAPI/bgn/init/":
+		server.serveInit(writer, request)
+	case strings.HasPrefix(path, "/caption/"):
+		server.serveCaptions(writer, request, strings.TrimSuffix(strings.TrimPrefix(path, "/caption/"), ".xml"))
+	case strings.HasPrefix(path, "/hds/"):
+		server.serveHDS(writer, request, strings.TrimPrefix(path, "/hds/"))
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+// Logs the user in, sending them to the top page either way like the real servlet
+func (server *Daisuki) serveLogin(writer http.ResponseWriter, request *http.Request) {
+	if request.FormValue("emailAddress") == server.Username && request.FormValue("password") == server.Password {
+		server.mutex.Lock()
+		server.token = newToken()
+		http.SetCookie(writer, &http.Cookie{Name: "JSESSIONID", Value: server.token, Path: "/"})
+		server.mutex.Unlock()
+	}
+	http.Redirect(writer, request, "/us/en/top.html", http.StatusFound)
+}
+
+// Ends the session the request carries, sending the user to the top page like signing in does
+func (server *Daisuki) serveLogout(writer http.ResponseWriter, request *http.Request) {
+	if server.loggedIn(request) {
+		server.mutex.Lock()
+		server.token = ""
+		server.mutex.Unlock()
+	}
+	http.Redirect(writer, request, "/us/en/top.html", http.StatusFound)
+}
+
+// Shows the account nickname once logged in
+func (server *Daisuki) serveAccount(writer http.ResponseWriter, request *http.Request) {
+	if !server.loggedIn(request) {
+		http.Redirect(writer, request, "/us/en/top.html", http.StatusFound)
+		return
+	}
+	writer.Write([]byte("<html><body><div id=\"Nickname\" class=\"clearFix accountInformation\">" +
+		"<div class=\"list02\">" + html.EscapeString(server.Nickname) + "</div></div></body></html>"))
+}
+
+// Lists every episode of a show, their watch pages are only given away by the thumbnail urls
+func (server *Daisuki) serveShow(writer http.ResponseWriter, request *http.Request, id string) {
+	show, ok := findShow(server.Shows, id)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	body := "<html><body><h1 id=\"animeTitle\">" + html.EscapeString(show.Title) + "</h1>" +
+		"<div id=\"moviesBlock\"><div id=\"contentList0\" class=\"contentList clearFix liquid\">"
+	for _, episode := range server.episodes(show) {
+		body += "<div class=\"item\"><img delay=\"" + siteURL(request) + "/img/thumb/anime/" + show.ID + "/" + strconv.Itoa(episode.ID) + "/m.jpg\"/>" +
+			"<p class=\"episodeNumber\">" + strconv.Itoa(episode.Number) + "</p></div>"
+	}
+	writer.Write([]byte(body + "</div></div></body></html>"))
+}
+
+// Serves an episodes watch page with the flashvars the player starts from, sending
+// anyone logged out back to the top page as episodes are members only
+func (server *Daisuki) serveWatch(writer http.ResponseWriter, request *http.Request, ids string) {
+	if !server.loggedIn(request) {
+		http.Redirect(writer, request, "/us/en/top.html", http.StatusFound)
+		return
+	}
+	parts := strings.Split(ids, ".")
+	if len(parts) != 2 {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Write([]byte("<html><body><div id=\"movieFlash\"><script type=\"text/javascript\">\n" +
+		"var flashvars = {'s':'" + newToken() + "','country':'/fastAPI/country/code/','init':'/fastAPI/bgn/init/'," +
+		"'mv_id':'" + parts[1] + "','device_cd':'1'};\n</script></div></body></html>"))
+}
+
+// Decrypts the players request with our private key and answers with the episodes encrypted metadata
+func (server *Daisuki) serveInit(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	encryptedKey, err := base64.StdEncoding.DecodeString(query.Get("a"))
+	if err != nil {
+		http.Error(writer, "bad key", http.StatusBadRequest)
+		return
+	}
+	key, err := rsa.DecryptPKCS1v15(rand.Reader, server.key, encryptedKey)
+	if err != nil {
+		http.Error(writer, "bad key", http.StatusBadRequest)
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		http.Error(writer, "bad key", http.StatusBadRequest)
+		return
+	}
+
+	// Reads which episode is wanted out of the encrypted api data
+	data, err := base64.StdEncoding.DecodeString(query.Get("d"))
+	if err != nil || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		http.Error(writer, "bad data", http.StatusBadRequest)
+		return
+	}
+	iv := make([]byte, aes.BlockSize)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	api := daisuki.ApiData{}
+	if err := json.Unmarshal(bytes.TrimRight(data, "\x00"), &api); err != nil {
+		http.Error(writer, "bad data", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.Atoi(api.MV_ID)
+	episode, ok := findEpisode(server.Shows, id)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+
+	// Encrypts the metadata with the players key, zero padded like the real thing
+	metadata, _ := json.Marshal(map[string]string{
+		"play_url":    siteURL(request) + "/hds/" + api.MV_ID + "/manifest.f4m?hdnea=" + newToken(),
+		"caption_url": siteURL(request) + "/caption/" + api.MV_ID + ".xml",
+		"title_str":   strconv.Itoa(episode.Number) + " " + episode.Title,
+	})
+	if len(metadata)%aes.BlockSize != 0 {
+		metadata = append(metadata, make([]byte, aes.BlockSize-len(metadata)%aes.BlockSize)...)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(metadata, metadata)
+	response, _ := json.Marshal(daisuki.InitResponse{Rcd: "01", Rtn: base64.StdEncoding.EncodeToString(metadata)})
+	writer.Header().Set("content-type", "application/json")
+	writer.Write(response)
+}
+
+// Serves an episodes subtitles as TTML
+func (server *Daisuki) serveCaptions(writer http.ResponseWriter, request *http.Request, id string) {
+	episodeID, _ := strconv.Atoi(id)
+	episode, ok := findEpisode(server.Shows, episodeID)
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+	body := "<?xml version=\"1.0\" encoding=\"UTF-8\"?><tt xmlns=\"http://www.w3.org/ns/ttml\"><head><styling>" +
+		"<style id=\"1\" textOutline=\"black 1px\" color=\"white\"/></styling></head><body><div xml:lang=\"english\">"
+	for _, line := range episode.Subtitles {
+		text := new(bytes.Buffer)
+		xml.EscapeText(text, []byte(line.Text))
+		body += "<p begin=\"" + line.Start + "\" end=\"" + line.End + "\" style=\"1\">" + text.String() + "</p>"
+	}
+	writer.Header().Set("content-type", "text/xml")
+	writer.Write([]byte(body + "</div></body></tt>"))
+}
+
+// Serves an episodes HDS manifest and the fragments it refers to
+func (server *Daisuki) serveHDS(writer http.ResponseWriter, request *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 2)
+	id, _ := strconv.Atoi(parts[0])
+	if _, ok := findEpisode(server.Shows, id); !ok || len(parts) != 2 {
+		http.NotFound(writer, request)
+		return
+	}
+	if parts[1] == "manifest.f4m" {
+		writer.Header().Set("content-type", "application/f4m+xml")
+		writer.Write(hdsManifest(server.Fragments))
+		return
+	}
+	fragment, err := strconv.Atoi(strings.TrimPrefix(parts[1], "media_Seg1-Frag"))
+	if err != nil || fragment < 1 || fragment > server.Fragments {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("content-type", "video/f4f")
+	writer.Write(hdsFragment(fragment))
+}
+
+// Checks whether the request carries the current session, expiring the token logs everyone out
+func (server *Daisuki) loggedIn(request *http.Request) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return hasSession(request, "JSESSIONID", server.token)
+}
+
+// Gets every episode of a show across its seasons
+func (server *Daisuki) episodes(show Show) []Episode {
+	episodes := []Episode{}
+	for _, season := range show.Seasons {
+		episodes = append(episodes, season.Episodes...)
+	}
+	return episodes
+}
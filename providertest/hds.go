@@ -0,0 +1,95 @@
+package providertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+)
+
+// How long each HDS fragment lasts in milliseconds
+const fragmentDuration = 2000
+
+// Builds an f4m manifest for a single rendition with its bootstrap info inline
+func hdsManifest(fragments int) []byte {
+	return []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>" +
+		"<manifest xmlns=\"http://ns.adobe.com/f4m/1.0\"><id>episode</id><streamType>recorded</streamType>" +
+		"<duration>" + strconv.Itoa(fragments*fragmentDuration/1000) + "</duration>" +
+		"<bootstrapInfo profile=\"named\" id=\"bootstrap0\">" + base64.StdEncoding.EncodeToString(hdsBootstrap(fragments)) + "</bootstrapInfo>" +
+		"<media url=\"media_\" bitrate=\"1500\" width=\"1280\" height=\"720\" bootstrapInfoId=\"bootstrap0\"></media>" +
+		"</manifest>")
+}
+
+// Builds an abst box listing fragments one up to fragments, all within segment one
+func hdsBootstrap(fragments int) []byte {
+	abst := new(bytes.Buffer)
+	abst.Write([]byte{0, 0, 0, 0})                                           // Version and flags
+	binary.Write(abst, binary.BigEndian, uint32(1))                          // Bootstrap info version
+	abst.WriteByte(0)                                                        // Profile, live and update flags
+	binary.Write(abst, binary.BigEndian, uint32(1000))                       // Timescale
+	binary.Write(abst, binary.BigEndian, uint64(fragments*fragmentDuration)) // Current media time
+	binary.Write(abst, binary.BigEndian, uint64(0))                          // Smpte time code offset
+	abst.Write([]byte{0, 0, 0, 0, 0})                                        // Movie identifier, servers, qualities, drm and metadata
+
+	// A single segment holding every fragment
+	asrt := new(bytes.Buffer)
+	asrt.Write([]byte{0, 0, 0, 0, 0})
+	binary.Write(asrt, binary.BigEndian, uint32(1))
+	binary.Write(asrt, binary.BigEndian, uint32(1))
+	binary.Write(asrt, binary.BigEndian, uint32(fragments))
+	abst.WriteByte(1)
+	abst.Write(box("asrt", asrt.Bytes()))
+
+	// A single run of evenly sized fragments
+	afrt := new(bytes.Buffer)
+	afrt.Write([]byte{0, 0, 0, 0})
+	binary.Write(afrt, binary.BigEndian, uint32(1000))
+	afrt.WriteByte(0)
+	binary.Write(afrt, binary.BigEndian, uint32(1))
+	binary.Write(afrt, binary.BigEndian, uint32(1))
+	binary.Write(afrt, binary.BigEndian, uint64(0))
+	binary.Write(afrt, binary.BigEndian, uint32(fragmentDuration))
+	abst.WriteByte(1)
+	abst.Write(box("afrt", afrt.Bytes()))
+	return box("abst", abst.Bytes())
+}
+
+// Builds a fragment whose mdat box carries a few seconds of FLV tags
+func hdsFragment(fragment int) []byte {
+	return append(box("afra", make([]byte, 9)), box("mdat", fragmentTags(fragment))...)
+}
+
+// Builds a few seconds of back to back FLV tags for the passed fragment. Every
+// fragment repeats the codec configuration as real streams do
+func fragmentTags(fragment int) []byte {
+	tags := new(bytes.Buffer)
+	start := uint32((fragment - 1) * fragmentDuration)
+	writeTag(tags, 0x09, start, []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64, 0x00, 0x1f})
+	writeTag(tags, 0x08, start, []byte{0xaf, 0x00, 0x12, 0x10})
+	for offset := uint32(0); offset < fragmentDuration; offset += 200 {
+		frameType := byte(0x27)
+		if offset == 0 {
+			frameType = 0x17
+		}
+		writeTag(tags, 0x09, start+offset, []byte{frameType, 0x01, 0, 0, 0, byte(fragment), byte(offset / 200)})
+		writeTag(tags, 0x08, start+offset, []byte{0xaf, 0x01, byte(fragment), byte(offset / 200)})
+	}
+	return tags.Bytes()
+}
+
+// Writes a single FLV tag followed by its previous tag size
+func writeTag(buffer *bytes.Buffer, tagType byte, timestamp uint32, payload []byte) {
+	size := len(payload)
+	buffer.Write([]byte{tagType, byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24), 0, 0, 0})
+	buffer.Write(payload)
+	binary.Write(buffer, binary.BigEndian, uint32(11+size))
+}
+
+// Wraps content in a box of the passed type
+func box(boxType string, content []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(8+len(content)))
+	copy(header[4:], boxType)
+	return append(header, content...)
+}
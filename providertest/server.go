@@ -0,0 +1,139 @@
+// Package providertest serves local stand-ins for the Crunchyroll and Daisuki
+// sites so the whole download pipeline can be exercised without the network.
+// Each fake provider runs its own server and is swapped in for the real site
+// with Use. Crunchyroll episodes are streamed from an rtmptest.Server started
+// alongside its web server, Daisuki episodes over HDS from the web server itself
+package providertest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Sends every request on to a fake provider whatever host it was for, leaving the
+// original host in the Host header so the pages served link back to the real site
+type routingTransport struct {
+	target    *url.URL
+	transport http.RoundTripper
+}
+
+// A show served by one of the fake providers
+type Show struct {
+	ID      string // The shows slug on Crunchyroll or its ad id on Daisuki
+	Title   string
+	Seasons []Season
+}
+
+type Season struct {
+	Title    string
+	Episodes []Episode
+}
+
+type Episode struct {
+	ID           int // Crunchyroll requires ids of exactly six digits
+	Number       int
+	Title        string
+	RegionLocked bool // Crunchyroll refuses to hand out the stream when set
+	Subtitles    []Line
+}
+
+// A single line of an episodes english subtitles
+type Line struct {
+	Start string // Formatted as 00:00:01.00
+	End   string
+	Text  string
+}
+
+// Creates a transport sending every request to the server at serverURL
+func newRoutingTransport(serverURL string) http.RoundTripper {
+	target, _ := url.Parse(serverURL)
+	return &routingTransport{target: target, transport: http.DefaultTransport}
+}
+
+func (routing *routingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	routed := request.Clone(request.Context())
+	routed.URL.Scheme, routed.URL.Host = routing.target.Scheme, routing.target.Host
+	routed.Host = request.URL.Host
+	return routing.transport.RoundTrip(routed)
+}
+
+// Gets the url of the site the request was made to, which is the real sites
+// when the request was routed here by Transport
+func siteURL(request *http.Request) string {
+	return "http://" + request.Host
+}
+
+// Creates the shows every fake provider starts out with
+func defaultShows() []Show {
+	return []Show{{
+		ID:    "test-show",
+		Title: "Test Show",
+		Seasons: []Season{{
+			Title: "Test Show",
+			Episodes: []Episode{
+				{ID: 600001, Number: 1, Title: "The Beginning", Subtitles: defaultLines()},
+				{ID: 600002, Number: 2, Title: "The Middle", Subtitles: defaultLines()},
+			},
+		}, {
+			Title: "Test Show Season 2",
+			Episodes: []Episode{
+				{ID: 600003, Number: 1, Title: "The Return", Subtitles: defaultLines()},
+				{ID: 600004, Number: 2, Title: "The End", RegionLocked: true, Subtitles: defaultLines()},
+			},
+		}},
+	}}
+}
+
+// Creates a couple of subtitle lines for an episode
+func defaultLines() []Line {
+	return []Line{
+		{Start: "00:00:01.00", End: "00:00:03.50", Text: "Where am I?"},
+		{Start: "00:00:04.00", End: "00:00:06.00", Text: "Somewhere safe for now."},
+	}
+}
+
+// Finds the show with the passed id
+func findShow(shows []Show, id string) (Show, bool) {
+	for _, show := range shows {
+		if show.ID == id {
+			return show, true
+		}
+	}
+	return Show{}, false
+}
+
+// Finds the episode with the passed id in any show
+func findEpisode(shows []Show, id int) (Episode, bool) {
+	for _, show := range shows {
+		for _, season := range show.Seasons {
+			for _, episode := range season.Episodes {
+				if episode.ID == id {
+					return episode, true
+				}
+			}
+		}
+	}
+	return Episode{}, false
+}
+
+// Turns a title into the lower case dashed form used in urls
+func slugify(title string) string {
+	return strings.Trim(regexp.MustCompile("[^a-z0-9]+").ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+// Generates a random token to hand out as a session cookie
+func newToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// Checks whether the request carries the session cookie the login handed out
+func hasSession(request *http.Request, cookieName, token string) bool {
+	cookie, err := request.Cookie(cookieName)
+	return err == nil && token != "" && cookie.Value == token
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+const (
+	// How often a worker marks the job it's running as still alive and checks whether it was canceled
+	queueHeartbeat = 5 * time.Second
+
+	// How long a running job can go without a heartbeat before it's taken to be left behind by a crash
+	queueAbandoned = time.Minute
+
+	// How many times a job is started before one left behind again is marked failed instead of requeued
+	queueMaxAttempts = 3
+
+	// How often an idle worker looks for jobs other processes have queued
+	queuePoll = 5 * time.Second
+)
+
+// The statuses a job moves through
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// A show or episode url queued to be ripped by serve or anirip queue run
+type job struct {
+	ID                string     `json:"id"`
+	URL               string     `json:"url"`
+	Options           ripOptions `json:"options"`
+	Subscription      bool       `json:"subscription,omitempty"` // Checks the shows subscription, only ripping what it hasn't got
+	Priority          int        `json:"priority"`               // Higher priorities run first, oldest first among equals
+	Status            string     `json:"status"`
+	Attempts          int        `json:"attempts"`        // How many times the job has been started
+	Error             string     `json:"error,omitempty"` // Why the last attempt failed
+	Owner             string     `json:"owner,omitempty"` // The host and pid of the process running the job
+	Heartbeat         *time.Time `json:"heartbeat,omitempty"`
+	Cancel            bool       `json:"cancel,omitempty"` // Asks whichever process is running the job to stop
+	Created           time.Time  `json:"created"`
+	Started           *time.Time `json:"started,omitempty"`
+	Finished          *time.Time `json:"finished,omitempty"`
+	Downloaded        int        `json:"downloaded"`
+	AlreadyDownloaded int        `json:"already_downloaded"`
+	Failed            int        `json:"failed"`
+
+	// Only known by the process running the job, so they're never stored
+	Episode string   `json:"episode,omitempty"` // The file name of the episode being ripped
+	Stage   string   `json:"stage,omitempty"`
+	Percent *float64 `json:"percent,omitempty"` // How far through its stage the episode is
+}
+
+// What's kept in the queue file
+type queueState struct {
+	NextID int    `json:"next_id"`
+	Jobs   []*job `json:"jobs"`
+}
+
+// The jobs waiting to be ripped, kept in a file in the users config directory so they survive
+// a crash and can be shared by several processes. Every change is made holding a lock file and
+// written atomically, so two processes can never claim the same job. Events about the job this
+// process is running update it and go out to every event stream client
+type jobQueue struct {
+	mutex    sync.Mutex
+	fileName string
+	owner    string
+	running  *job // The job this process is ripping, along with how far it's got
+	stopping bool // Whether the running job has been canceled
+	wake     chan struct{}
+	clients  map[chan event]bool
+}
+
+// Gets the file the job queue is kept in
+func queueFile() string {
+	return filepath.Join(anirip.ConfigDir(), "queue.json")
+}
+
+// Opens the queue kept in fileName, which is created once the first job is added
+func newJobQueue(fileName string) *jobQueue {
+	host, _ := os.Hostname()
+	return &jobQueue{
+		fileName: fileName,
+		owner:    host + ":" + strconv.Itoa(os.Getpid()),
+		wake:     make(chan struct{}, 1),
+		clients:  map[chan event]bool{},
+	}
+}
+
+// Reads the queue file, which is only ever replaced whole so it can be read without the lock
+func (queue *jobQueue) load() (*queueState, error) {
+	state := &queueState{Jobs: []*job{}}
+	data, err := ioutil.ReadFile(queue.fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the job queue", Err: err}
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, anirip.Error{Message: "There was an error parsing the job queue", Err: err}
+	}
+	return state, nil
+}
+
+// Writes the queue back to its file, the caller must hold the lock
+func (queue *jobQueue) save(state *queueState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return anirip.Error{Message: "There was an error encoding the job queue", Err: err}
+	}
+	return writeFileAtomic(queue.fileName, data)
+}
+
+// Runs change on the queue holding its lock, writing it back unless change fails
+func (queue *jobQueue) update(change func(*queueState) error) error {
+	unlock, err := lockFile(queue.fileName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := queue.load()
+	if err != nil {
+		return err
+	}
+	if err := change(state); err != nil {
+		return err
+	}
+	return queue.save(state)
+}
+
+// Finds a job by its id
+func (state *queueState) find(id string) *job {
+	for _, queued := range state.Jobs {
+		if queued.ID == id {
+			return queued
+		}
+	}
+	return nil
+}
+
+// Requeues running jobs that haven't had a heartbeat in queueAbandoned, as whatever ran them has gone.
+// One that has been started queueMaxAttempts times is marked failed, in case it's what takes anirip down
+func (state *queueState) requeueAbandoned(now time.Time) {
+	for _, queued := range state.Jobs {
+		if queued.Status != jobRunning || (queued.Heartbeat != nil && now.Sub(*queued.Heartbeat) < queueAbandoned) {
+			continue
+		}
+		queued.Owner, queued.Heartbeat = "", nil
+		switch {
+		case queued.Cancel:
+			queued.Status, queued.Finished = jobCanceled, &now
+		case queued.Attempts >= queueMaxAttempts:
+			queued.Status, queued.Finished = jobFailed, &now
+			queued.Error = "The job was left unfinished " + strconv.Itoa(queued.Attempts) + " times"
+		default:
+			queued.Status = jobQueued
+		}
+	}
+}
+
+// Gets the error for a job id that isn't in the queue
+func noJob(id string) error {
+	return anirip.Error{Message: "There's no job " + id}
+}
+
+// Queues a url to be ripped, returning a copy of the new job. A subscription that's already
+// waiting or running isn't queued again, its job is returned instead
+func (queue *jobQueue) add(url string, options ripOptions, subscription bool, priority int) (job, error) {
+	added, isNew := job{}, false
+	err := queue.update(func(state *queueState) error {
+		if subscription {
+			for _, queued := range state.Jobs {
+				if queued.Subscription && queued.URL == url && (queued.Status == jobQueued || queued.Status == jobRunning) {
+					added = *queued
+					return nil
+				}
+			}
+		}
+		state.NextID++
+		added = job{
+			ID:           strconv.Itoa(state.NextID),
+			URL:          url,
+			Options:      options,
+			Subscription: subscription,
+			Priority:     priority,
+			Status:       jobQueued,
+			Created:      time.Now(),
+		}
+		copied := added
+		state.Jobs = append(state.Jobs, &copied)
+		isNew = true
+		return nil
+	})
+	if err != nil || !isNew {
+		return added, err
+	}
+	events.jobChanged(added.ID, added.Status, added.URL)
+	queue.signal()
+	return added, nil
+}
+
+// Wakes the worker if it's waiting for a job
+func (queue *jobQueue) signal() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Gets a copy of every job, oldest first, with how far this process has got with the one it's running
+func (queue *jobQueue) list() ([]job, error) {
+	state, err := queue.load()
+	if err != nil {
+		return nil, err
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	jobs := []job{}
+	for _, queued := range state.Jobs {
+		if running := queue.running; running != nil && running.ID == queued.ID && queued.Owner == queue.owner {
+			queued.Downloaded, queued.AlreadyDownloaded, queued.Failed = running.Downloaded, running.AlreadyDownloaded, running.Failed
+			queued.Episode, queued.Stage, queued.Percent = running.Episode, running.Stage, running.Percent
+		}
+		jobs = append(jobs, *queued)
+	}
+	return jobs, nil
+}
+
+// Gets a copy of a job by its id, with an empty id when there's no such job
+func (queue *jobQueue) get(id string) (job, error) {
+	jobs, err := queue.list()
+	if err != nil {
+		return job{}, err
+	}
+	for _, queued := range jobs {
+		if queued.ID == id {
+			return queued, nil
+		}
+	}
+	return job{}, noJob(id)
+}
+
+// Cancels a job, straight away if it's waiting and as soon as whichever process is running it notices if it's running
+func (queue *jobQueue) cancel(id string) (job, error) {
+	found := job{}
+	err := queue.update(func(state *queueState) error {
+		stored := state.find(id)
+		if stored == nil {
+			return noJob(id)
+		}
+		found = *stored
+		switch stored.Status {
+		case jobQueued:
+			now := time.Now()
+			stored.Status, stored.Finished = jobCanceled, &now
+		case jobRunning:
+			stored.Cancel = true
+		default:
+			return anirip.Error{Message: "Job " + id + " has already finished"}
+		}
+		found = *stored
+		return nil
+	})
+	if err != nil {
+		return found, err
+	}
+	if found.Status == jobCanceled {
+		events.jobChanged(found.ID, jobCanceled, "")
+	}
+
+	// The heartbeat would notice, but there's no need to wait for it when the job is ours
+	queue.mutex.Lock()
+	if queue.running != nil && queue.running.ID == id && found.Owner == queue.owner {
+		queue.stopping = true
+	}
+	queue.mutex.Unlock()
+	return found, nil
+}
+
+// Queues a job that failed or was canceled to run again, starting its attempts over
+func (queue *jobQueue) retry(id string) (job, error) {
+	found := job{}
+	err := queue.update(func(state *queueState) error {
+		stored := state.find(id)
+		if stored == nil {
+			return noJob(id)
+		}
+		found = *stored
+		if stored.Status != jobFailed && stored.Status != jobCanceled {
+			return anirip.Error{Message: "Job " + id + " can only be retried once it has failed or been canceled"}
+		}
+		*stored = job{
+			ID:           stored.ID,
+			URL:          stored.URL,
+			Options:      stored.Options,
+			Subscription: stored.Subscription,
+			Priority:     stored.Priority,
+			Status:       jobQueued,
+			Error:        stored.Error,
+			Created:      stored.Created,
+		}
+		found = *stored
+		return nil
+	})
+	if err != nil {
+		return found, err
+	}
+	events.jobChanged(found.ID, jobQueued, found.URL)
+	queue.signal()
+	return found, nil
+}
+
+// Removes a job that isn't running along with anything it left in the temp directory
+func (queue *jobQueue) remove(id string) (job, error) {
+	found := job{}
+	err := queue.update(func(state *queueState) error {
+		for i, stored := range state.Jobs {
+			if stored.ID != id {
+				continue
+			}
+			found = *stored
+			if stored.Status == jobRunning {
+				return anirip.Error{Message: "Job " + id + " is running, cancel it first"}
+			}
+			state.Jobs = append(state.Jobs[:i], state.Jobs[i+1:]...)
+			return nil
+		}
+		return noJob(id)
+	})
+	if err != nil {
+		return found, err
+	}
+	os.RemoveAll(jobTempDir(id))
+	return found, nil
+}
+
+// Claims the queued job with the highest priority for this process, after requeuing any
+// left behind by a crash. Returns false when there's nothing to run
+func (queue *jobQueue) claim() (job, bool, error) {
+	claimed := job{}
+	found := false
+	err := queue.update(func(state *queueState) error {
+		now := time.Now()
+		state.requeueAbandoned(now)
+		waiting := []*job{}
+		for _, queued := range state.Jobs {
+			if queued.Status == jobQueued {
+				waiting = append(waiting, queued)
+			}
+		}
+		if len(waiting) == 0 {
+			return nil
+		}
+		sort.SliceStable(waiting, func(i, j int) bool {
+			return waiting[i].Priority > waiting[j].Priority
+		})
+		next := waiting[0]
+		next.Status, next.Owner, next.Started, next.Heartbeat = jobRunning, queue.owner, &now, &now
+		next.Attempts++
+		next.Cancel, next.Finished = false, nil
+		next.Downloaded, next.AlreadyDownloaded, next.Failed = 0, 0, 0
+		claimed, found = *next, true
+		return nil
+	})
+	if err != nil || !found {
+		return job{}, false, err
+	}
+	queue.mutex.Lock()
+	copied := claimed
+	queue.running, queue.stopping = &copied, false
+	queue.mutex.Unlock()
+	return claimed, true, nil
+}
+
+// Waits for a job this process can run, checking every queuePoll for ones other processes queued.
+// Returns false once the queue is empty when untilEmpty is set
+func (queue *jobQueue) next(untilEmpty bool) (job, bool) {
+	for {
+		claimed, found, err := queue.claim()
+		if err != nil {
+			logger.Failure(err)
+		}
+		if found {
+			return claimed, true
+		}
+		if untilEmpty && err == nil {
+			return job{}, false
+		}
+		select {
+		case <-queue.wake:
+		case <-time.After(queuePoll):
+		}
+	}
+}
+
+// Marks the running job alive every queueHeartbeat until stop is closed, canceling it when
+// it's been canceled by another process or taken back from us
+func (queue *jobQueue) beat(id string, stop chan struct{}) {
+	ticker := time.NewTicker(queueHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		lost := false
+		err := queue.update(func(state *queueState) error {
+			stored := state.find(id)
+			if stored == nil || stored.Status != jobRunning || stored.Owner != queue.owner {
+				lost = true
+				return nil
+			}
+			now := time.Now()
+			stored.Heartbeat = &now
+			lost = stored.Cancel
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Unable to update the job queue : " + err.Error())
+			continue
+		}
+		if lost {
+			queue.mutex.Lock()
+			queue.stopping = true
+			queue.mutex.Unlock()
+		}
+	}
+}
+
+// Marks the running job finished with how its rip went, returning the status it ended up with
+func (queue *jobQueue) finish(err error) (string, string) {
+	queue.mutex.Lock()
+	finished := *queue.running
+	stopping := queue.stopping
+	queue.running, queue.stopping = nil, false
+	queue.mutex.Unlock()
+
+	status, message := jobDone, ""
+	switch {
+	case stopping:
+		status = jobCanceled
+	case err != nil:
+		status, message = jobFailed, err.Error()
+	case finished.Failed > 0:
+		status, message = jobFailed, strconv.Itoa(finished.Failed)+" episodes failed"
+	}
+	saveErr := queue.update(func(state *queueState) error {
+		stored := state.find(finished.ID)
+		if stored == nil || stored.Owner != queue.owner {
+			return nil
+		}
+		now := time.Now()
+		stored.Status, stored.Finished, stored.Owner, stored.Heartbeat = status, &now, "", nil
+		stored.Downloaded, stored.AlreadyDownloaded, stored.Failed = finished.Downloaded, finished.AlreadyDownloaded, finished.Failed
+		if message != "" {
+			stored.Error = message
+		}
+		return nil
+	})
+	if saveErr != nil {
+		logger.Failure(saveErr)
+	}
+
+	// Partial downloads are kept for a retry to pick up from
+	if status == jobDone {
+		os.RemoveAll(jobTempDir(finished.ID))
+	}
+	return status, message
+}
+
+// Checks whether the running job has been canceled, set as anirip.Canceled
+func (queue *jobQueue) canceled() bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.running != nil && queue.stopping
+}
+
+// Takes every event written, keeping the running job up to date and passing it on to the event stream clients
+func (queue *jobQueue) onEvent(e event) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if running := queue.running; running != nil && e.Job == running.ID {
+		switch e.Event {
+		case "episode_started":
+			running.Episode, running.Stage, running.Percent = e.FileName, "", nil
+		case "stage":
+			running.Episode, running.Stage, running.Percent = e.FileName, e.Stage, nil
+		case "progress":
+			running.Percent = e.Percent
+		case "episode_done":
+			if e.Skipped {
+				running.AlreadyDownloaded++
+			} else {
+				running.Downloaded++
+			}
+			running.Episode, running.Stage, running.Percent = "", "", nil
+		case "episode_failed":
+			if e.ErrorKind != "canceled" {
+				running.Failed++
+			}
+			running.Episode, running.Stage, running.Percent = "", "", nil
+		}
+	}
+	for client := range queue.clients {
+		select {
+		case client <- e:
+		default:
+		}
+	}
+}
+
+// Adds an event stream client, which must be removed with unlisten once it's gone
+func (queue *jobQueue) listen() chan event {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	client := make(chan event, serveEventBuffer)
+	queue.clients[client] = true
+	return client
+}
+
+// Removes an event stream client
+func (queue *jobQueue) unlisten(client chan event) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.clients, client)
+}
+
+// Gets the temp directory a job is put together in, kept between attempts so downloads pick up where they stopped
+func jobTempDir(id string) string {
+	return filepath.Join(tempDir, "job-"+id)
+}
+
+// Rips queued jobs one after another, forever unless untilEmpty is set, returning how many failed
+func (queue *jobQueue) work(rip *ripper, store *subscriptionStore, untilEmpty bool) int {
+	failed := 0
+	for {
+		running, ok := queue.next(untilEmpty)
+		if !ok {
+			return failed
+		}
+		events.jobStarted(running.ID)
+		events.jobChanged(running.ID, jobRunning, running.URL)
+		logger.Info("Starting job " + running.ID + " for " + running.URL + " (attempt " + strconv.Itoa(running.Attempts) + ")")
+		stop := make(chan struct{})
+		go queue.beat(running.ID, stop)
+
+		// Each job gets its own temp directory so processes sharing the queue don't get in each others way
+		jobRip := *rip
+		jobRip.tempDir = jobTempDir(running.ID)
+		err := os.MkdirAll(jobRip.tempDir, 0777)
+		if err == nil {
+			err = queue.run(&jobRip, store, running)
+		}
+		close(stop)
+		if err != nil && !anirip.IsCanceled(err) {
+			logger.Failure(err)
+		}
+		jobRip.reportRegions()
+		events.summary(err)
+		events.jobStarted("")
+		status, message := queue.finish(err)
+		if status == jobFailed {
+			failed++
+		}
+		events.jobChanged(running.ID, status, message)
+		logger.Info("Job " + running.ID + " " + status)
+	}
+}
+
+// Rips a single job, stopping before the next episode once it's canceled
+func (queue *jobQueue) run(rip *ripper, store *subscriptionStore, running job) error {
+	if running.Subscription {
+		if err := store.reload(); err != nil {
+			return err
+		}
+		for _, sub := range store.list() {
+			if sub.URL == running.URL {
+				return watchSubscription(rip, store, sub)
+			}
+		}
+		return anirip.Error{Message: "There's no longer a subscription to " + running.URL}
+	}
+	return rip.ripShow(running.URL, running.Options, func(anirip.Season, anirip.Episode) bool {
+		return anirip.CheckCanceled() != nil
+	}, nil)
+}
+
+// Queues a job for every subscription that's due and hasn't got one yet, checking again every minWatchSleep
+func (queue *jobQueue) schedule(store *subscriptionStore, interval time.Duration) {
+	for {
+		if err := store.reload(); err != nil {
+			logger.Failure(err)
+		}
+		due, _ := store.due(interval, time.Now())
+		for _, sub := range due {
+			if _, err := queue.add(sub.URL, sub.Options, true, 0); err != nil {
+				logger.Failure(err)
+			}
+		}
+		time.Sleep(minWatchSleep)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJobQueueClaimOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int    // Of the jobs in the order they're added
+		claimed    []string // The ids of the jobs in the order they're claimed
+	}{
+		{name: "oldest first", priorities: []int{0, 0, 0}, claimed: []string{"1", "2", "3"}},
+		{name: "highest first", priorities: []int{0, 5, 10}, claimed: []string{"3", "2", "1"}},
+		{name: "oldest first among equals", priorities: []int{1, 5, 1, 5}, claimed: []string{"2", "4", "1", "3"}},
+		{name: "negative after default", priorities: []int{-1, 0}, claimed: []string{"2", "1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := newJobQueue(filepath.Join(t.TempDir(), "queue.json"))
+			for _, priority := range test.priorities {
+				if _, err := queue.add("http://example.com/show", ripOptions{}, false, priority); err != nil {
+					t.Fatal(err)
+				}
+			}
+			claimed := []string{}
+			for {
+				next, found, err := queue.claim()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !found {
+					break
+				}
+				claimed = append(claimed, next.ID)
+				queue.finish(nil)
+			}
+			if len(claimed) != len(test.claimed) {
+				t.Fatalf("claimed %v, expected %v", claimed, test.claimed)
+			}
+			for i := range claimed {
+				if claimed[i] != test.claimed[i] {
+					t.Fatalf("claimed %v, expected %v", claimed, test.claimed)
+				}
+			}
+		})
+	}
+}
+
+func TestJobQueueAdd(t *testing.T) {
+	queue := newJobQueue(filepath.Join(t.TempDir(), "queue.json"))
+	tests := []struct {
+		url          string
+		options      ripOptions
+		subscription bool
+		id           string // The id of the job given back
+	}{
+		{url: "http://example.com/show", id: "1"},
+		{url: "http://example.com/show", options: ripOptions{Force: true}, id: "2"}, // Only subscriptions are kept to one job
+		{url: "http://example.com/show", subscription: true, id: "3"},
+		{url: "http://example.com/show", subscription: true, id: "3"},
+		{url: "http://example.com/other", subscription: true, id: "4"},
+	}
+	for _, test := range tests {
+		added, err := queue.add(test.url, test.options, test.subscription, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added.ID != test.id {
+			t.Errorf("queued %s as job %s, expected %s", test.url, added.ID, test.id)
+		}
+	}
+
+	// Forcing is kept with the job for whichever process runs it
+	forced, err := queue.get("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forced.Options.Force {
+		t.Error("job 2 lost --force")
+	}
+	if plain, _ := queue.get("1"); plain.Options.Force {
+		t.Error("job 1 was given --force")
+	}
+
+	// Once the subscriptions job has finished another can be queued for it
+	for {
+		_, found, err := queue.claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			break
+		}
+		queue.finish(nil)
+	}
+	if added, err := queue.add("http://example.com/show", ripOptions{}, true, 0); err != nil || added.ID != "5" {
+		t.Errorf("queued job %s once the last had finished: %v", added.ID, err)
+	}
+}
+
+func TestRequeueAbandoned(t *testing.T) {
+	now := time.Now()
+	recent, stale := now.Add(-queueHeartbeat), now.Add(-queueAbandoned-time.Second)
+	tests := []struct {
+		name   string
+		job    job
+		status string
+	}{
+		{name: "alive", job: job{Status: jobRunning, Attempts: 1, Heartbeat: &recent}, status: jobRunning},
+		{name: "abandoned", job: job{Status: jobRunning, Attempts: 1, Heartbeat: &stale}, status: jobQueued},
+		{name: "never beat", job: job{Status: jobRunning, Attempts: 1}, status: jobQueued},
+		{name: "abandoned too often", job: job{Status: jobRunning, Attempts: queueMaxAttempts, Heartbeat: &stale}, status: jobFailed},
+		{name: "alive after many attempts", job: job{Status: jobRunning, Attempts: queueMaxAttempts, Heartbeat: &recent}, status: jobRunning},
+		{name: "abandoned once canceled", job: job{Status: jobRunning, Attempts: 1, Heartbeat: &stale, Cancel: true}, status: jobCanceled},
+		{name: "queued", job: job{Status: jobQueued}, status: jobQueued},
+		{name: "done", job: job{Status: jobDone, Attempts: queueMaxAttempts}, status: jobDone},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queued := test.job
+			queued.Owner = "elsewhere:1"
+			state := &queueState{Jobs: []*job{&queued}}
+			state.requeueAbandoned(now)
+			if queued.Status != test.status {
+				t.Fatalf("became %s, expected %s", queued.Status, test.status)
+			}
+			if test.job.Status == jobRunning && queued.Status != jobRunning {
+				if queued.Owner != "" || queued.Heartbeat != nil {
+					t.Errorf("kept owner %q and heartbeat %v", queued.Owner, queued.Heartbeat)
+				}
+				if (queued.Status == jobQueued) == (queued.Finished != nil) {
+					t.Errorf("finished %v as %s", queued.Finished, queued.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestJobQueueRequeuesOnClaim(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "queue.json")
+	crashed := newJobQueue(fileName)
+	crashed.owner = "elsewhere:1"
+	if _, err := crashed.add("http://example.com/show", ripOptions{Force: true}, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := crashed.claim(); err != nil || !found {
+		t.Fatalf("claimed %v: %v", found, err)
+	}
+
+	// Another process picks the job up once its heartbeat has gone stale
+	queue := newJobQueue(fileName)
+	if _, found, err := queue.claim(); err != nil || found {
+		t.Fatalf("claimed a job that's still alive %v: %v", found, err)
+	}
+	err := queue.update(func(state *queueState) error {
+		stale := time.Now().Add(-queueAbandoned - time.Second)
+		state.find("1").Heartbeat = &stale
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, found, err := queue.claim()
+	if err != nil || !found {
+		t.Fatalf("claimed %v: %v", found, err)
+	}
+	if claimed.Owner != queue.owner || claimed.Attempts != 2 || !claimed.Options.Force {
+		t.Errorf("claimed %+v", claimed)
+	}
+}
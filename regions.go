@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// Remembers which country worked for each show in a JSON file in the users config directory,
+// so later runs go straight to its proxy instead of finding out the region lock again
+type regionMemory struct {
+	fileName string
+}
+
+// What's kept in the region memory file, keyed by regionKey
+type regionState struct {
+	Countries map[string]string `json:"countries"`
+}
+
+// Gets the file the region memory is kept in
+func regionsFile() string {
+	return filepath.Join(anirip.ConfigDir(), "regions.json")
+}
+
+// Identifies a show by its provider and title, as shows on different providers can share a title
+func regionKey(provider, show string) string {
+	return provider + ":" + show
+}
+
+// Reads the region memory file, starting empty if no country has been needed yet
+func (memory *regionMemory) load() (*regionState, error) {
+	state := &regionState{Countries: map[string]string{}}
+	data, err := ioutil.ReadFile(memory.fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the region memory", Err: err}
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, anirip.Error{Message: "There was an error parsing the region memory", Err: err}
+	}
+	if state.Countries == nil {
+		state.Countries = map[string]string{}
+	}
+	return state, nil
+}
+
+// Gets the country that last worked for a show, empty if none has been needed
+func (memory *regionMemory) get(provider, show string) (string, error) {
+	state, err := memory.load()
+	if err != nil {
+		return "", err
+	}
+	return state.Countries[regionKey(provider, show)], nil
+}
+
+// Records the country that worked for a show, holding the lock so other processes
+// ripping at the same time don't lose each others countries
+func (memory *regionMemory) set(provider, show, country string) error {
+	unlock, err := lockFile(memory.fileName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	state, err := memory.load()
+	if err != nil {
+		return err
+	}
+	key := regionKey(provider, show)
+	if state.Countries[key] == country {
+		return nil
+	}
+	state.Countries[key] = country
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return anirip.Error{Message: "There was an error encoding the region memory", Err: err}
+	}
+	return writeFileAtomic(memory.fileName, data)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+func TestRegionMemory(t *testing.T) {
+	memory := &regionMemory{fileName: filepath.Join(t.TempDir(), "regions.json")}
+	sets := []struct{ provider, show, country string }{
+		{"crunchyroll", "Test Show", "US"},
+		{"daisuki", "Test Show", "GB"},
+		{"crunchyroll", "Other Show", "FR"},
+		{"crunchyroll", "Test Show", "CA"},
+	}
+	for _, set := range sets {
+		if err := memory.set(set.provider, set.show, set.country); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fresh memory reads what the first wrote, as another process would
+	memory = &regionMemory{fileName: memory.fileName}
+	tests := []struct{ provider, show, want string }{
+		{"crunchyroll", "Test Show", "CA"},
+		{"daisuki", "Test Show", "GB"},
+		{"crunchyroll", "Other Show", "FR"},
+		{"daisuki", "Other Show", ""},
+	}
+	for _, test := range tests {
+		country, err := memory.get(test.provider, test.show)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if country != test.want {
+			t.Errorf("got %q for %s on %s, expected %q", country, test.show, test.provider, test.want)
+		}
+	}
+}
+
+// A session that only hands out its client
+type proxySession struct {
+	anirip.Session
+	client *anirip.Client
+}
+
+func (session proxySession) GetClient() *anirip.Client {
+	return session.client
+}
+
+// An episode that's region locked everywhere but through the proxies in works, noting the
+// proxy each attempt was made through
+type regionLockedEpisode struct {
+	anirip.Episode
+	works    map[string]bool
+	attempts []string
+}
+
+func (episode *regionLockedEpisode) GetEpisodeInfo(quality string, client *anirip.Client) error {
+	proxy := ""
+	if client.Proxy != nil {
+		proxy = client.Proxy.Hostname()
+	}
+	episode.attempts = append(episode.attempts, proxy)
+	if episode.works[proxy] {
+		return nil
+	}
+	return anirip.ErrRegionLocked
+}
+
+func TestGetEpisodeInfoCountryOrder(t *testing.T) {
+	regionProxies := []anirip.RegionProxy{{Country: "US", URL: "http://us"}, {Country: "GB", URL: "http://gb"}, {Country: "FR", URL: "http://fr"}}
+	tests := []struct {
+		name       string
+		remembered string
+		works      []string
+		country    string // Empty when the normal route worked or nothing did
+		attempts   []string
+	}{
+		{name: "normal route", works: []string{"default"}, attempts: []string{"default"}},
+		{name: "first country", works: []string{"us"}, country: "US", attempts: []string{"default", "us"}},
+		{name: "last country", works: []string{"fr"}, country: "FR", attempts: []string{"default", "us", "gb", "fr"}},
+		{name: "remembered", remembered: "GB", works: []string{"gb", "default"}, country: "GB", attempts: []string{"gb"}},
+		{name: "remembered stopped working", remembered: "GB", works: []string{"default"}, attempts: []string{"gb", "default"}},
+		{name: "remembered then others", remembered: "GB", works: []string{"fr"}, country: "FR", attempts: []string{"gb", "default", "us", "fr"}},
+		{name: "nowhere", works: nil, attempts: []string{"default", "us", "gb", "fr"}},
+	}
+	for _, test := range tests {
+		episode := &regionLockedEpisode{works: map[string]bool{}}
+		for _, proxy := range test.works {
+			episode.works[proxy] = true
+		}
+		country, err := getEpisodeInfo(proxySession{client: anirip.NewClient(nil)}, episode, "720p", "http://default", test.remembered, regionProxies)
+		if (err != nil) != (len(test.works) == 0) {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if country != test.country || !reflect.DeepEqual(episode.attempts, test.attempts) {
+			t.Errorf("%s: got %q after trying %v, expected %q after %v", test.name, country, episode.attempts, test.country, test.attempts)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/crunchyroll"
+	"github.com/sdwolfe32/anirip/daisuki"
+)
+
+// The directories each season of a show is saved in
+var seasonDirs = map[int]string{
+	0:  "Specials",
+	1:  "Season One",
+	2:  "Season Two",
+	3:  "Season Three",
+	4:  "Season Four",
+	5:  "Season Five",
+	6:  "Season Six",
+	7:  "Season Seven",
+	8:  "Season Eight",
+	9:  "Season Nine",
+	10: "Season Ten",
+}
+
+// The language the audio of every episode is in, picked out of DASH manifests and tagged on the MKV
+const audioLanguage = "jpn"
+
+// How a show is ripped, given by the global flags or kept with a subscription
+type ripOptions struct {
+	Quality string `json:"quality"`
+	Lang    string `json:"lang"`
+	Trim    string `json:"trim,omitempty"`
+	Profile string `json:"profile"`
+	Dir     string `json:"dir,omitempty"`   // Where the shows directory is made, the working directory when empty
+	Force   bool   `json:"force,omitempty"` // Rips episodes again even when the history or their file says they've been ripped
+}
+
+// Rips shows, keeping what's shared between them such as the countries region proxies were needed in
+type ripper struct {
+	tempDir            string // Where episodes are put together, each queued job gets its own so they can run side by side
+	settings           config
+	proxyFor           func(provider string) string
+	rateLimiter        *anirip.RateLimiter // Shared by every job so --limit-rate holds across all of them
+	segmentConcurrency int
+	regions            *regionMemory
+	history            *downloadHistory
+	regionProxies      []anirip.RegionProxy
+	regionReport       []string
+}
+
+// Creates a ripper, applying the download settings to every stream it fetches
+func newRipper(settings config, proxyFor func(provider string) string, limitRate string, concurrency int, regionProxyList []string) (*ripper, error) {
+	rate, err := anirip.ParseRate(limitRate)
+	if err != nil {
+		return nil, err
+	}
+
+	// Loads the proxies we can fall back on for region locked episodes
+	regionProxies, err := anirip.ParseRegionProxies(regionProxyList)
+	if err != nil {
+		return nil, err
+	}
+	// Creates the temp directory, which providers that dump straight to a file don't do themselves
+	if err := os.MkdirAll(tempDir, 0777); err != nil {
+		return nil, anirip.Error{Message: "There was an error creating the temp directory " + tempDir, Err: err}
+	}
+	return &ripper{
+		tempDir:            tempDir,
+		settings:           settings,
+		proxyFor:           proxyFor,
+		rateLimiter:        anirip.NewRateLimiter(rate),
+		segmentConcurrency: concurrency,
+		regions:            &regionMemory{fileName: regionsFile()},
+		history:            &downloadHistory{fileName: historyFile()},
+		regionProxies:      regionProxies,
+	}, nil
+}
+
+// Picks the provider a show url belongs to, along with an empty show to scrape it into
+func parseShowURL(showURL string) (string, anirip.Show, error) {
+	// Parses the URL so we can accurately judge the provider based on the host
+	url, err := url.Parse(showURL)
+	if err != nil {
+		return "", nil, anirip.Error{Message: "There was an error parsing the URL you entered", Err: err}
+	}
+	if isProvider(url, "crunchyroll", crunchyroll.BaseURL) {
+		return "crunchyroll", new(crunchyroll.CrunchyrollShow), nil
+	}
+	if isProvider(url, "daisuki", daisuki.BaseURL) {
+		return "daisuki", new(daisuki.DaisukiShow), nil
+	}
+	return "", nil, anirip.Error{Message: "The URL provided is not supported"}
+}
+
+// Splits a url to rip into the show to scrape and, when it's an episode url, the path of the only episode wanted
+func splitEpisodeURL(target string) (string, string) {
+	providerName, _, err := parseShowURL(target)
+	if err != nil {
+		return target, ""
+	}
+	episodeShowURL := crunchyroll.EpisodeShowURL
+	if providerName == "daisuki" {
+		episodeShowURL = daisuki.EpisodeShowURL
+	}
+	showURL, ok := episodeShowURL(target)
+	if !ok {
+		return target, ""
+	}
+	parsed, _ := url.Parse(target)
+	return showURL, parsed.Path
+}
+
+// Checks whether an episodes page is at episodePath, whatever host it was scraped from
+func isEpisodeAt(episode anirip.Episode, episodePath string) bool {
+	parsed, err := url.Parse(episode.GetURL())
+	return err == nil && parsed.Path == episodePath
+}
+
+// Scrapes a show and rips every episode skip doesn't rule out, or all of them when skip is nil. Given
+// an episode url only that episode is ripped. ripped is told about each episode that ends up on disk,
+// including ones that were already there
+func (rip *ripper) ripShow(target string, options ripOptions, skip func(anirip.Season, anirip.Episode) bool, ripped func(anirip.Season, anirip.Episode)) error {
+	showURL, episodePath := splitEpisodeURL(target)
+	providerName, show, err := parseShowURL(showURL)
+	if err != nil {
+		return err
+	}
+	providerProxy := rip.proxyFor(providerName)
+
+	// Performs the generic login procedure, credentials are looked up if the session needs them
+	accounts := newAccountPool(providerName, options.Profile, providerProxy)
+	accounts.rateLimiter, accounts.segmentConcurrency = rip.rateLimiter, rip.segmentConcurrency
+	if err := accounts.login(); err != nil {
+		return anirip.Error{Message: "Unable to login to provider", Err: err}
+	}
+
+	// Attempts to scrape the shows metadata/information
+	logger.Info("Getting a list of episodes for the show...")
+	if err := accounts.run(func(session anirip.Session) error {
+		return show.ScrapeEpisodes(showURL, session.GetClient())
+	}); err != nil {
+		return anirip.Error{Message: "Unable to get episodes", Err: err}
+	}
+	events.showScraped(providerName, show)
+
+	// Tags every message about the show with it, so a verbose or JSON log says which episode it's about
+	showLog := logger.With(anirip.Fields{"provider": providerName, "show": show.GetTitle()})
+	showDir := filepath.Join(options.Dir, show.GetTitle())
+	os.MkdirAll(showDir, 0777)
+	matched, started, totals := false, time.Now(), &eventTotals{Shows: 1}
+	for _, season := range show.GetSeasons() {
+		seasonDir := filepath.Join(showDir, seasonDirs[season.GetNumber()])
+		os.Mkdir(seasonDir, 0777)
+		for _, episode := range season.GetEpisodes() {
+			if episodePath != "" && !isEpisodeAt(episode, episodePath) {
+				continue
+			}
+			matched = true
+			if skip != nil && skip(season, episode) {
+				continue
+			}
+			if rip.ripEpisode(accounts, options, providerProxy, show, season, episode, seasonDir, showLog, totals) && ripped != nil {
+				ripped(season, episode)
+			}
+		}
+	}
+	if episodePath != "" && !matched {
+		return anirip.Error{Message: "The episode " + target + " wasn't found in " + show.GetTitle()}
+	}
+	totals.Episodes = totals.Downloaded + totals.AlreadyDownloaded + totals.Failed
+	totals.Seconds = math.Round(time.Since(started).Seconds()*10) / 10
+
+	// A canceled show isn't done, its totals would only count the episodes reached before it stopped
+	if anirip.CheckCanceled() != nil {
+		showLog.Info("Stopped processing episodes for " + show.GetTitle() + " as it was canceled")
+		return nil
+	}
+	rip.settings.Hooks.run("on_show_done", hookPayload{Provider: providerName, Show: show.GetTitle(), Path: showDir, Totals: totals}, showLog)
+	showLog.Info("Completed processing episodes for " + show.GetTitle())
+	return nil
+}
+
+// Rips a single episode into seasonDir, reporting how it went and counting it in totals. Returns whether the episode is now on disk
+func (rip *ripper) ripEpisode(accounts *accountPool, options ripOptions, providerProxy string, show anirip.Show, season anirip.Season, episode anirip.Episode, seasonDir string, showLog *anirip.Logger, totals *eventTotals) bool {
+	episodeLog := showLog.With(anirip.Fields{"season": season.GetNumber(), "episode": episode.GetFileName()})
+	seasonNumber, episodeNumber, outputFile := season.GetNumber(), episode.GetNumber(), ""
+	payload := func() hookPayload {
+		return hookPayload{Provider: accounts.provider, Show: show.GetTitle(), Season: &seasonNumber, Episode: &episodeNumber, FileName: episode.GetFileName(), Path: outputFile, Quality: options.Quality}
+	}
+	failed := func(err error) bool {
+		episodeLog.Failure(err)
+		events.episodeFailed(err)
+		totals.Failed++
+		failure := payload()
+		failure.ErrorKind, failure.Error = errorKind(err), err.Error()
+		rip.settings.Hooks.run("on_episode_failed", failure, episodeLog)
+		return false
+	}
+	events.episodeStarted(season, episode)
+
+	// Skips episodes the history says were ripped, wherever their file has gone since
+	if !options.Force {
+		ripped, err := rip.history.find(accounts.provider, episode.GetID())
+		if err != nil {
+			return failed(err)
+		}
+		if ripped != nil {
+			events.episodeFile(ripped.FileName, ripped.Output)
+			episodeLog.Success(ripped.FileName + " was already ripped to " + ripped.Output + " on " + ripped.Ripped.Format("Jan 2 2006") + "...")
+			events.episodeDone(true)
+			totals.AlreadyDownloaded++
+			return true
+		}
+	}
+	events.stageChanged("episode_info")
+	episodeLog.Info("Getting Episode Info...")
+	remembered, rememberErr := rip.regions.get(accounts.provider, show.GetTitle())
+	if rememberErr != nil {
+		episodeLog.Failure(rememberErr)
+	}
+	country := ""
+	if err := accounts.run(func(session anirip.Session) (err error) {
+		country, err = getEpisodeInfo(session, episode, options.Quality, providerProxy, remembered, rip.regionProxies)
+		return err
+	}); err != nil {
+		return failed(err)
+	}
+
+	// The file name now has the episodes title in it
+	episodeLog = showLog.With(anirip.Fields{"season": season.GetNumber(), "episode": episode.GetFileName()})
+	outputFile = filepath.Join(seasonDir, episode.GetFileName()+".mkv")
+	events.episodeFile(episode.GetFileName(), outputFile)
+	if country != "" {
+		episodeLog.Info(episode.GetFileName() + " is being downloaded through " + country)
+		rip.regionReport = append(rip.regionReport, show.GetTitle()+" - "+episode.GetFileName()+" : "+country)
+		if err := rip.regions.set(accounts.provider, show.GetTitle(), country); err != nil {
+			episodeLog.Failure(err)
+		}
+	}
+
+	// Checks to see if the episode already exists, in which case it's added to the history and we continue to the next
+	if info, err := os.Stat(outputFile); err == nil && !options.Force {
+		if err := rip.history.record(historyEntry{
+			Provider: accounts.provider,
+			ID:       episode.GetID(),
+			Show:     show.GetTitle(),
+			Season:   season.GetNumber(),
+			Episode:  episode.GetNumber(),
+			FileName: episode.GetFileName(),
+			Output:   outputFile,
+			Ripped:   info.ModTime(),
+		}); err != nil {
+			episodeLog.Failure(err)
+		}
+		episodeLog.Success(episode.GetFileName() + ".mkv has already been downloaded successfully...")
+		events.episodeDone(true)
+		totals.AlreadyDownloaded++
+		return true
+	}
+
+	subOffset := 0
+	episodeLog.Info("Downloading " + episode.GetFileName())
+	// Downloads full MKV video from stream provider
+	episodeLog.Info("Downloading video...")
+	events.stageChanged("download")
+	progress.begin(episodeLog, "Downloading video")
+	err := accounts.run(func(session anirip.Session) error {
+		return downloadEpisode(episode, options.Quality, audioLanguage, rip.tempDir, session.GetClient())
+	})
+	progress.end()
+	if err != nil {
+		return failed(err)
+	}
+
+	// Trims down the downloaded MKV for every intro the user wants trimmed
+	intros := rip.settings.trimIntros(options.Trim)
+	if len(intros) > 0 {
+		events.stageChanged("trim")
+	}
+	for _, intro := range intros {
+		introLength := rip.settings.Trims[intro]
+		subOffset = subOffset + introLength
+		episodeLog.Info("Trimming off " + intro + " intro - " + strconv.Itoa(introLength) + "ms")
+		progress.begin(episodeLog, "Trimming off "+intro+" intro")
+		err := trimMKV(introLength, rip.tempDir)
+		progress.end()
+		if err != nil {
+			return failed(err)
+		}
+	}
+
+	// Downloads the subtitles to .ass format and
+	// offsets their times by the passed provided interval
+	episodeLog.Info("Downloading subtitles with a total offset of " + strconv.Itoa(subOffset) + "ms...")
+	events.stageChanged("subtitles")
+	subtitleLang := ""
+	if err := accounts.run(func(session anirip.Session) (err error) {
+		subtitleLang, err = episode.DownloadSubtitles(options.Lang, subOffset, rip.tempDir, session.GetClient())
+		return err
+	}); err != nil {
+		return failed(err)
+	}
+
+	// Attempts to merge the downloaded subtitles into the video strea
+	episodeLog.Info("Merging subtitles into mkv container...")
+	events.stageChanged("merge")
+	progress.begin(episodeLog, "Merging subtitles")
+	err = mergeSubtitles(audioLanguage, subtitleLang, rip.tempDir)
+	progress.end()
+	if err != nil {
+		return failed(err)
+	}
+
+	// Cleans the MKVs metadata for better reading by clients
+	episodeLog.Info("Cleaning MKV...")
+	events.stageChanged("clean")
+	if err := cleanMKV(rip.tempDir); err != nil {
+		return failed(err)
+	}
+
+	// Moves the episode to the appropriate season sub-directory
+	if err := anirip.Rename(rip.tempDir+string(os.PathSeparator)+"episode.mkv", outputFile, 10); err != nil {
+		return failed(err)
+	}
+	if err := rip.history.record(historyEntry{
+		Provider:  accounts.provider,
+		ID:        episode.GetID(),
+		Show:      show.GetTitle(),
+		Season:    season.GetNumber(),
+		Episode:   episode.GetNumber(),
+		FileName:  episode.GetFileName(),
+		Output:    outputFile,
+		Quality:   options.Quality,
+		Subtitles: subtitleLang,
+		Ripped:    time.Now(),
+	}); err != nil {
+		episodeLog.Failure(err)
+	}
+	episodeLog.Success("Downloading and merging completed successfully.")
+	events.episodeDone(false)
+	totals.Downloaded++
+	done := payload()
+	done.Subtitles = subtitleLang
+	rip.settings.Hooks.run("on_episode_done", done, episodeLog)
+	return true
+}
+
+// Lists every episode that needed a region proxy to be downloaded, then starts the list over
+func (rip *ripper) reportRegions() {
+	if len(rip.regionReport) > 0 {
+		logger.Info("Episodes downloaded through a region proxy:")
+		for _, line := range rip.regionReport {
+			logger.Info("  " + line)
+		}
+	}
+	rip.regionReport = nil
+}
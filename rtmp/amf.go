@@ -0,0 +1,203 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// AMF0 type markers used by the commands we send and recieve
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+// An AMF0 object property, kept as a slice so the order we write them in is preserved
+type amfProperty struct {
+	Name  string
+	Value interface{}
+}
+
+// An ordered AMF0 object
+type amfObjectValue []amfProperty
+
+// Looks up a property of the object by name
+func (object amfObjectValue) get(name string) interface{} {
+	for _, property := range object {
+		if property.Name == name {
+			return property.Value
+		}
+	}
+	return nil
+}
+
+// Encodes each of the passed values to AMF0 in order
+func encodeAMF(values ...interface{}) []byte {
+	buffer := new(bytes.Buffer)
+	for _, value := range values {
+		writeAMFValue(buffer, value)
+	}
+	return buffer.Bytes()
+}
+
+// Writes a single go value to the buffer as AMF0
+func writeAMFValue(buffer *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(amfNull)
+	case float64:
+		buffer.WriteByte(amfNumber)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(v))
+	case int:
+		writeAMFValue(buffer, float64(v))
+	case bool:
+		buffer.WriteByte(amfBoolean)
+		if v {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+	case string:
+		if len(v) > 0xffff {
+			buffer.WriteByte(amfLongString)
+			binary.Write(buffer, binary.BigEndian, uint32(len(v)))
+		} else {
+			buffer.WriteByte(amfString)
+			binary.Write(buffer, binary.BigEndian, uint16(len(v)))
+		}
+		buffer.WriteString(v)
+	case amfObjectValue:
+		buffer.WriteByte(amfObject)
+		for _, property := range v {
+			binary.Write(buffer, binary.BigEndian, uint16(len(property.Name)))
+			buffer.WriteString(property.Name)
+			writeAMFValue(buffer, property.Value)
+		}
+		buffer.Write([]byte{0x00, 0x00, amfObjectEnd})
+	default:
+		buffer.WriteByte(amfUndefined)
+	}
+}
+
+// Decodes every AMF0 value found in the passed payload
+func decodeAMF(payload []byte) ([]interface{}, error) {
+	reader := bytes.NewReader(payload)
+	values := []interface{}{}
+	for reader.Len() > 0 {
+		value, err := readAMFValue(reader)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Reads a single AMF0 value from the reader
+func readAMFValue(reader *bytes.Reader) (interface{}, error) {
+	marker, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case amfBoolean:
+		b, err := reader.ReadByte()
+		return b != 0, err
+	case amfString:
+		return readAMFString(reader)
+	case amfLongString:
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		str := make([]byte, length)
+		_, err := io.ReadFull(reader, str)
+		return string(str), err
+	case amfObject:
+		return readAMFObject(reader)
+	case amfECMAArray:
+		// ECMA arrays are objects prefixed by an (unreliable) count
+		if _, err := reader.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return readAMFObject(reader)
+	case amfStrictArray:
+		var count uint32
+		if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		array := []interface{}{}
+		for i := uint32(0); i < count; i++ {
+			value, err := readAMFValue(reader)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case amfDate:
+		// Dates are a double followed by a (deprecated) timezone
+		var bits uint64
+		if err := binary.Read(reader, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		_, err := reader.Seek(2, io.SeekCurrent)
+		return math.Float64frombits(bits), err
+	case amfNull, amfUndefined:
+		return nil, nil
+	}
+	return nil, anirip.Error{Message: "Unsupported AMF0 type marker " + strconv.Itoa(int(marker))}
+}
+
+// Reads a length prefixed AMF0 string
+func readAMFString(reader *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	str := make([]byte, length)
+	_, err := io.ReadFull(reader, str)
+	return string(str), err
+}
+
+// Reads object properties until the object end marker is found
+func readAMFObject(reader *bytes.Reader) (amfObjectValue, error) {
+	object := amfObjectValue{}
+	for {
+		name, err := readAMFString(reader)
+		if err != nil {
+			return object, err
+		}
+		if name == "" {
+			marker, err := reader.ReadByte()
+			if err != nil || marker == amfObjectEnd {
+				return object, err
+			}
+			reader.UnreadByte()
+		}
+		value, err := readAMFValue(reader)
+		if err != nil {
+			return object, err
+		}
+		object = append(object, amfProperty{Name: name, Value: value})
+	}
+}
@@ -0,0 +1,104 @@
+package rtmp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"number", float64(1.5), float64(1.5)},
+		{"int", 42, float64(42)},
+		{"true", true, true},
+		{"false", false, false},
+		{"string", "connect", "connect"},
+		{"empty string", "", ""},
+		{"long string", strings.Repeat("a", 0x10000), strings.Repeat("a", 0x10000)},
+		{"null", nil, nil},
+		{"object", amfObjectValue{
+			{Name: "app", Value: "ondemand"},
+			{Name: "fpad", Value: false},
+			{Name: "nested", Value: amfObjectValue{{Name: "code", Value: "NetStream.Play.Start"}}},
+		}, amfObjectValue{
+			{Name: "app", Value: "ondemand"},
+			{Name: "fpad", Value: false},
+			{Name: "nested", Value: amfObjectValue{{Name: "code", Value: "NetStream.Play.Start"}}},
+		}},
+		{"empty object", amfObjectValue{}, amfObjectValue{}},
+	}
+	for _, test := range tests {
+		values, err := decodeAMF(encodeAMF(test.value))
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", test.name, err)
+			continue
+		}
+		if len(values) != 1 || !reflect.DeepEqual(values[0], test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, values, test.want)
+		}
+	}
+}
+
+func TestAMFCommand(t *testing.T) {
+	payload := encodeAMF("play", float64(4), nil, "mp4:600001.mp4", float64(0))
+	values, err := decodeAMF(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"play", float64(4), nil, "mp4:600001.mp4", float64(0)}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %#v, want %#v", values, want)
+	}
+}
+
+func TestAMFDecodeServerTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    interface{}
+	}{
+		{"undefined", []byte{amfUndefined}, nil},
+		{"ecma array", []byte{amfECMAArray, 0, 0, 0, 1, 0, 1, 'a', amfBoolean, 1, 0, 0, amfObjectEnd},
+			amfObjectValue{{Name: "a", Value: true}}},
+		{"strict array", []byte{amfStrictArray, 0, 0, 0, 2, amfNull, amfString, 0, 1, 'b'},
+			[]interface{}{nil, "b"}},
+		{"date", []byte{amfDate, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0, 0}, float64(1)},
+	}
+	for _, test := range tests {
+		values, err := decodeAMF(test.payload)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", test.name, err)
+			continue
+		}
+		if len(values) != 1 || !reflect.DeepEqual(values[0], test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, values, test.want)
+		}
+	}
+}
+
+func TestAMFDecodeErrors(t *testing.T) {
+	for name, payload := range map[string][]byte{
+		"unknown marker":   {0x11},
+		"truncated number": {amfNumber, 0x3f, 0xf0},
+		"truncated string": {amfString, 0, 5, 'a'},
+		"unclosed object":  {amfObject, 0, 1, 'a', amfNull},
+	} {
+		if _, err := decodeAMF(payload); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMetadataDuration(t *testing.T) {
+	duration, ok := metadataDuration(encodeAMF("onMetaData", amfObjectValue{{Name: "duration", Value: float64(12.5)}}))
+	if !ok || duration.Seconds() != 12.5 {
+		t.Errorf("got %v %v, want 12.5s", duration, ok)
+	}
+	if _, ok := metadataDuration(encodeAMF("onCuePoint", amfObjectValue{{Name: "duration", Value: float64(1)}})); ok {
+		t.Error("only onMetaData should carry a duration")
+	}
+}
@@ -0,0 +1,221 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// RTMP message types we either send or act on
+const (
+	msgSetChunkSize     = 0x01
+	msgAbort            = 0x02
+	msgAcknowledgement  = 0x03
+	msgUserControl      = 0x04
+	msgWindowAckSize    = 0x05
+	msgSetPeerBandwidth = 0x06
+	msgAudio            = 0x08
+	msgVideo            = 0x09
+	msgDataAMF0         = 0x12
+	msgCommandAMF0      = 0x14
+	msgAggregate        = 0x16
+)
+
+// User control event types
+const (
+	eventStreamBegin     = 0x00
+	eventStreamEOF       = 0x01
+	eventSetBufferLength = 0x03
+	eventPingRequest     = 0x06
+	eventPingResponse    = 0x07
+	eventSWFVerify       = 0x1a
+	eventSWFVerifyReply  = 0x1b
+)
+
+// A fully reassembled RTMP message
+type message struct {
+	Type      byte
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+// The last header seen on a chunk stream, later chunks only send what changed
+type chunkState struct {
+	Timestamp      uint32
+	TimestampDelta uint32
+	Length         uint32
+	Type           byte
+	StreamID       uint32
+	Extended       bool
+	Payload        *bytes.Buffer
+}
+
+// Reads chunks off of the connection until a whole message has been reassembled
+func (conn *connection) readMessage() (*message, error) {
+	for {
+		// Reads the basic header which tells us the format and chunk stream ID
+		basicHeader, err := conn.readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		format := basicHeader[0] >> 6
+		chunkStreamID := uint32(basicHeader[0] & 0x3f)
+		switch chunkStreamID {
+		case 0:
+			b, err := conn.readBytes(1)
+			if err != nil {
+				return nil, err
+			}
+			chunkStreamID = uint32(b[0]) + 64
+		case 1:
+			b, err := conn.readBytes(2)
+			if err != nil {
+				return nil, err
+			}
+			chunkStreamID = uint32(b[1])*256 + uint32(b[0]) + 64
+		}
+
+		// Gets the previous state for this chunk stream so we can fill in omitted fields
+		state, ok := conn.inChunks[chunkStreamID]
+		if !ok {
+			if format != 0 {
+				return nil, anirip.Error{Message: "Recieved a compressed chunk header for an unknown chunk stream"}
+			}
+			state = &chunkState{Payload: new(bytes.Buffer)}
+			conn.inChunks[chunkStreamID] = state
+		}
+
+		// Reads the message header, its size depends on the chunk format
+		headerSizes := []int{11, 7, 3, 0}
+		header, err := conn.readBytes(headerSizes[format])
+		if err != nil {
+			return nil, err
+		}
+		timestamp := uint32(0)
+		if format < 3 {
+			timestamp = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			state.Extended = timestamp == 0xffffff
+		}
+		if format < 2 {
+			state.Length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			state.Type = header[6]
+		}
+		if format == 0 {
+			state.StreamID = binary.LittleEndian.Uint32(header[7:11])
+		}
+
+		// Extended timestamps are sent whenever the three byte field overflowed
+		if state.Extended {
+			b, err := conn.readBytes(4)
+			if err != nil {
+				return nil, err
+			}
+			if format < 3 {
+				timestamp = binary.BigEndian.Uint32(b)
+			}
+		}
+
+		// Applies the timestamp once at the start of every message
+		if state.Payload.Len() == 0 {
+			switch format {
+			case 0:
+				state.Timestamp = timestamp
+			case 1, 2:
+				state.TimestampDelta = timestamp
+				state.Timestamp += timestamp
+			case 3:
+				state.Timestamp += state.TimestampDelta
+			}
+		}
+
+		// Reads the chunk payload, which can be at most our incoming chunk size
+		remaining := int(state.Length) - state.Payload.Len()
+		if remaining > conn.inChunkSize {
+			remaining = conn.inChunkSize
+		}
+		payload, err := conn.readBytes(remaining)
+		if err != nil {
+			return nil, err
+		}
+		state.Payload.Write(payload)
+
+		// Returns the message once all of its chunks have arrived
+		if state.Payload.Len() >= int(state.Length) {
+			msg := &message{
+				Type:      state.Type,
+				StreamID:  state.StreamID,
+				Timestamp: state.Timestamp,
+				Payload:   append([]byte{}, state.Payload.Bytes()...),
+			}
+			state.Payload.Reset()
+			return msg, nil
+		}
+	}
+}
+
+// Splits a message into chunks and writes them to the connection
+func (conn *connection) writeMessage(chunkStreamID byte, msg *message) error {
+	buffer := new(bytes.Buffer)
+
+	// Always sends a full type 0 header for the first chunk
+	buffer.WriteByte(chunkStreamID & 0x3f)
+	timestamp := msg.Timestamp
+	if timestamp >= 0xffffff {
+		timestamp = 0xffffff
+	}
+	buffer.Write([]byte{byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp)})
+	length := len(msg.Payload)
+	buffer.Write([]byte{byte(length >> 16), byte(length >> 8), byte(length)})
+	buffer.WriteByte(msg.Type)
+	binary.Write(buffer, binary.LittleEndian, msg.StreamID)
+	if timestamp == 0xffffff {
+		binary.Write(buffer, binary.BigEndian, msg.Timestamp)
+	}
+
+	// Every following chunk uses a type 3 header continuing the same message, which
+	// repeats the extended timestamp as the reader expects
+	for i := 0; i < length; i += conn.outChunkSize {
+		if i > 0 {
+			buffer.WriteByte(0xc0 | (chunkStreamID & 0x3f))
+			if timestamp == 0xffffff {
+				binary.Write(buffer, binary.BigEndian, msg.Timestamp)
+			}
+		}
+		end := i + conn.outChunkSize
+		if end > length {
+			end = length
+		}
+		buffer.Write(msg.Payload[i:end])
+	}
+
+	if _, err := conn.writer.Write(buffer.Bytes()); err != nil {
+		return anirip.Error{Message: "There was an error writing to the RTMP connection", Err: err}
+	}
+	return nil
+}
+
+// Reads exactly n bytes from the connection, acknowledging bytes as the server requested
+func (conn *connection) readBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if n == 0 {
+		return b, nil
+	}
+	if _, err := io.ReadFull(conn.reader, b); err != nil {
+		return nil, anirip.Error{Message: "There was an error reading from the RTMP connection", Err: err}
+	}
+
+	// Sends an acknowledgement every time we pass the servers window size
+	conn.bytesIn += uint32(n)
+	if conn.windowAckSize > 0 && conn.bytesIn-conn.lastAck >= conn.windowAckSize {
+		conn.lastAck = conn.bytesIn
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint32(ack, conn.bytesIn)
+		if err := conn.writeMessage(2, &message{Type: msgAcknowledgement, Payload: ack}); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,166 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Creates a connection that reads from in and writes to out
+func testConnection(in []byte, out *bytes.Buffer) *connection {
+	return &connection{
+		reader:       bytes.NewReader(in),
+		writer:       out,
+		inChunks:     map[uint32]*chunkState{},
+		inChunkSize:  128,
+		outChunkSize: 128,
+	}
+}
+
+// Builds a payload of n bytes that differ from one another
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize int
+		msg       message
+	}{
+		{"empty", 128, message{Type: msgCommandAMF0, Payload: []byte{}}},
+		{"single chunk", 128, message{Type: msgAudio, StreamID: 1, Timestamp: 40, Payload: testPayload(100)}},
+		{"exact chunk", 128, message{Type: msgVideo, StreamID: 1, Timestamp: 80, Payload: testPayload(128)}},
+		{"many chunks", 128, message{Type: msgVideo, StreamID: 1, Timestamp: 120, Payload: testPayload(1000)}},
+		{"large chunks", 4096, message{Type: msgVideo, StreamID: 1, Timestamp: 160, Payload: testPayload(10000)}},
+		{"extended timestamp", 128, message{Type: msgVideo, StreamID: 1, Timestamp: 0x1000000, Payload: testPayload(300)}},
+	}
+	for _, test := range tests {
+		out := new(bytes.Buffer)
+		writer := testConnection(nil, out)
+		writer.outChunkSize = test.chunkSize
+		if err := writer.writeMessage(6, &test.msg); err != nil {
+			t.Errorf("%s: write failed: %v", test.name, err)
+			continue
+		}
+		reader := testConnection(out.Bytes(), nil)
+		reader.inChunkSize = test.chunkSize
+		msg, err := reader.readMessage()
+		if err != nil {
+			t.Errorf("%s: read failed: %v", test.name, err)
+			continue
+		}
+		if msg.Type != test.msg.Type || msg.StreamID != test.msg.StreamID || msg.Timestamp != test.msg.Timestamp || !bytes.Equal(msg.Payload, test.msg.Payload) {
+			t.Errorf("%s: got type %d stream %d timestamp %d with %d bytes", test.name, msg.Type, msg.StreamID, msg.Timestamp, len(msg.Payload))
+		}
+	}
+}
+
+// Builds a chunk with a full type 0 header
+func chunkType0(chunkStreamID byte, timestamp uint32, msgType byte, length int, streamID uint32, payload []byte) []byte {
+	chunk := []byte{chunkStreamID, byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(length >> 16), byte(length >> 8), byte(length), msgType}
+	chunk = binary.LittleEndian.AppendUint32(chunk, streamID)
+	return append(chunk, payload...)
+}
+
+func TestChunkReassembly(t *testing.T) {
+	video := testPayload(300)
+	audio := testPayload(20)
+	stream := new(bytes.Buffer)
+
+	// A video message split in three, with an audio message on another chunk stream in between
+	stream.Write(chunkType0(6, 1000, msgVideo, len(video), 1, video[:128]))
+	stream.Write(chunkType0(4, 1000, msgAudio, len(audio), 1, audio))
+	stream.Write(append([]byte{0xc0 | 6}, video[128:256]...))
+	stream.Write(append([]byte{0xc0 | 6}, video[256:]...))
+
+	// A type 1 header changing the length and adding a 40ms delta, then a type 2 header with a 20ms delta
+	stream.Write(append([]byte{0x40 | 6, 0, 0, 40, 0, 0, 10, msgVideo}, video[:10]...))
+	stream.Write(append([]byte{0x80 | 6, 0, 0, 20}, video[10:20]...))
+
+	// A type 3 header starting a new message repeats the last delta
+	stream.Write(append([]byte{0xc0 | 6}, video[20:30]...))
+
+	conn := testConnection(stream.Bytes(), nil)
+	want := []struct {
+		msgType   byte
+		timestamp uint32
+		payload   []byte
+	}{
+		{msgAudio, 1000, audio},
+		{msgVideo, 1000, video},
+		{msgVideo, 1040, video[:10]},
+		{msgVideo, 1060, video[10:20]},
+		{msgVideo, 1080, video[20:30]},
+	}
+	for i, expected := range want {
+		msg, err := conn.readMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.Type != expected.msgType || msg.Timestamp != expected.timestamp || msg.StreamID != 1 || !bytes.Equal(msg.Payload, expected.payload) {
+			t.Errorf("message %d: got type %d at %d with %d bytes, want type %d at %d with %d bytes",
+				i, msg.Type, msg.Timestamp, len(msg.Payload), expected.msgType, expected.timestamp, len(expected.payload))
+		}
+	}
+}
+
+func TestChunkBasicHeaders(t *testing.T) {
+	stream := new(bytes.Buffer)
+
+	// Two byte basic header for chunk stream 64 + 10
+	stream.WriteByte(0)
+	stream.Write(chunkType0(10, 5, msgAudio, 2, 1, []byte{1, 2}))
+
+	// Three byte basic header for chunk stream 64 + 2 + 256
+	stream.Write([]byte{1, 2, 1})
+	stream.Write(chunkType0(0, 6, msgAudio, 2, 1, []byte{3, 4})[1:])
+
+	// Extended timestamp on a type 0 header
+	extended := chunkType0(3, 0xffffff, msgVideo, 2, 1, nil)
+	extended = binary.BigEndian.AppendUint32(extended, 0x12345678)
+	stream.Write(append(extended, 5, 6))
+
+	conn := testConnection(stream.Bytes(), nil)
+	for i, timestamp := range []uint32{5, 6, 0x12345678} {
+		msg, err := conn.readMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.Timestamp != timestamp {
+			t.Errorf("message %d: got timestamp %d, want %d", i, msg.Timestamp, timestamp)
+		}
+	}
+	for _, chunkStreamID := range []uint32{74, 64 + 2 + 256, 3} {
+		if _, ok := conn.inChunks[chunkStreamID]; !ok {
+			t.Errorf("chunk stream %d was never seen", chunkStreamID)
+		}
+	}
+}
+
+func TestChunkUnknownStream(t *testing.T) {
+	conn := testConnection([]byte{0x40 | 5, 0, 0, 0, 0, 0, 1, msgAudio, 0}, nil)
+	if _, err := conn.readMessage(); err == nil {
+		t.Error("expected a compressed header on a new chunk stream to fail")
+	}
+}
+
+func TestChunkAcknowledgement(t *testing.T) {
+	out := new(bytes.Buffer)
+	conn := testConnection(chunkType0(6, 0, msgVideo, 100, 1, testPayload(100)), out)
+	conn.windowAckSize = 50
+	if _, err := conn.readMessage(); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := testConnection(out.Bytes(), nil).readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Type != msgAcknowledgement || binary.BigEndian.Uint32(ack.Payload) != conn.lastAck || conn.lastAck < 50 {
+		t.Errorf("got type %d acknowledging %d, want an acknowledgement of %d", ack.Type, binary.BigEndian.Uint32(ack.Payload), conn.lastAck)
+	}
+}
@@ -0,0 +1,385 @@
+package rtmp
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// Everything needed to connect to an RTMP(E) server and play back a single stream
+type Options struct {
+	URL       string                                          // Server URL such as rtmpe://host/ondemand/
+	App       string                                          // Application to connect to, defaults to the path of URL
+	Playpath  string                                          // Stream to play such as mp4:path/to/file.mp4
+	FlashVer  string                                          // Flash player version reported to the server
+	SwfURL    string                                          // Player SWF, used for SWF verification when SwfVerify is set
+	PageURL   string                                          // Web page the player was embedded in
+	Timeout   time.Duration                                   // Time to wait on the network before giving up
+	SwfVerify bool                                            // Answers the servers SWF verification requests using SwfURL
+	Client    *anirip.Client                                  // Client used to fetch the player SWF, a fresh one is used when nil. Its rate limit applies to the stream
+	Dial      func(network, address string) (net.Conn, error) // Opens the connection to the server, such as through a proxy
+}
+
+// Determines whether the RTMPE handshake is required by the URL scheme
+func (options Options) encrypted() bool {
+	return strings.HasPrefix(strings.ToLower(options.URL), "rtmpe")
+}
+
+// An open RTMP connection and the protocol state that goes along with it
+type connection struct {
+	options       Options
+	conn          net.Conn
+	reader        io.Reader
+	writer        io.Writer
+	encrypter     cipher.Stream
+	decrypter     cipher.Stream
+	inChunks      map[uint32]*chunkState
+	inChunkSize   int
+	outChunkSize  int
+	windowAckSize uint32
+	bytesIn       uint32
+	lastAck       uint32
+	transactionID int
+	swfHash       []byte
+	swfSize       uint32
+	serverSig     []byte
+}
+
+// Wraps a cipher so everything written is encrypted first
+type cipherWriter struct {
+	w      io.Writer
+	stream cipher.Stream
+}
+
+func (cw cipherWriter) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	cw.stream.XORKeyStream(encrypted, p)
+	return cw.w.Write(encrypted)
+}
+
+// Wraps a cipher so everything read is decrypted before being returned
+type cipherReader struct {
+	r      io.Reader
+	stream cipher.Stream
+}
+
+func (cr cipherReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.stream.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Deadline refreshing connection wrapper so a stalled server times out instead of hanging
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (tc timeoutConn) Read(p []byte) (int, error) {
+	tc.Conn.SetReadDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Read(p)
+}
+
+func (tc timeoutConn) Write(p []byte) (int, error) {
+	tc.Conn.SetWriteDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Write(p)
+}
+
+// Connects to the RTMP server described by options, plays the stream and writes it to out as FLV
+func Dump(options Options, out io.Writer) error {
+	// Parses the server URL so we know where to connect to
+	serverURL, err := url.Parse(options.URL)
+	if err != nil {
+		return anirip.Error{Message: "There was an error parsing the RTMP URL", Err: err}
+	}
+	host := serverURL.Host
+	if serverURL.Port() == "" {
+		host = net.JoinHostPort(serverURL.Hostname(), "1935")
+	}
+	if options.App == "" {
+		options.App = strings.Trim(serverURL.Path, "/")
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+
+	// Gets the SWF hash ahead of time in case the server asks us to verify
+	conn := &connection{
+		options:      options,
+		inChunks:     map[uint32]*chunkState{},
+		inChunkSize:  128,
+		outChunkSize: 128,
+	}
+	if options.SwfVerify {
+		client := options.Client
+		if client == nil {
+			client = anirip.NewClient(nil)
+		}
+		if conn.swfHash, conn.swfSize, err = hashSWF(client, options.SwfURL); err != nil {
+			return err
+		}
+	}
+
+	// Opens the TCP connection to the server
+	var netConn net.Conn
+	if options.Dial != nil {
+		netConn, err = options.Dial("tcp", host)
+	} else {
+		netConn, err = net.DialTimeout("tcp", host, options.Timeout)
+	}
+	if err != nil {
+		return anirip.Error{Message: "There was an error connecting to the RTMP server " + host, Err: err}
+	}
+	defer netConn.Close()
+	conn.conn = timeoutConn{netConn, options.Timeout}
+	conn.writer = conn.conn
+
+	// Everything after the handshake is read through the clients rate limit, if it has one
+	var limiter *anirip.RateLimiter
+	if options.Client != nil {
+		limiter = options.Client.RateLimiter
+	}
+	conn.reader = limiter.Reader(conn.conn)
+
+	// Performs the handshake and keeps the server signature around for SWF verification
+	if conn.serverSig, err = conn.handshake(); err != nil {
+		return err
+	}
+
+	// Connects to the application and plays our stream
+	tcURL := serverURL.Scheme + "://" + host + "/" + options.App
+	if err := conn.connect(tcURL); err != nil {
+		return err
+	}
+	return conn.play(&anirip.FLVWriter{Out: out})
+}
+
+// Sends an AMF0 command message over the command chunk stream
+func (conn *connection) sendCommand(streamID uint32, name string, args ...interface{}) error {
+	conn.transactionID++
+	payload := encodeAMF(append([]interface{}{name, float64(conn.transactionID)}, args...)...)
+	chunkStreamID := byte(3)
+	if streamID != 0 {
+		chunkStreamID = 8
+	}
+	return conn.writeMessage(chunkStreamID, &message{Type: msgCommandAMF0, StreamID: streamID, Payload: payload})
+}
+
+// Sends a user control event with the passed event data
+func (conn *connection) sendUserControl(event uint16, data []byte) error {
+	payload := binary.BigEndian.AppendUint16(nil, event)
+	return conn.writeMessage(2, &message{Type: msgUserControl, Payload: append(payload, data...)})
+}
+
+// Sends the connect command and waits for the server to accept it
+func (conn *connection) connect(tcURL string) error {
+	if err := conn.sendCommand(0, "connect", amfObjectValue{
+		{Name: "app", Value: conn.options.App},
+		{Name: "flashVer", Value: conn.options.FlashVer},
+		{Name: "swfUrl", Value: conn.options.SwfURL},
+		{Name: "tcUrl", Value: tcURL},
+		{Name: "fpad", Value: false},
+		{Name: "capabilities", Value: float64(15)},
+		{Name: "audioCodecs", Value: float64(3191)},
+		{Name: "videoCodecs", Value: float64(252)},
+		{Name: "videoFunction", Value: float64(1)},
+		{Name: "pageUrl", Value: conn.options.PageURL},
+		{Name: "objectEncoding", Value: float64(0)},
+	}); err != nil {
+		return err
+	}
+	_, err := conn.waitForResult()
+	return err
+}
+
+// Creates a stream, plays the playpath on it and writes media to flv until the stream ends
+func (conn *connection) play(flv *anirip.FLVWriter) error {
+	// Creates the stream we'll be playing on
+	if err := conn.sendCommand(0, "createStream", nil); err != nil {
+		return err
+	}
+	result, err := conn.waitForResult()
+	if err != nil {
+		return err
+	}
+	streamIDValue, ok := result.(float64)
+	if !ok {
+		return anirip.Error{Message: "The RTMP server did not return a stream ID"}
+	}
+	streamID := uint32(streamIDValue)
+
+	// Requests playback from the start along with a large buffer so the server sends as fast as it can
+	if err := conn.sendCommand(streamID, "play", nil, conn.options.Playpath, float64(0)); err != nil {
+		return err
+	}
+	bufferLength := binary.BigEndian.AppendUint32(nil, streamID)
+	bufferLength = binary.BigEndian.AppendUint32(bufferLength, 36000000)
+	if err := conn.sendUserControl(eventSetBufferLength, bufferLength); err != nil {
+		return err
+	}
+
+	// Writes every media message we recieve until the server says the stream is complete,
+	// reporting how far into the stream we are as it arrives
+	progress := anirip.Progress{}
+	for {
+		if err := anirip.CheckCanceled(); err != nil {
+			return err
+		}
+		msg, err := conn.readMessage()
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case msgAudio, msgVideo, msgDataAMF0:
+			if msg.Type == msgDataAMF0 {
+				if duration, ok := metadataDuration(msg.Payload); ok {
+					progress.Duration = duration
+				}
+			}
+			if err := flv.WriteTag(msg.Type, msg.Timestamp, msg.Payload); err != nil {
+				return err
+			}
+		case msgAggregate:
+			if err := writeAggregate(flv, msg); err != nil {
+				return err
+			}
+		case msgCommandAMF0:
+			done, err := conn.handlePlayStatus(msg)
+			if done && err == nil {
+				progress.Done = true
+				anirip.NotifyProgress(progress)
+			}
+			if err != nil || done {
+				return err
+			}
+		default:
+			if err := conn.handleControl(msg); err != nil {
+				return err
+			}
+		}
+		if msg.Type == msgAudio || msg.Type == msgVideo || msg.Type == msgAggregate {
+			progress.Bytes += int64(len(msg.Payload))
+			progress.Position = time.Duration(msg.Timestamp) * time.Millisecond
+			anirip.NotifyProgress(progress)
+		}
+	}
+}
+
+// Gets the length of the stream from an onMetaData message, if that's what the payload is
+func metadataDuration(payload []byte) (time.Duration, bool) {
+	values, err := decodeAMF(payload)
+	if err != nil || len(values) < 2 {
+		return 0, false
+	}
+	if name, _ := values[0].(string); name != "onMetaData" {
+		return 0, false
+	}
+	metadata, _ := values[1].(amfObjectValue)
+	seconds, ok := metadata.get("duration").(float64)
+	if !ok || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// Reads messages until we get the result of our last command, returning its first return value
+func (conn *connection) waitForResult() (interface{}, error) {
+	for {
+		msg, err := conn.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type != msgCommandAMF0 {
+			if err := conn.handleControl(msg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Decodes the command and checks if it's the reply we are waiting for
+		values, err := decodeAMF(msg.Payload)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		name, _ := values[0].(string)
+		transactionID, _ := values[1].(float64)
+		switch {
+		case name == "_result" && int(transactionID) == conn.transactionID:
+			if len(values) > 3 {
+				return values[3], nil
+			}
+			return nil, nil
+		case name == "_error":
+			return nil, anirip.Error{Message: "The RTMP server rejected our request : " + statusDescription(values)}
+		}
+	}
+}
+
+// Acts on any status messages that arrive while we're playing, returning true once playback is over
+func (conn *connection) handlePlayStatus(msg *message) (bool, error) {
+	values, err := decodeAMF(msg.Payload)
+	if err != nil || len(values) < 1 {
+		return false, nil
+	}
+	if name, _ := values[0].(string); name != "onStatus" || len(values) < 4 {
+		return false, nil
+	}
+	status, _ := values[3].(amfObjectValue)
+	code, _ := status.get("code").(string)
+	switch code {
+	case "NetStream.Play.Complete", "NetStream.Play.Stop":
+		return true, nil
+	case "NetStream.Play.StreamNotFound", "NetStream.Play.Failed", "NetStream.Failed":
+		return true, anirip.Error{Message: "The RTMP server could not play the stream : " + statusDescription(values)}
+	}
+	return false, nil
+}
+
+// Handles protocol control and user control messages
+func (conn *connection) handleControl(msg *message) error {
+	switch msg.Type {
+	case msgSetChunkSize:
+		if len(msg.Payload) >= 4 {
+			conn.inChunkSize = int(binary.BigEndian.Uint32(msg.Payload) & 0x7fffffff)
+		}
+	case msgWindowAckSize:
+		if len(msg.Payload) >= 4 {
+			conn.windowAckSize = binary.BigEndian.Uint32(msg.Payload)
+		}
+	case msgSetPeerBandwidth:
+		// Replies with our own window size as flash player does
+		windowSize := binary.BigEndian.AppendUint32(nil, 2500000)
+		return conn.writeMessage(2, &message{Type: msgWindowAckSize, Payload: windowSize})
+	case msgUserControl:
+		if len(msg.Payload) < 2 {
+			return nil
+		}
+		switch binary.BigEndian.Uint16(msg.Payload) {
+		case eventPingRequest:
+			return conn.sendUserControl(eventPingResponse, msg.Payload[2:])
+		case eventSWFVerify:
+			if conn.swfHash == nil {
+				return anirip.Error{Message: "The RTMP server requested SWF verification but no SWF was given"}
+			}
+			return conn.sendUserControl(eventSWFVerifyReply, swfVerification(conn.swfHash, conn.swfSize, conn.serverSig))
+		}
+	}
+	return nil
+}
+
+// Pulls the description out of a status or error command for our error messages
+func statusDescription(values []interface{}) string {
+	if len(values) < 4 {
+		return "unknown error"
+	}
+	status, _ := values[3].(amfObjectValue)
+	description, _ := status.get("description").(string)
+	code, _ := status.get("code").(string)
+	return strings.TrimSpace(code + " " + description)
+}
@@ -0,0 +1,135 @@
+package rtmp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+	"github.com/sdwolfe32/anirip/internal/rtmptest"
+)
+
+// Builds a few seconds of alternating video and audio tags
+func testTags() []anirip.FLVTag {
+	tags := []anirip.FLVTag{}
+	for timestamp := uint32(0); timestamp < 3000; timestamp += 100 {
+		tags = append(tags,
+			anirip.FLVTag{Type: msgVideo, Timestamp: timestamp, Payload: append([]byte{0x27, 0x01}, testPayload(300)...)},
+			anirip.FLVTag{Type: msgAudio, Timestamp: timestamp, Payload: []byte{0xaf, 0x01, byte(timestamp)}},
+		)
+	}
+	return tags
+}
+
+// Builds a zlib compressed SWF, which is hashed as if it were uncompressed
+func testSWF() []byte {
+	body := new(bytes.Buffer)
+	writer := zlib.NewWriter(body)
+	writer.Write(testPayload(5000))
+	writer.Close()
+	return append([]byte{'C', 'W', 'S', 10, 0x90, 0x13, 0, 0}, body.Bytes()...)
+}
+
+// Starts an RTMP server playing testTags along with a web server hosting the SWF
+func testServer(t *testing.T, swf []byte) (*rtmptest.Server, *httptest.Server) {
+	server, err := rtmptest.NewServer(map[string][]anirip.FLVTag{"mp4:episode.mp4": testTags()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SWF = testSWF()
+	server.ChunkSize = 4096
+	web := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write(swf)
+	}))
+	return server, web
+}
+
+func TestDump(t *testing.T) {
+	server, web := testServer(t, testSWF())
+	defer server.Close()
+	defer web.Close()
+	for _, scheme := range []string{"rtmp", "rtmpe"} {
+		out := new(bytes.Buffer)
+		if err := Dump(Options{
+			URL:       scheme + "://" + server.Addr() + "/ondemand/",
+			Playpath:  "mp4:episode.mp4",
+			SwfURL:    web.URL + "/player.swf",
+			SwfVerify: true,
+		}, out); err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if !bytes.HasPrefix(out.Bytes(), []byte("FLV")) {
+			t.Fatalf("%s: the output isn't an FLV", scheme)
+		}
+
+		// Drops the metadata so only media tags are compared
+		tags := []anirip.FLVTag{}
+		for _, tag := range anirip.ParseFLVTags(out.Bytes()[13:]) {
+			if tag.Type != msgDataAMF0 {
+				tags = append(tags, tag)
+			}
+		}
+		if !reflect.DeepEqual(tags, testTags()) {
+			t.Errorf("%s: got %d tags back, want the %d played", scheme, len(tags), len(testTags()))
+		}
+	}
+}
+
+func TestDumpErrors(t *testing.T) {
+	server, web := testServer(t, []byte("FWS\x0a\x10\x00\x00\x00some other swf"))
+	defer server.Close()
+	defer web.Close()
+
+	// The wrong SWF fails verification
+	err := Dump(Options{
+		URL:       "rtmpe://" + server.Addr() + "/ondemand/",
+		Playpath:  "mp4:episode.mp4",
+		SwfURL:    web.URL + "/player.swf",
+		SwfVerify: true,
+	}, new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "NetStream.Play.Failed") {
+		t.Errorf("got %v, want a failed play", err)
+	}
+
+	// Skipping verification when the server asks for it fails before playing
+	err = Dump(Options{URL: "rtmpe://" + server.Addr() + "/ondemand/", Playpath: "mp4:episode.mp4"}, new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "SWF verification") {
+		t.Errorf("got %v, want a SWF verification error", err)
+	}
+
+	// Unknown streams aren't found
+	server.SWF = nil
+	err = Dump(Options{URL: "rtmp://" + server.Addr() + "/ondemand/", Playpath: "mp4:missing.mp4"}, new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "NetStream.Play.StreamNotFound") {
+		t.Errorf("got %v, want the stream not to be found", err)
+	}
+}
+
+func TestDumpRateLimit(t *testing.T) {
+	server, web := testServer(t, testSWF())
+	defer server.Close()
+	defer web.Close()
+
+	// The limiter lets a seconds worth through straight away, so the rest of the stream has to wait
+	client := anirip.NewClient(nil)
+	client.RateLimiter = anirip.NewRateLimiter(4096)
+	started := time.Now()
+	out := new(bytes.Buffer)
+	if err := Dump(Options{
+		URL:       "rtmpe://" + server.Addr() + "/ondemand/",
+		Playpath:  "mp4:episode.mp4",
+		SwfURL:    web.URL + "/player.swf",
+		SwfVerify: true,
+		Client:    client,
+	}, out); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, least := time.Since(started), time.Duration(float64(out.Len()-4096)/4096*0.8*float64(time.Second)); elapsed < least {
+		t.Errorf("dumping %d bytes took %v, want at least %v", out.Len(), elapsed, least)
+	}
+}
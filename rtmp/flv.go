@@ -0,0 +1,18 @@
+package rtmp
+
+import "github.com/sdwolfe32/anirip/anirip"
+
+// Unpacks an aggregate message into the FLV tags it contains, shifting
+// their timestamps to line up with the timestamp of the aggregate itself
+func writeAggregate(flv *anirip.FLVWriter, msg *message) error {
+	offset := int64(-1)
+	for _, tag := range anirip.ParseFLVTags(msg.Payload) {
+		if offset < 0 {
+			offset = int64(msg.Timestamp) - int64(tag.Timestamp)
+		}
+		if err := flv.WriteTag(tag.Type, uint32(int64(tag.Timestamp)+offset), tag.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
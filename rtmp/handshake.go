@@ -0,0 +1,214 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+const (
+	handshakeSize = 1536
+	digestSize    = 32
+	dhKeySize     = 128
+)
+
+// Handshake keys used by Flash Player and Flash Media Server when signing handshakes
+var (
+	genuineFPKey   = append([]byte("Genuine Adobe Flash Player 001"), flashKeySuffix...)
+	genuineFMSKey  = append([]byte("Genuine Adobe Flash Media Server 001"), flashKeySuffix...)
+	flashKeySuffix = []byte{
+		0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8, 0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+		0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab, 0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+	}
+)
+
+// The 1024 bit Diffie-Hellman group (RFC 2409 group 2) used by RTMPE
+var dhPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+// Performs the flash player handshake, returning the signature the server sent
+// us which is later needed to answer SWF verification requests
+func (conn *connection) handshake() ([]byte, error) {
+	version := byte(0x03)
+	if conn.options.encrypted() {
+		version = 0x06
+	}
+
+	// Builds our C1 signature, a timestamp, the flash player version and random filler
+	c1 := make([]byte, handshakeSize)
+	if _, err := rand.Read(c1); err != nil {
+		return nil, anirip.Error{Message: "There was an error generating our handshake", Err: err}
+	}
+	binary.BigEndian.PutUint32(c1[0:4], uint32(time.Now().Unix()))
+	copy(c1[4:8], []byte{0x80, 0x00, 0x07, 0x02})
+
+	// RTMPE embeds our public Diffie-Hellman key in the signature before it gets signed
+	var dhPrivate *big.Int
+	if conn.options.encrypted() {
+		var err error
+		dhPrivate, err = rand.Int(rand.Reader, new(big.Int).Sub(dhPrime, big.NewInt(2)))
+		if err != nil {
+			return nil, anirip.Error{Message: "There was an error generating our RTMPE key", Err: err}
+		}
+		copy(c1[dhOffset(c1, 0):], dhPublicKey(dhPrivate))
+	}
+
+	// Signs C1 and sends it off along with our requested version
+	c1DigestOffset := digestOffset(c1, 0)
+	copy(c1[c1DigestOffset:], signatureDigest(c1, c1DigestOffset, genuineFPKey[:30]))
+	if _, err := conn.conn.Write(append([]byte{version}, c1...)); err != nil {
+		return nil, anirip.Error{Message: "There was an error sending the handshake", Err: err}
+	}
+
+	// Reads back the servers version and S1 signature
+	s0s1 := make([]byte, handshakeSize+1)
+	if _, err := io.ReadFull(conn.conn, s0s1); err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the server handshake", Err: err}
+	}
+	// Types 8 and 9 encrypt the signatures and Crunchyroll's type 10 is only known from a patched
+	// rtmpdump, none of which this client does
+	switch {
+	case s0s1[0] != version && s0s1[0] > 0x06:
+		return nil, anirip.Error{Message: "The RTMP server answered with handshake type " + strconv.Itoa(int(s0s1[0])) + ", which isn't supported"}
+	case conn.options.encrypted() && s0s1[0] != version:
+		return nil, anirip.Error{Message: "The server does not support RTMPE"}
+	}
+	s1 := s0s1[1:]
+
+	// Figures out which of the two digest schemes the server signed S1 with
+	scheme := -1
+	for _, s := range []int{0, 1} {
+		offset := digestOffset(s1, s)
+		if hmac.Equal(s1[offset:offset+digestSize], signatureDigest(s1, offset, genuineFMSKey[:36])) {
+			scheme = s
+			break
+		}
+	}
+
+	// Sets up our RC4 ciphers using the servers public key if this connection is encrypted
+	if conn.options.encrypted() {
+		if scheme < 0 {
+			return nil, anirip.Error{Message: "The server RTMPE handshake signature could not be verified"}
+		}
+		serverKey := s1[dhOffset(s1, scheme) : dhOffset(s1, scheme)+dhKeySize]
+		clientKey := c1[dhOffset(c1, 0) : dhOffset(c1, 0)+dhKeySize]
+		if err := conn.setupEncryption(dhSharedSecret(dhPrivate, serverKey), serverKey, clientKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// Builds C2, which for digest handshakes is signed using the servers S1 digest
+	c2 := make([]byte, handshakeSize)
+	if scheme >= 0 {
+		if _, err := rand.Read(c2); err != nil {
+			return nil, anirip.Error{Message: "There was an error generating our handshake", Err: err}
+		}
+		serverDigestOffset := digestOffset(s1, scheme)
+		key := hmacSHA256(genuineFPKey, s1[serverDigestOffset:serverDigestOffset+digestSize])
+		copy(c2[handshakeSize-digestSize:], hmacSHA256(key, c2[:handshakeSize-digestSize]))
+	} else {
+		copy(c2, s1)
+	}
+	if _, err := conn.conn.Write(c2); err != nil {
+		return nil, anirip.Error{Message: "There was an error sending the handshake", Err: err}
+	}
+
+	// Reads S2, which we don't need to verify as we've already sent C2
+	s2 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(conn.conn, s2); err != nil {
+		return nil, anirip.Error{Message: "There was an error reading the server handshake", Err: err}
+	}
+
+	// Both sides act as if the handshake itself was encrypted so advances the RC4 state
+	if conn.options.encrypted() {
+		conn.encrypter.XORKeyStream(make([]byte, handshakeSize), make([]byte, handshakeSize))
+		conn.decrypter.XORKeyStream(make([]byte, handshakeSize), make([]byte, handshakeSize))
+		conn.writer = cipherWriter{conn.conn, conn.encrypter}
+		conn.reader = cipherReader{conn.reader, conn.decrypter}
+	}
+	return s1, nil
+}
+
+// Creates the RC4 ciphers used for RTMPE from the Diffie-Hellman shared secret
+func (conn *connection) setupEncryption(sharedSecret, serverKey, clientKey []byte) error {
+	var err error
+	if conn.encrypter, err = rc4.NewCipher(hmacSHA256(sharedSecret, serverKey)[:16]); err != nil {
+		return anirip.Error{Message: "There was an error creating the RTMPE cipher", Err: err}
+	}
+	if conn.decrypter, err = rc4.NewCipher(hmacSHA256(sharedSecret, clientKey)[:16]); err != nil {
+		return anirip.Error{Message: "There was an error creating the RTMPE cipher", Err: err}
+	}
+	return nil
+}
+
+// Gets the public Diffie-Hellman key for a private key, as the 128 bytes sent in the handshake
+func dhPublicKey(private *big.Int) []byte {
+	return leftPad(new(big.Int).Exp(big.NewInt(2), private, dhPrime).Bytes(), dhKeySize)
+}
+
+// Gets the secret shared with the peer that sent publicKey
+func dhSharedSecret(private *big.Int, publicKey []byte) []byte {
+	return leftPad(new(big.Int).Exp(new(big.Int).SetBytes(publicKey), private, dhPrime).Bytes(), dhKeySize)
+}
+
+// Finds the offset of the digest within a handshake signature for the given scheme
+func digestOffset(signature []byte, scheme int) int {
+	if scheme == 0 {
+		return sumBytes(signature[8:12])%728 + 12
+	}
+	return sumBytes(signature[772:776])%728 + 776
+}
+
+// Finds the offset of the Diffie-Hellman public key within a handshake signature for the given scheme
+func dhOffset(signature []byte, scheme int) int {
+	if scheme == 0 {
+		return sumBytes(signature[1532:1536])%632 + 772
+	}
+	return sumBytes(signature[768:772])%632 + 8
+}
+
+// Calculates the digest of a signature, skipping over the digest itself
+func signatureDigest(signature []byte, offset int, key []byte) []byte {
+	message := new(bytes.Buffer)
+	message.Write(signature[:offset])
+	message.Write(signature[offset+digestSize:])
+	return hmacSHA256(key, message.Bytes())
+}
+
+// Shorthand for a single HMAC-SHA256 calculation
+func hmacSHA256(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// Adds up every byte passed
+func sumBytes(b []byte) int {
+	sum := 0
+	for _, v := range b {
+		sum += int(v)
+	}
+	return sum
+}
+
+// Pads the start of the passed slice with zeros to fill up the requested length
+func leftPad(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b[len(b)-length:]
+	}
+	return append(make([]byte, length-len(b)), b...)
+}
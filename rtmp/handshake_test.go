@@ -0,0 +1,222 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects a client and server connection over loopback, as unlike net.Pipe
+// it buffers writes the way the handshake relies on
+func testPipe(t *testing.T, url string) (*connection, *connection) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &connection{
+		options:      Options{URL: url},
+		conn:         timeoutConn{clientConn, 5 * time.Second},
+		inChunks:     map[uint32]*chunkState{},
+		inChunkSize:  128,
+		outChunkSize: 128,
+	}
+	client.reader, client.writer = client.conn, client.conn
+	server := &connection{
+		conn:         timeoutConn{serverConn, 5 * time.Second},
+		inChunks:     map[uint32]*chunkState{},
+		inChunkSize:  128,
+		outChunkSize: 128,
+	}
+	server.reader, server.writer = server.conn, server.conn
+	return client, server
+}
+
+// The known answers below were worked out with Python's hmac and hashlib from the algorithm rtmpdump
+// uses, rather than with this package, so they catch the client and rtmptest agreeing on a mistake
+
+// A signature whose every byte is different, so an offset read from the wrong place shows up
+func testSignature() []byte {
+	signature := make([]byte, handshakeSize)
+	for i := range signature {
+		signature[i] = byte(i*7 + 3)
+	}
+	return signature
+}
+
+func TestHandshakeKnownAnswers(t *testing.T) {
+	signature := testSignature()
+	if offset := digestOffset(signature, 0); offset != 290 {
+		t.Errorf("scheme 0 digest offset %d, want 290", offset)
+	}
+	if offset := digestOffset(signature, 1); offset != 942 {
+		t.Errorf("scheme 1 digest offset %d, want 942", offset)
+	}
+	if offset := dhOffset(signature, 0); offset != 1106 {
+		t.Errorf("scheme 0 key offset %d, want 1106", offset)
+	}
+	if offset := dhOffset(signature, 1); offset != 62 {
+		t.Errorf("scheme 1 key offset %d, want 62", offset)
+	}
+	digest := hex.EncodeToString(signatureDigest(signature, 290, genuineFPKey[:30]))
+	if digest != "36d27b365b84e5e55f376e2f24f3a7dd6b8b5e9b002f035f99366c07e43b8d41" {
+		t.Errorf("got digest %s", digest)
+	}
+}
+
+func TestRTMPEKnownAnswers(t *testing.T) {
+	clientPrivate, serverPrivate := new(big.Int), new(big.Int)
+	for i := 0; i < 128; i++ {
+		clientPrivate.Lsh(clientPrivate, 8).Or(clientPrivate, big.NewInt(int64(i+1)))
+		serverPrivate.Lsh(serverPrivate, 8).Or(serverPrivate, big.NewInt(int64(i+128)))
+	}
+	clientKey, serverKey := dhPublicKey(clientPrivate), dhPublicKey(serverPrivate)
+	if sum := sha256.Sum256(clientKey); hex.EncodeToString(sum[:]) != "2c3b2c4419c899b7f00f2d69ddf7cdca994c170f0d8c0cc432d1381823398963" {
+		t.Errorf("got public key %x", clientKey)
+	}
+	secret := dhSharedSecret(clientPrivate, serverKey)
+	if !bytes.Equal(secret, dhSharedSecret(serverPrivate, clientKey)) {
+		t.Fatal("the two sides came up with different secrets")
+	}
+	if sum := sha256.Sum256(secret); hex.EncodeToString(sum[:]) != "d44dbbf96af0734f226aa5019c6dbbf7c80e323ef7d10cfe62c4d957adac418d" {
+		t.Errorf("got shared secret %x", secret)
+	}
+
+	// The keystreams carry on from where the handshake left them
+	conn := &connection{}
+	if err := conn.setupEncryption(secret, serverKey, clientKey); err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		stream cipher.Stream
+		want   string
+	}{
+		"encrypter": {conn.encrypter, "9b62b09ae5c2915aeff777f9d68d8275"},
+		"decrypter": {conn.decrypter, "bd7d3d21b43ec3d6c182a919474c6383"},
+	} {
+		test.stream.XORKeyStream(make([]byte, handshakeSize), make([]byte, handshakeSize))
+		keystream := make([]byte, 16)
+		test.stream.XORKeyStream(keystream, keystream)
+		if hex.EncodeToString(keystream) != test.want {
+			t.Errorf("%s keystream %x, want %s", name, keystream, test.want)
+		}
+	}
+}
+
+func TestSWFKnownAnswers(t *testing.T) {
+	body := bytes.Repeat([]byte("anirip test swf "), 20)
+	uncompressed := append([]byte{'F', 'W', 'S', 10, 0x48, 0x01, 0, 0}, body...)
+	compressed, _ := hex.DecodeString("4357530a48010000789c4bcccb2cca2c5028492d2e51282e4f53481ce593c40700cc6676fd")
+	for name, swf := range map[string][]byte{"uncompressed": uncompressed, "compressed": compressed} {
+		hash, size, err := hashSWFData(swf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if size != 328 || hex.EncodeToString(hash) != "2308061305107e72a5ded53033ad34b1620f52c51c3a979486c704eaec70b85e" {
+			t.Errorf("%s: got hash %x of size %d", name, hash, size)
+		}
+		reply := hex.EncodeToString(swfVerification(hash, size, testSignature()))
+		if reply != "0101000001480000014869530a5109e2e79645c9f1e1322ba6218dc9c4555a34d6ecd70ce854623c6b69" {
+			t.Errorf("%s: got verification reply %s", name, reply)
+		}
+	}
+}
+
+func TestHandshakeTypes(t *testing.T) {
+	server, web := testServer(t, testSWF())
+	defer server.Close()
+	defer web.Close()
+	tests := []struct {
+		scheme string
+		answer byte
+		err    string
+	}{
+		{scheme: "rtmpe", answer: 0x0a, err: "handshake type 10, which isn't supported"},
+		{scheme: "rtmp", answer: 0x08, err: "handshake type 8, which isn't supported"},
+		{scheme: "rtmpe", answer: 0x03, err: "does not support RTMPE"},
+	}
+	for _, test := range tests {
+		server.HandshakeType = test.answer
+		err := Dump(Options{
+			URL:       test.scheme + "://" + server.Addr() + "/ondemand/",
+			Playpath:  "mp4:episode.mp4",
+			SwfURL:    web.URL + "/player.swf",
+			SwfVerify: true,
+		}, new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s answered with %d: got %v", test.scheme, test.answer, err)
+		}
+	}
+}
+
+func TestHandshakeUnsignedServer(t *testing.T) {
+	// A plain RTMP server that doesn't sign S1 gets C2 as an echo of S1
+	client, server := testPipe(t, "rtmp://localhost/ondemand")
+	s1 := make([]byte, handshakeSize)
+	rand.Read(s1)
+	go func() {
+		io.ReadFull(server.conn, make([]byte, handshakeSize+1))
+		server.conn.Write(append([]byte{3}, s1...))
+		c2 := make([]byte, handshakeSize)
+		io.ReadFull(server.conn, c2)
+		if !bytes.Equal(c2, s1) {
+			t.Error("C2 did not echo S1")
+		}
+		server.conn.Write(make([]byte, handshakeSize))
+	}()
+	if _, err := client.handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client.conn.Close()
+
+	// RTMPE can't be set up without a signed S1
+	client, server = testPipe(t, "rtmpe://localhost/ondemand")
+	go func() {
+		io.ReadFull(server.conn, make([]byte, handshakeSize+1))
+		server.conn.Write(append([]byte{6}, s1...))
+	}()
+	if _, err := client.handshake(); err == nil {
+		t.Error("expected an unsigned RTMPE handshake to fail")
+	}
+	client.conn.Close()
+}
+
+func TestHandshakeOffsets(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		signature := make([]byte, handshakeSize)
+		rand.Read(signature)
+		for _, scheme := range []int{0, 1} {
+			if offset := digestOffset(signature, scheme); offset < 12 || offset+digestSize > handshakeSize {
+				t.Fatalf("scheme %d digest offset %d is out of range", scheme, offset)
+			}
+			if offset := dhOffset(signature, scheme); offset < 8 || offset+dhKeySize > handshakeSize {
+				t.Fatalf("scheme %d key offset %d is out of range", scheme, offset)
+			}
+		}
+	}
+}
+
+func TestLeftPad(t *testing.T) {
+	if got := leftPad([]byte{1, 2}, 4); !bytes.Equal(got, []byte{0, 0, 1, 2}) {
+		t.Errorf("got %v", got)
+	}
+	if got := leftPad([]byte{1, 2, 3}, 2); !bytes.Equal(got, []byte{2, 3}) {
+		t.Errorf("got %v", got)
+	}
+}
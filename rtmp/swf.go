@@ -0,0 +1,61 @@
+package rtmp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// Downloads the player SWF and calculates the hash and size needed for SWF verification
+func hashSWF(client *anirip.Client, swfURL string) ([]byte, uint32, error) {
+	swfResponse, err := client.Do("GET",
+		swfURL,
+		nil,
+		nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Reads the entire SWF into memory
+	swf, err := ioutil.ReadAll(swfResponse.Body)
+	if err != nil {
+		return nil, 0, anirip.Error{Message: "There was an error reading the player SWF", Err: err}
+	}
+	return hashSWFData(swf)
+}
+
+// Calculates the hash and size of a SWF already in memory
+func hashSWFData(swf []byte) ([]byte, uint32, error) {
+	if len(swf) < 8 {
+		return nil, 0, anirip.Error{Message: "The player SWF was too short to be valid"}
+	}
+
+	// Compressed SWFs are hashed as if they were never compressed
+	if swf[0] == 'C' {
+		zlibReader, err := zlib.NewReader(bytes.NewReader(swf[8:]))
+		if err != nil {
+			return nil, 0, anirip.Error{Message: "There was an error decompressing the player SWF", Err: err}
+		}
+		body, err := ioutil.ReadAll(zlibReader)
+		zlibReader.Close()
+		if err != nil {
+			return nil, 0, anirip.Error{Message: "There was an error decompressing the player SWF", Err: err}
+		}
+		swf = append([]byte{'F', swf[1], swf[2], swf[3], swf[4], swf[5], swf[6], swf[7]}, body...)
+	}
+
+	// Signs the uncompressed SWF the same way flash player does and returns it with its size
+	return hmacSHA256(genuineFPKey[:30], swf), uint32(len(swf)), nil
+}
+
+// Builds the response to a SWF verification request, signed with the last
+// bytes of the signature the server sent us during the handshake
+func swfVerification(swfHash []byte, swfSize uint32, serverSignature []byte) []byte {
+	response := []byte{0x01, 0x01}
+	response = binary.BigEndian.AppendUint32(response, swfSize)
+	response = binary.BigEndian.AppendUint32(response, swfSize)
+	return append(response, hmacSHA256(serverSignature[handshakeSize-digestSize:], swfHash)...)
+}
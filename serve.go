@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+const (
+	// How many events a slow event stream client can fall behind before it misses some
+	serveEventBuffer = 256
+
+	// How often an idle event stream is sent a comment so proxies don't close it
+	serveKeepAlive = 15 * time.Second
+)
+
+// What a client sends to queue a job or add a subscription, anything left out takes serves own settings
+type jobRequest struct {
+	URL      string `json:"url"`
+	Quality  string `json:"quality"`
+	Lang     string `json:"lang"`
+	Trim     string `json:"trim"`
+	Profile  string `json:"profile"`
+	Dir      string `json:"dir"`
+	Priority int    `json:"priority"` // Only used by jobs
+	Force    bool   `json:"force"`    // Only used by jobs
+	Release  string `json:"release"`  // Only used by subscriptions
+}
+
+// Serves the control API, queuing jobs on queue and ripping them with defaults unless a request says otherwise
+type server struct {
+	queue    *jobQueue
+	store    *subscriptionStore
+	defaults ripOptions
+	token    string // Required of every request when set
+}
+
+// Sets up the routes of the control API
+func (srv *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/jobs", srv.handleJobs)
+	mux.HandleFunc("/api/jobs/", srv.handleJob)
+	mux.HandleFunc("/api/events", srv.handleEvents)
+	mux.HandleFunc("/api/subscriptions", srv.handleSubscriptions)
+	return srv.authorize(mux)
+}
+
+// Turns away requests a web page could have made on behalf of someone who has the API open
+// in their browser, along with those without the token when one is set. Only event streams
+// can pass the token as a query parameter, as browsers can't give EventSource a header
+func (srv *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if origin := request.Header.Get("origin"); origin != "" {
+			if originURL, err := url.Parse(origin); err != nil || originURL.Host != request.Host {
+				writeError(writer, http.StatusForbidden, anirip.Error{Message: "Requests from " + origin + " aren't allowed"})
+				return
+			}
+		}
+		// Forms can post across sites without asking first but they can't send JSON
+		if request.Method == "POST" {
+			if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("content-type")); mediaType != "application/json" {
+				writeError(writer, http.StatusUnsupportedMediaType, anirip.Error{Message: "POST requests must be sent as application/json"})
+				return
+			}
+		}
+		if srv.token != "" {
+			given := strings.TrimPrefix(request.Header.Get("authorization"), "Bearer ")
+			if given == "" && request.URL.Path == "/api/events" {
+				given = request.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(srv.token)) != 1 {
+				writeError(writer, http.StatusUnauthorized, anirip.Error{Message: "A valid token is needed"})
+				return
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// Lists jobs or queues a new one
+func (srv *server) handleJobs(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		jobs, err := srv.queue.list()
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, jobs)
+	case "POST":
+		jobRequest, options, err := srv.readRequest(request)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		options.Force = jobRequest.Force
+		added, err := srv.queue.add(jobRequest.URL, options, false, jobRequest.Priority)
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(writer, http.StatusCreated, added)
+	default:
+		writeError(writer, http.StatusMethodNotAllowed, anirip.Error{Message: request.Method + " isn't supported on " + request.URL.Path})
+	}
+}
+
+// Gets, removes, cancels or retries a single job, at /api/jobs/ID, /api/jobs/ID/cancel and /api/jobs/ID/retry
+func (srv *server) handleJob(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/jobs/"), "/"), "/")
+	id, action := parts[0], ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	var found job
+	var err error
+	switch {
+	case action == "" && request.Method == "GET":
+		found, err = srv.queue.get(id)
+	case action == "" && request.Method == "DELETE":
+		if found, err = srv.queue.remove(id); err == nil {
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case action == "cancel" && request.Method == "POST":
+		found, err = srv.queue.cancel(id)
+	case action == "retry" && request.Method == "POST":
+		found, err = srv.queue.retry(id)
+	default:
+		writeError(writer, http.StatusNotFound, anirip.Error{Message: request.Method + " " + request.URL.Path + " isn't part of the API"})
+		return
+	}
+	if err != nil {
+		status := http.StatusConflict
+		if found.ID == "" {
+			status = http.StatusNotFound
+		}
+		writeError(writer, status, err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, found)
+}
+
+// Streams every event as server sent events, only those of one job when ?job=ID is given
+func (srv *server) handleEvents(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, http.StatusInternalServerError, anirip.Error{Message: "Streaming isn't supported"})
+		return
+	}
+	only := request.URL.Query().Get("job")
+	client := srv.queue.listen()
+	defer srv.queue.unlisten(client)
+	writer.Header().Set("content-type", "text/event-stream")
+	writer.Header().Set("cache-control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(serveKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-client:
+			if only != "" && e.Job != only {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", e.Event, data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(writer, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// Lists, adds or removes subscriptions, which are removed by ?url=
+func (srv *server) handleSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		if err := srv.store.reload(); err != nil {
+			writeError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, srv.store.list())
+	case "POST":
+		jobRequest, options, err := srv.readRequest(request)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err)
+			return
+		}
+		if jobRequest.Release != "" {
+			if _, err := parseReleaseHint(jobRequest.Release); err != nil {
+				writeError(writer, http.StatusBadRequest, err)
+				return
+			}
+		}
+		showURL, _ := splitEpisodeURL(jobRequest.URL)
+		providerName, _, _ := parseShowURL(showURL)
+		sub := &subscription{URL: showURL, Provider: providerName, Options: options, Release: jobRequest.Release, Added: time.Now(), Ripped: []string{}}
+		added, err := srv.store.add(sub)
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		status := http.StatusOK
+		if added {
+			status = http.StatusCreated
+		}
+		for _, stored := range srv.store.list() {
+			if stored.URL == showURL {
+				writeJSON(writer, status, stored)
+			}
+		}
+	case "DELETE":
+		showURL := request.URL.Query().Get("url")
+		removed, err := srv.store.remove(showURL)
+		if err != nil {
+			writeError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		if !removed {
+			writeError(writer, http.StatusNotFound, anirip.Error{Message: "There's no subscription to " + showURL})
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(writer, http.StatusMethodNotAllowed, anirip.Error{Message: request.Method + " isn't supported on " + request.URL.Path})
+	}
+}
+
+// Reads a job or subscription request, filling in serves settings for anything it leaves out
+func (srv *server) readRequest(request *http.Request) (jobRequest, ripOptions, error) {
+	jobRequest := jobRequest{}
+	if err := json.NewDecoder(request.Body).Decode(&jobRequest); err != nil {
+		return jobRequest, ripOptions{}, anirip.Error{Message: "The request body isn't valid JSON", Err: err}
+	}
+	if jobRequest.URL == "" {
+		return jobRequest, ripOptions{}, anirip.Error{Message: "A url is needed"}
+	}
+	if _, _, err := parseShowURL(jobRequest.URL); err != nil {
+		return jobRequest, ripOptions{}, err
+	}
+	options := srv.defaults
+	for _, field := range []struct{ value, option *string }{
+		{&jobRequest.Quality, &options.Quality},
+		{&jobRequest.Lang, &options.Lang},
+		{&jobRequest.Trim, &options.Trim},
+		{&jobRequest.Profile, &options.Profile},
+	} {
+		if *field.value != "" {
+			*field.option = *field.value
+		}
+	}
+	if err := anirip.ValidateProfile(options.Profile); err != nil {
+		return jobRequest, options, err
+	}
+
+	// Directories are taken from the directory serve was started in and can't leave it
+	if jobRequest.Dir != "" {
+		dir := filepath.Join(srv.defaults.Dir, jobRequest.Dir)
+		rel, err := filepath.Rel(srv.defaults.Dir, dir)
+		if filepath.IsAbs(jobRequest.Dir) || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return jobRequest, options, anirip.Error{Message: "The dir " + jobRequest.Dir + " must be a relative path inside the directory anirip serve was started in"}
+		}
+		options.Dir = dir
+	}
+	return jobRequest, options, nil
+}
+
+// Writes value as the JSON response
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("content-type", "application/json")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// Writes err as a JSON error response
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJSON(writer, status, map[string]string{"error": err.Error(), "error_kind": errorKind(err)})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+func TestReadRequestDir(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "anime")
+	srv := &server{defaults: ripOptions{Quality: "1080p", Profile: anirip.DefaultProfile, Dir: base}}
+	tests := []struct {
+		dir  string
+		want string // Empty when the request is turned away
+	}{
+		{dir: "", want: base},
+		{dir: "simulcasts", want: filepath.Join(base, "simulcasts")},
+		{dir: "simulcasts/../older", want: filepath.Join(base, "older")},
+		{dir: "./", want: base},
+		{dir: "..", want: ""},
+		{dir: "../elsewhere", want: ""},
+		{dir: "simulcasts/../../elsewhere", want: ""},
+		{dir: "/etc", want: ""},
+		{dir: base, want: ""},
+	}
+	for _, test := range tests {
+		body := `{"url":"http://www.crunchyroll.com/test-show","dir":"` + test.dir + `"}`
+		_, options, err := srv.readRequest(httptest.NewRequest("POST", "/api/jobs", strings.NewReader(body)))
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("accepted dir %q as %s", test.dir, options.Dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("turned away dir %q: %v", test.dir, err)
+		} else if options.Dir != test.want {
+			t.Errorf("dir %q became %s, expected %s", test.dir, options.Dir, test.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	srv := &server{token: "s3cret"}
+	handler := srv.authorize(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"bearer token", "GET", "/api/jobs", map[string]string{"authorization": "Bearer s3cret"}, http.StatusOK},
+		{"no token", "GET", "/api/jobs", nil, http.StatusUnauthorized},
+		{"wrong token", "GET", "/api/jobs", map[string]string{"authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"query token on events", "GET", "/api/events?token=s3cret", nil, http.StatusOK},
+		{"query token elsewhere", "GET", "/api/jobs?token=s3cret", nil, http.StatusUnauthorized},
+		{"json post", "POST", "/api/jobs/1/cancel", map[string]string{"authorization": "Bearer s3cret", "content-type": "application/json; charset=utf-8"}, http.StatusOK},
+		{"form post", "POST", "/api/jobs/1/cancel", map[string]string{"authorization": "Bearer s3cret", "content-type": "application/x-www-form-urlencoded"}, http.StatusUnsupportedMediaType},
+		{"bare post", "POST", "/api/jobs/1/cancel", map[string]string{"authorization": "Bearer s3cret"}, http.StatusUnsupportedMediaType},
+		{"same origin", "GET", "/api/jobs", map[string]string{"authorization": "Bearer s3cret", "origin": "http://127.0.0.1:8680"}, http.StatusOK},
+		{"foreign origin", "GET", "/api/jobs", map[string]string{"authorization": "Bearer s3cret", "origin": "http://evil.example.com"}, http.StatusForbidden},
+		{"null origin", "GET", "/api/jobs", map[string]string{"authorization": "Bearer s3cret", "origin": "null"}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "http://127.0.0.1:8680"+test.path, nil)
+		for name, value := range test.header {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// The fields of a session written by older versions of anirip as gob into the temp directory
+type legacySession struct {
+	User    string
+	Cookies []*http.Cookie
+}
+
+// Moves sessions older versions left readable by anyone in the temp directory into the session directory
+func migrateLegacySessions(tempDir, sessionDir string) {
+	for _, provider := range []string{"crunchyroll", "daisuki"} {
+		fileName := tempDir + string(os.PathSeparator) + provider + ".cookie"
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+
+		// Only carries the session over if there isn't a newer one already
+		legacy := legacySession{}
+		if stored, err := anirip.LoadSession(sessionDir, provider, anirip.DefaultProfile); err == nil && stored == nil {
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy); err == nil && legacy.User != "" {
+				if err := anirip.SaveSession(sessionDir, anirip.NewStoredSession(provider, anirip.DefaultProfile, legacy.User, legacy.Cookies)); err != nil {
+					logger.Failure(err)
+					continue
+				}
+				logger.Warn("Moved your " + provider + " session to " + sessionDir)
+			}
+		}
+		os.Remove(fileName)
+	}
+}
+
+// Checks whether any sessions have been stored yet
+func sessionsExist(sessionDir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(sessionDir, "*.session"))
+	return len(matches) > 0
+}
+
+// Logs session in with the cookies in a Netscape cookies.txt file
+func importCookies(session anirip.Session, user, fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return anirip.Error{Message: "There was an error opening the cookies file " + fileName, Err: err}
+	}
+	defer file.Close()
+	cookies, err := anirip.ReadCookiesTxt(file)
+	if err != nil {
+		return err
+	}
+	if len(cookies) == 0 {
+		return anirip.Error{Message: "The cookies file " + fileName + " has no cookies that haven't expired"}
+	}
+	return session.ImportCookies(user, cookies, sessionDir)
+}
+
+// Writes the session stored for a providers profile to a Netscape cookies.txt file readable only by us
+func exportCookies(provider, profile, fileName string) error {
+	stored, err := anirip.LoadSession(sessionDir, provider, profile)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return anirip.Error{Message: "No " + provider + " session is stored for the " + profile + " profile, log in first"}
+	}
+
+	// Cookies without a domain are sent to every host, so they're tied to the providers domain instead
+	cookies := stored.HTTPCookies()
+	for _, cookie := range cookies {
+		if cookie.Domain == "" {
+			cookie.Domain = "." + strings.TrimPrefix(providerHost(provider), "www.")
+		}
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return anirip.Error{Message: "There was an error creating " + fileName, Err: err}
+	}
+	if err := anirip.WriteCookiesTxt(file, cookies); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
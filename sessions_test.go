@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+func TestMigrateLegacySessions(t *testing.T) {
+	legacyDir, sessionDir := t.TempDir(), filepath.Join(t.TempDir(), "sessions")
+	passphrase := anirip.SessionPassphrase
+	t.Cleanup(func() { anirip.SessionPassphrase = passphrase })
+	anirip.SessionPassphrase = nil
+
+	// Daisuki already has a newer session which the legacy one mustn't replace
+	if err := anirip.SaveSession(sessionDir, anirip.NewStoredSession("daisuki", anirip.DefaultProfile, "newer", nil)); err != nil {
+		t.Fatal(err)
+	}
+	for provider, user := range map[string]string{"crunchyroll": "someone", "daisuki": "older"} {
+		data := new(bytes.Buffer)
+		legacy := legacySession{User: user, Cookies: []*http.Cookie{{Name: "session_id", Value: provider, Domain: "." + provider + ".com"}}}
+		if err := gob.NewEncoder(data).Encode(legacy); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(legacyDir, provider+".cookie"), data.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrateLegacySessions(legacyDir, sessionDir)
+
+	for provider, user := range map[string]string{"crunchyroll": "someone", "daisuki": "newer"} {
+		stored, err := anirip.LoadSession(sessionDir, provider, anirip.DefaultProfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored == nil || stored.User != user {
+			t.Errorf("got %+v for %s, expected the session of %s", stored, provider, user)
+		}
+		if _, err := os.Stat(filepath.Join(legacyDir, provider+".cookie")); !os.IsNotExist(err) {
+			t.Errorf("the legacy %s session was left in the temp directory", provider)
+		}
+	}
+	stored, _ := anirip.LoadSession(sessionDir, "crunchyroll", anirip.DefaultProfile)
+	if cookies := stored.HTTPCookies(); len(cookies) != 1 || cookies[0].Value != "crunchyroll" {
+		t.Errorf("got cookies %+v carried over", cookies)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+const (
+	// How long after a release hint a show keeps being checked every interval for its new episode
+	releaseWindow = 48 * time.Hour
+
+	// How often a show is checked once its release window has passed without a new episode
+	releaseRetry = 24 * time.Hour
+
+	// The shortest watch sleeps between passes, so a subscription that's always due can't spin
+	minWatchSleep = time.Minute
+)
+
+// A show that watch keeps ripping new episodes of, with the options it was subscribed with
+type subscription struct {
+	URL         string     `json:"url"`
+	Provider    string     `json:"provider"`
+	Options     ripOptions `json:"options"`
+	Release     string     `json:"release,omitempty"` // When new episodes come out, such as sat 15:30 Asia/Tokyo
+	Added       time.Time  `json:"added"`
+	LastChecked time.Time  `json:"last_checked"`
+	LastFound   time.Time  `json:"last_found"` // When a new episode was last ripped
+	Episodes    int        `json:"episodes"`   // How many episodes the show had at the last check
+	Ripped      []string   `json:"ripped"`     // Every episode on disk, by episodeKey
+}
+
+// Keeps the subscriptions in a JSON file in the users config directory. Every change is made to
+// the file as it is on disk under its lock file, so the subscribe and unsubscribe commands can
+// run while watch or serve has the subscriptions loaded
+type subscriptionStore struct {
+	mutex         sync.Mutex
+	fileName      string
+	Subscriptions []*subscription `json:"subscriptions"`
+}
+
+// Gets the file subscriptions are kept in
+func subscriptionsFile() string {
+	return filepath.Join(anirip.ConfigDir(), "subscriptions.json")
+}
+
+// Loads the subscriptions stored in fileName, starting empty if there aren't any yet
+func loadSubscriptions(fileName string) (*subscriptionStore, error) {
+	store := &subscriptionStore{fileName: fileName, Subscriptions: []*subscription{}}
+	if err := store.read(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Loads the subscriptions again, picking up changes made by other processes since
+func (store *subscriptionStore) reload() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	unlock, err := lockFile(store.fileName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return store.read()
+}
+
+// Runs change on the subscriptions as they are on disk and writes them back, holding the
+// lock file throughout so no other process's change is lost and nothing sees them half changed
+func (store *subscriptionStore) update(change func()) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	unlock, err := lockFile(store.fileName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := store.read(); err != nil {
+		return err
+	}
+	change()
+	return store.write()
+}
+
+// Gets a copy of every subscription that's safe to read while watch updates them
+func (store *subscriptionStore) list() []subscription {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	subs := []subscription{}
+	for _, sub := range store.Subscriptions {
+		copied := *sub
+		copied.Ripped = append([]string{}, sub.Ripped...)
+		subs = append(subs, copied)
+	}
+	return subs
+}
+
+// Reads the subscriptions from their file, the caller must hold the lock
+func (store *subscriptionStore) read() error {
+	loaded := struct {
+		Subscriptions []*subscription `json:"subscriptions"`
+	}{Subscriptions: []*subscription{}}
+	data, err := ioutil.ReadFile(store.fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return anirip.Error{Message: "There was an error reading the subscriptions", Err: err}
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return anirip.Error{Message: "There was an error parsing the subscriptions", Err: err}
+		}
+	}
+	store.Subscriptions = loaded.Subscriptions
+	return nil
+}
+
+// Writes the subscriptions to their file, the caller must hold the lock and the lock file
+func (store *subscriptionStore) write() error {
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return anirip.Error{Message: "There was an error encoding the subscriptions", Err: err}
+	}
+	return writeFileAtomic(store.fileName, data)
+}
+
+// Gets the subscription for a show url, nil if there isn't one
+func (store *subscriptionStore) find(showURL string) *subscription {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.lookup(showURL)
+}
+
+// Finds the subscription for a show url, the caller must hold the lock
+func (store *subscriptionStore) lookup(showURL string) *subscription {
+	for _, sub := range store.Subscriptions {
+		if sub.URL == showURL {
+			return sub
+		}
+	}
+	return nil
+}
+
+// Adds a subscription and saves it, replacing the options and release hint of one that's already
+// there for the same show while keeping track of the episodes it has ripped. Returns whether it's new
+func (store *subscriptionStore) add(sub *subscription) (bool, error) {
+	added := false
+	err := store.update(func() {
+		if existing := store.lookup(sub.URL); existing != nil {
+			existing.Options, existing.Release = sub.Options, sub.Release
+			return
+		}
+		store.Subscriptions = append(store.Subscriptions, sub)
+		added = true
+	})
+	return added, err
+}
+
+// Removes the subscription for a show url and saves the rest, returning whether there was one
+func (store *subscriptionStore) remove(showURL string) (bool, error) {
+	removed := false
+	err := store.update(func() {
+		for i, sub := range store.Subscriptions {
+			if sub.URL == showURL {
+				store.Subscriptions = append(store.Subscriptions[:i], store.Subscriptions[i+1:]...)
+				removed = true
+				return
+			}
+		}
+	})
+	return removed, err
+}
+
+// Identifies an episode by its season and number, which are known without getting its info
+func episodeKey(season anirip.Season, episode anirip.Episode) string {
+	return "S" + strconv.Itoa(season.GetNumber()) + "E" + strconv.FormatFloat(episode.GetNumber(), 'f', -1, 64)
+}
+
+// When a show is expected to put out a new episode each week
+type releaseHint struct {
+	weekday  time.Weekday
+	hour     int
+	minute   int
+	location *time.Location
+}
+
+// Parses a release hint such as sat 15:30 or saturday 15:30 Asia/Tokyo, in local time when no zone is given
+func parseReleaseHint(hint string) (releaseHint, error) {
+	invalid := anirip.Error{Message: "The release hint " + hint + " should look like sat 15:30 or sat 15:30 Asia/Tokyo"}
+	fields := strings.Fields(hint)
+	if len(fields) < 2 || len(fields) > 3 || len(fields[0]) < 3 {
+		return releaseHint{}, invalid
+	}
+	parsed := releaseHint{weekday: -1, location: time.Local}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.HasPrefix(strings.ToLower(day.String()), strings.ToLower(fields[0])) {
+			parsed.weekday = day
+		}
+	}
+	clock, err := time.Parse("15:04", fields[1])
+	if parsed.weekday < 0 || err != nil {
+		return releaseHint{}, invalid
+	}
+	parsed.hour, parsed.minute = clock.Hour(), clock.Minute()
+	if len(fields) == 3 {
+		if parsed.location, err = time.LoadLocation(fields[2]); err != nil {
+			return releaseHint{}, anirip.Error{Message: "The release hint " + hint + " has an unknown time zone", Err: err}
+		}
+	}
+	return parsed, nil
+}
+
+// Gets the latest release at or before now
+func (hint releaseHint) latest(now time.Time) time.Time {
+	now = now.In(hint.location)
+	release := time.Date(now.Year(), now.Month(), now.Day(), hint.hour, hint.minute, 0, 0, hint.location)
+	release = release.AddDate(0, 0, -((int(now.Weekday()) - int(hint.weekday) + 7) % 7))
+	if release.After(now) {
+		release = release.AddDate(0, 0, -7)
+	}
+	return release
+}
+
+// Works out when the subscription should next be checked. Without a release hint that's every
+// interval, with one it's every interval for releaseWindow after each release until its episode
+// turns up, then once every releaseRetry until the next release. A new subscription is due at once
+func (sub *subscription) nextCheck(interval time.Duration) time.Time {
+	if sub.LastChecked.IsZero() {
+		return time.Time{}
+	}
+	next := sub.LastChecked.Add(interval)
+	hint, err := parseReleaseHint(sub.Release)
+	if sub.Release == "" || err != nil {
+		return next
+	}
+	release := hint.latest(sub.LastChecked)
+	upcoming := release.AddDate(0, 0, 7)
+	if sub.LastFound.After(release) {
+		return upcoming
+	}
+	if sub.LastChecked.Sub(release) >= releaseWindow {
+		next = sub.LastChecked.Add(releaseRetry)
+	}
+	if next.After(upcoming) {
+		return upcoming
+	}
+	return next
+}
+
+// Gets the subscriptions due to be checked by now, along with when the next of the rest is due
+func (store *subscriptionStore) due(interval time.Duration, now time.Time) ([]subscription, time.Time) {
+	due, next := []subscription{}, time.Time{}
+	for _, sub := range store.list() {
+		check := sub.nextCheck(interval)
+		if !check.After(now) {
+			due = append(due, sub)
+			continue
+		}
+		logger.Debug(sub.URL + " isn't due to be checked until " + check.Format("Mon Jan 2 15:04"))
+		if next.IsZero() || check.Before(next) {
+			next = check
+		}
+	}
+	return due, next
+}
+
+// Scrapes a subscribed show and rips the episodes it hasn't ripped yet, recording what it found.
+// sub is a copy, the stored subscription is updated once the show has been checked
+func watchSubscription(rip *ripper, store *subscriptionStore, sub subscription) error {
+	ripped := map[string]bool{}
+	for _, key := range sub.Ripped {
+		ripped[key] = true
+	}
+
+	// Only episodes we haven't got are queued, ones already on disk are marked ripped without downloading them
+	listed, queued, found := 0, 0, []string{}
+	err := rip.ripShow(sub.URL, sub.Options, func(season anirip.Season, episode anirip.Episode) bool {
+		listed++
+		if ripped[episodeKey(season, episode)] || anirip.CheckCanceled() != nil {
+			return true
+		}
+		queued++
+		return false
+	}, func(season anirip.Season, episode anirip.Episode) {
+		ripped[episodeKey(season, episode)] = true
+		found = append(found, episodeKey(season, episode))
+	})
+	saveErr := store.update(func() {
+		stored := store.lookup(sub.URL)
+		if stored == nil {
+			return
+		}
+		now := time.Now()
+		stored.LastChecked = now
+		stored.Ripped = append(stored.Ripped, found...)
+		if err == nil {
+			// The weeks episode counts as found once the show has grown and everything new was ripped
+			if stored.Episodes > 0 && listed > stored.Episodes && len(found) == queued {
+				stored.LastFound = now
+			}
+			stored.Episodes = listed
+		}
+	})
+	if err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Checks every subscription that's due, then sleeps until the next one is, unless once is set
+func watchSubscriptions(rip *ripper, store *subscriptionStore, interval time.Duration, once bool) error {
+	for {
+		if err := store.reload(); err != nil {
+			logger.Failure(err)
+		}
+		due, next := store.due(interval, time.Now())
+		for _, sub := range due {
+			logger.Info("Checking " + sub.URL + " for new episodes...")
+			if err := watchSubscription(rip, store, sub); err != nil {
+				logger.Failure(err)
+			}
+			if stored := store.find(sub.URL); stored != nil {
+				if check := stored.nextCheck(interval); next.IsZero() || check.Before(next) {
+					next = check
+				}
+			}
+		}
+		rip.reportRegions()
+		events.summary(nil)
+		if once {
+			return nil
+		}
+
+		// Sleeps until the soonest subscription is due again
+		wait := next.Sub(time.Now())
+		if wait < minWatchSleep {
+			wait = minWatchSleep
+		}
+		logger.Info("Waiting until " + time.Now().Add(wait).Format("Mon Jan 2 15:04") + " to check for new episodes...")
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionStoreKeepsOtherChanges(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "subscriptions.json")
+
+	// Stands in for watch, which loads the subscriptions once and keeps them
+	watching, err := loadSubscriptions(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watching.add(&subscription{URL: "http://example.com/one", Ripped: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribes to another show from a separate process
+	subscribing, err := loadSubscriptions(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, err := subscribing.add(&subscription{URL: "http://example.com/two", Ripped: []string{}}); err != nil || !added {
+		t.Fatalf("added %v: %v", added, err)
+	}
+
+	// Watch records a check of the show it knew about, which mustn't lose the new subscription
+	err = watching.update(func() {
+		watching.lookup("http://example.com/one").Ripped = []string{"S1E1"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadSubscriptions(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Subscriptions) != 2 || reloaded.find("http://example.com/two") == nil {
+		t.Fatalf("got subscriptions %+v", reloaded.Subscriptions)
+	}
+	if ripped := reloaded.find("http://example.com/one").Ripped; len(ripped) != 1 {
+		t.Errorf("got ripped %v", ripped)
+	}
+
+	// Unsubscribing elsewhere is seen by watch once it reloads
+	if removed, err := subscribing.remove("http://example.com/one"); err != nil || !removed {
+		t.Fatalf("removed %v: %v", removed, err)
+	}
+	if err := watching.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if watching.find("http://example.com/one") != nil {
+		t.Error("watch still has the removed subscription after reloading")
+	}
+	if removed, err := watching.remove("http://example.com/one"); err != nil || removed {
+		t.Errorf("removed %v a second time: %v", removed, err)
+	}
+}
+
+func TestSubscriptionStoreConcurrentAdds(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "subscriptions.json")
+	wait := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			store, err := loadSubscriptions(fileName)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			url := "http://example.com/" + strings.Repeat("a", i+1)
+			if _, err := store.add(&subscription{URL: url, Added: time.Now(), Ripped: []string{}}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	store, err := loadSubscriptions(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Subscriptions) != 10 {
+		data, _ := ioutil.ReadFile(fileName)
+		t.Errorf("kept %d of 10 subscriptions:\n%s", len(store.Subscriptions), data)
+	}
+}
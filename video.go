@@ -4,10 +4,46 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/sdwolfe32/anirip/anirip"
 )
 
+// Downloads the episode to episode.mkv in our temp directory, fetching HLS and DASH
+// streams ourselves and leaving any other stream to the provider
+func downloadEpisode(episode anirip.Episode, quality, audioLang, tempDir string, client *anirip.Client) error {
+	stream := episode.GetStreamInfo()
+	if stream.DASH != nil {
+		return downloadDASH(*stream.DASH, quality, audioLang, tempDir, client)
+	}
+	if stream.HLS == nil {
+		return episode.DownloadEpisode(quality, tempDir, client)
+	}
+
+	// Remove stale temp file to avoid conflcts with the downloader
+	os.Remove(tempDir + string(os.PathSeparator) + "incomplete.episode.ts")
+	if err := anirip.DownloadHLS(*stream.HLS, quality, client, tempDir+string(os.PathSeparator)+"incomplete.episode.ts"); err != nil {
+		return err
+	}
+
+	// The segments are remuxed along with the subtitles later on, the same as dumped FLVs
+	return anirip.Rename(tempDir+string(os.PathSeparator)+"incomplete.episode.ts", tempDir+string(os.PathSeparator)+"episode.mkv", 10)
+}
+
+// Downloads the video and audio of a DASH stream as separate tracks and muxes them into episode.mkv
+func downloadDASH(info anirip.DASHInfo, quality, audioLang, tempDir string, client *anirip.Client) error {
+	tracks, err := anirip.DownloadDASH(info, quality, audioLang, client, tempDir)
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for _, track := range tracks {
+		files = append(files, track.Kind+" "+track.File)
+	}
+	logger.Debug("Muxing " + strings.Join(files, ", "))
+	return anirip.MuxTracks(tracks, tempDir+string(os.PathSeparator)+"episode.mkv")
+}
+
 // Trims the first couple seconds off of the video to remove any logos
 func trimMKV(adLength int, tempDir string) error {
 	// Removes a stale temp files to avoid conflcts in func
@@ -28,7 +64,7 @@ func trimMKV(adLength int, tempDir string) error {
 		"-o", "split.episode.mkv",
 		"untrimmed.episode.mkv")
 	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(cmd); err != nil {
 		return anirip.Error{Message: "There was an error while splitting the episode", Err: err}
 	}
 
@@ -42,7 +78,7 @@ func trimMKV(adLength int, tempDir string) error {
 		"-c:a", "copy", "-y", // Use AAC as audio codec to match video.mkv
 		"prefix.episode.mkv")
 	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
+	if err := runFFmpeg(cmd); err != nil {
 		return anirip.Error{Message: "There was an error while creating the prefix clip", Err: err}
 	}
 
@@ -59,7 +95,7 @@ func trimMKV(adLength int, tempDir string) error {
 		"-c", "copy", "-y",
 		"episode.mkv")
 	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
+	if err := runFFmpeg(cmd); err != nil {
 		return anirip.Error{Message: "There was an error while merging video and prefix", Err: err}
 	}
 
@@ -84,7 +120,7 @@ func cleanMKV(tempDir string) error {
 		"dirty.episode.mkv",
 		"episode.mkv")
 	cmd.Dir = tempDir
-	if err := cmd.Run(); err != nil {
+	if err := runCommand(cmd); err != nil {
 		return anirip.Error{Message: "There was an error while cleaning video", Err: err}
 	}
 
@@ -127,7 +163,7 @@ func mergeSubtitles(audioLang, subtitleLang, tempDir string) error {
 	cmd.Dir = tempDir
 
 	// Executes the command
-	if err := cmd.Run(); err != nil {
+	if err := runFFmpeg(cmd); err != nil {
 		return anirip.Error{Message: "There was an error while merging subtitles", Err: err}
 	}
 
@@ -136,3 +172,15 @@ func mergeSubtitles(audioLang, subtitleLang, tempDir string) error {
 	os.Remove(tempDir + string(os.PathSeparator) + "unmerged.episode.mkv")
 	return nil
 }
+
+// Runs an external command, logging it for the run log and keeping its stderr for when it fails
+func runCommand(cmd *exec.Cmd) error {
+	logger.Debug("Running " + strings.Join(cmd.Args, " "))
+	return anirip.RunCommand(cmd)
+}
+
+// Runs an ffmpeg command like runCommand, reporting its progress as it goes
+func runFFmpeg(cmd *exec.Cmd) error {
+	logger.Debug("Running " + strings.Join(cmd.Args, " "))
+	return anirip.RunFFmpeg(cmd)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sdwolfe32/anirip/anirip"
+)
+
+// An episode that either hands out an HLS stream or downloads itself
+type testEpisode struct {
+	stream     anirip.StreamInfo
+	downloaded bool
+}
+
+func (episode *testEpisode) GetEpisodeInfo(string, *anirip.Client) error { return nil }
+func (episode *testEpisode) DownloadSubtitles(string, int, string, *anirip.Client) (string, error) {
+	return "", nil
+}
+func (episode *testEpisode) GetFileName() string              { return "Test Show - S01E01 - Test" }
+func (episode *testEpisode) GetNumber() float64               { return 1 }
+func (episode *testEpisode) GetURL() string                   { return "" }
+func (episode *testEpisode) GetID() string                    { return "1" }
+func (episode *testEpisode) GetStreamInfo() anirip.StreamInfo { return episode.stream }
+func (episode *testEpisode) DownloadEpisode(quality, tempDir string, client *anirip.Client) error {
+	episode.downloaded = true
+	return ioutil.WriteFile(filepath.Join(tempDir, "episode.mkv"), []byte("provider"), 0644)
+}
+
+func TestDownloadEpisode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/index.m3u8":
+			writer.Write([]byte("#EXTM3U\n#EXTINF:2,\na.ts\n#EXTINF:2,\nb.ts\n"))
+		case "/manifest.mpd":
+			writer.Write([]byte(`<MPD mediaPresentationDuration="PT2S"><Period>
+  <AdaptationSet mimeType="video/mp4"><Representation id="v"><BaseURL>video.mp4</BaseURL></Representation></AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" lang="en"><Representation id="en"><BaseURL>en.mp4</BaseURL></Representation></AdaptationSet>
+  <AdaptationSet mimeType="audio/mp4" lang="ja"><Representation id="ja"><BaseURL>ja.mp4</BaseURL></Representation></AdaptationSet>
+</Period></MPD>`))
+		case "/a.ts", "/b.ts", "/video.mp4", "/en.mp4", "/ja.mp4":
+			writer.Write([]byte(request.URL.Path))
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "anirip-video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Stands in for ffmpeg when muxing, joining every input into the output
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand in ffmpeg is a shell script")
+	}
+	ffmpeg := filepath.Join(tempDir, "ffmpeg")
+	script := "#!/bin/sh\ninputs=\"\"\nwhile [ $# -gt 1 ]; do\n  if [ \"$1\" = -i ]; then inputs=\"$inputs $2\"; fi\n  shift\ndone\ncat $inputs > \"$1\"\n"
+	if err := ioutil.WriteFile(ffmpeg, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { anirip.BinaryPaths["ffmpeg"] = path }(anirip.BinaryPaths["ffmpeg"])
+	anirip.BinaryPaths["ffmpeg"] = ffmpeg
+
+	tests := []struct {
+		name     string
+		episode  *testEpisode
+		want     string
+		provider bool
+	}{
+		{"provider download", &testEpisode{}, "provider", true},
+		{"hls", &testEpisode{stream: anirip.StreamInfo{HLS: &anirip.HLSInfo{PlaylistURL: server.URL + "/index.m3u8"}}}, "/a.ts/b.ts", false},
+		{"dash", &testEpisode{stream: anirip.StreamInfo{DASH: &anirip.DASHInfo{ManifestURL: server.URL + "/manifest.mpd"}}}, "/video.mp4/ja.mp4", false},
+	}
+	for _, test := range tests {
+		if err := downloadEpisode(test.episode, "720p", audioLanguage, tempDir, anirip.NewClient(nil)); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(tempDir, "episode.mkv"))
+		if string(data) != test.want || test.episode.downloaded != test.provider {
+			t.Errorf("%s: got %q downloaded by the provider %v", test.name, data, test.episode.downloaded)
+		}
+	}
+}